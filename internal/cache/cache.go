@@ -64,6 +64,17 @@ func (c *Cache) Set(key string, value interface{}) {
 	}
 }
 
+// Len returns the number of items in the cache, including expired items which were not yet removed.
+func (c *Cache) Len() int {
+	return c.cacheList.Len()
+}
+
+// Clear removes all items from the cache.
+func (c *Cache) Clear() {
+	c.cacheMap = make(map[string]*list.Element)
+	c.cacheList.Init()
+}
+
 func (c *Cache) removeElement(elem *list.Element) {
 	c.cacheList.Remove(elem)
 	cacheItem := elem.Value.(*Item)
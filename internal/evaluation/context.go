@@ -4,7 +4,27 @@ import (
 	"github.com/amplitude/experiment-go-server/pkg/experiment"
 )
 
+// ContextBucketingKey is the key of the user's bucketing key in the user of the evaluation context,
+// which replaces the user's identity for bucketing. See experiment.User.BucketingKey.
+const ContextBucketingKey = "bucketing_key"
+
+// UserToContext converts the user to an evaluation context. Nested maps in user and group properties
+// are kept nested, and conditions may select their values with a dotted property name, e.g.
+// "subscription.plan" for the plan of the subscription property.
 func UserToContext(user *experiment.User) map[string]interface{} {
+	return userToContext(user, false)
+}
+
+// UserToContextMultiValueGroups converts the user to an evaluation context which includes all
+// group names of each group type, rather than only the first. For each group type, group_name and
+// group_properties remain those of the first group name, so bucketing is unchanged, group_names
+// contains all group names, and cohort_ids is the union of the cohorts of all group names. Cohort
+// targeting therefore matches if any of the user's groups of the type is in the cohort.
+func UserToContextMultiValueGroups(user *experiment.User) map[string]interface{} {
+	return userToContext(user, true)
+}
+
+func userToContext(user *experiment.User, multiValueGroups bool) map[string]interface{} {
 	if user == nil {
 		return nil
 	}
@@ -56,6 +76,9 @@ func UserToContext(user *experiment.User) map[string]interface{} {
 	if len(user.Library) != 0 {
 		userMap["library"] = user.Library
 	}
+	if len(user.BucketingKey) != 0 {
+		userMap[ContextBucketingKey] = user.BucketingKey
+	}
 	if len(user.UserProperties) != 0 {
 		userMap["user_properties"] = user.UserProperties
 	}
@@ -88,9 +111,23 @@ func UserToContext(user *experiment.User) map[string]interface{} {
 				}
 			}
 
+			if multiValueGroups {
+				groupNameMap["group_names"] = groupNames
+			}
+
 			if user.GroupCohortIds != nil {
 				if groupCohortIdsType, ok := user.GroupCohortIds[groupType]; ok {
-					if groupCohortIdsName, ok := groupCohortIdsType[groupName]; ok {
+					if multiValueGroups {
+						cohortIds := make(map[string]struct{})
+						for _, name := range groupNames {
+							for cohortId := range groupCohortIdsType[name] {
+								cohortIds[cohortId] = struct{}{}
+							}
+						}
+						if len(cohortIds) > 0 {
+							groupNameMap["cohort_ids"] = extractKeys(cohortIds)
+						}
+					} else if groupCohortIdsName, ok := groupCohortIdsType[groupName]; ok {
 						groupNameMap["cohort_ids"] = extractKeys(groupCohortIdsName)
 					}
 				}
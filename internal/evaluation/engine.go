@@ -7,27 +7,52 @@ import (
 	"github.com/spaolacci/murmur3"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Engine struct {
-	log *logger.Log
+	log     *logger.Log
+	options EngineOptions
+}
+
+// EngineOptions change how flags are evaluated from the defaults, which match remote evaluation.
+type EngineOptions struct {
+	// BucketingSalt, if not empty, replaces the salt of every segment bucket.
+	BucketingSalt string
+	// CaseInsensitiveMatch compares string values case-insensitively for the is, is not, and set
+	// operators. Other operators are unaffected.
+	CaseInsensitiveMatch bool
 }
 
 type target struct {
 	context map[string]interface{}
 	result  map[string]Variant
+	// evaluationTime is the time selected by SelectorEvaluationTime, or the current time if zero.
+	evaluationTime time.Time
 }
 
 func NewEngine(log *logger.Log) *Engine {
-	return &Engine{log}
+	return &Engine{log: log}
+}
+
+func NewEngineWithOptions(log *logger.Log, options EngineOptions) *Engine {
+	return &Engine{log: log, options: options}
 }
 
 func (e *Engine) Evaluate(context map[string]interface{}, flags []*Flag) map[string]Variant {
+	return e.EvaluateAt(context, flags, time.Time{})
+}
+
+// EvaluateAt evaluates like Evaluate, at the evaluation time, or the current time if it is zero.
+// The time is an input of the engine rather than of the context, and conditions select it with
+// SelectorEvaluationTime.
+func (e *Engine) EvaluateAt(context map[string]interface{}, flags []*Flag, evaluationTime time.Time) map[string]Variant {
 	e.log.Debug("Evaluating %v flags with context %v", len(flags), context)
 	results := make(map[string]Variant)
-	target := &target{context, results}
+	target := &target{context, results, evaluationTime}
 	for _, flag := range flags {
 		// Evaluate flag and update results
 		variant := e.evaluateFlag(target, flag)
@@ -41,6 +66,72 @@ func (e *Engine) Evaluate(context map[string]interface{}, flags []*Flag) map[str
 	return results
 }
 
+// EvaluateIndependent evaluates flags which do not depend on each other, given the results of
+// flags they may depend on. The results argument is only read, so it may be shared between
+// concurrent calls. Returns the results of the given flags only.
+func (e *Engine) EvaluateIndependent(context map[string]interface{}, flags []*Flag, results map[string]Variant) map[string]Variant {
+	return e.EvaluateIndependentAt(context, flags, results, time.Time{})
+}
+
+// EvaluateIndependentAt evaluates like EvaluateIndependent, at the evaluation time, or the current
+// time if it is zero.
+func (e *Engine) EvaluateIndependentAt(context map[string]interface{}, flags []*Flag, results map[string]Variant, evaluationTime time.Time) map[string]Variant {
+	target := &target{context, results, evaluationTime}
+	flagResults := make(map[string]Variant, len(flags))
+	for _, flag := range flags {
+		variant := e.evaluateFlag(target, flag)
+		if variant != nil {
+			flagResults[flag.Key] = *variant
+		} else {
+			e.log.Debug("Flag %v evaluation returned nil result", flag.Key)
+		}
+	}
+	return flagResults
+}
+
+// SegmentMatch is a segment of a flag whose conditions match the target.
+type SegmentMatch struct {
+	// Index is the position of the segment in the flag's segments.
+	Index int
+	// Variant is the key of the variant the segment buckets the target into, or empty if the segment
+	// has no such variant, e.g. because the target is not allocated.
+	Variant string
+	// Metadata is the segment's metadata.
+	Metadata map[string]interface{}
+}
+
+// EvaluateMatches evaluates the flags like Evaluate, and also returns every segment of each flag
+// whose conditions match the target, including segments after the one which assigned the variant.
+// Flags without matching segments have no matches.
+func (e *Engine) EvaluateMatches(context map[string]interface{}, flags []*Flag) (map[string]Variant, map[string][]SegmentMatch) {
+	return e.EvaluateMatchesAt(context, flags, time.Time{})
+}
+
+// EvaluateMatchesAt evaluates like EvaluateMatches, at the evaluation time, or the current time if
+// it is zero.
+func (e *Engine) EvaluateMatchesAt(context map[string]interface{}, flags []*Flag, evaluationTime time.Time) (map[string]Variant, map[string][]SegmentMatch) {
+	results := make(map[string]Variant)
+	matches := make(map[string][]SegmentMatch)
+	target := &target{context, results, evaluationTime}
+	for _, flag := range flags {
+		for i, segment := range flag.Segments {
+			if !e.matchSegment(target, segment) {
+				continue
+			}
+			match := SegmentMatch{Index: i, Metadata: segment.Metadata}
+			if variant := flag.Variants[e.bucket(target, segment)]; variant != nil {
+				match.Variant = variant.Key
+			}
+			matches[flag.Key] = append(matches[flag.Key], match)
+		}
+		variant := e.evaluateFlag(target, flag)
+		if variant != nil {
+			results[flag.Key] = *variant
+		}
+	}
+	return results, matches
+}
+
 func (e *Engine) evaluateFlag(target *target, flag *Flag) *Variant {
 	e.log.Verbose("Evaluating flag %v with target %v", flag, target)
 	var result *Variant
@@ -59,11 +150,20 @@ func (e *Engine) evaluateFlag(target *target, flag *Flag) *Variant {
 
 func (e *Engine) evaluateSegment(target *target, flag *Flag, segment *Segment) *Variant {
 	e.log.Verbose("Evaluating segment %v with target %")
+	if !e.matchSegment(target, segment) {
+		return nil
+	}
+	variantKey := e.bucket(target, segment)
+	return flag.Variants[variantKey]
+}
+
+// matchSegment returns true if the segment's conditions match the target, in which case the target
+// is bucketed by the segment.
+func (e *Engine) matchSegment(target *target, segment *Segment) bool {
 	if segment.Conditions == nil {
 		e.log.Verbose("Segment conditions are nil, bucketing target")
 		// Null conditions always match
-		variantKey := e.bucket(target, segment)
-		return flag.Variants[variantKey]
+		return true
 	}
 	// Outer list logic is "or" (||)
 	for _, conditions := range segment.Conditions {
@@ -81,11 +181,10 @@ func (e *Engine) evaluateSegment(target *target, flag *Flag, segment *Segment) *
 		// On match bucket the user
 		if match {
 			e.log.Verbose("Segment conditions matched, bucketing target")
-			variantKey := e.bucket(target, segment)
-			return flag.Variants[variantKey]
+			return true
 		}
 	}
-	return nil
+	return false
 }
 
 func (e *Engine) matchCondition(target *target, condition *Condition) bool {
@@ -100,16 +199,35 @@ func (e *Engine) matchCondition(target *target, condition *Condition) bool {
 		if err != nil {
 			return false
 		}
-		return matchSet(propValueStringList, condition.Op, condition.Values)
+		filterValues := condition.Values
+		if e.options.CaseInsensitiveMatch {
+			propValueStringList = toLowerEach(propValueStringList)
+			filterValues = toLowerEach(filterValues)
+		}
+		return matchSet(propValueStringList, condition.Op, filterValues)
 	} else {
 		propValueString := coerceString(propValue)
 		if propValueString == nil {
 			return false
 		}
+		if e.options.CaseInsensitiveMatch && (condition.Op == OpIs || condition.Op == OpIsNot) {
+			return matchString(strings.ToLower(*propValueString), condition.Op, toLowerEach(condition.Values))
+		}
 		return matchString(*propValueString, condition.Op, condition.Values)
 	}
 }
 
+func toLowerEach(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	result := make([]string, len(values))
+	for i, value := range values {
+		result[i] = strings.ToLower(value)
+	}
+	return result
+}
+
 func (e *Engine) getHash(key string) uint64 {
 	return uint64(murmur3.Sum32WithSeed([]byte(key), 0))
 }
@@ -122,7 +240,7 @@ func (e *Engine) bucket(target *target, segment *Segment) string {
 		return segment.Variant
 	}
 	// Select the bucketing value
-	bucketingValue := coerceString(selectEach(target, segment.Bucket.Selector))
+	bucketingValue := coerceString(selectEach(target, bucketingSelector(target, segment.Bucket.Selector)))
 	e.log.Verbose("Selected bucketing value %v from target", bucketingValue)
 	if bucketingValue == nil || len(*bucketingValue) == 0 {
 		// A nil or empty bucketing value cannot be bucketed. Select the default variant.
@@ -130,7 +248,11 @@ func (e *Engine) bucket(target *target, segment *Segment) string {
 		return segment.Variant
 	}
 	// Salt and hash the value, and compute the allocation and distribution values.
-	keyToHash := fmt.Sprintf("%v/%v", segment.Bucket.Salt, *bucketingValue)
+	salt := segment.Bucket.Salt
+	if e.options.BucketingSalt != "" {
+		salt = e.options.BucketingSalt
+	}
+	keyToHash := fmt.Sprintf("%v/%v", salt, *bucketingValue)
 	hash := e.getHash(keyToHash)
 	allocationValue := hash % 100
 	distributionValue := hash / 100
@@ -151,6 +273,23 @@ func (e *Engine) bucket(target *target, segment *Segment) string {
 	return segment.Variant
 }
 
+// userIdentityKeys are the keys of the user's identity in the user of the evaluation context, which
+// the user's bucketing key replaces for bucketing.
+var userIdentityKeys = map[string]bool{"user_id": true, "device_id": true, "amplitude_id": true}
+
+// bucketingSelector returns the selector of the user's bucketing key if the target has one and the
+// selector selects the user's identity, otherwise the selector.
+func bucketingSelector(target *target, selector []string) []string {
+	if len(selector) != 3 || selector[0] != "context" || selector[1] != "user" || !userIdentityKeys[selector[2]] {
+		return selector
+	}
+	bucketingKeySelector := []string{"context", "user", ContextBucketingKey}
+	if bucketingKey := coerceString(selectEach(target, bucketingKeySelector)); bucketingKey == nil || len(*bucketingKey) == 0 {
+		return selector
+	}
+	return bucketingKeySelector
+}
+
 func mergeMetadata(metadata []map[string]interface{}) map[string]interface{} {
 	mergedMetadata := make(map[string]interface{})
 	for _, m := range metadata {
@@ -184,47 +323,87 @@ func matchNull(op string, filterValues []string) bool {
 	}
 }
 
+// setMatchers is the dispatch table of operators which match a set of property values.
+var setMatchers = map[string]func(propValues []string, filterValues []string) bool{
+	OpSetIs:                matchesSetIs,
+	OpSetIsNot:             not(matchesSetIs),
+	OpSetContains:          matchesSetContainsAll,
+	OpSetDoesNotContain:    not(matchesSetContainsAll),
+	OpSetContainsAny:       matchesSetContainsAny,
+	OpSetDoesNotContainAny: not(matchesSetContainsAny),
+}
+
+// stringMatchers is the dispatch table of operators which match a single property value, coerced
+// to a string.
+var stringMatchers = map[string]func(propValue string, filterValues []string) bool{
+	OpIs:                       matchesIs,
+	OpIsNot:                    notString(matchesIs),
+	OpContains:                 matchesContains,
+	OpDoesNotContain:           notString(matchesContains),
+	OpLessThan:                 compareWith(OpLessThan),
+	OpLessThanEquals:           compareWith(OpLessThanEquals),
+	OpGreaterThan:              compareWith(OpGreaterThan),
+	OpGreaterThanEquals:        compareWith(OpGreaterThanEquals),
+	OpVersionLessThan:          compareVersionWith(OpVersionLessThan),
+	OpVersionLessThanEquals:    compareVersionWith(OpVersionLessThanEquals),
+	OpVersionGreaterThan:       compareVersionWith(OpVersionGreaterThan),
+	OpVersionGreaterThanEquals: compareVersionWith(OpVersionGreaterThanEquals),
+	OpRegexMatch:               matchesRegex,
+	OpRegexDoesNotMatch:        notString(matchesRegex),
+}
+
+// SupportedOperators returns the condition operators the engine evaluates, sorted. Conditions with
+// other operators never match.
+func SupportedOperators() []string {
+	ops := make([]string, 0, len(setMatchers)+len(stringMatchers))
+	for op := range setMatchers {
+		ops = append(ops, op)
+	}
+	for op := range stringMatchers {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+func not(matcher func(propValues []string, filterValues []string) bool) func(propValues []string, filterValues []string) bool {
+	return func(propValues []string, filterValues []string) bool {
+		return !matcher(propValues, filterValues)
+	}
+}
+
+func notString(matcher func(propValue string, filterValues []string) bool) func(propValue string, filterValues []string) bool {
+	return func(propValue string, filterValues []string) bool {
+		return !matcher(propValue, filterValues)
+	}
+}
+
+func compareWith(op string) func(propValue string, filterValues []string) bool {
+	return func(propValue string, filterValues []string) bool {
+		return compare(propValue, op, filterValues)
+	}
+}
+
+func compareVersionWith(op string) func(propValue string, filterValues []string) bool {
+	return func(propValue string, filterValues []string) bool {
+		return compareVersion(propValue, op, filterValues)
+	}
+}
+
 func matchSet(propValues []string, op string, filterValues []string) bool {
-	switch op {
-	case OpSetIs:
-		return matchesSetIs(propValues, filterValues)
-	case OpSetIsNot:
-		return !matchesSetIs(propValues, filterValues)
-	case OpSetContains:
-		return matchesSetContainsAll(propValues, filterValues)
-	case OpSetDoesNotContain:
-		return !matchesSetContainsAll(propValues, filterValues)
-	case OpSetContainsAny:
-		return matchesSetContainsAny(propValues, filterValues)
-	case OpSetDoesNotContainAny:
-		return !matchesSetContainsAny(propValues, filterValues)
-	default:
+	matcher, ok := setMatchers[op]
+	if !ok {
 		return false
 	}
+	return matcher(propValues, filterValues)
 }
 
 func matchString(propValue string, op string, filterValues []string) bool {
-	switch op {
-	case OpIs:
-		return matchesIs(propValue, filterValues)
-	case OpIsNot:
-		return !matchesIs(propValue, filterValues)
-	case OpContains:
-		return matchesContains(propValue, filterValues)
-	case OpDoesNotContain:
-		return !matchesContains(propValue, filterValues)
-	case OpLessThan, OpLessThanEquals, OpGreaterThan, OpGreaterThanEquals:
-		return compare(propValue, op, filterValues)
-	case OpVersionLessThan, OpVersionLessThanEquals, OpVersionGreaterThan,
-		OpVersionGreaterThanEquals:
-		return compareVersion(propValue, op, filterValues)
-	case OpRegexMatch:
-		return matchesRegex(propValue, filterValues)
-	case OpRegexDoesNotMatch:
-		return !matchesRegex(propValue, filterValues)
-	default:
+	matcher, ok := stringMatchers[op]
+	if !ok {
 		return false
 	}
+	return matcher(propValue, filterValues)
 }
 
 func matchesIs(propValue string, filterValues []string) bool {
@@ -495,11 +674,6 @@ func coerceStringList(value interface{}) ([]string, error) {
 }
 
 func isSetOperator(op string) bool {
-	switch op {
-	case OpSetIs, OpSetIsNot, OpSetContains, OpSetDoesNotContain,
-		OpSetContainsAny, OpSetDoesNotContainAny:
-		return true
-	default:
-		return false
-	}
+	_, ok := setMatchers[op]
+	return ok
 }
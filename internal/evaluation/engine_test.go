@@ -19,7 +19,7 @@ import (
 const deploymentKey = "server-NgJxxvg8OGwwBsWVXqyxQbdiflbhvugy"
 
 var flags []*Flag
-var engine = &Engine{logger.New(false)}
+var engine = &Engine{log: logger.New(false)}
 
 func init() {
 	rawFlags, err := getFlagConfigsRaw()
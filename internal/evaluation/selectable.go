@@ -1,6 +1,15 @@
 package evaluation
 
-import "reflect"
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// SelectorEvaluationTime selects the time of evaluation, in milliseconds since the epoch, for
+// conditions which target a time window, e.g. with the selector ["evaluation_time"]. It is an
+// input of the local evaluation engine only, and isn't part of the evaluation context.
+const SelectorEvaluationTime = "evaluation_time"
 
 type selectable interface {
 	Select(selector string) interface{}
@@ -12,6 +21,12 @@ func (t target) Select(selector string) interface{} {
 		return t.context
 	case "result":
 		return t.result
+	case SelectorEvaluationTime:
+		evaluationTime := t.evaluationTime
+		if evaluationTime.IsZero() {
+			evaluationTime = time.Now()
+		}
+		return evaluationTime.UnixMilli()
 	default:
 		return nil
 	}
@@ -32,6 +47,12 @@ func (v Variant) Select(selector string) interface{} {
 	}
 }
 
+// selectEach selects the value at the selector from nested selectables and maps. If a selector
+// element isn't a key of a map[string]interface{}, such as user or group properties, but contains
+// dots, it is treated as a dotted path into nested maps, e.g. "subscription.plan" selects the "plan"
+// of the "subscription" property. Keys containing dots take precedence over paths. Paths don't
+// index into arrays, so a path through an array selects nothing, while a path ending at an array
+// selects the array.
 func selectEach(s interface{}, selector []string) interface{} {
 	if s == nil || selector == nil || len(selector) == 0 {
 		return nil
@@ -44,7 +65,11 @@ func selectEach(s interface{}, selector []string) interface{} {
 		case selectable:
 			s = t.Select(selectorElement)
 		case map[string]interface{}:
-			s = t[selectorElement]
+			value, ok := t[selectorElement]
+			if !ok && strings.Contains(selectorElement, ".") {
+				value = selectEach(t, strings.Split(selectorElement, "."))
+			}
+			s = value
 		case map[string]Variant:
 			s = t[selectorElement]
 		default:
@@ -152,3 +152,34 @@ func TestUnstructuredJson(t *testing.T) {
 		t.Fatalf("unexpected value %v", nestedBooleanValue2)
 	}
 }
+
+func TestSelectDottedPath(t *testing.T) {
+	object := map[string]interface{}{
+		"subscription": map[string]interface{}{
+			"plan":  "pro",
+			"seats": []interface{}{map[string]interface{}{"role": "admin"}},
+			"tiers": map[string]string{"support": "priority"},
+		},
+		"dotted.key": "literal",
+		"dotted":     map[string]interface{}{"key": "nested"},
+	}
+	tests := []struct {
+		selector []string
+		expected interface{}
+	}{
+		{[]string{"subscription.plan"}, "pro"},
+		{[]string{"subscription.tiers.support"}, "priority"},
+		{[]string{"subscription.missing"}, nil},
+		{[]string{"subscription.plan.missing"}, nil},
+		// Paths select arrays, but don't index into them.
+		{[]string{"subscription.seats"}, []interface{}{map[string]interface{}{"role": "admin"}}},
+		{[]string{"subscription.seats.role"}, nil},
+		// Keys containing dots take precedence.
+		{[]string{"dotted.key"}, "literal"},
+	}
+	for _, tt := range tests {
+		if actual := selectEach(object, tt.selector); !reflect.DeepEqual(actual, tt.expected) {
+			t.Fatalf("selector %v: expected %v, got %v", tt.selector, tt.expected, actual)
+		}
+	}
+}
@@ -11,6 +11,7 @@ type Level int
 const (
 	Verbose Level = iota
 	Debug
+	Info
 	Error
 )
 
@@ -24,7 +25,7 @@ func New(debug bool) *Log {
 	if debug {
 		level = Debug
 	} else {
-		level = Error
+		level = Info
 	}
 	return &Log{
 		logger: log.New(os.Stderr, "", log.LstdFlags),
@@ -46,6 +47,13 @@ func (l *Log) Debug(format string, args ...interface{}) {
 	}
 }
 
+func (l *Log) Info(format string, args ...interface{}) {
+	if l.level <= Info {
+		format = fmt.Sprintf("INFO - %v\n", format)
+		l.logger.Printf(format, args...)
+	}
+}
+
 func (l *Log) Error(format string, args ...interface{}) {
 	if l.level <= Error {
 		format = fmt.Sprintf("ERROR - %v\n", format)
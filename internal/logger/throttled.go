@@ -0,0 +1,80 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// throttledMaxMessages is the number of distinct messages tracked before expired messages are dropped.
+const throttledMaxMessages = 100
+
+type throttledMessage struct {
+	lastLogged time.Time
+	suppressed int
+}
+
+// Throttled logs each distinct error message at most once per interval. Repeats within the
+// interval are counted, and the count is included when the message is next logged.
+type Throttled struct {
+	log      *Log
+	interval time.Duration
+	now      func() time.Time
+	lock     sync.Mutex
+	messages map[string]*throttledMessage
+}
+
+// NewThrottled returns a throttled logger which logs to log. An interval of zero or less
+// disables throttling.
+func NewThrottled(log *Log, interval time.Duration) *Throttled {
+	return &Throttled{
+		log:      log,
+		interval: interval,
+		now:      time.Now,
+		messages: make(map[string]*throttledMessage),
+	}
+}
+
+func (t *Throttled) Error(format string, args ...interface{}) {
+	if t.interval <= 0 {
+		t.log.Error(format, args...)
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	now := t.now()
+	t.lock.Lock()
+	entry := t.messages[message]
+	if entry != nil && now.Sub(entry.lastLogged) < t.interval {
+		entry.suppressed++
+		t.lock.Unlock()
+		return
+	}
+	suppressed := 0
+	if entry == nil {
+		if len(t.messages) >= throttledMaxMessages {
+			t.removeExpired(now)
+		}
+		entry = &throttledMessage{}
+		t.messages[message] = entry
+	} else {
+		suppressed = entry.suppressed
+	}
+	entry.lastLogged = now
+	entry.suppressed = 0
+	t.lock.Unlock()
+	if suppressed > 0 {
+		t.log.Error("%s (repeated %d times since last logged)", message, suppressed)
+	} else {
+		t.log.Error("%s", message)
+	}
+}
+
+// removeExpired drops messages which were last logged more than an interval ago, and so would
+// be logged on their next occurrence anyway. Suppressed counts of dropped messages are lost.
+func (t *Throttled) removeExpired(now time.Time) {
+	for message, entry := range t.messages {
+		if now.Sub(entry.lastLogged) >= t.interval {
+			delete(t.messages, message)
+		}
+	}
+}
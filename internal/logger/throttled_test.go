@@ -0,0 +1,47 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThrottled(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(false)
+	l.logger = log.New(&buf, "", 0)
+	now := time.Unix(0, 0)
+	throttled := NewThrottled(l, 10*time.Second)
+	throttled.now = func() time.Time { return now }
+
+	throttled.Error("fetch failed: %v", "timeout")
+	throttled.Error("fetch failed: %v", "timeout")
+	throttled.Error("fetch failed: %v", "timeout")
+	throttled.Error("fetch failed: %v", "refused")
+	now = now.Add(10 * time.Second)
+	throttled.Error("fetch failed: %v", "timeout")
+
+	expected := []string{
+		"ERROR - fetch failed: timeout",
+		"ERROR - fetch failed: refused",
+		"ERROR - fetch failed: timeout (repeated 2 times since last logged)",
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected log lines %q", lines)
+	}
+}
+
+func TestThrottledDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(false)
+	l.logger = log.New(&buf, "", 0)
+	throttled := NewThrottled(l, 0)
+	throttled.Error("fetch failed")
+	throttled.Error("fetch failed")
+	if strings.Count(buf.String(), "fetch failed") != 2 {
+		t.Fatalf("Unexpected log output %q", buf.String())
+	}
+}
@@ -7,12 +7,26 @@ import (
 	"time"
 )
 
+// Assignment is the evaluation of flags for a user which is tracked as an assignment event.
+type Assignment struct {
+	User    *experiment.User
+	Results map[string]experiment.Variant
+	// Timestamp is the time of the evaluation in milliseconds since the epoch.
+	Timestamp int64
+}
+
 type assignment struct {
 	user      *experiment.User
 	results   map[string]experiment.Variant
 	timestamp int64
 }
 
+// NewAssignment returns the assignment of the evaluation results for the user at the current time,
+// e.g. to build its event with BuildAssignmentEvent.
+func NewAssignment(user *experiment.User, results map[string]experiment.Variant) *Assignment {
+	return newAssignment(user, results).export()
+}
+
 func newAssignment(user *experiment.User, results map[string]experiment.Variant) *assignment {
 	assignment := &assignment{
 		user:      user,
@@ -49,3 +63,40 @@ func (a *assignment) Canonicalize() string {
 
 	return sb.String()
 }
+
+// withoutUntrackedResults returns the assignment without the results of flags whose metadata opts
+// out of assignment tracking with experiment.MetadataTrackAssignment.
+func (a *assignment) withoutUntrackedResults() *assignment {
+	var results map[string]experiment.Variant
+	for key, result := range a.results {
+		if track, ok := result.Metadata[experiment.MetadataTrackAssignment].(bool); ok && !track {
+			if results == nil {
+				results = make(map[string]experiment.Variant, len(a.results))
+				for k, v := range a.results {
+					results[k] = v
+				}
+			}
+			delete(results, key)
+		}
+	}
+	if results == nil {
+		return a
+	}
+	return &assignment{user: a.user, results: results, timestamp: a.timestamp}
+}
+
+func (a *Assignment) internal() *assignment {
+	return &assignment{
+		user:      a.User,
+		results:   a.Results,
+		timestamp: a.Timestamp,
+	}
+}
+
+func (a *assignment) export() *Assignment {
+	return &Assignment{
+		User:      a.user,
+		Results:   a.results,
+		Timestamp: a.timestamp,
+	}
+}
@@ -33,3 +33,18 @@ func (f *assignmentFilter) shouldTrack(assignment *assignment) bool {
 	f.mu.Unlock()
 	return track == 0
 }
+
+// size returns the number of assignments in the filter, including expired assignments which were
+// not yet removed.
+func (f *assignmentFilter) size() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cache.Len()
+}
+
+// reset removes all assignments from the filter, so they are tracked again.
+func (f *assignmentFilter) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cache.Clear()
+}
@@ -274,3 +274,22 @@ func TestTTLBasedEviction(t *testing.T) {
 		t.Errorf("Assignment2 should not be tracked")
 	}
 }
+
+func TestResetAssignmentFilter(t *testing.T) {
+	user := &experiment.User{UserId: "user"}
+	results := map[string]experiment.Variant{"flag-key-1": {Key: "on"}}
+	filter := newAssignmentFilter(100)
+	if !filter.shouldTrack(newAssignment(user, results)) {
+		t.Errorf("Assignment should be tracked")
+	}
+	if filter.size() != 1 {
+		t.Errorf("Unexpected filter size %d", filter.size())
+	}
+	filter.reset()
+	if filter.size() != 0 {
+		t.Errorf("Unexpected filter size %d after reset", filter.size())
+	}
+	if !filter.shouldTrack(newAssignment(user, results)) {
+		t.Errorf("Assignment should be tracked again after reset")
+	}
+}
@@ -1,28 +1,256 @@
 package local
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
+
 	"github.com/amplitude/analytics-go/amplitude"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
 )
 
 const dayMillis = 24 * 60 * 60 * 1000
 const flagTypeMutualExclusionGroup = "mutual-exclusion-group"
+const flagTypeHoldoutGroup = "holdout-group"
+const holdoutVariantKey = "holdout"
+const assignmentEventType = "[Experiment] Assignment"
+const assignmentPropertyPrefix = "[Experiment] "
 
 type assignmentService struct {
-	amplitude *amplitude.Client
-	filter    *assignmentFilter
+	amplitude      *amplitude.Client
+	filter         *assignmentFilter
+	exposureFilter *assignmentFilter
+	insertIDHash   func(string) uint64
+	eventType      string
+	propertyPrefix string
+	userProperties bool
+	onTrackError   func(*Assignment, error)
+	pendingMutex   sync.Mutex
+	pending        map[string]*assignment
+	// deliveries are the channels of TrackSync calls waiting for the delivery results of events,
+	// keyed by insert ID. Delivery results are only reported to executeCallback if reportsDelivery.
+	deliveries      map[string][]chan amplitude.ExecuteResult
+	reportsDelivery bool
+	// ownsAmplitude is true if the amplitude client was constructed for the service, so close shuts
+	// it down.
+	ownsAmplitude bool
+}
+
+func newAssignmentService(amplitude *amplitude.Client, config *AssignmentConfig) *assignmentService {
+	insertIDHash := config.InsertIDHash
+	if insertIDHash == nil {
+		insertIDHash = defaultInsertIDHash
+	}
+	eventType := config.EventType
+	if eventType == "" {
+		eventType = assignmentEventType
+	}
+	propertyPrefix := config.PropertyPrefix
+	if propertyPrefix == "" {
+		propertyPrefix = assignmentPropertyPrefix
+	}
+	return &assignmentService{
+		amplitude:      amplitude,
+		filter:         newAssignmentFilter(config.CacheCapacity),
+		exposureFilter: newAssignmentFilter(config.CacheCapacity),
+		insertIDHash:   insertIDHash,
+		eventType:      eventType,
+		propertyPrefix: propertyPrefix,
+		userProperties: !config.DisableUserProperties,
+		pending:        make(map[string]*assignment),
+	}
+}
+
+// newAmplitudeAssignmentService constructs an amplitude client from the config which reports
+// failed assignment events to the config's OnTrackError.
+func newAmplitudeAssignmentService(config *AssignmentConfig) *assignmentService {
+	s := newAssignmentService(nil, config)
+	amplitudeConfig := config.Config
+	s.onTrackError = config.OnTrackError
+	s.reportsDelivery = true
+	s.ownsAmplitude = true
+	amplitudeConfig.ExecuteCallback = s.executeCallback(amplitudeConfig.ExecuteCallback)
+	amplitudeClient := amplitude.NewClient(amplitudeConfig)
+	s.amplitude = &amplitudeClient
+	return s
+}
+
+// newSinkAssignmentService tracks events to the config's TestSink rather than an amplitude client.
+func newSinkAssignmentService(config *AssignmentConfig) *assignmentService {
+	var sinkClient amplitude.Client = &sinkAmplitudeClient{sink: config.TestSink}
+	s := newAssignmentService(&sinkClient, config)
+	s.ownsAmplitude = true
+	return s
+}
+
+// sinkAmplitudeClient is an amplitude client which passes tracked events to AssignmentConfig.TestSink.
+type sinkAmplitudeClient struct {
+	amplitude.Client
+	sink func(amplitude.Event)
+}
+
+func (c *sinkAmplitudeClient) Track(event amplitude.Event) {
+	c.sink(event)
+}
+
+// Flush does nothing, since events are passed to the sink as they are tracked.
+func (c *sinkAmplitudeClient) Flush() {}
+
+// Shutdown does nothing, since the sink holds no buffered events or goroutines.
+func (c *sinkAmplitudeClient) Shutdown() {}
+
+// close flushes the events buffered by the amplitude client, and shuts the client down if it was
+// constructed for the service, rather than passed in AssignmentConfig.Client.
+func (s *assignmentService) close() {
+	(*s.amplitude).Flush()
+	if s.ownsAmplitude {
+		(*s.amplitude).Shutdown()
+	}
 }
 
 func (s *assignmentService) Track(assignment *assignment) {
+	assignment = assignment.withoutUntrackedResults()
+	if len(assignment.results) == 0 {
+		return
+	}
 	if s.filter.shouldTrack(assignment) {
-		(*s.amplitude).Track(toEvent(assignment))
+		s.track(assignment)
+	}
+}
+
+// TrackSync tracks the assignment event like Track, except that the event is sent even if the
+// assignment filter has seen the assignment, and flushes the amplitude client to wait for the
+// event's delivery result. The event's insert ID is the same as Track's, so Amplitude still
+// deduplicates it with an event of the same assignment on the same day. It returns an error if the
+// event failed to be delivered, or ctx's error if ctx is done first.
+func (s *assignmentService) TrackSync(ctx context.Context, assignment *assignment) error {
+	assignment = assignment.withoutUntrackedResults()
+	if len(assignment.results) == 0 {
+		return nil
+	}
+	// Record the assignment, so Track deduplicates it.
+	s.filter.shouldTrack(assignment)
+	if _, ok := (*s.amplitude).(*sinkAmplitudeClient); ok {
+		s.track(assignment)
+		return nil
+	}
+	if !s.reportsDelivery {
+		return errors.New("delivery results of AssignmentConfig.Client are not reported")
+	}
+	delivered := make(chan amplitude.ExecuteResult, 1)
+	event := s.track(assignment, delivered)
+	// The callback removes the pending event and delivery when it reports the result, which it
+	// may never do, e.g. if the amplitude client drops the event, so they are removed however
+	// TrackSync returns. The caller learns of the failure from the returned error instead.
+	defer func() {
+		s.pendingMutex.Lock()
+		defer s.pendingMutex.Unlock()
+		delete(s.pending, event.InsertID)
+		s.removeDelivery(event.InsertID, delivered)
+	}()
+	(*s.amplitude).Flush()
+	select {
+	case result := <-delivered:
+		if result.Code < 200 || result.Code >= 300 {
+			return fmt.Errorf("assignment event failed with status %d: %s", result.Code, result.Message)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track tracks the assignment's event, and returns it. The event's delivery result is sent to the
+// delivered channels.
+func (s *assignmentService) track(assignment *assignment, delivered ...chan amplitude.ExecuteResult) amplitude.Event {
+	event := toEventWithNames(assignment, s.insertIDHash, s.eventType, s.propertyPrefix)
+	if !s.userProperties {
+		event.UserProperties = nil
+	}
+	if s.onTrackError != nil || len(delivered) > 0 {
+		s.pendingMutex.Lock()
+		if s.onTrackError != nil {
+			s.pending[event.InsertID] = assignment
+		}
+		if len(delivered) > 0 {
+			if s.deliveries == nil {
+				s.deliveries = make(map[string][]chan amplitude.ExecuteResult)
+			}
+			s.deliveries[event.InsertID] = append(s.deliveries[event.InsertID], delivered...)
+		}
+		s.pendingMutex.Unlock()
 	}
+	(*s.amplitude).Track(event)
+	return event
 }
 
-func toEvent(assignment *assignment) amplitude.Event {
+func (s *assignmentService) removeDelivery(insertID string, delivered chan amplitude.ExecuteResult) {
+	deliveries := s.deliveries[insertID]
+	for i, d := range deliveries {
+		if d == delivered {
+			deliveries = append(deliveries[:i], deliveries[i+1:]...)
+			break
+		}
+	}
+	if len(deliveries) == 0 {
+		delete(s.deliveries, insertID)
+	} else {
+		s.deliveries[insertID] = deliveries
+	}
+}
+
+// executeCallback wraps the amplitude client's callback to resolve pending assignment events.
+func (s *assignmentService) executeCallback(next func(amplitude.ExecuteResult)) func(amplitude.ExecuteResult) {
+	return func(result amplitude.ExecuteResult) {
+		if result.Event != nil && result.Event.EventType == s.eventType {
+			s.pendingMutex.Lock()
+			assignment := s.pending[result.Event.InsertID]
+			delete(s.pending, result.Event.InsertID)
+			deliveries := s.deliveries[result.Event.InsertID]
+			delete(s.deliveries, result.Event.InsertID)
+			s.pendingMutex.Unlock()
+			for _, delivered := range deliveries {
+				delivered <- result
+			}
+			if assignment != nil && (result.Code < 200 || result.Code >= 300) {
+				s.onTrackError(assignment.export(), fmt.Errorf("assignment event failed with status %d: %s", result.Code, result.Message))
+			}
+		}
+		if next != nil {
+			next(result)
+		}
+	}
+}
+
+// Expose tracks an exposure event for each exposable result. Exposures are deduplicated per user, flag, and variant.
+func (s *assignmentService) Expose(user *experiment.User, results map[string]experiment.Variant) {
+	for flagKey, result := range results {
+		if !isExposable(result) {
+			continue
+		}
+		exposure := newExposure(user, flagKey, result)
+		if s.exposureFilter.shouldTrack(exposure) {
+			(*s.amplitude).Track(toExposureEvent(exposure, s.insertIDHash))
+		}
+	}
+}
+
+// BuildAssignmentEvent returns the event tracked for the assignment, without tracking it, so it can
+// be sent elsewhere. The insert ID is computed with the default hash, not AssignmentConfig.InsertIDHash.
+func BuildAssignmentEvent(assignment *Assignment) amplitude.Event {
+	return toEvent(assignment.internal().withoutUntrackedResults(), defaultInsertIDHash)
+}
+
+func toEvent(assignment *assignment, insertIDHash func(string) uint64) amplitude.Event {
+	return toEventWithNames(assignment, insertIDHash, assignmentEventType, assignmentPropertyPrefix)
+}
 
+// toEventWithNames returns the assignment event with the event type, and with the flag keys in user
+// property names prefixed by the property prefix.
+func toEventWithNames(assignment *assignment, insertIDHash func(string) uint64, eventType, propertyPrefix string) amplitude.Event {
 	event := amplitude.Event{
-		EventType:       "[Experiment] Assignment",
+		EventType:       eventType,
 		UserID:          assignment.user.UserId,
 		DeviceID:        assignment.user.DeviceId,
 		EventProperties: make(map[string]interface{}),
@@ -45,20 +273,20 @@ func toEvent(assignment *assignment) amplitude.Event {
 
 	// Loop to set user_properties
 	for resultsKey, result := range assignment.results {
-		flagType, _ := result.Metadata["flagType"].(string)
-		isDefault, _ := result.Metadata["default"].(bool)
+		flagType, _ := result.Metadata[experiment.MetadataFlagType].(string)
+		isDefault, _ := result.Metadata[experiment.MetadataDefault].(bool)
 		if flagType == flagTypeMutualExclusionGroup {
 			continue
 		} else if isDefault {
-			unset[fmt.Sprintf("[Experiment] %s", resultsKey)] = "-"
+			unset[propertyPrefix+resultsKey] = "-"
 		} else {
-			set[fmt.Sprintf("[Experiment] %s", resultsKey)] = result.Key
+			set[propertyPrefix+resultsKey] = result.Key
 		}
 	}
 
 	event.UserProperties["$set"] = set
 	event.UserProperties["$unset"] = unset
 
-	event.InsertID = fmt.Sprintf("%s %s %d %d", event.UserID, event.DeviceID, hashCode(assignment.Canonicalize()), assignment.timestamp/dayMillis)
+	event.InsertID = fmt.Sprintf("%s %s %d %d", event.UserID, event.DeviceID, insertIDHash(assignment.Canonicalize()), assignment.timestamp/dayMillis)
 	return event
 }
@@ -1,12 +1,58 @@
 package local
 
 import (
+	"context"
 	"fmt"
+	"github.com/amplitude/analytics-go/amplitude"
 	"github.com/amplitude/experiment-go-server/pkg/experiment"
 	"reflect"
+	"sync"
 	"testing"
 )
 
+type mockAmplitudeClient struct {
+	amplitude.Client
+	lock   sync.Mutex
+	events []amplitude.Event
+}
+
+func (m *mockAmplitudeClient) Track(event amplitude.Event) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.events = append(m.events, event)
+}
+
+func (m *mockAmplitudeClient) trackedEvents() []amplitude.Event {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]amplitude.Event{}, m.events...)
+}
+
+// closingAmplitudeClient counts the calls of Flush and Shutdown.
+type closingAmplitudeClient struct {
+	mockAmplitudeClient
+	flushes, shutdowns int
+}
+
+func (m *closingAmplitudeClient) Flush() { m.flushes++ }
+
+func (m *closingAmplitudeClient) Shutdown() { m.shutdowns++ }
+
+func TestAssignmentServiceClose(t *testing.T) {
+	mock := &closingAmplitudeClient{}
+	var amplitudeClient amplitude.Client = mock
+	s := newAssignmentService(&amplitudeClient, &AssignmentConfig{})
+	s.close()
+	if mock.flushes != 1 || mock.shutdowns != 0 {
+		t.Fatalf("Expected an existing client to be flushed only, got %d flushes and %d shutdowns", mock.flushes, mock.shutdowns)
+	}
+	s.ownsAmplitude = true
+	s.close()
+	if mock.flushes != 2 || mock.shutdowns != 1 {
+		t.Fatalf("Expected an owned client to be flushed and shut down, got %d flushes and %d shutdowns", mock.flushes, mock.shutdowns)
+	}
+}
+
 func TestToEvent(t *testing.T) {
 	user := &experiment.User{
 		UserId:   "user",
@@ -32,7 +78,7 @@ func TestToEvent(t *testing.T) {
 	}
 
 	assignment := newAssignment(user, results)
-	event := toEvent(assignment)
+	event := toEvent(assignment, defaultInsertIDHash)
 	canonicalization := "user device flag-key-1 on flag-key-2 control "
 	expectedInsertID := fmt.Sprintf("user device %d %d", hashCode(canonicalization), assignment.timestamp/dayMillis)
 	if event.UserID != "user" {
@@ -91,7 +137,7 @@ func TestToEventNoDetails(t *testing.T) {
 	}
 
 	assignment := newAssignment(user, results)
-	event := toEvent(assignment)
+	event := toEvent(assignment, defaultInsertIDHash)
 	canonicalization := "user device flag-key-1 on flag-key-2 control "
 	expectedInsertID := fmt.Sprintf("user device %d %d", hashCode(canonicalization), assignment.timestamp/dayMillis)
 	if event.UserID != "user" {
@@ -110,3 +156,348 @@ func TestToEventNoDetails(t *testing.T) {
 		t.Errorf("InsertID was %s, expected %s", event.InsertID, expectedInsertID)
 	}
 }
+
+func TestBuildAssignmentEvent(t *testing.T) {
+	user := &experiment.User{UserId: "user", DeviceId: "device"}
+	results := map[string]experiment.Variant{
+		"flag-key-1": {Key: "on", Metadata: map[string]interface{}{"segmentName": "Segment", "flagVersion": float64(13)}},
+	}
+	assignment := NewAssignment(user, results)
+	event := BuildAssignmentEvent(assignment)
+	expected := toEvent(assignment.internal(), defaultInsertIDHash)
+	if !reflect.DeepEqual(expected, event) {
+		t.Errorf("Unexpected event %v, expected %v", event, expected)
+	}
+	if event.EventProperties["flag-key-1.variant"] != "on" {
+		t.Errorf("Unexpected event properties %v", event.EventProperties)
+	}
+}
+
+func TestAssignmentConfigClient(t *testing.T) {
+	mock := &mockAmplitudeClient{}
+	var amplitudeClient amplitude.Client = mock
+	c := Initialize("test-"+t.Name(), &Config{AssignmentConfig: &AssignmentConfig{Client: &amplitudeClient}})
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("flag", nil))
+	_, err := c.EvaluateV2(&experiment.User{UserId: "user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	events := mock.trackedEvents()
+	if len(events) != 1 {
+		t.Fatalf("Tracked %d events, expected %d", len(events), 1)
+	}
+	if events[0].EventProperties["flag.variant"] != "on" {
+		t.Errorf("Unexpected event properties %v", events[0].EventProperties)
+	}
+}
+
+func TestAssignmentDisableUserProperties(t *testing.T) {
+	mock := &mockAmplitudeClient{}
+	var amplitudeClient amplitude.Client = mock
+	c := Initialize("test-"+t.Name(), &Config{AssignmentConfig: &AssignmentConfig{Client: &amplitudeClient, DisableUserProperties: true}})
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("flag", nil))
+	_, err := c.EvaluateV2(&experiment.User{UserId: "user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	events := mock.trackedEvents()
+	if len(events) != 1 {
+		t.Fatalf("Tracked %d events, expected %d", len(events), 1)
+	}
+	if events[0].EventProperties["flag.variant"] != "on" {
+		t.Errorf("Unexpected event properties %v", events[0].EventProperties)
+	}
+	if events[0].UserProperties != nil {
+		t.Errorf("Unexpected user properties %v", events[0].UserProperties)
+	}
+}
+
+func TestAssignmentTrackAssignmentMetadata(t *testing.T) {
+	mock := &mockAmplitudeClient{}
+	var amplitudeClient amplitude.Client = mock
+	c := Initialize("test-"+t.Name(), &Config{AssignmentConfig: &AssignmentConfig{Client: &amplitudeClient}})
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("flag", nil))
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("kill-switch", map[string]interface{}{experiment.MetadataTrackAssignment: false}))
+	_, err := c.EvaluateV2(&experiment.User{UserId: "user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	_, err = c.EvaluateV2(&experiment.User{UserId: "user"}, []string{"kill-switch"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	events := mock.trackedEvents()
+	if len(events) != 1 {
+		t.Fatalf("Tracked %d events, expected %d", len(events), 1)
+	}
+	if events[0].EventProperties["flag.variant"] != "on" {
+		t.Errorf("Unexpected event properties %v", events[0].EventProperties)
+	}
+	if _, ok := events[0].EventProperties["kill-switch.variant"]; ok {
+		t.Errorf("Unexpected event properties %v", events[0].EventProperties)
+	}
+	if _, ok := events[0].UserProperties["$set"]["[Experiment] kill-switch"]; ok {
+		t.Errorf("Unexpected user properties %v", events[0].UserProperties)
+	}
+}
+
+func TestInsertIDHashCollision(t *testing.T) {
+	user := &experiment.User{UserId: "user", DeviceId: "device"}
+	assignment1 := newAssignment(user, map[string]experiment.Variant{"flag": {Key: "Aa"}})
+	assignment2 := newAssignment(user, map[string]experiment.Variant{"flag": {Key: "BB"}})
+	assignment2.timestamp = assignment1.timestamp
+	// The default hash collides for these assignments.
+	if toEvent(assignment1, defaultInsertIDHash).InsertID != toEvent(assignment2, defaultInsertIDHash).InsertID {
+		t.Errorf("Expected default insert IDs to collide")
+	}
+	if toEvent(assignment1, FNV1aHash).InsertID == toEvent(assignment2, FNV1aHash).InsertID {
+		t.Errorf("Expected FNV-1a insert IDs to be distinct")
+	}
+}
+
+func TestFNV1aInsertIDsDistinct(t *testing.T) {
+	user := &experiment.User{UserId: "user", DeviceId: "device"}
+	variants := []string{"control", "treatment", "on", "off", "A", "B"}
+	timestamp := newAssignment(user, nil).timestamp
+	insertIDs := make(map[string]struct{})
+	count := 0
+	// Every combination of variants for a user across 5 flags.
+	var generate func(results map[string]experiment.Variant, flag int)
+	generate = func(results map[string]experiment.Variant, flag int) {
+		if flag == 5 {
+			assignment := newAssignment(user, results)
+			assignment.timestamp = timestamp
+			insertIDs[toEvent(assignment, FNV1aHash).InsertID] = struct{}{}
+			count++
+			return
+		}
+		for _, variant := range variants {
+			next := map[string]experiment.Variant{fmt.Sprintf("flag-%d", flag): {Key: variant}}
+			for k, v := range results {
+				next[k] = v
+			}
+			generate(next, flag+1)
+		}
+	}
+	generate(map[string]experiment.Variant{}, 0)
+	if len(insertIDs) != count {
+		t.Errorf("Got %d distinct insert IDs for %d distinct assignments", len(insertIDs), count)
+	}
+}
+
+func TestAssignmentOnTrackError(t *testing.T) {
+	mock := &mockAmplitudeClient{}
+	var amplitudeClient amplitude.Client = mock
+	var failed []*Assignment
+	s := newAssignmentService(&amplitudeClient, &AssignmentConfig{})
+	s.onTrackError = func(assignment *Assignment, err error) {
+		failed = append(failed, assignment)
+	}
+	callback := s.executeCallback(nil)
+
+	user1 := &experiment.User{UserId: "user1"}
+	user2 := &experiment.User{UserId: "user2"}
+	s.Track(newAssignment(user1, map[string]experiment.Variant{"flag": {Key: "on"}}))
+	s.Track(newAssignment(user2, map[string]experiment.Variant{"flag": {Key: "on"}}))
+	events := mock.trackedEvents()
+	if len(events) != 2 {
+		t.Fatalf("Tracked %d events, expected %d", len(events), 2)
+	}
+	callback(amplitude.ExecuteResult{Event: &events[0], Code: 200})
+	callback(amplitude.ExecuteResult{Event: &events[1], Code: 400, Message: "Invalid request"})
+
+	if len(failed) != 1 {
+		t.Fatalf("Reported %d failures, expected %d", len(failed), 1)
+	}
+	if failed[0].User != user2 || failed[0].Results["flag"].Key != "on" {
+		t.Errorf("Unexpected failed assignment %v", failed[0])
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("Expected no pending assignments, got %d", len(s.pending))
+	}
+}
+
+func TestAssignmentConfigTestSink(t *testing.T) {
+	var lock sync.Mutex
+	var events []amplitude.Event
+	sink := func(event amplitude.Event) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	}
+	c := Initialize("test-"+t.Name(), &Config{AssignmentConfig: &AssignmentConfig{TestSink: sink}})
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("flag", nil))
+	user := &experiment.User{UserId: "user", DeviceId: "device"}
+	variants, err := c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(events) != 1 {
+		t.Fatalf("Tracked %d events, expected %d", len(events), 1)
+	}
+	expected := toEvent(newAssignment(user, variants), defaultInsertIDHash)
+	if events[0].EventType != assignmentEventType || events[0].InsertID != expected.InsertID {
+		t.Errorf("Unexpected event %v, expected %v", events[0], expected)
+	}
+	if events[0].EventProperties["flag.variant"] != "on" {
+		t.Errorf("Unexpected event properties %v", events[0].EventProperties)
+	}
+	if events[0].UserProperties["$set"]["[Experiment] flag"] != "on" {
+		t.Errorf("Unexpected user properties %v", events[0].UserProperties)
+	}
+}
+
+func TestSinkAmplitudeClientFlushAndShutdown(t *testing.T) {
+	s := newSinkAssignmentService(&AssignmentConfig{TestSink: func(amplitude.Event) {}})
+	(*s.amplitude).Flush()
+	(*s.amplitude).Shutdown()
+}
+
+func TestAssignmentConfigEventNames(t *testing.T) {
+	var events []amplitude.Event
+	config := &AssignmentConfig{
+		TestSink:       func(event amplitude.Event) { events = append(events, event) },
+		EventType:      "Variant Assigned",
+		PropertyPrefix: "exp_",
+	}
+	c := Initialize("test-"+t.Name(), &Config{AssignmentConfig: config})
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("flag", nil))
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("default", map[string]interface{}{experiment.MetadataDefault: true}))
+	_, err := c.EvaluateV2(&experiment.User{UserId: "user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Tracked %d events, expected %d", len(events), 1)
+	}
+	if events[0].EventType != "Variant Assigned" {
+		t.Errorf("Unexpected event type %v", events[0].EventType)
+	}
+	expected := map[amplitude.IdentityOp]map[string]interface{}{
+		"$set":   {"exp_flag": "on"},
+		"$unset": {"exp_default": "-"},
+	}
+	if !reflect.DeepEqual(events[0].UserProperties, expected) {
+		t.Errorf("Unexpected user properties %v", events[0].UserProperties)
+	}
+}
+
+// deliveringAmplitudeClient reports the delivery results of the tracked events to the callback
+// when flushed, like an amplitude client sending them.
+type deliveringAmplitudeClient struct {
+	mockAmplitudeClient
+	code     int
+	callback func(amplitude.ExecuteResult)
+}
+
+func (m *deliveringAmplitudeClient) Flush() {
+	for _, event := range m.trackedEvents() {
+		event := event
+		go m.callback(amplitude.ExecuteResult{Event: &event, Code: m.code})
+	}
+}
+
+func TestAssignmentTrackSync(t *testing.T) {
+	mock := &deliveringAmplitudeClient{code: 200}
+	var amplitudeClient amplitude.Client = mock
+	s := newAssignmentService(&amplitudeClient, &AssignmentConfig{})
+	s.reportsDelivery = true
+	mock.callback = s.executeCallback(nil)
+	assignment := newAssignment(&experiment.User{UserId: "user"}, map[string]experiment.Variant{"flag": {Key: "on"}})
+
+	if err := s.TrackSync(context.Background(), assignment); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := s.TrackSync(context.Background(), assignment); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if events := mock.trackedEvents(); len(events) != 2 {
+		t.Fatalf("Tracked %d events, expected %d", len(events), 2)
+	}
+	s.Track(assignment)
+	if events := mock.trackedEvents(); len(events) != 2 {
+		t.Fatalf("Expected Track to deduplicate the synchronously tracked assignment")
+	}
+
+	mock.code = 400
+	if err := s.TrackSync(context.Background(), assignment); err == nil {
+		t.Fatalf("Expected an error for the failed event")
+	}
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+	if len(s.deliveries) != 0 {
+		t.Errorf("Expected no waiting deliveries, got %d", len(s.deliveries))
+	}
+}
+
+func TestAssignmentTrackSyncCanceled(t *testing.T) {
+	var amplitudeClient amplitude.Client = &deliveringAmplitudeClient{callback: func(amplitude.ExecuteResult) {}}
+	s := newAssignmentService(&amplitudeClient, &AssignmentConfig{})
+	assignment := newAssignment(&experiment.User{UserId: "user"}, map[string]experiment.Variant{"flag": {Key: "on"}})
+	if err := s.TrackSync(context.Background(), assignment); err == nil {
+		t.Fatalf("Expected an error without delivery results")
+	}
+
+	// The callback never reports the event, so only TrackSync removes it.
+	s.reportsDelivery = true
+	s.onTrackError = func(*Assignment, error) {}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.TrackSync(ctx, assignment); err != context.Canceled {
+		t.Fatalf("Expected context canceled, got %v", err)
+	}
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+	if len(s.deliveries) != 0 {
+		t.Errorf("Expected no waiting deliveries, got %d", len(s.deliveries))
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("Expected no pending events, got %d", len(s.pending))
+	}
+}
+
+func TestClientTrackSync(t *testing.T) {
+	var events []amplitude.Event
+	c := Initialize("test-"+t.Name(), &Config{AssignmentConfig: &AssignmentConfig{
+		TestSink: func(event amplitude.Event) { events = append(events, event) },
+	}})
+	assignment := NewAssignment(&experiment.User{UserId: "user"}, map[string]experiment.Variant{"flag": {Key: "on"}})
+	if err := c.TrackSync(context.Background(), assignment); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Tracked %d events, expected %d", len(events), 1)
+	}
+	untracked := Initialize("test-"+t.Name()+"-untracked", &Config{})
+	if err := untracked.TrackSync(context.Background(), assignment); err == nil {
+		t.Fatalf("Expected an error without AssignmentConfig")
+	}
+}
+
+func TestResetAssignmentCache(t *testing.T) {
+	mock := &mockAmplitudeClient{}
+	var amplitudeClient amplitude.Client = mock
+	c := Initialize("test-"+t.Name(), &Config{AssignmentConfig: &AssignmentConfig{Client: &amplitudeClient, CacheCapacity: 100}})
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("flag", nil))
+	user := &experiment.User{UserId: "user"}
+	for i := 0; i < 2; i++ {
+		if _, err := c.EvaluateV2(user, nil); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if len(mock.trackedEvents()) != 1 || c.AssignmentCacheSize() != 1 {
+		t.Fatalf("Tracked %d events with cache size %d, expected 1 and 1", len(mock.trackedEvents()), c.AssignmentCacheSize())
+	}
+	c.ResetAssignmentCache()
+	if c.AssignmentCacheSize() != 0 {
+		t.Fatalf("Unexpected cache size %d after reset", c.AssignmentCacheSize())
+	}
+	if _, err := c.EvaluateV2(user, nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(mock.trackedEvents()) != 2 {
+		t.Fatalf("Tracked %d events, expected the assignment to be tracked again", len(mock.trackedEvents()))
+	}
+}
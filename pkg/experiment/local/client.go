@@ -3,14 +3,14 @@ package local
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"reflect"
+	"sort"
 	"sync"
-
-	"github.com/amplitude/analytics-go/amplitude"
+	"time"
 
 	"github.com/amplitude/experiment-go-server/internal/evaluation"
 
@@ -25,6 +25,7 @@ var initMutex = sync.Mutex{}
 type Client struct {
 	log               *logger.Log
 	apiKey            string
+	apiKeyMutex       sync.RWMutex
 	config            *Config
 	client            *http.Client
 	poller            *poller
@@ -35,8 +36,45 @@ type Client struct {
 	flagConfigStorage flagConfigStorage
 	cohortLoader      *cohortLoader
 	deploymentRunner  *deploymentRunner
+	metrics           Metrics
+	listenersMutex    sync.RWMutex
+	listeners         map[string][]evaluationListener
+	// drainMutex guards draining, and is read locked while evaluations are added, so no evaluation
+	// starts once Drain waits for in flight evaluations.
+	drainMutex  sync.RWMutex
+	draining    bool
+	evaluations sync.WaitGroup
+	// accessedFlagKeys counts the evaluations of each flag if Config.RecordFlagAccess is set.
+	accessMutex      sync.Mutex
+	accessedFlagKeys map[string]int
+	// flagApi and flagStreamApi are the deployment runner's APIs, whose deployment key SetApiKey
+	// changes. The stream API is nil unless streaming.
+	flagApi       *flagConfigApiV2
+	flagStreamApi *flagConfigStreamApiV2
+	// shadowFlags are the flag configs EvaluateV2 also evaluates users against, and
+	// shadowListeners are called with the results which diverge. See SetShadowFlags.
+	shadowMutex     sync.RWMutex
+	shadowFlags     map[string]*evaluation.Flag
+	shadowListeners []func(flagKey string, live, shadow experiment.Variant)
+	// shadowEvaluations are the shadow evaluations in progress, which are added while shadowMutex is
+	// read locked, so none is added while waitForShadowEvaluations waits. shadowRunning counts them
+	// to drop shadow evaluations beyond maxShadowEvaluations.
+	shadowEvaluations sync.WaitGroup
+	shadowRunning     int32
+	// refs counts the Initialize calls which returned the client and were not yet closed. It is
+	// guarded by initMutex.
+	refs int
+}
+
+type evaluationListener struct {
+	fn    func(user *experiment.User, variant experiment.Variant)
+	async bool
 }
 
+// Initialize returns the client for the deployment key, creating it with the config on the first call.
+// Later calls with the same key return the same client and ignore the config, so all users of a
+// deployment in the process share one flag config poller or stream connection, and one set of flag
+// configs and cohorts.
 func Initialize(apiKey string, config *Config) *Client {
 	initMutex.Lock()
 	client := clients[apiKey]
@@ -47,50 +85,118 @@ func Initialize(apiKey string, config *Config) *Client {
 		config = fillConfigDefaults(config)
 		log := logger.New(config.Debug)
 		var as *assignmentService
-		if config.AssignmentConfig != nil && config.AssignmentConfig.APIKey != "" {
-			amplitudeClient := amplitude.NewClient(config.AssignmentConfig.Config)
-			as = &assignmentService{
-				amplitude: &amplitudeClient,
-				filter:    newAssignmentFilter(config.AssignmentConfig.CacheCapacity),
+		if config.AssignmentConfig != nil && config.AssignmentConfig.TestSink != nil {
+			as = newSinkAssignmentService(config.AssignmentConfig)
+		} else if config.AssignmentConfig != nil && config.AssignmentConfig.Client != nil {
+			as = newAssignmentService(config.AssignmentConfig.Client, config.AssignmentConfig)
+		} else if config.AssignmentConfig != nil && config.AssignmentConfig.APIKey != "" {
+			as = newAmplitudeAssignmentService(config.AssignmentConfig)
+		}
+		var cohortStorage cohortStorage = newInMemoryCohortStorage()
+		if config.CohortSyncConfig != nil && config.CohortSyncConfig.IndexCohortsByMember {
+			cohortStorage = newMemberIndexCohortStorage()
+		}
+		if config.CohortFilePath != "" {
+			cohorts, err := loadCohortFile(config.CohortFilePath)
+			if err != nil {
+				log.Error("Failed to load cohorts from CohortFilePath: %v", err)
+			}
+			for _, cohort := range cohorts {
+				cohortStorage.putCohort(cohort)
 			}
 		}
-		cohortStorage := newInMemoryCohortStorage()
 		flagConfigStorage := newInMemoryFlagConfigStorage()
 		var cohortLoader *cohortLoader
+		var cohortDownloadApi *directCohortDownloadApi
 		var deploymentRunner *deploymentRunner
 		if config.CohortSyncConfig != nil {
-			cohortDownloadApi := newDirectCohortDownloadApi(config.CohortSyncConfig.ApiKey, config.CohortSyncConfig.SecretKey, config.CohortSyncConfig.MaxCohortSize, config.CohortSyncConfig.CohortServerUrl, config.Debug)
+			log.Info("Syncing cohorts from %s", config.CohortSyncConfig.CohortServerUrl)
+			if cohortServerZoneMismatch(config) {
+				log.Error("CohortServerUrl %s is not in the region of ServerUrl %s, cohorts may be downloaded empty", config.CohortSyncConfig.CohortServerUrl, config.ServerUrl)
+			}
+			cohortDownloadApi = newDirectCohortDownloadApi(config.CohortSyncConfig.ApiKey, config.CohortSyncConfig.SecretKey, config.CohortSyncConfig.MaxCohortSize, config.CohortSyncConfig.MaxCohortBytes, config.CohortSyncConfig.CohortServerUrl, config.CohortSyncConfig.RequestTimeout, config.Debug)
 			cohortLoader = newCohortLoader(cohortDownloadApi, cohortStorage, config.Debug)
 		}
 		var flagStreamApi *flagConfigStreamApiV2
 		if config.StreamUpdates {
 			flagStreamApi = newFlagConfigStreamApiV2(apiKey, config.StreamServerUrl, config.StreamFlagConnTimeout)
+			flagStreamApi.log = log
+			flagStreamApi.metrics = metricsOrNoop(config.Metrics)
+			flagStreamApi.lenientInitParse = config.StreamLenientInitParse
+			flagStreamApi.queryParams = config.StreamQueryParams
+			flagStreamApi.connectRetries = config.StreamConnectRetries
+			flagStreamApi.retryClassifier = config.RetryClassifier
+			flagStreamApi.keepaliveTimeout = config.StreamKeepaliveTimeout
+			flagStreamApi.reconnInterval = config.StreamReconnectInterval
+			if config.StreamMaxReconnectJitter > 0 {
+				flagStreamApi.maxJitter = config.StreamMaxReconnectJitter
+			} else {
+				flagStreamApi.maxJitter = 0
+			}
+			if config.TLSConfig != nil || config.DialContext != nil {
+				flagStreamApi.newSseStreamFactory = newSseStreamFactoryWithTransport(config.TLSConfig, config.DialContext)
+			}
+		}
+		httpClient := newHttpClient(config.TLSConfig, config.DialContext)
+		flagApi := newFlagConfigApiV2(apiKey, config.ServerUrl, config.FlagConfigPollerRequestTimeout, httpClient, config.MaxFlagConfigBytes)
+		flagApi.queryParams = config.FlagConfigQueryParams
+		flagApi.version = config.FlagsApiVersion
+		deploymentRunner = newDeploymentRunner(config, flagApi, flagStreamApi, flagConfigStorage, cohortStorage, cohortLoader)
+		deploymentRunner.deploymentKey = flagApi.deploymentKey
+		if cohortDownloadApi != nil {
+			cohortDownloadApi.retryBudget = deploymentRunner.retryBudget
+			cohortDownloadApi.client = httpClient
 		}
-		deploymentRunner = newDeploymentRunner(
-			config,
-			newFlagConfigApiV2(apiKey, config.ServerUrl, config.FlagConfigPollerRequestTimeout),
-			flagStreamApi, flagConfigStorage, cohortStorage, cohortLoader)
 		client = &Client{
 			log:               log,
 			apiKey:            apiKey,
 			config:            config,
-			client:            &http.Client{},
+			client:            httpClient,
 			poller:            newPoller(),
 			flagsMutex:        &sync.RWMutex{},
-			engine:            evaluation.NewEngine(log),
+			engine:            evaluation.NewEngineWithOptions(log, engineOptions(config)),
 			assignmentService: as,
 			cohortStorage:     cohortStorage,
 			flagConfigStorage: flagConfigStorage,
 			cohortLoader:      cohortLoader,
 			deploymentRunner:  deploymentRunner,
+			flagApi:           flagApi,
+			flagStreamApi:     flagStreamApi,
+			metrics:           metricsOrNoop(config.Metrics),
 		}
 		client.log.Debug("config: %v", *config)
 		clients[apiKey] = client
 	}
+	client.refs++
 	initMutex.Unlock()
 	return client
 }
 
+// engineOptions returns the evaluation engine options for the config.
+func engineOptions(c *Config) evaluation.EngineOptions {
+	return evaluation.EngineOptions{
+		BucketingSalt:        c.BucketingSeedOverride,
+		CaseInsensitiveMatch: c.CaseInsensitivePropertyMatch,
+	}
+}
+
+// InitializeWithError initializes a client like Initialize, but returns a ConfigError if the api key
+// is empty or the config is invalid or inconsistent, e.g. streaming is enabled without a stream
+// server URL, rather than panicking or silently misbehaving.
+func InitializeWithError(apiKey string, config *Config) (*Client, error) {
+	if apiKey == "" {
+		return nil, &ConfigError{Message: "api key must be set"}
+	}
+	config = fillConfigDefaults(config)
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+	return Initialize(apiKey, config), nil
+}
+
+// Start loads the flag configs and starts updating them in the background. Start may be called
+// concurrently, e.g. by each user of a client shared through Initialize. Once it succeeds, later
+// calls return nil without starting again.
 func (c *Client) Start() error {
 	err := c.deploymentRunner.start()
 	if err != nil {
@@ -99,61 +205,846 @@ func (c *Client) Start() error {
 	return nil
 }
 
+// SetFlag adds the flag config, replacing any flag config with the same key. It is meant for clients
+// which are not started, e.g. in tests, whose flag configs are not loaded from Amplitude. Once the
+// client is started, flag configs are managed by the poller or stream, so SetFlag does nothing.
+func (c *Client) SetFlag(flag *evaluation.Flag) {
+	if c.deploymentRunner != nil && c.deploymentRunner.isStarted() {
+		c.log.Error("SetFlag(%s): flag configs of a started client can't be set", flag.Key)
+		return
+	}
+	c.flagConfigStorage.putFlagConfig(flag)
+}
+
+// RemoveFlag removes the flag config with the key, if there is one. Like SetFlag, it does nothing
+// once the client is started.
+func (c *Client) RemoveFlag(flagKey string) {
+	if c.deploymentRunner != nil && c.deploymentRunner.isStarted() {
+		c.log.Error("RemoveFlag(%s): flag configs of a started client can't be removed", flagKey)
+		return
+	}
+	c.flagConfigStorage.removeIf(func(f *evaluation.Flag) bool {
+		return f.Key == flagKey
+	})
+}
+
+// SetApiKey changes the deployment key used for later flag config requests and stream connections,
+// e.g. to rotate keys without initializing a new client. If the client is streaming, the stream
+// reconnects with the new key, and an error is returned if it fails to reconnect, in which case flag
+// configs are polled until it reconnects. Cohorts are downloaded with CohortSyncConfig's keys, which
+// are unaffected. Initialize returns the client for both the previous and the new key.
+func (c *Client) SetApiKey(apiKey string) error {
+	if apiKey == "" {
+		return errors.New("api key must be set")
+	}
+	initMutex.Lock()
+	if existing := clients[apiKey]; existing != nil && existing != c {
+		initMutex.Unlock()
+		return errors.New("a different client is initialized with the api key")
+	}
+	clients[apiKey] = c
+	initMutex.Unlock()
+
+	c.apiKeyMutex.Lock()
+	c.apiKey = apiKey
+	c.apiKeyMutex.Unlock()
+	if c.flagApi != nil {
+		c.flagApi.setDeploymentKey(apiKey)
+	}
+	if c.flagStreamApi != nil {
+		c.flagStreamApi.setDeploymentKey(apiKey)
+		if c.deploymentRunner.isStarted() {
+			return c.deploymentRunner.reconnectStream()
+		}
+	}
+	return nil
+}
+
+func (c *Client) getApiKey() string {
+	c.apiKeyMutex.RLock()
+	defer c.apiKeyMutex.RUnlock()
+	return c.apiKey
+}
+
+// ReconnectStream closes the current flag config stream connection and opens a
+// new one. An error is returned if stream updates are not enabled, the client
+// has not been started, or the new connection fails to load the initial flag
+// configs. On failure, flag configs are polled until the stream reconnects.
+func (c *Client) ReconnectStream() error {
+	return c.deploymentRunner.reconnectStream()
+}
+
+// TimeSinceLastStreamMessage returns the time since the flag config stream last received a message,
+// excluding keepalives, e.g. to alert when the stream is connected but silent. It returns zero if
+// stream updates are not enabled or no message was received.
+func (c *Client) TimeSinceLastStreamMessage() time.Duration {
+	if c.flagStreamApi == nil {
+		return 0
+	}
+	lastMessage := c.flagStreamApi.lastMessageTime()
+	if lastMessage.IsZero() {
+		return 0
+	}
+	return time.Since(lastMessage)
+}
+
+// IsReady returns true if flag configs have been loaded and, if Config.MaxConfigStaleness
+// is set, were last updated within MaxConfigStaleness.
+func (c *Client) IsReady() bool {
+	if c.flagConfigStorage.getLastUpdated().IsZero() {
+		return false
+	}
+	return !c.isStale()
+}
+
+// OnCohortsLoaded registers a function which is called once all cohorts targeted by the flag configs
+// are loaded, after the flag configs are first loaded and again whenever an update changes the
+// targeted cohorts. Together with IsReady, this can be used to wait until cohort targeting is
+// accurate. The function is called on the goroutine which loaded the cohorts, so it should not
+// block. It is never called if CohortSyncConfig is not set.
+func (c *Client) OnCohortsLoaded(fn func()) {
+	if c.cohortLoader != nil {
+		c.cohortLoader.onCohortsLoaded(fn)
+	}
+}
+
+// OnFlagConfigUpdate registers a listener which is called after each flag config update which adds,
+// removes, or changes flags, with the sorted keys of those flags, e.g. to invalidate content cached
+// by variant. Listeners are called on the goroutine applying the update, so they should not block.
+func (c *Client) OnFlagConfigUpdate(fn func(changedKeys []string)) {
+	if c.deploymentRunner != nil {
+		c.deploymentRunner.updateListeners.add(fn)
+	}
+}
+
+// OnMissingDependencies registers a listener which is called after a flag config update if any flags
+// depend on flags which are not loaded, with the sorted keys of the missing dependencies keyed by
+// flag key. Missing dependencies are skipped in evaluation, so the flags which depend on them are
+// evaluated as if the dependencies assigned no variant. Listeners are called on the goroutine
+// applying the update, so they should not block.
+func (c *Client) OnMissingDependencies(fn func(missing map[string][]string)) {
+	if c.deploymentRunner != nil {
+		c.deploymentRunner.updateListeners.addMissingDependencies(fn)
+	}
+}
+
+// Drain stops the client from starting new evaluations, which return ErrDraining, and waits for
+// evaluations in progress to complete. Flag configs and cohorts are still updated. Use it during
+// shutdown, once the service stops receiving new requests.
+func (c *Client) Drain() {
+	c.drainMutex.Lock()
+	c.draining = true
+	c.drainMutex.Unlock()
+	c.evaluations.Wait()
+	c.waitForShadowEvaluations()
+}
+
+// Close releases the client returned by Initialize. Since Initialize returns the same client for
+// each call with the deployment key, the client is only torn down once Close was called for each
+// Initialize call. Then Close stops updating flag configs and cohorts in the background, flushes
+// the assignment and exposure events, shutting down the amplitude client constructed for them, and
+// removes the client from the clients Initialize returns, so a later Initialize with the deployment
+// key creates a new client. The client still evaluates the flag configs and cohorts it has, but no
+// longer tracks events once its amplitude client is shut down.
+func (c *Client) Close() {
+	initMutex.Lock()
+	if c.refs > 1 {
+		c.refs--
+		initMutex.Unlock()
+		return
+	}
+	c.refs = 0
+	for key, client := range clients {
+		if client == c {
+			delete(clients, key)
+		}
+	}
+	initMutex.Unlock()
+	c.deploymentRunner.stop()
+	c.waitForShadowEvaluations()
+	if c.assignmentService != nil {
+		c.assignmentService.close()
+	}
+}
+
+// GoroutineCount returns the number of running background goroutines of the client, i.e. of flag
+// config polling and stream message delivery, cohort polling, cohort downloads, and shadow evaluations.
+// Goroutines exit shortly
+// after Close, so tests may wait for the count to reach zero to check that a client was torn down.
+func (c *Client) GoroutineCount() int {
+	return c.deploymentRunner.goroutines.get()
+}
+
+// startEvaluation adds an evaluation in progress, unless the client is draining. The caller must
+// call c.evaluations.Done when the evaluation completes.
+func (c *Client) startEvaluation() bool {
+	c.drainMutex.RLock()
+	defer c.drainMutex.RUnlock()
+	if c.draining {
+		return false
+	}
+	c.evaluations.Add(1)
+	return true
+}
+
+func (c *Client) isStale() bool {
+	if c.config.MaxConfigStaleness <= 0 {
+		return false
+	}
+	lastUpdated := c.flagConfigStorage.getLastUpdated()
+	return lastUpdated.IsZero() || time.Since(lastUpdated) > c.config.MaxConfigStaleness
+}
+
 // Deprecated: Use EvaluateV2
 func (c *Client) Evaluate(user *experiment.User, flagKeys []string) (map[string]experiment.Variant, error) {
 	variants, err := c.EvaluateV2(user, flagKeys)
 	if err != nil {
 		return nil, err
 	}
+	return filterDefaultAndUndeployed(variants), nil
+}
+
+// EvaluateCompare evaluates the flags once and returns both the result of the deprecated Evaluate,
+// v1, and the result of EvaluateV2, v2, e.g. to diff them while migrating from Evaluate.
+func (c *Client) EvaluateCompare(user *experiment.User, flagKeys []string) (v1 map[string]experiment.Variant, v2 map[string]experiment.Variant, err error) {
+	v2, err = c.EvaluateV2(user, flagKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return filterDefaultAndUndeployed(v2), v2, nil
+}
+
+// filterDefaultAndUndeployed returns the variants without default variants and the variants of
+// undeployed flags, as returned by the deprecated Evaluate.
+func filterDefaultAndUndeployed(variants map[string]experiment.Variant) map[string]experiment.Variant {
 	results := make(map[string]experiment.Variant)
 	for key, variant := range variants {
-		isDefault, ok := variant.Metadata["default"].(bool)
+		isDefault, ok := variant.Metadata[experiment.MetadataDefault].(bool)
 		if !ok {
 			isDefault = false
 		}
-		isDeployed, ok := variant.Metadata["deployed"].(bool)
-		if !ok {
-			isDeployed = true
-		}
-		if !isDefault && isDeployed {
+		if !isDefault && isDeployed(variant) {
 			results[key] = variant
 		}
 	}
-	return results, nil
+	return results
 }
 
+// isDeployed returns false if the variant is of a flag which is not deployed. Variants without the
+// deployed metadata are deployed.
+func isDeployed(variant experiment.Variant) bool {
+	deployed, ok := variant.Metadata["deployed"].(bool)
+	return !ok || deployed
+}
+
+// EvaluateV2 evaluates the flags with the flag keys, and the flags they depend on, for the user. If
+// flagKeys is empty, all flags are evaluated, unless Config.EmptyKeysMeansNone is set, in which case
+// no flags are evaluated. Unlike the deprecated Evaluate, default variants and the variants of
+// undeployed flags are returned.
 func (c *Client) EvaluateV2(user *experiment.User, flagKeys []string) (map[string]experiment.Variant, error) {
 	flagConfigs := c.flagConfigStorage.getFlagConfigs()
-	sortedFlags, err := topologicalSort(flagConfigs, flagKeys)
+	variants, err := c.evaluate(user, flagConfigs, flagKeys)
 	if err != nil {
 		return nil, err
 	}
-	c.requiredCohortsInStorage(sortedFlags)
-	enrichedUser, err := c.enrichUserWithCohorts(user, flagConfigs)
+	c.evaluateShadow(user, flagKeys, variants)
+	return variants, nil
+}
+
+// EvaluateFlag evaluates a single flag, and the flags it depends on, for the user. It returns false
+// if the flag is not loaded or assigns the user no variant. Unlike EvaluateV2 with one flag key, only
+// the flag and its dependencies are read from storage, and only the cohorts they target are looked up.
+func (c *Client) EvaluateFlag(user *experiment.User, flagKey string) (experiment.Variant, bool, error) {
+	flagConfigs := c.flagConfigStorage.getFlagConfigWithDependencies(flagKey)
+	variants, _, err := c.evaluateWithUser(user, flagConfigs, []string{flagKey}, EvaluateOptions{})
+	if err != nil {
+		return experiment.Variant{}, false, err
+	}
+	variant, ok := variants[flagKey]
+	return variant, ok, nil
+}
+
+// EvaluateV2WithUser evaluates like EvaluateV2 and also returns the user enriched with the cohorts
+// the user is a member of, i.e. the targeting inputs of the evaluation. The given user is not modified.
+func (c *Client) EvaluateV2WithUser(user *experiment.User, flagKeys []string) (map[string]experiment.Variant, *experiment.User, error) {
+	flagConfigs := c.flagConfigStorage.getFlagConfigs()
+	return c.evaluateWithUser(user, flagConfigs, flagKeys, EvaluateOptions{})
+}
+
+// EvaluateOptions change how EvaluateV2WithOptions evaluates flags.
+type EvaluateOptions struct {
+	// EvaluationTime, if set, is the time flags are evaluated at, e.g. to test or replay evaluations
+	// of flags which target a time window. Conditions with the selector ["evaluation_time"] compare
+	// with it in milliseconds since the epoch. The time is an input of local evaluation only, and is
+	// neither part of the user's evaluation context nor supported by remote evaluation. Defaults to
+	// the current time.
+	EvaluationTime time.Time
+	// DeployedOnly excludes the variants of flags which are not deployed, like the deprecated
+	// Evaluate, but unlike Evaluate keeps default variants and their metadata. Undeployed flags are
+	// still evaluated, e.g. as dependencies of deployed flags.
+	DeployedOnly bool
+	// TrustProvidedCohorts evaluates the user with the cohorts set on the user, e.g. cohort
+	// membership known from the caller's own systems, rather than looking them up in the downloaded
+	// cohorts. If the user's CohortIds is not nil, it is used as the user's cohorts, and for each
+	// group with cohorts in GroupCohortIds, they are used as the group's cohorts. Cohorts of groups
+	// which are not in GroupCohortIds, and the user's cohorts if CohortIds is nil, are still looked up.
+	// An empty, non-nil CohortIds is trusted to mean the user is in no cohorts.
+	TrustProvidedCohorts bool
+}
+
+// EvaluateV2WithOptions evaluates like EvaluateV2 with the options.
+func (c *Client) EvaluateV2WithOptions(user *experiment.User, flagKeys []string, options EvaluateOptions) (map[string]experiment.Variant, error) {
+	flagConfigs := c.flagConfigStorage.getFlagConfigs()
+	variants, _, err := c.evaluateWithUser(user, flagConfigs, flagKeys, options)
+	if err != nil {
+		return nil, err
+	}
+	if options.DeployedOnly {
+		for key, variant := range variants {
+			if !isDeployed(variant) {
+				delete(variants, key)
+			}
+		}
+	}
+	return variants, nil
+}
+
+// UserVariants is the result of evaluating a user with EvaluateStream.
+type UserVariants struct {
+	User     *experiment.User
+	Variants map[string]experiment.Variant
+	// Err is the error evaluating the user, in which case Variants is nil.
+	Err error
+}
+
+// EvaluateStream evaluates each user received from users like EvaluateV2, and sends the results on
+// the returned channel, which is closed once users is closed and all received users are evaluated,
+// e.g. to evaluate more users in a batch job than fit in memory. The flag configs are read and
+// sorted once, so all users are evaluated with the same flag configs. Users are evaluated on up to
+// EvaluationConcurrency goroutines, so results may be sent in a different order than the users were
+// received. Evaluation waits for the caller to receive results, so memory use doesn't grow with the
+// number of users.
+func (c *Client) EvaluateStream(users <-chan *experiment.User, flagKeys []string) <-chan UserVariants {
+	flagConfigs := c.flagConfigStorage.getFlagConfigs()
+	sortedFlags, sortErr := c.sortFlags(flagConfigs, flagKeys)
+	workers := c.config.EvaluationConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	results := make(chan UserVariants)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for user := range users {
+				result := UserVariants{User: user, Err: sortErr}
+				if sortErr == nil {
+					result.Variants, _, result.Err = c.evaluateSortedWithUser(user, flagConfigs, sortedFlags, EvaluateOptions{})
+				}
+				results <- result
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// VariantEntry is the variant a user was assigned for a flag.
+type VariantEntry struct {
+	FlagKey string
+	Variant experiment.Variant
+}
+
+// EvaluateOrdered evaluates like EvaluateV2, and returns the variants in evaluation order, for
+// stable output in logs and tests. Each flag follows the flags it depends on, and flags are
+// otherwise ordered as in flagKeys, or by flag key if flagKeys is empty.
+func (c *Client) EvaluateOrdered(user *experiment.User, flagKeys []string) ([]VariantEntry, error) {
+	flagConfigs := c.flagConfigStorage.getFlagConfigs()
+	if len(flagKeys) == 0 && !c.config.EmptyKeysMeansNone {
+		flagKeys = make([]string, 0, len(flagConfigs))
+		for key := range flagConfigs {
+			flagKeys = append(flagKeys, key)
+		}
+		sort.Strings(flagKeys)
+	}
+	variants, err := c.evaluate(user, flagConfigs, flagKeys)
+	if err != nil {
+		return nil, err
+	}
+	sortedFlags, err := c.sortFlags(flagConfigs, flagKeys)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]VariantEntry, 0, len(variants))
+	for _, flag := range sortedFlags {
+		if variant, ok := variants[flag.Key]; ok {
+			entries = append(entries, VariantEntry{FlagKey: flag.Key, Variant: variant})
+		}
+	}
+	return entries, nil
+}
+
+// GetConfig evaluates flags like EvaluateV2, for flags used as remote config, and returns the
+// payload of each flag's variant, keyed by flag key. Flags whose variant has no payload are omitted.
+func (c *Client) GetConfig(user *experiment.User, flagKeys []string) (map[string]interface{}, error) {
+	variants, err := c.EvaluateV2(user, flagKeys)
+	if err != nil {
+		return nil, err
+	}
+	payloads := make(map[string]interface{}, len(variants))
+	for key, variant := range variants {
+		if variant.Payload != nil {
+			payloads[key] = variant.Payload
+		}
+	}
+	return payloads, nil
+}
+
+// EvaluationDetail is the result of evaluating a flag with EvaluateDetailed.
+type EvaluationDetail struct {
+	// Variant is the variant the user was assigned, as returned by EvaluateV2.
+	Variant experiment.Variant
+	// Segment is the index of the flag's segment which assigned the variant, or -1 if the user
+	// matched no segment with a variant.
+	Segment int
+	// MatchingSegments are all segments of the flag whose targeting the user matched, in order.
+	MatchingSegments []SegmentMatch
+	// IsHoldout is true if the user is held out by a holdout group, i.e. the flag is a holdout group
+	// which assigned the user its holdout variant, or the flag depends on one, directly or through
+	// other flags. Held out users are typically assigned the flag's default variant, which IsHoldout
+	// tells apart from users who were not allocated.
+	IsHoldout bool
+	// ConfigVersion is the version of the flag configs the flag was evaluated with, a hash of all
+	// loaded flag configs. Clients which evaluated the same flag configs have the same version, so
+	// differing variants for the same user with the same version are not caused by config skew.
+	ConfigVersion string
+}
+
+// SegmentMatch is a segment of a flag whose targeting conditions matched the user.
+type SegmentMatch struct {
+	// Index is the position of the segment in the flag's segments.
+	Index int
+	// Variant is the key of the variant the segment would assign the user, or empty if the user is
+	// not allocated by the segment.
+	Variant string
+	// Metadata is the segment's metadata, e.g. its name.
+	Metadata map[string]interface{}
+}
+
+// EvaluateDetailed evaluates like EvaluateV2, and also returns every segment of each flag whose
+// targeting the user matched, including segments after the one which assigned the variant, e.g. to
+// understand overlapping targeting. Flags are evaluated a second time to find the segments, so
+// EvaluateDetailed is slower than EvaluateV2 and meant for debugging. Only flags with a variant or a
+// matching segment are returned.
+func (c *Client) EvaluateDetailed(user *experiment.User, flagKeys []string) (map[string]EvaluationDetail, error) {
+	flagConfigs, configVersion := c.flagConfigStorage.getFlagConfigsWithVersion()
+	options := EvaluateOptions{EvaluationTime: time.Now()}
+	variants, enrichedUser, err := c.evaluateWithUser(user, flagConfigs, flagKeys, options)
 	if err != nil {
 		return nil, err
 	}
-	userContext := evaluation.UserToContext(enrichedUser)
+	sortedFlags, err := c.sortFlags(flagConfigs, flagKeys)
 	if err != nil {
 		return nil, err
 	}
+	results, matches := c.engine.EvaluateMatchesAt(c.evaluationContext(enrichedUser), sortedFlags, options.EvaluationTime)
+	details := make(map[string]EvaluationDetail)
+	// Flags are sorted after their dependencies, so the dependencies' holdouts are known.
+	holdouts := make(map[string]bool)
+	for _, flag := range sortedFlags {
+		flagType, _ := flag.Metadata[experiment.MetadataFlagType].(string)
+		holdout := flagType == flagTypeHoldoutGroup && results[flag.Key].Key == holdoutVariantKey
+		for _, dependency := range flag.Dependencies {
+			holdout = holdout || holdouts[dependency]
+		}
+		holdouts[flag.Key] = holdout
+		variant, ok := variants[flag.Key]
+		if !ok && len(matches[flag.Key]) == 0 {
+			continue
+		}
+		detail := EvaluationDetail{Variant: variant, Segment: -1, IsHoldout: holdout, ConfigVersion: configVersion}
+		for _, match := range matches[flag.Key] {
+			if detail.Segment == -1 && match.Variant != "" {
+				detail.Segment = match.Index
+			}
+			detail.MatchingSegments = append(detail.MatchingSegments, SegmentMatch{
+				Index:    match.Index,
+				Variant:  match.Variant,
+				Metadata: match.Metadata,
+			})
+		}
+		details[flag.Key] = detail
+	}
+	return details, nil
+}
+
+func (c *Client) evaluate(user *experiment.User, flagConfigs map[string]*evaluation.Flag, flagKeys []string) (map[string]experiment.Variant, error) {
+	variants, _, err := c.evaluateWithUser(user, flagConfigs, flagKeys, EvaluateOptions{})
+	return variants, err
+}
+
+func (c *Client) evaluateWithUser(user *experiment.User, flagConfigs map[string]*evaluation.Flag, flagKeys []string, options EvaluateOptions) (map[string]experiment.Variant, *experiment.User, error) {
+	sortedFlags, err := c.sortFlags(flagConfigs, flagKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.evaluateSortedWithUser(user, flagConfigs, sortedFlags, options)
+}
+
+// evaluateSortedWithUser evaluates the flags, sorted in dependency order, like evaluateWithUser.
+func (c *Client) evaluateSortedWithUser(user *experiment.User, flagConfigs map[string]*evaluation.Flag, sortedFlags []*evaluation.Flag, options EvaluateOptions) (map[string]experiment.Variant, *experiment.User, error) {
+	if err := c.beginEvaluation(user); err != nil {
+		return nil, nil, err
+	}
+	defer c.evaluations.Done()
+	c.requiredCohortsInStorage(sortedFlags)
+	enrichedUser, err := c.enrichUserWithCohorts(user, flagConfigs, options.TrustProvidedCohorts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.evaluateSortedFlags(user, enrichedUser, flagConfigs, sortedFlags, options.EvaluationTime), enrichedUser, nil
+}
+
+// sortFlags returns the flags with the flag keys and the flags they depend on in dependency order.
+// If flagKeys is empty, it returns all flags, or none if Config.EmptyKeysMeansNone is set.
+func (c *Client) sortFlags(flagConfigs map[string]*evaluation.Flag, flagKeys []string) ([]*evaluation.Flag, error) {
+	if len(flagKeys) == 0 && c.config.EmptyKeysMeansNone {
+		return []*evaluation.Flag{}, nil
+	}
+	return topologicalSort(flagConfigs, flagKeys)
+}
+
+// beginEvaluation returns an error if the user may not be evaluated, e.g. because the client is
+// draining. If it returns nil, the caller must call c.evaluations.Done when the evaluation completes.
+func (c *Client) beginEvaluation(user *experiment.User) error {
+	if !c.startEvaluation() {
+		return ErrDraining
+	}
+	if c.config.FailEvaluationOnStaleConfig && c.isStale() {
+		c.evaluations.Done()
+		return ErrStaleFlagConfigs
+	}
+	if c.config.StrictUserValidation {
+		if err := ValidateUser(user); err != nil {
+			c.evaluations.Done()
+			return err
+		}
+	}
+	return nil
+}
+
+// evaluateSortedFlags evaluates the flags, in dependency order, for the user enriched with cohorts,
+// at the evaluation time, or the current time if it is zero, and tracks the assignment of the user.
+// Sticky buckets and assignments use the user's fallback identity, like bucketing.
+func (c *Client) evaluateSortedFlags(user, enrichedUser *experiment.User, flagConfigs map[string]*evaluation.Flag, sortedFlags []*evaluation.Flag, evaluationTime time.Time) map[string]experiment.Variant {
+	userContext := c.evaluationContext(enrichedUser)
 	c.log.Debug("evaluate:\n\t- user: %v\n\t- flags: %v\n", user, sortedFlags)
-	results := c.engine.Evaluate(userContext, sortedFlags)
+	start := time.Now()
+	var results map[string]evaluation.Variant
+	if c.config.EvaluationConcurrency > 1 {
+		results = c.evaluateConcurrently(userContext, sortedFlags, evaluationTime)
+	} else {
+		results = c.engine.EvaluateAt(userContext, sortedFlags, evaluationTime)
+	}
+	c.metrics.OnEvaluation(len(sortedFlags), time.Since(start))
+	if c.config.RecordFlagAccess {
+		c.recordFlagAccess(sortedFlags)
+	}
+	variants := toVariants(results)
+	identifiedUser := c.withFallbackIdentity(user)
+	if c.config.StickyBucketStore != nil {
+		c.applyStickyBuckets(identifiedUser, flagConfigs, variants)
+	}
+	if c.config.PayloadDecoder != nil {
+		c.decodePayloads(variants)
+	}
+	if c.assignmentService != nil {
+		c.assignmentService.Track(newAssignment(identifiedUser, variants))
+	}
+	c.notifyListeners(user, variants)
+	return variants
+}
+
+// toVariants returns the engine's results as variants.
+func toVariants(results map[string]evaluation.Variant) map[string]experiment.Variant {
 	variants := make(map[string]experiment.Variant)
 	for key, result := range results {
+		// The engine merges the flag, segment, and variant metadata into a new map per result, so
+		// it may be modified.
+		metadata := result.Metadata
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+		}
+		metadata[experiment.MetadataFlagKey] = key
 		variants[key] = experiment.Variant{
 			Key:      result.Key,
 			Value:    coerceString(result.Value),
 			Payload:  result.Payload,
-			Metadata: result.Metadata,
+			Metadata: metadata,
+		}
+	}
+	return variants
+}
+
+// decodePayloads replaces the payloads of the variants with the result of Config.PayloadDecoder,
+// keeping the raw payload if it fails.
+func (c *Client) decodePayloads(variants map[string]experiment.Variant) {
+	for key, variant := range variants {
+		if variant.Payload == nil {
+			continue
+		}
+		payload, err := c.config.PayloadDecoder(variant.Payload)
+		if err != nil {
+			c.log.Error("Failed to decode payload of flag %s: %v", key, err)
+			continue
+		}
+		variant.Payload = payload
+		variants[key] = variant
+	}
+}
+
+func (c *Client) recordFlagAccess(flags []*evaluation.Flag) {
+	c.accessMutex.Lock()
+	defer c.accessMutex.Unlock()
+	if c.accessedFlagKeys == nil {
+		c.accessedFlagKeys = make(map[string]int)
+	}
+	for _, flag := range flags {
+		c.accessedFlagKeys[flag.Key]++
+	}
+}
+
+// AccessedFlagKeys returns the number of times each flag was evaluated since the client was
+// initialized, keyed by flag key, if Config.RecordFlagAccess is set. Flags evaluated as dependencies
+// of other flags are counted, as are all flags evaluated when no flag keys are given. Flags which
+// were never evaluated are not included.
+func (c *Client) AccessedFlagKeys() map[string]int {
+	c.accessMutex.Lock()
+	defer c.accessMutex.Unlock()
+	result := make(map[string]int, len(c.accessedFlagKeys))
+	for key, count := range c.accessedFlagKeys {
+		result[key] = count
+	}
+	return result
+}
+
+// evaluationContext returns the engine's context for the user enriched with cohorts, identified by
+// its fallback identity if it has one.
+func (c *Client) evaluationContext(enrichedUser *experiment.User) map[string]interface{} {
+	enrichedUser = c.withFallbackIdentity(enrichedUser)
+	if c.config.MultiValueGroups {
+		return evaluation.UserToContextMultiValueGroups(enrichedUser)
+	}
+	return evaluation.UserToContext(enrichedUser)
+}
+
+// OnEvaluate registers a listener which is called with the user and the result each time the flag
+// is evaluated, including as a dependency of another flag. The listener is called synchronously
+// after evaluation, before the results are returned, so it should return quickly.
+func (c *Client) OnEvaluate(flagKey string, fn func(user *experiment.User, variant experiment.Variant)) {
+	c.addListener(flagKey, evaluationListener{fn: fn})
+}
+
+// OnEvaluateAsync registers a listener like OnEvaluate, which is called on a new goroutine so it
+// doesn't delay evaluation. Panics in the listener are recovered and logged.
+func (c *Client) OnEvaluateAsync(flagKey string, fn func(user *experiment.User, variant experiment.Variant)) {
+	c.addListener(flagKey, evaluationListener{fn: fn, async: true})
+}
+
+// addListener copies the listeners on write, so they can be read without holding the lock while
+// listeners are called.
+func (c *Client) addListener(flagKey string, listener evaluationListener) {
+	c.listenersMutex.Lock()
+	defer c.listenersMutex.Unlock()
+	listeners := make(map[string][]evaluationListener, len(c.listeners)+1)
+	for key, value := range c.listeners {
+		listeners[key] = value
+	}
+	listeners[flagKey] = append(append([]evaluationListener{}, c.listeners[flagKey]...), listener)
+	c.listeners = listeners
+}
+
+func (c *Client) notifyListeners(user *experiment.User, variants map[string]experiment.Variant) {
+	c.listenersMutex.RLock()
+	listeners := c.listeners
+	c.listenersMutex.RUnlock()
+	if len(listeners) == 0 {
+		return
+	}
+	for flagKey, variant := range variants {
+		for _, listener := range listeners[flagKey] {
+			if listener.async {
+				go func(fn func(*experiment.User, experiment.Variant), variant experiment.Variant) {
+					defer recoverPanic(c.log, c.metrics, "evaluation listener")
+					fn(user, variant)
+				}(listener.fn, variant)
+			} else {
+				listener.fn(user, variant)
+			}
+		}
+	}
+}
+
+// EvaluateV2WithDeadline evaluates like EvaluateV2, but returns by the deadline even if resolving
+// the user's cohorts, e.g. with a slow CohortMembershipResolver, takes longer. If the cohorts are not
+// resolved by the deadline, flags which do not target cohorts are evaluated without them, and flags
+// which target cohorts, or depend on flags which do, are returned as default variants with
+// experiment.MetadataDeadlineExceeded set. Assignments are not tracked for those flags. Cohort
+// resolution is not canceled, and completes in the background.
+func (c *Client) EvaluateV2WithDeadline(deadline time.Time, user *experiment.User, flagKeys []string) (map[string]experiment.Variant, error) {
+	if !c.startEvaluation() {
+		return nil, ErrDraining
+	}
+	defer c.evaluations.Done()
+	if c.config.FailEvaluationOnStaleConfig && c.isStale() {
+		return nil, ErrStaleFlagConfigs
+	}
+	if c.config.StrictUserValidation {
+		if err := ValidateUser(user); err != nil {
+			return nil, err
 		}
 	}
+	flagConfigs := c.flagConfigStorage.getFlagConfigs()
+	sortedFlags, err := c.sortFlags(flagConfigs, flagKeys)
+	if err != nil {
+		return nil, err
+	}
+	c.requiredCohortsInStorage(sortedFlags)
+	type enrichResult struct {
+		user *experiment.User
+		err  error
+	}
+	enriched := make(chan enrichResult, 1)
+	go func() {
+		enrichedUser, err := c.enrichUserWithCohorts(user, flagConfigs, false)
+		enriched <- enrichResult{enrichedUser, err}
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case result := <-enriched:
+		if result.err != nil {
+			return nil, result.err
+		}
+		return c.evaluateSortedFlags(user, result.user, flagConfigs, sortedFlags, time.Time{}), nil
+	case <-timer.C:
+	}
+
+	c.log.Debug("Cohorts were not resolved by the deadline, evaluating flags without cohorts")
+	var evaluableFlags []*evaluation.Flag
+	skipped := make(map[string]struct{})
+	for _, flag := range sortedFlags {
+		skip := len(getAllCohortIDsFromFlag(flag)) > 0
+		for _, dependency := range flag.Dependencies {
+			if _, ok := skipped[dependency]; ok {
+				skip = true
+			}
+		}
+		if skip {
+			skipped[flag.Key] = struct{}{}
+		} else {
+			evaluableFlags = append(evaluableFlags, flag)
+		}
+	}
+	variants := c.evaluateSortedFlags(user, user, flagConfigs, evaluableFlags, time.Time{})
+	for flagKey := range skipped {
+		variants[flagKey] = experiment.Variant{Metadata: map[string]interface{}{
+			experiment.MetadataFlagKey:          flagKey,
+			experiment.MetadataDefault:          true,
+			experiment.MetadataDeadlineExceeded: true,
+		}}
+	}
+	return variants, nil
+}
+
+// EvaluateByMetadata evaluates all flags in storage whose metadata matches the
+// predicate. Dependencies of matching flags are evaluated as well, in
+// dependency order, exactly as with EvaluateV2.
+func (c *Client) EvaluateByMetadata(user *experiment.User, predicate func(metadata map[string]interface{}) bool) (map[string]experiment.Variant, error) {
+	flagConfigs := c.flagConfigStorage.getFlagConfigs()
+	flagKeys := make([]string, 0)
+	for key, flag := range flagConfigs {
+		if predicate(flag.Metadata) {
+			flagKeys = append(flagKeys, key)
+		}
+	}
+	if len(flagKeys) == 0 {
+		// An empty key list means all flags to evaluate.
+		return make(map[string]experiment.Variant), nil
+	}
+	return c.evaluate(user, flagConfigs, flagKeys)
+}
+
+// EvaluateAndExpose evaluates the user like EvaluateV2, and tracks an exposure
+// event for each non-default variant served. Exposures are deduplicated
+// separately from assignments. Exposures are only tracked if AssignmentConfig
+// is configured.
+func (c *Client) EvaluateAndExpose(user *experiment.User, flagKeys []string) (map[string]experiment.Variant, error) {
+	variants, err := c.EvaluateV2(user, flagKeys)
+	if err != nil {
+		return nil, err
+	}
 	if c.assignmentService != nil {
-		c.assignmentService.Track(newAssignment(user, variants))
+		c.assignmentService.Expose(user, variants)
 	}
 	return variants, nil
 }
 
+// ResetAssignmentCache clears the cache which deduplicates assignment events, so assignments which
+// were already tracked are tracked again when next evaluated. Exposures are deduplicated separately
+// and are not affected. It does nothing if AssignmentConfig is not configured.
+func (c *Client) ResetAssignmentCache() {
+	if c.assignmentService != nil {
+		c.assignmentService.filter.reset()
+	}
+}
+
+// AssignmentCacheSize returns the number of assignments in the cache which deduplicates assignment
+// events, including expired assignments which were not yet removed, or 0 if AssignmentConfig is not
+// configured.
+func (c *Client) AssignmentCacheSize() int {
+	if c.assignmentService == nil {
+		return 0
+	}
+	return c.assignmentService.filter.size()
+}
+
+// TrackSync tracks the assignment event, and waits until the amplitude client has sent it, e.g. to
+// verify that an assignment was recorded for compliance. The amplitude client's buffered events are
+// flushed and TrackSync blocks for the round trip, including retries, so it is unsuitable for the
+// hot path. Unlike the assignments tracked by evaluations, the event is sent even if the assignment
+// was tracked before, though Amplitude deduplicates events of the same assignment on the same day by
+// their insert ID. It returns an error if the event failed to be sent, if ctx is done first, if
+// AssignmentConfig is not configured, or if AssignmentConfig.Client is set, whose delivery results
+// are not reported.
+func (c *Client) TrackSync(ctx context.Context, assignment *Assignment) error {
+	if c.assignmentService == nil {
+		return errors.New("assignment tracking is not configured")
+	}
+	return c.assignmentService.TrackSync(ctx, assignment.internal())
+}
+
+// EvaluateToken resolves the token to a user with Config.UserResolver, then
+// evaluates the user like EvaluateV2. If the token can't be resolved, a
+// *UserResolverError is returned.
+func (c *Client) EvaluateToken(token string, flagKeys []string) (map[string]experiment.Variant, error) {
+	if c.config.UserResolver == nil {
+		return nil, errors.New("user resolver is not configured")
+	}
+	user, err := c.config.UserResolver(token)
+	if err != nil {
+		return nil, &UserResolverError{Err: err}
+	}
+	if user == nil {
+		return nil, &UserResolverError{Err: errors.New("resolved user is nil")}
+	}
+	return c.EvaluateV2(user, flagKeys)
+}
+
 func (c *Client) FlagsV2() (string, error) {
 	flags, err := c.doFlagsV2()
 	if err != nil {
@@ -173,23 +1064,82 @@ func (c *Client) FlagMetadata(flagKey string) map[string]interface{} {
 	if f == nil {
 		return nil
 	}
+	return copyMetadata(f.Metadata)
+}
 
-	metadata := make(map[string]interface{})
-	for k, v := range f.Metadata {
-		metadata[k] = v
+// AllFlagMetadata returns copies of the metadata of all loaded flags, keyed by flag key. Prefer this to
+// calling FlagMetadata for each flag, as the flags are read from storage at once.
+func (c *Client) AllFlagMetadata() map[string]map[string]interface{} {
+	flagConfigs := c.flagConfigStorage.getFlagConfigs()
+	result := make(map[string]map[string]interface{}, len(flagConfigs))
+	for key, f := range flagConfigs {
+		result[key] = copyMetadata(f.Metadata)
 	}
+	return result
+}
 
-	return metadata
+// FlagsByType returns the sorted keys of the loaded flags of the type, i.e. with the flag type
+// metadata experiment.MetadataFlagType, e.g. "experiment" or "release".
+func (c *Client) FlagsByType(flagType string) []string {
+	keys := []string{}
+	for key, f := range c.flagConfigStorage.getFlagConfigs() {
+		if t, _ := f.Metadata[experiment.MetadataFlagType].(string); t == flagType {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func copyMetadata(metadata map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		result[k] = v
+	}
+	return result
+}
+
+// ReferencedCohortIDs returns the IDs of the cohorts targeted by the currently loaded flags, sorted
+// and keyed by group type. User cohorts have the group type "User".
+func (c *Client) ReferencedCohortIDs() map[string][]string {
+	groupedCohortIDs := getGroupedCohortIDsFromFlags(c.flagConfigStorage.getFlagConfigsArray())
+	result := make(map[string][]string, len(groupedCohortIDs))
+	for groupType, cohortIDs := range groupedCohortIDs {
+		ids := make([]string, 0, len(cohortIDs))
+		for id := range cohortIDs {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		result[groupType] = ids
+	}
+	return result
+}
+
+// GetCohortsForGroup returns which of the given cohorts the group is a member of, according to the
+// downloaded cohorts. The result is empty, not nil, if the group is in none of the cohorts.
+func (c *Client) GetCohortsForGroup(groupType, groupName string, cohortIds map[string]struct{}) map[string]struct{} {
+	return c.cohortStorage.getCohortsForGroup(groupType, groupName, cohortIds)
+}
+
+// RefreshCohort downloads the cohort and stores it now, rather than on the next cohort poll, e.g.
+// when the cohort was just updated. If ctx is done first, the download is canceled, nothing is
+// stored, and RefreshCohort returns ctx's error. It returns an error if cohort sync is not
+// configured.
+func (c *Client) RefreshCohort(ctx context.Context, cohortId string) error {
+	if c.cohortLoader == nil {
+		return errors.New("cohort sync is not configured")
+	}
+	return c.cohortLoader.refreshCohort(ctx, cohortId)
 }
 
 func (c *Client) doFlagsV2() (map[string]*evaluation.Flag, error) {
-	client := &http.Client{}
-	endpoint, err := url.Parse("https://api.lab.amplitude.com/")
+	endpoint, err := url.Parse(c.config.ServerUrl)
 	if err != nil {
 		return nil, err
 	}
 	endpoint.Path = "sdk/v2/flags"
 	endpoint.RawQuery = "v=0"
+	setQueryParams(endpoint, c.config.FlagConfigQueryParams)
 	ctx, cancel := context.WithTimeout(context.Background(), c.config.FlagConfigPollerRequestTimeout)
 	defer cancel()
 	req, err := http.NewRequest("GET", endpoint.String(), nil)
@@ -197,15 +1147,15 @@ func (c *Client) doFlagsV2() (map[string]*evaluation.Flag, error) {
 		return nil, err
 	}
 	req = req.WithContext(ctx)
-	req.Header.Set("Authorization", fmt.Sprintf("Api-Key %s", c.apiKey))
+	req.Header.Set("Authorization", fmt.Sprintf("Api-Key %s", c.getApiKey()))
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("X-Amp-Exp-Library", fmt.Sprintf("experiment-go-server/%v", experiment.VERSION))
-	resp, err := client.Do(req)
+	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := readAllLimited(resp.Body, c.config.MaxFlagConfigBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -240,7 +1190,7 @@ func (c *Client) doRules() (map[string]interface{}, error) {
 		return nil, err
 	}
 	req = req.WithContext(ctx)
-	req.Header.Set("Authorization", fmt.Sprintf("Api-Key %s", c.apiKey))
+	req.Header.Set("Authorization", fmt.Sprintf("Api-Key %s", c.getApiKey()))
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("X-Amp-Exp-Library", fmt.Sprintf("experiment-go-server/%v", experiment.VERSION))
 	resp, err := c.client.Do(req)
@@ -248,7 +1198,7 @@ func (c *Client) doRules() (map[string]interface{}, error) {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := readAllLimited(resp.Body, c.config.MaxFlagConfigBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -293,7 +1243,7 @@ func (c *Client) doFlags() (map[string]interface{}, error) {
 		return nil, err
 	}
 	req = req.WithContext(ctx)
-	req.Header.Set("Authorization", fmt.Sprintf("Api-Key %s", c.apiKey))
+	req.Header.Set("Authorization", fmt.Sprintf("Api-Key %s", c.getApiKey()))
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("X-Amp-Exp-Library", fmt.Sprintf("experiment-go-server/%v", experiment.VERSION))
 	resp, err := c.client.Do(req)
@@ -301,7 +1251,7 @@ func (c *Client) doFlags() (map[string]interface{}, error) {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := readAllLimited(resp.Body, c.config.MaxFlagConfigBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -325,6 +1275,39 @@ func (c *Client) doFlags() (map[string]interface{}, error) {
 	return flags, nil
 }
 
+// evaluateConcurrently evaluates each wave of independent flags on up to EvaluationConcurrency
+// goroutines, waiting for each wave to complete before evaluating the flags which depend on it.
+func (c *Client) evaluateConcurrently(userContext map[string]interface{}, sortedFlags []*evaluation.Flag, evaluationTime time.Time) map[string]evaluation.Variant {
+	results := make(map[string]evaluation.Variant, len(sortedFlags))
+	for _, wave := range dependencyWaves(sortedFlags) {
+		chunkSize := (len(wave) + c.config.EvaluationConcurrency - 1) / c.config.EvaluationConcurrency
+		chunkResults := make([]map[string]evaluation.Variant, 0, c.config.EvaluationConcurrency)
+		var resultsMutex sync.Mutex
+		var wg sync.WaitGroup
+		for start := 0; start < len(wave); start += chunkSize {
+			end := start + chunkSize
+			if end > len(wave) {
+				end = len(wave)
+			}
+			wg.Add(1)
+			go func(chunk []*evaluation.Flag) {
+				defer wg.Done()
+				chunkResult := c.engine.EvaluateIndependentAt(userContext, chunk, results, evaluationTime)
+				resultsMutex.Lock()
+				defer resultsMutex.Unlock()
+				chunkResults = append(chunkResults, chunkResult)
+			}(wave[start:end])
+		}
+		wg.Wait()
+		for _, chunkResult := range chunkResults {
+			for key, variant := range chunkResult {
+				results[key] = variant
+			}
+		}
+	}
+	return results
+}
+
 func contains(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -350,9 +1333,12 @@ func coerceString(value interface{}) string {
 
 func (c *Client) requiredCohortsInStorage(flagConfigs []*evaluation.Flag) {
 	storedCohortIDs := c.cohortStorage.getCohortIds()
+	hits, misses := 0, 0
 	for _, flag := range flagConfigs {
 		flagCohortIDs := getAllCohortIDsFromFlag(flag)
 		missingCohorts := difference(flagCohortIDs, storedCohortIDs)
+		hits += len(flagCohortIDs) - len(missingCohorts)
+		misses += len(missingCohorts)
 
 		if len(missingCohorts) > 0 {
 			if c.config.CohortSyncConfig != nil {
@@ -368,9 +1354,12 @@ func (c *Client) requiredCohortsInStorage(flagConfigs []*evaluation.Flag) {
 			}
 		}
 	}
+	c.metrics.OnCohortCacheLookup(hits, misses)
 }
 
-func (c *Client) enrichUserWithCohorts(user *experiment.User, flagConfigs map[string]*evaluation.Flag) (*experiment.User, error) {
+// enrichUserWithCohorts returns a copy of the user with the cohorts the user and the user's groups
+// are members of. If trustProvided, cohorts which are set on the user are kept rather than looked up.
+func (c *Client) enrichUserWithCohorts(user *experiment.User, flagConfigs map[string]*evaluation.Flag, trustProvided bool) (*experiment.User, error) {
 	flagConfigSlice := make([]*evaluation.Flag, 0, len(flagConfigs))
 
 	for _, value := range flagConfigs {
@@ -378,25 +1367,82 @@ func (c *Client) enrichUserWithCohorts(user *experiment.User, flagConfigs map[st
 	}
 	groupedCohortIDs := getGroupedCohortIDsFromFlags(flagConfigSlice)
 
-	if cohortIDs, ok := groupedCohortIDs[userGroupType]; ok {
-		if len(cohortIDs) > 0 && user.UserId != "" {
-			user.CohortIds = c.cohortStorage.getCohortsForUser(user.UserId, cohortIDs)
+	// Enrich a copy so the caller's user is not modified.
+	enrichedUser := *user
+	if user.GroupCohortIds != nil {
+		enrichedUser.GroupCohortIds = make(map[string]map[string]map[string]struct{}, len(user.GroupCohortIds))
+		for groupType, groupNames := range user.GroupCohortIds {
+			copyGroupNames := make(map[string]map[string]struct{}, len(groupNames))
+			for groupName, cohortIds := range groupNames {
+				copyGroupNames[groupName] = cohortIds
+			}
+			enrichedUser.GroupCohortIds[groupType] = copyGroupNames
+		}
+	}
+	user = &enrichedUser
+	// The fallback identity resolves user cohorts, but isn't set on the returned user.
+	memberID := user.UserId
+	if id := c.fallbackIdentity(user); id != "" {
+		memberID = id
+	}
+
+	// User cohorts contain user IDs, so anonymous users with only a device ID are in no user cohorts.
+	trustUserCohorts := trustProvided && user.CohortIds != nil
+	if cohortIDs, ok := groupedCohortIDs[userGroupType]; ok && !trustUserCohorts {
+		if len(cohortIDs) > 0 && memberID != "" {
+			if c.config.CohortMembershipResolver != nil {
+				user.CohortIds = c.config.CohortMembershipResolver(memberID, cohortIDs)
+			} else {
+				user.CohortIds = c.cohortStorage.getCohortsForUser(memberID, cohortIDs)
+			}
 		}
 	}
 
 	if user.Groups != nil {
 		for groupType, groupNames := range user.Groups {
-			groupName := ""
-			if len(groupNames) > 0 {
-				groupName = groupNames[0]
+			if !c.config.MultiValueGroups && len(groupNames) > 1 {
+				groupNames = groupNames[:1]
 			}
-			if groupName == "" {
+			cohortIDs, ok := groupedCohortIDs[groupType]
+			if !ok {
 				continue
 			}
-			if cohortIDs, ok := groupedCohortIDs[groupType]; ok {
+			for _, groupName := range groupNames {
+				if groupName == "" {
+					continue
+				}
+				if _, ok := user.GroupCohortIds[groupType][groupName]; ok && trustProvided {
+					continue
+				}
 				user.AddGroupCohortIds(groupType, groupName, c.cohortStorage.getCohortsForGroup(groupType, groupName, cohortIDs))
 			}
 		}
 	}
 	return user, nil
 }
+
+// fallbackIdentity returns the user's FallbackIdentityProperty user property, if the user has
+// neither a user ID nor a device ID and the property is a non-empty string, or else "".
+func (c *Client) fallbackIdentity(user *experiment.User) string {
+	if c.config.FallbackIdentityProperty == "" || user.UserId != "" || user.DeviceId != "" {
+		return ""
+	}
+	id, _ := user.UserProperties[c.config.FallbackIdentityProperty].(string)
+	return id
+}
+
+// withFallbackIdentity returns a copy of the user with its fallback identity as its user ID and
+// device ID, or the user itself if it has no fallback identity.
+func (c *Client) withFallbackIdentity(user *experiment.User) *experiment.User {
+	if user == nil {
+		return nil
+	}
+	id := c.fallbackIdentity(user)
+	if id == "" {
+		return user
+	}
+	fallbackUser := *user
+	fallbackUser.UserId = id
+	fallbackUser.DeviceId = id
+	return &fallbackUser
+}
@@ -1,10 +1,30 @@
 package local
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
 	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/amplitude/analytics-go/amplitude"
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
 	"github.com/amplitude/experiment-go-server/pkg/experiment"
 	"github.com/joho/godotenv"
 )
@@ -231,3 +251,1727 @@ func TestEvaluateV2GroupCohort(t *testing.T) {
 		t.Fatalf("Unexpected variant %v", variant)
 	}
 }
+
+func newTestClient(t *testing.T, flags ...*evaluation.Flag) *Client {
+	c := Initialize("test-"+t.Name(), &Config{})
+	for _, flag := range flags {
+		c.flagConfigStorage.putFlagConfig(flag)
+	}
+	return c
+}
+
+func createTestVariantFlag(key string, metadata map[string]interface{}, dependencies ...string) *evaluation.Flag {
+	return &evaluation.Flag{
+		Key: key,
+		Variants: map[string]*evaluation.Variant{
+			"on": {Key: "on", Value: "on"},
+		},
+		Segments:     []*evaluation.Segment{{Variant: "on"}},
+		Dependencies: dependencies,
+		Metadata:     metadata,
+	}
+}
+
+func TestEvaluateByMetadata(t *testing.T) {
+	c := newTestClient(t,
+		createTestVariantFlag("team-a-flag", map[string]interface{}{"team": "a"}, "shared-flag"),
+		createTestVariantFlag("team-b-flag", map[string]interface{}{"team": "b"}),
+		createTestVariantFlag("shared-flag", nil),
+	)
+	user := &experiment.User{UserId: "test_user"}
+	result, err := c.EvaluateByMetadata(user, func(metadata map[string]interface{}) bool {
+		return metadata["team"] == "a"
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["team-a-flag"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["team-a-flag"])
+	}
+	if _, ok := result["shared-flag"]; !ok {
+		t.Fatalf("Expected dependency to be evaluated %v", result)
+	}
+	if _, ok := result["team-b-flag"]; ok {
+		t.Fatalf("Unexpected variant %v", result["team-b-flag"])
+	}
+}
+
+func TestEvaluateByMetadataNoMatch(t *testing.T) {
+	c := newTestClient(t, createTestVariantFlag("team-a-flag", map[string]interface{}{"team": "a"}))
+	user := &experiment.User{UserId: "test_user"}
+	result, err := c.EvaluateByMetadata(user, func(metadata map[string]interface{}) bool {
+		return false
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(result) != 0 {
+		t.Fatalf("Unexpected result %v", result)
+	}
+}
+
+func TestIsReady(t *testing.T) {
+	c := newTestClient(t, createTestVariantFlag("flag", nil))
+	if c.IsReady() {
+		t.Fatalf("Expected client not ready before first update")
+	}
+	c.flagConfigStorage.setLastUpdated(time.Now())
+	if !c.IsReady() {
+		t.Fatalf("Expected client ready after update")
+	}
+}
+
+func TestStaleConfigEvaluation(t *testing.T) {
+	c := newTestClient(t, createTestVariantFlag("flag", nil))
+	c.config.MaxConfigStaleness = time.Minute
+	c.config.FailEvaluationOnStaleConfig = true
+	user := &experiment.User{UserId: "test_user"}
+
+	c.flagConfigStorage.setLastUpdated(time.Now().Add(-2 * time.Minute))
+	if c.IsReady() {
+		t.Fatalf("Expected stale client not ready")
+	}
+	_, err := c.EvaluateV2(user, nil)
+	if err != ErrStaleFlagConfigs {
+		t.Fatalf("Expected stale error, got %v", err)
+	}
+
+	c.flagConfigStorage.setLastUpdated(time.Now())
+	if !c.IsReady() {
+		t.Fatalf("Expected client ready after update")
+	}
+	result, err := c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["flag"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["flag"])
+	}
+}
+
+func TestCohortMembershipResolver(t *testing.T) {
+	c := newTestClient(t, createTestFlag())
+	c.config.CohortMembershipResolver = func(userId string, cohortIds map[string]struct{}) map[string]struct{} {
+		if userId != "member" {
+			return map[string]struct{}{}
+		}
+		if _, ok := cohortIds[CohortId]; !ok {
+			t.Fatalf("Unexpected cohort ids %v", cohortIds)
+		}
+		return map[string]struct{}{CohortId: {}}
+	}
+	_, member, err := c.EvaluateV2WithUser(&experiment.User{UserId: "member"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, ok := member.CohortIds[CohortId]; !ok {
+		t.Fatalf("Unexpected cohort ids %v", member.CohortIds)
+	}
+	_, nonMember, err := c.EvaluateV2WithUser(&experiment.User{UserId: "non-member"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(nonMember.CohortIds) != 0 {
+		t.Fatalf("Unexpected cohort ids %v", nonMember.CohortIds)
+	}
+}
+
+func TestEvaluateToken(t *testing.T) {
+	c := newTestClient(t, createTestVariantFlag("flag", nil))
+	c.config.UserResolver = func(token string) (*experiment.User, error) {
+		if token != "valid" {
+			return nil, errors.New("invalid token")
+		}
+		return &experiment.User{UserId: "test_user"}, nil
+	}
+	result, err := c.EvaluateToken("valid", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["flag"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["flag"])
+	}
+	_, err = c.EvaluateToken("invalid", nil)
+	if _, ok := err.(*UserResolverError); !ok {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestFlagsV2UsesServerUrl(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		_, _ = w.Write([]byte(`[{"key":"flag"}]`))
+	}))
+	defer server.Close()
+
+	c := newTestClient(t)
+	c.config.ServerUrl = server.URL
+	flags, err := c.doFlagsV2()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if flags["flag"] == nil {
+		t.Fatalf("Unexpected flags %v", flags)
+	}
+	request := <-requests
+	if request.URL.Path != "/sdk/v2/flags" {
+		t.Fatalf("Unexpected path %s", request.URL.Path)
+	}
+	if request.Header.Get("Authorization") != "Api-Key test-"+t.Name() {
+		t.Fatalf("Unexpected authorization %s", request.Header.Get("Authorization"))
+	}
+}
+
+func TestFlagConfigApiVersion(t *testing.T) {
+	paths := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		_, _ = w.Write([]byte(`[{"key":"flag"}]`))
+	}))
+	defer server.Close()
+
+	api := newFlagConfigApiV2("deployment-key", server.URL, time.Second, server.Client(), 0)
+	api.version = 3
+	if _, err := api.getFlagConfigs(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if path := <-paths; path != "/sdk/v3/flags" {
+		t.Fatalf("Unexpected path %s", path)
+	}
+}
+
+func TestFlagsV2ReusesConnections(t *testing.T) {
+	var lock sync.Mutex
+	newConnections := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"key":"flag"}]`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			lock.Lock()
+			defer lock.Unlock()
+			newConnections++
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	c := newTestClient(t)
+	c.config.ServerUrl = server.URL
+	for i := 0; i < 5; i++ {
+		_, err := c.FlagsV2()
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if newConnections != 1 {
+		t.Fatalf("Opened %d connections, expected %d", newConnections, 1)
+	}
+}
+
+func TestMultiValueGroups(t *testing.T) {
+	flag := &evaluation.Flag{
+		Key: "group-cohort-flag",
+		Variants: map[string]*evaluation.Variant{
+			"on": {Key: "on", Value: "on"},
+		},
+		Segments: []*evaluation.Segment{
+			{
+				Conditions: [][]*evaluation.Condition{
+					{
+						{
+							Selector: []string{"context", "groups", "team", "cohort_ids"},
+							Op:       "set contains any",
+							Values:   []string{"team-cohort"},
+						},
+					},
+				},
+				Variant: "on",
+			},
+		},
+	}
+	user := &experiment.User{UserId: "test_user", Groups: map[string][]string{"team": {"a", "b"}}}
+
+	c := newTestClient(t, flag)
+	c.cohortStorage.putCohort(&Cohort{Id: "team-cohort", GroupType: "team", MemberIds: []string{"b"}})
+	result, err := c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["group-cohort-flag"].Key == "on" {
+		t.Fatalf("Expected only the first group to be evaluated %v", result["group-cohort-flag"])
+	}
+
+	c.config.MultiValueGroups = true
+	result, err = c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["group-cohort-flag"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["group-cohort-flag"])
+	}
+}
+
+func TestEvaluationConcurrency(t *testing.T) {
+	flags := []*evaluation.Flag{createTestVariantFlag("parent", nil)}
+	for i := 0; i < 100; i++ {
+		flags = append(flags, &evaluation.Flag{
+			Key: fmt.Sprintf("child-%d", i),
+			Variants: map[string]*evaluation.Variant{
+				"on": {Key: "on", Value: "on"},
+			},
+			Segments: []*evaluation.Segment{
+				{
+					Conditions: [][]*evaluation.Condition{
+						{
+							{
+								Selector: []string{"result", "parent", "key"},
+								Op:       "is",
+								Values:   []string{"on"},
+							},
+						},
+					},
+					Variant: "on",
+				},
+			},
+			Dependencies: []string{"parent"},
+		})
+	}
+	c := newTestClient(t, flags...)
+	c.config.EvaluationConcurrency = 8
+	result, err := c.EvaluateV2(&experiment.User{UserId: "test_user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(result) != len(flags) {
+		t.Fatalf("Evaluated %d flags, expected %d", len(result), len(flags))
+	}
+	for _, flag := range flags {
+		if result[flag.Key].Key != "on" {
+			t.Fatalf("Unexpected variant for %s: %v", flag.Key, result[flag.Key])
+		}
+	}
+}
+
+func BenchmarkEvaluateIndependentFlags(b *testing.B) {
+	c := Initialize("test-"+b.Name(), &Config{})
+	for i := 0; i < 5000; i++ {
+		flag := createTestVariantFlag(fmt.Sprintf("flag-%d", i), nil)
+		flag.Segments = []*evaluation.Segment{
+			{
+				Bucket: &evaluation.Bucket{
+					Selector:    []string{"context", "user", "user_id"},
+					Salt:        flag.Key,
+					Allocations: []*evaluation.Allocation{{Range: []uint64{0, 100}, Distributions: []*evaluation.Distribution{{Variant: "on", Range: []uint64{0, 42949673}}}}},
+				},
+			},
+		}
+		c.flagConfigStorage.putFlagConfig(flag)
+	}
+	user := &experiment.User{UserId: "test_user"}
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			c.config.EvaluationConcurrency = concurrency
+			for i := 0; i < b.N; i++ {
+				_, _ = c.EvaluateV2(user, nil)
+			}
+		})
+	}
+}
+
+func TestReferencedCohortIDs(t *testing.T) {
+	groupFlag := createTestVariantFlag("group-flag", nil)
+	groupFlag.Segments = []*evaluation.Segment{
+		{
+			Conditions: [][]*evaluation.Condition{
+				{
+					{
+						Selector: []string{"context", "groups", "org name", "cohort_ids"},
+						Op:       "set contains any",
+						Values:   []string{"b", "a"},
+					},
+				},
+			},
+			Variant: "on",
+		},
+	}
+	c := newTestClient(t, createTestFlag(), groupFlag, createTestVariantFlag("no-cohort-flag", nil))
+	expected := map[string][]string{
+		userGroupType: {CohortId},
+		"org name":    {"a", "b"},
+	}
+	if actual := c.ReferencedCohortIDs(); !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %v, actual %v", expected, actual)
+	}
+}
+
+func TestFlagsV2MaxFlagConfigBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"key":"flag-1"},{"key":"flag-2"}]`))
+	}))
+	defer server.Close()
+
+	c := newTestClient(t)
+	c.config.ServerUrl = server.URL
+	c.config.MaxFlagConfigBytes = 16
+	_, err := c.FlagsV2()
+	var tooLarge *responseTooLargeException
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("Expected response too large error, got %v", err)
+	}
+
+	c.config.MaxFlagConfigBytes = 1024
+	_, err = c.FlagsV2()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestEvaluateV2WithUser(t *testing.T) {
+	c := newTestClient(t, createTestFlag())
+	c.cohortStorage.putCohort(&Cohort{Id: CohortId, GroupType: userGroupType, Size: 1, MemberIds: []string{"member"}})
+	user := &experiment.User{UserId: "member"}
+	_, enrichedUser, err := c.EvaluateV2WithUser(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, ok := enrichedUser.CohortIds[CohortId]; !ok {
+		t.Fatalf("Unexpected cohort ids %v", enrichedUser.CohortIds)
+	}
+	if user.CohortIds != nil {
+		t.Fatalf("Expected user not to be modified %v", user.CohortIds)
+	}
+}
+
+func TestEvaluateV2WellKnownMetadata(t *testing.T) {
+	experimentFlag := createTestVariantFlag("experiment-flag", map[string]interface{}{
+		experiment.MetadataFlagType:      "experiment",
+		experiment.MetadataExperimentKey: "exp-1",
+	})
+	experimentFlag.Segments[0].Metadata = map[string]interface{}{experiment.MetadataSegmentName: "All Other Users"}
+	c := newTestClient(t, experimentFlag, createTestVariantFlag("release-flag", nil))
+	result, err := c.EvaluateV2(&experiment.User{UserId: "test_user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := map[string]interface{}{
+		experiment.MetadataFlagKey:       "experiment-flag",
+		experiment.MetadataFlagType:      "experiment",
+		experiment.MetadataExperimentKey: "exp-1",
+		experiment.MetadataSegmentName:   "All Other Users",
+	}
+	if !reflect.DeepEqual(expected, result["experiment-flag"].Metadata) {
+		t.Fatalf("Unexpected metadata %v", result["experiment-flag"].Metadata)
+	}
+	expected = map[string]interface{}{experiment.MetadataFlagKey: "release-flag"}
+	if !reflect.DeepEqual(expected, result["release-flag"].Metadata) {
+		t.Fatalf("Unexpected metadata %v", result["release-flag"].Metadata)
+	}
+}
+
+func TestEvaluateDeviceIdOnlyUser(t *testing.T) {
+	cohortSegment := createTestFlag().Segments[0]
+	cohortSegment.Variant = "off"
+	flag := &evaluation.Flag{
+		Key: "device-flag",
+		Variants: map[string]*evaluation.Variant{
+			"on":  {Key: "on", Value: "on"},
+			"off": {Key: "off", Value: "off"},
+		},
+		Segments: []*evaluation.Segment{
+			cohortSegment,
+			{
+				Bucket: &evaluation.Bucket{
+					Selector: []string{"context", "user", "device_id"},
+					Salt:     "salt",
+					Allocations: []*evaluation.Allocation{{
+						Range:         []uint64{0, 100},
+						Distributions: []*evaluation.Distribution{{Variant: "on", Range: []uint64{0, 42949673}}},
+					}},
+				},
+				Variant: "off",
+			},
+		},
+	}
+	mock := &mockAmplitudeClient{}
+	var amplitudeClient amplitude.Client = mock
+	c := Initialize("test-"+t.Name(), &Config{AssignmentConfig: &AssignmentConfig{Client: &amplitudeClient}})
+	c.flagConfigStorage.putFlagConfig(flag)
+	// Device IDs are not user IDs, so must not match user cohorts.
+	c.cohortStorage.putCohort(&Cohort{Id: CohortId, GroupType: userGroupType, Size: 1, MemberIds: []string{"device-1"}})
+
+	for _, deviceId := range []string{"device-1", "device-2"} {
+		result, err := c.EvaluateV2(&experiment.User{DeviceId: deviceId}, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if result["device-flag"].Key != "on" {
+			t.Fatalf("Unexpected variant %v for device %s", result["device-flag"], deviceId)
+		}
+	}
+	// Without a device ID the user cannot be bucketed.
+	result, err := c.EvaluateV2(&experiment.User{}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["device-flag"].Key != "off" {
+		t.Fatalf("Unexpected variant %v", result["device-flag"])
+	}
+
+	events := mock.trackedEvents()
+	if len(events) != 3 {
+		t.Fatalf("Tracked %d events, expected %d", len(events), 3)
+	}
+	if events[0].UserID != "" || events[0].DeviceID != "device-1" {
+		t.Errorf("Unexpected event ids %q %q", events[0].UserID, events[0].DeviceID)
+	}
+	if events[0].InsertID == events[1].InsertID {
+		t.Errorf("Expected distinct insert IDs for devices, got %s", events[0].InsertID)
+	}
+}
+
+func TestEvaluateV2WithDeadline(t *testing.T) {
+	cohortFlag := createTestVariantFlag("cohort-flag", nil)
+	cohortFlag.Segments[0].Conditions = createTestFlag().Segments[0].Conditions
+	release := make(chan struct{})
+	c := newTestClient(t, cohortFlag, createTestVariantFlag("dependent-flag", nil, "cohort-flag"), createTestVariantFlag("plain-flag", nil))
+	c.config.CohortMembershipResolver = func(userId string, cohortIds map[string]struct{}) map[string]struct{} {
+		<-release
+		return cohortIds
+	}
+	defer close(release)
+	user := &experiment.User{UserId: "test_user"}
+
+	start := time.Now()
+	result, err := c.EvaluateV2WithDeadline(time.Now().Add(50*time.Millisecond), user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Evaluation took %v, expected to return by the deadline", time.Since(start))
+	}
+	if result["plain-flag"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["plain-flag"])
+	}
+	for _, flagKey := range []string{"cohort-flag", "dependent-flag"} {
+		variant := result[flagKey]
+		if variant.Key != "" || variant.Metadata[experiment.MetadataDeadlineExceeded] != true || variant.Metadata[experiment.MetadataDefault] != true {
+			t.Fatalf("Unexpected variant %v for %s", variant, flagKey)
+		}
+	}
+}
+
+func TestEvaluateV2WithDeadlineMet(t *testing.T) {
+	cohortFlag := createTestVariantFlag("cohort-flag", nil)
+	cohortFlag.Segments[0].Conditions = createTestFlag().Segments[0].Conditions
+	c := newTestClient(t, cohortFlag)
+	c.config.CohortMembershipResolver = func(userId string, cohortIds map[string]struct{}) map[string]struct{} {
+		return cohortIds
+	}
+	result, err := c.EvaluateV2WithDeadline(time.Now().Add(time.Minute), &experiment.User{UserId: "test_user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["cohort-flag"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["cohort-flag"])
+	}
+}
+
+func TestOnEvaluate(t *testing.T) {
+	c := newTestClient(t, createTestVariantFlag("flag", nil), createTestVariantFlag("other-flag", nil))
+	var evaluated []experiment.Variant
+	c.OnEvaluate("flag", func(user *experiment.User, variant experiment.Variant) {
+		if user.UserId != "test_user" {
+			t.Errorf("Unexpected user %v", user)
+		}
+		evaluated = append(evaluated, variant)
+	})
+	asyncEvaluated := make(chan experiment.Variant, 1)
+	c.OnEvaluateAsync("flag", func(user *experiment.User, variant experiment.Variant) {
+		asyncEvaluated <- variant
+	})
+
+	_, err := c.EvaluateV2(&experiment.User{UserId: "test_user"}, []string{"flag", "other-flag"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(evaluated) != 1 || evaluated[0].Key != "on" {
+		t.Fatalf("Unexpected listener calls %v", evaluated)
+	}
+	select {
+	case variant := <-asyncEvaluated:
+		if variant.Key != "on" {
+			t.Fatalf("Unexpected variant %v", variant)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Async listener was not called")
+	}
+
+	_, err = c.EvaluateV2(&experiment.User{UserId: "test_user"}, []string{"other-flag"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(evaluated) != 1 {
+		t.Fatalf("Listener called for other flag")
+	}
+}
+
+func createTestBucketedFlag(key, salt string) *evaluation.Flag {
+	return &evaluation.Flag{
+		Key: key,
+		Variants: map[string]*evaluation.Variant{
+			"control":   {Key: "control", Value: "control"},
+			"treatment": {Key: "treatment", Value: "treatment"},
+		},
+		Segments: []*evaluation.Segment{{
+			Bucket: &evaluation.Bucket{
+				Selector: []string{"context", "user", "user_id"},
+				Salt:     salt,
+				Allocations: []*evaluation.Allocation{{
+					Range: []uint64{0, 100},
+					Distributions: []*evaluation.Distribution{
+						{Variant: "control", Range: []uint64{0, 21474837}},
+						{Variant: "treatment", Range: []uint64{21474837, 42949673}},
+					},
+				}},
+			},
+		}},
+	}
+}
+
+func TestBucketingSeedOverride(t *testing.T) {
+	overridden := Initialize("test-"+t.Name()+"-overridden", &Config{BucketingSeedOverride: "seed"})
+	overridden.flagConfigStorage.putFlagConfig(createTestBucketedFlag("flag", "flag-salt"))
+	seeded := Initialize("test-"+t.Name()+"-seeded", &Config{})
+	seeded.flagConfigStorage.putFlagConfig(createTestBucketedFlag("flag", "seed"))
+	unseeded := newTestClient(t, createTestBucketedFlag("flag", "flag-salt"))
+	differs := false
+	for i := 0; i < 100; i++ {
+		user := &experiment.User{UserId: fmt.Sprintf("user-%d", i)}
+		actual, err := overridden.EvaluateV2(user, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		expected, _ := seeded.EvaluateV2(user, nil)
+		if actual["flag"].Key != expected["flag"].Key {
+			t.Fatalf("Expected %v to be bucketed with the seed, got %v want %v", user.UserId, actual["flag"].Key, expected["flag"].Key)
+		}
+		unseededResult, _ := unseeded.EvaluateV2(user, nil)
+		if actual["flag"].Key != unseededResult["flag"].Key {
+			differs = true
+		}
+	}
+	if !differs {
+		t.Fatalf("Expected the seed to change bucketing of some users")
+	}
+}
+
+func TestBucketingKey(t *testing.T) {
+	c := newTestClient(t, createTestBucketedFlag("flag", "salt"))
+	variants := make(map[string]bool)
+	bucketedVariants := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		result, err := c.EvaluateV2(&experiment.User{UserId: fmt.Sprintf("user-%d", i)}, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		variants[result["flag"].Key] = true
+		// Users of the same account get the same variant.
+		result, _ = c.EvaluateV2(&experiment.User{UserId: fmt.Sprintf("user-%d", i), BucketingKey: "account"}, nil)
+		bucketedVariants[result["flag"].Key] = true
+	}
+	if len(variants) != 2 {
+		t.Fatalf("Expected users to be bucketed into both variants, got %v", variants)
+	}
+	if len(bucketedVariants) != 1 {
+		t.Fatalf("Expected users with the same bucketing key to get the same variant, got %v", bucketedVariants)
+	}
+
+	// The bucketing key is bucketed like a user ID.
+	expected, _ := c.EvaluateV2(&experiment.User{UserId: "account"}, nil)
+	actual, _ := c.EvaluateV2(&experiment.User{DeviceId: "device", BucketingKey: "account"}, nil)
+	if actual["flag"].Key != expected["flag"].Key {
+		t.Fatalf("Unexpected variant %v, want %v", actual["flag"], expected["flag"])
+	}
+}
+
+func TestBucketingKeyIgnoredForPropertyBucketing(t *testing.T) {
+	flag := createTestBucketedFlag("flag", "salt")
+	flag.Segments[0].Bucket.Selector = []string{"context", "user", "user_properties", "team"}
+	c := newTestClient(t, flag)
+	variants := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		user := &experiment.User{BucketingKey: "account", UserProperties: map[string]interface{}{"team": fmt.Sprintf("team-%d", i)}}
+		result, err := c.EvaluateV2(user, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		variants[result["flag"].Key] = true
+	}
+	if len(variants) != 2 {
+		t.Fatalf("Expected users to be bucketed by the property, got %v", variants)
+	}
+}
+
+func createTestConditionFlag(key string, condition *evaluation.Condition) *evaluation.Flag {
+	return &evaluation.Flag{
+		Key: key,
+		Variants: map[string]*evaluation.Variant{
+			"on": {Key: "on", Value: "on"},
+		},
+		Segments: []*evaluation.Segment{{
+			Conditions: [][]*evaluation.Condition{{condition}},
+			Variant:    "on",
+		}},
+	}
+}
+
+func TestCaseInsensitivePropertyMatch(t *testing.T) {
+	flags := []*evaluation.Flag{
+		createTestConditionFlag("is", &evaluation.Condition{
+			Selector: []string{"context", "user", "country"}, Op: evaluation.OpIs, Values: []string{"US"},
+		}),
+		createTestConditionFlag("is-not", &evaluation.Condition{
+			Selector: []string{"context", "user", "country"}, Op: evaluation.OpIsNot, Values: []string{"US"},
+		}),
+		createTestConditionFlag("set-contains-any", &evaluation.Condition{
+			Selector: []string{"context", "user", "user_properties", "plans"}, Op: evaluation.OpSetContainsAny, Values: []string{"Pro"},
+		}),
+		createTestConditionFlag("regex", &evaluation.Condition{
+			Selector: []string{"context", "user", "country"}, Op: evaluation.OpRegexMatch, Values: []string{"^US$"},
+		}),
+	}
+	user := &experiment.User{
+		UserId:         "test_user",
+		Country:        "us",
+		UserProperties: map[string]interface{}{"plans": []interface{}{"pro", "team"}},
+	}
+	tests := []struct {
+		caseInsensitive bool
+		expected        map[string]bool
+	}{
+		{false, map[string]bool{"is": false, "is-not": true, "set-contains-any": false, "regex": false}},
+		{true, map[string]bool{"is": true, "is-not": false, "set-contains-any": true, "regex": false}},
+	}
+	for _, tt := range tests {
+		c := Initialize(fmt.Sprintf("test-%s-%v", t.Name(), tt.caseInsensitive), &Config{CaseInsensitivePropertyMatch: tt.caseInsensitive})
+		for _, flag := range flags {
+			c.flagConfigStorage.putFlagConfig(flag)
+		}
+		result, err := c.EvaluateV2(user, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		for key, expected := range tt.expected {
+			if actual := result[key].Key == "on"; actual != expected {
+				t.Fatalf("CaseInsensitivePropertyMatch %v: expected flag %s match %v, got %v", tt.caseInsensitive, key, expected, actual)
+			}
+		}
+	}
+}
+
+func TestEvaluationTime(t *testing.T) {
+	launch := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	c := newTestClient(t, createTestConditionFlag("launch", &evaluation.Condition{
+		Selector: []string{evaluation.SelectorEvaluationTime},
+		Op:       evaluation.OpGreaterThanEquals,
+		Values:   []string{strconv.FormatInt(launch.UnixMilli(), 10)},
+	}))
+	user := &experiment.User{UserId: "test_user"}
+	tests := []struct {
+		evaluationTime time.Time
+		expected       bool
+	}{
+		{launch.Add(-time.Millisecond), false},
+		{launch, true},
+		{launch.Add(time.Hour), true},
+		{time.Time{}, true},
+	}
+	for _, tt := range tests {
+		result, err := c.EvaluateV2WithOptions(user, nil, EvaluateOptions{EvaluationTime: tt.evaluationTime})
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if actual := result["launch"].Key == "on"; actual != tt.expected {
+			t.Fatalf("EvaluationTime %v: expected flag on %v, got %v", tt.evaluationTime, tt.expected, actual)
+		}
+	}
+}
+
+func TestAllFlagMetadata(t *testing.T) {
+	c := newTestClient(t,
+		createTestVariantFlag("a", map[string]interface{}{"evaluationMode": "local"}),
+		createTestVariantFlag("b", nil),
+	)
+	expected := map[string]map[string]interface{}{
+		"a": {"evaluationMode": "local"},
+		"b": {},
+	}
+	metadata := c.AllFlagMetadata()
+	if !reflect.DeepEqual(metadata, expected) {
+		t.Fatalf("Unexpected metadata %v", metadata)
+	}
+	// The metadata are copies.
+	metadata["a"]["evaluationMode"] = "remote"
+	if md := c.FlagMetadata("a"); md["evaluationMode"] != "local" {
+		t.Fatalf("Unexpected metadata %v", md)
+	}
+}
+
+func TestFlagsByType(t *testing.T) {
+	c := newTestClient(t,
+		createTestVariantFlag("experiment-b", map[string]interface{}{experiment.MetadataFlagType: "experiment"}),
+		createTestVariantFlag("experiment-a", map[string]interface{}{experiment.MetadataFlagType: "experiment"}),
+		createTestVariantFlag("release", map[string]interface{}{experiment.MetadataFlagType: "release"}),
+		createTestVariantFlag("untyped", nil),
+	)
+	if keys := c.FlagsByType("experiment"); !reflect.DeepEqual(keys, []string{"experiment-a", "experiment-b"}) {
+		t.Fatalf("Unexpected experiments %v", keys)
+	}
+	if keys := c.FlagsByType("release"); !reflect.DeepEqual(keys, []string{"release"}) {
+		t.Fatalf("Unexpected releases %v", keys)
+	}
+	if keys := c.FlagsByType("holdout-group"); len(keys) != 0 {
+		t.Fatalf("Unexpected holdouts %v", keys)
+	}
+}
+
+func TestEvaluateDetailed(t *testing.T) {
+	country := &evaluation.Condition{Selector: []string{"context", "user", "country"}, Op: evaluation.OpIs, Values: []string{"US"}}
+	plan := &evaluation.Condition{Selector: []string{"context", "user", "user_properties", "plan"}, Op: evaluation.OpIs, Values: []string{"pro"}}
+	device := &evaluation.Condition{Selector: []string{"context", "user", "device_id"}, Op: evaluation.OpIs, Values: []string{"device"}}
+	flag := &evaluation.Flag{
+		Key: "flag",
+		Variants: map[string]*evaluation.Variant{
+			"a":   {Key: "a", Value: "a"},
+			"b":   {Key: "b", Value: "b"},
+			"off": {Key: "off"},
+		},
+		Segments: []*evaluation.Segment{
+			// Matches, but doesn't allocate the user.
+			{Conditions: [][]*evaluation.Condition{{country}}, Bucket: &evaluation.Bucket{Selector: []string{"context", "user", "user_id"}, Salt: "salt"}},
+			{Conditions: [][]*evaluation.Condition{{country}}, Variant: "a", Metadata: map[string]interface{}{"segmentName": "US"}},
+			{Conditions: [][]*evaluation.Condition{{device}}, Variant: "b"},
+			{Conditions: [][]*evaluation.Condition{{plan}}, Variant: "b"},
+			{Variant: "off"},
+		},
+	}
+	c := newTestClient(t, flag, &evaluation.Flag{Key: "unmatched", Variants: map[string]*evaluation.Variant{}})
+	user := &experiment.User{UserId: "test_user", Country: "US", UserProperties: map[string]interface{}{"plan": "pro"}}
+	details, err := c.EvaluateDetailed(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, ok := details["unmatched"]; ok {
+		t.Fatalf("Expected no detail for a flag without a variant or matches")
+	}
+	detail := details["flag"]
+	if detail.Variant.Key != "a" || detail.Segment != 1 {
+		t.Fatalf("Unexpected variant %v from segment %d", detail.Variant.Key, detail.Segment)
+	}
+	expected := []SegmentMatch{
+		{Index: 0},
+		{Index: 1, Variant: "a", Metadata: map[string]interface{}{"segmentName": "US"}},
+		{Index: 3, Variant: "b"},
+		{Index: 4, Variant: "off"},
+	}
+	if !reflect.DeepEqual(detail.MatchingSegments, expected) {
+		t.Fatalf("Unexpected matching segments %+v", detail.MatchingSegments)
+	}
+}
+
+func TestSetAndRemoveFlag(t *testing.T) {
+	c := newTestClient(t)
+	user := &experiment.User{UserId: "test_user"}
+	c.SetFlag(createTestVariantFlag("flag", nil))
+	result, err := c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["flag"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["flag"])
+	}
+	c.RemoveFlag("flag")
+	c.RemoveFlag("flag")
+	result, err = c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, ok := result["flag"]; ok {
+		t.Fatalf("Expected flag to be removed, got %v", result["flag"])
+	}
+}
+
+func TestSetFlagStartedClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+	c := Initialize("test-"+t.Name(), &Config{ServerUrl: server.URL})
+	defer c.Close()
+	if err := c.Start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	c.SetFlag(createTestVariantFlag("flag", nil))
+	if c.FlagMetadata("flag") != nil {
+		t.Fatalf("Expected flag not to be set on a started client")
+	}
+}
+
+func TestNestedUserProperties(t *testing.T) {
+	c := newTestClient(t, createTestConditionFlag("pro", &evaluation.Condition{
+		Selector: []string{"context", "user", "user_properties", "subscription.plan"},
+		Op:       evaluation.OpIs,
+		Values:   []string{"pro"},
+	}))
+	tests := []struct {
+		properties map[string]interface{}
+		expected   bool
+	}{
+		{map[string]interface{}{"subscription": map[string]interface{}{"plan": "pro"}}, true},
+		{map[string]interface{}{"subscription": map[string]interface{}{"plan": "free"}}, false},
+		{map[string]interface{}{"subscription": "pro"}, false},
+	}
+	for _, tt := range tests {
+		result, err := c.EvaluateV2(&experiment.User{UserId: "test_user", UserProperties: tt.properties}, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if actual := result["pro"].Key == "on"; actual != tt.expected {
+			t.Fatalf("Properties %v: expected flag on %v, got %v", tt.properties, tt.expected, actual)
+		}
+	}
+}
+
+func TestGetConfig(t *testing.T) {
+	config := createTestVariantFlag("config", nil, "dependency")
+	config.Variants["on"].Payload = map[string]interface{}{"limit": 10.0}
+	config.Segments = []*evaluation.Segment{{
+		Conditions: [][]*evaluation.Condition{{{
+			Selector: []string{"result", "dependency", "key"}, Op: evaluation.OpIs, Values: []string{"on"},
+		}}},
+		Variant: "on",
+	}}
+	c := newTestClient(t, config, createTestVariantFlag("dependency", nil))
+	payloads, err := c.GetConfig(&experiment.User{UserId: "test_user"}, []string{"config"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := map[string]interface{}{"config": map[string]interface{}{"limit": 10.0}}
+	if !reflect.DeepEqual(payloads, expected) {
+		t.Fatalf("Unexpected payloads %v", payloads)
+	}
+}
+
+func TestEvaluateMissingDependency(t *testing.T) {
+	// Missing dependencies are evaluated like dependencies which assigned no variant.
+	flag := createTestConditionFlag("flag", &evaluation.Condition{
+		Selector: []string{"result", "dependency", "key"}, Op: evaluation.OpIsNot, Values: []string{"on"},
+	})
+	flag.Dependencies = []string{"dependency"}
+	c := newTestClient(t, flag)
+	user := &experiment.User{UserId: "test_user"}
+	missing, err := c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	c.SetFlag(&evaluation.Flag{Key: "dependency", Variants: map[string]*evaluation.Variant{}})
+	unassigned, err := c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if missing["flag"].Key != "on" || unassigned["flag"].Key != "on" {
+		t.Fatalf("Unexpected variants %v and %v", missing["flag"], unassigned["flag"])
+	}
+}
+
+func TestGetCohortsForGroup(t *testing.T) {
+	c := newTestClient(t)
+	c.cohortStorage.putCohort(&Cohort{Id: "a", GroupType: "org", Size: 1, MemberIds: []string{"amplitude"}})
+	c.cohortStorage.putCohort(&Cohort{Id: "b", GroupType: "org", Size: 1, MemberIds: []string{"other"}})
+	cohortIds := map[string]struct{}{"a": {}, "b": {}, "c": {}}
+	result := c.GetCohortsForGroup("org", "amplitude", cohortIds)
+	if !reflect.DeepEqual(result, map[string]struct{}{"a": {}}) {
+		t.Fatalf("Unexpected cohorts %v", result)
+	}
+	result = c.GetCohortsForGroup("team", "amplitude", cohortIds)
+	if result == nil || len(result) != 0 {
+		t.Fatalf("Unexpected cohorts %v, expected an empty set", result)
+	}
+}
+
+func TestEvaluateDetailedHoldout(t *testing.T) {
+	heldOut := &evaluation.Condition{Selector: []string{"context", "user", "user_id"}, Op: evaluation.OpIs, Values: []string{"held-out"}}
+	holdout := &evaluation.Flag{
+		Key:      "holdout",
+		Metadata: map[string]interface{}{experiment.MetadataFlagType: flagTypeHoldoutGroup},
+		Variants: map[string]*evaluation.Variant{"holdout": {Key: "holdout"}, "on": {Key: "on"}},
+		Segments: []*evaluation.Segment{
+			{Conditions: [][]*evaluation.Condition{{heldOut}}, Variant: "holdout"},
+			{Variant: "on"},
+		},
+	}
+	experimentFlag := &evaluation.Flag{
+		Key:          "experiment",
+		Dependencies: []string{"holdout"},
+		Variants:     map[string]*evaluation.Variant{"on": {Key: "on"}, "off": {Key: "off"}},
+		Segments: []*evaluation.Segment{
+			{Conditions: [][]*evaluation.Condition{{{Selector: []string{"result", "holdout", "key"}, Op: evaluation.OpIsNot, Values: []string{"holdout"}}}}, Variant: "on"},
+			{Variant: "off"},
+		},
+	}
+	c := newTestClient(t, holdout, experimentFlag)
+	details, err := c.EvaluateDetailed(&experiment.User{UserId: "held-out"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !details["holdout"].IsHoldout || !details["experiment"].IsHoldout || details["experiment"].Variant.Key != "off" {
+		t.Fatalf("Unexpected details %+v", details)
+	}
+	details, err = c.EvaluateDetailed(&experiment.User{UserId: "user"}, []string{"experiment"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if details["experiment"].IsHoldout || details["experiment"].Variant.Key != "on" {
+		t.Fatalf("Unexpected details %+v", details)
+	}
+}
+
+func TestEvaluateFlag(t *testing.T) {
+	dependency := createTestVariantFlag("dependency", nil)
+	flag := createTestConditionFlag("flag", &evaluation.Condition{
+		Selector: []string{"result", "dependency", "key"}, Op: evaluation.OpIs, Values: []string{"on"},
+	})
+	flag.Dependencies = []string{"dependency"}
+	c := newTestClient(t, dependency, flag, createTestVariantFlag("other", nil))
+	user := &experiment.User{UserId: "test_user"}
+	variant, ok, err := c.EvaluateFlag(user, "flag")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !ok || variant.Key != "on" {
+		t.Fatalf("Unexpected variant %v, found %v", variant, ok)
+	}
+	_, ok, err = c.EvaluateFlag(user, "missing")
+	if err != nil || ok {
+		t.Fatalf("Unexpected result for a missing flag, found %v, error %v", ok, err)
+	}
+}
+
+func TestAccessedFlagKeys(t *testing.T) {
+	dependency := createTestVariantFlag("dependency", nil)
+	flag := createTestVariantFlag("flag", nil, "dependency")
+	c := Initialize("test-"+t.Name(), &Config{RecordFlagAccess: true})
+	c.flagConfigStorage.putFlagConfig(dependency)
+	c.flagConfigStorage.putFlagConfig(flag)
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("unused", nil))
+	user := &experiment.User{UserId: "test_user"}
+	for i := 0; i < 2; i++ {
+		if _, err := c.EvaluateV2(user, []string{"flag"}); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if _, _, err := c.EvaluateFlag(user, "dependency"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := map[string]int{"flag": 2, "dependency": 3}
+	if accessed := c.AccessedFlagKeys(); !reflect.DeepEqual(accessed, expected) {
+		t.Fatalf("Unexpected accessed flag keys %v, expected %v", accessed, expected)
+	}
+	disabled := Initialize("test-"+t.Name()+"-disabled", &Config{})
+	disabled.flagConfigStorage.putFlagConfig(createTestVariantFlag("flag", nil))
+	if _, err := disabled.EvaluateV2(user, nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if accessed := disabled.AccessedFlagKeys(); len(accessed) != 0 {
+		t.Fatalf("Unexpected accessed flag keys %v without RecordFlagAccess", accessed)
+	}
+}
+
+func TestSetApiKey(t *testing.T) {
+	var lock sync.Mutex
+	var authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		authorizations = append(authorizations, r.Header.Get("Authorization"))
+		lock.Unlock()
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	c := Initialize("test-"+t.Name(), &Config{ServerUrl: server.URL, FlagConfigPollerInterval: 20 * time.Millisecond})
+	if err := c.Start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer c.deploymentRunner.flagConfigUpdater.Stop()
+	if err := c.SetApiKey(""); err == nil {
+		t.Fatalf("Expected an error for an empty api key")
+	}
+	newKey := "test-" + t.Name() + "-rotated"
+	if err := c.SetApiKey(newKey); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if Initialize(newKey, nil) != c {
+		t.Fatalf("Expected the client for the new api key")
+	}
+	if _, err := c.FlagsV2(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	// The flag configs are fetched with the new key by both FlagsV2 and the poller.
+	rotated := 0
+	for _, authorization := range authorizations {
+		if authorization == "Api-Key "+newKey {
+			rotated++
+		}
+	}
+	if authorizations[0] != "Api-Key test-"+t.Name() || rotated < 2 {
+		t.Fatalf("Unexpected authorizations %v", authorizations)
+	}
+}
+
+func TestEvaluateDetailedConfigVersion(t *testing.T) {
+	c := newTestClient(t, createTestVariantFlag("flag", nil))
+	other := Initialize("test-"+t.Name()+"-other", &Config{})
+	other.flagConfigStorage.putFlagConfig(createTestVariantFlag("flag", nil))
+	user := &experiment.User{UserId: "test_user"}
+	details, err := c.EvaluateDetailed(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	otherDetails, err := other.EvaluateDetailed(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	version := details["flag"].ConfigVersion
+	if version == "" || version != otherDetails["flag"].ConfigVersion {
+		t.Fatalf("Unexpected config versions %q and %q", version, otherDetails["flag"].ConfigVersion)
+	}
+	other.flagConfigStorage.putFlagConfig(createTestVariantFlag("added", nil))
+	otherDetails, err = other.EvaluateDetailed(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if otherDetails["flag"].ConfigVersion == version {
+		t.Fatalf("Expected the config version to change")
+	}
+}
+
+func TestEvaluateFallbackIdentityProperty(t *testing.T) {
+	c := newTestClient(t,
+		createTestConditionFlag("cohort", &evaluation.Condition{
+			Selector: []string{"context", "user", "cohort_ids"}, Op: evaluation.OpSetContainsAny, Values: []string{CohortId},
+		}),
+		createTestConditionFlag("user-id", &evaluation.Condition{
+			Selector: []string{"context", "user", "user_id"}, Op: evaluation.OpIs, Values: []string{"external-1"},
+		}),
+		createTestConditionFlag("device-id", &evaluation.Condition{
+			Selector: []string{"context", "user", "device_id"}, Op: evaluation.OpIs, Values: []string{"external-1"},
+		}),
+	)
+	c.cohortStorage.putCohort(&Cohort{Id: CohortId, GroupType: userGroupType, Size: 1, MemberIds: []string{"external-1"}})
+	c.config.FallbackIdentityProperty = "external_id"
+	tests := []struct {
+		name     string
+		user     *experiment.User
+		expected string
+	}{
+		{"fallback", &experiment.User{UserProperties: map[string]interface{}{"external_id": "external-1"}}, "on"},
+		{"device id precedence", &experiment.User{DeviceId: "device-1", UserProperties: map[string]interface{}{"external_id": "external-1"}}, ""},
+		{"user id precedence", &experiment.User{UserId: "user-1", UserProperties: map[string]interface{}{"external_id": "external-1"}}, ""},
+		{"non-string property", &experiment.User{UserProperties: map[string]interface{}{"external_id": 1}}, ""},
+		{"no identity", &experiment.User{}, ""},
+	}
+	for _, test := range tests {
+		result, err := c.EvaluateV2(test.user, nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", test.name, err)
+		}
+		for _, flagKey := range []string{"cohort", "user-id", "device-id"} {
+			if result[flagKey].Key != test.expected {
+				t.Fatalf("%s: unexpected variant %v for flag %s", test.name, result[flagKey], flagKey)
+			}
+		}
+	}
+	if tests[0].user.UserId != "" {
+		t.Fatalf("Expected user not to be modified, got user ID %s", tests[0].user.UserId)
+	}
+	_, enrichedUser, err := c.EvaluateV2WithUser(tests[0].user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if enrichedUser.UserId != "" || enrichedUser.DeviceId != "" {
+		t.Fatalf("Expected the returned user to keep its IDs, got %v", enrichedUser)
+	}
+	if _, ok := enrichedUser.CohortIds[CohortId]; !ok {
+		t.Fatalf("Expected the returned user's cohorts to be resolved, got %v", enrichedUser.CohortIds)
+	}
+}
+
+func TestFallbackIdentityAssignment(t *testing.T) {
+	var events []amplitude.Event
+	c := Initialize("test-"+t.Name(), &Config{
+		FallbackIdentityProperty: "external_id",
+		AssignmentConfig:         &AssignmentConfig{TestSink: func(event amplitude.Event) { events = append(events, event) }},
+	})
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("flag", nil))
+	if _, err := c.EvaluateV2(&experiment.User{UserProperties: map[string]interface{}{"external_id": "external-1"}}, nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Tracked %d events, expected %d", len(events), 1)
+	}
+	if events[0].UserID != "external-1" || events[0].DeviceID != "external-1" {
+		t.Fatalf("Expected the event to use the fallback identity, got user ID %q and device ID %q", events[0].UserID, events[0].DeviceID)
+	}
+}
+
+func TestRefreshCohort(t *testing.T) {
+	c := newTestClient(t)
+	if err := c.RefreshCohort(context.Background(), CohortId); err == nil {
+		t.Fatalf("Expected an error without cohort sync")
+	}
+	c.cohortStorage.putCohort(&Cohort{Id: CohortId, GroupType: userGroupType, LastModified: 1, Size: 1, MemberIds: []string{"old"}})
+	downloadApi := &mockCohortDownloadApi{getCohortFunc: func(cohortID string, cohort *Cohort) (*Cohort, error) {
+		if cohort != nil {
+			t.Fatalf("Expected the whole cohort to be downloaded")
+		}
+		return &Cohort{Id: cohortID, GroupType: userGroupType, LastModified: 2, Size: 1, MemberIds: []string{"new"}}, nil
+	}}
+	c.cohortLoader = newCohortLoader(downloadApi, c.cohortStorage, false)
+	if err := c.RefreshCohort(context.Background(), CohortId); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if cohorts := c.cohortStorage.getCohortsForUser("new", map[string]struct{}{CohortId: {}}); len(cohorts) != 1 {
+		t.Fatalf("Expected the refreshed cohort to be stored, got %v", cohorts)
+	}
+
+	downloadApi.getCohortFunc = func(cohortID string, cohort *Cohort) (*Cohort, error) {
+		return nil, &httpErrorResponseException{StatusCode: 404, Message: "Unexpected response code"}
+	}
+	if err := c.RefreshCohort(context.Background(), CohortId); err == nil {
+		t.Fatalf("Expected the download error")
+	}
+
+	// Canceling ctx cancels the download, and nothing is stored.
+	requested := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	api := newDirectCohortDownloadApi("api", "secret", 15000, 0, server.URL, time.Minute, false)
+	c.cohortLoader = newCohortLoader(api, c.cohortStorage, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-requested
+		cancel()
+	}()
+	if err := c.RefreshCohort(ctx, CohortId); err != context.Canceled {
+		t.Fatalf("Expected context canceled, got %v", err)
+	}
+	if cohort := c.cohortStorage.getCohort(CohortId); cohort.LastModified != 2 {
+		t.Fatalf("Expected the stored cohort to be unchanged, got %v", cohort)
+	}
+}
+
+func TestEvaluateV2WithOptionsDeployedOnly(t *testing.T) {
+	undeployed := createTestVariantFlag("undeployed", map[string]interface{}{"deployed": false})
+	unassigned := createTestConditionFlag("unassigned", &evaluation.Condition{
+		Selector: []string{"context", "user", "user_id"}, Op: evaluation.OpIs, Values: []string{"other_user"},
+	})
+	unassigned.Variants["off"] = &evaluation.Variant{Key: "off"}
+	unassigned.Segments = append(unassigned.Segments, &evaluation.Segment{
+		Variant: "off", Metadata: map[string]interface{}{experiment.MetadataDefault: true},
+	})
+	c := newTestClient(t, undeployed, unassigned, createTestVariantFlag("deployed", map[string]interface{}{"deployed": true}))
+	user := &experiment.User{UserId: "test_user"}
+	all, err := c.EvaluateV2WithOptions(user, nil, EvaluateOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, ok := all["undeployed"]; !ok {
+		t.Fatalf("Expected undeployed flag without DeployedOnly, got %v", all)
+	}
+	deployed, err := c.EvaluateV2WithOptions(user, nil, EvaluateOptions{DeployedOnly: true})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, ok := deployed["undeployed"]; ok {
+		t.Fatalf("Expected undeployed flag to be excluded, got %v", deployed)
+	}
+	if deployed["deployed"].Key != "on" {
+		t.Fatalf("Unexpected deployed variant %v", deployed["deployed"])
+	}
+	if isDefault, _ := deployed["unassigned"].Metadata[experiment.MetadataDefault].(bool); !isDefault {
+		t.Fatalf("Expected default variant to be kept, got %v", deployed["unassigned"])
+	}
+}
+
+func TestEvaluateCompare(t *testing.T) {
+	unassigned := createTestConditionFlag("unassigned", &evaluation.Condition{
+		Selector: []string{"context", "user", "user_id"}, Op: evaluation.OpIs, Values: []string{"other_user"},
+	})
+	unassigned.Variants["off"] = &evaluation.Variant{Key: "off"}
+	unassigned.Segments = append(unassigned.Segments, &evaluation.Segment{
+		Variant: "off", Metadata: map[string]interface{}{experiment.MetadataDefault: true},
+	})
+	c := newTestClient(t, unassigned,
+		createTestVariantFlag("undeployed", map[string]interface{}{"deployed": false}),
+		createTestVariantFlag("deployed", map[string]interface{}{"deployed": true}))
+	v1, v2, err := c.EvaluateCompare(&experiment.User{UserId: "test_user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(v2) != 3 {
+		t.Fatalf("Expected all flags in v2, got %v", v2)
+	}
+	if len(v1) != 1 || v1["deployed"].Key != "on" {
+		t.Fatalf("Expected only the deployed flag in v1, got %v", v1)
+	}
+}
+
+func TestPayloadDecoder(t *testing.T) {
+	decoded := createTestVariantFlag("decoded", nil)
+	decoded.Variants["on"].Payload = "encoded"
+	invalid := createTestVariantFlag("invalid", nil)
+	invalid.Variants["on"].Payload = "invalid"
+	c := newTestClient(t, decoded, invalid, createTestVariantFlag("no-payload", nil))
+	c.config.PayloadDecoder = func(raw interface{}) (interface{}, error) {
+		if raw == "invalid" {
+			return nil, fmt.Errorf("invalid payload")
+		}
+		return map[string]interface{}{"decoded": raw}, nil
+	}
+	result, err := c.EvaluateV2(&experiment.User{UserId: "test_user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if payload, ok := result["decoded"].Payload.(map[string]interface{}); !ok || payload["decoded"] != "encoded" {
+		t.Fatalf("Expected decoded payload, got %v", result["decoded"].Payload)
+	}
+	if result["invalid"].Payload != "invalid" {
+		t.Fatalf("Expected raw payload on decoder error, got %v", result["invalid"].Payload)
+	}
+	if result["no-payload"].Payload != nil {
+		t.Fatalf("Expected no payload, got %v", result["no-payload"].Payload)
+	}
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"key":"flag"}]`))
+	}))
+	defer server.Close()
+	apiKey := "test-" + t.Name()
+	c := Initialize(apiKey, &Config{ServerUrl: server.URL, FlagConfigPollerInterval: time.Hour})
+	if err := c.Start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if c.GoroutineCount() == 0 {
+		t.Fatalf("Expected the poller's goroutine to be counted")
+	}
+	c.Close()
+	deadline := time.Now().Add(time.Second)
+	for c.GoroutineCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no goroutines after Close, got %d", c.GoroutineCount())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if Initialize(apiKey, &Config{}) == c {
+		t.Fatalf("Expected Initialize to create a new client after Close")
+	}
+	if _, err := c.EvaluateV2(&experiment.User{UserId: "test_user"}, nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestCloseSharedClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"key":"flag"}]`))
+	}))
+	defer server.Close()
+	apiKey := "test-" + t.Name()
+	mock := &closingAmplitudeClient{}
+	var amplitudeClient amplitude.Client = mock
+	config := &Config{ServerUrl: server.URL, FlagConfigPollerInterval: time.Hour, AssignmentConfig: &AssignmentConfig{Client: &amplitudeClient}}
+	c := Initialize(apiKey, config)
+	if Initialize(apiKey, config) != c {
+		t.Fatalf("Expected Initialize to return the shared client")
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	c.Close()
+	if Initialize(apiKey, config) != c {
+		t.Fatalf("Expected the client to be shared until each Initialize call is closed")
+	}
+	c.Close()
+	if c.GoroutineCount() == 0 || mock.flushes != 0 {
+		t.Fatalf("Expected the client not to be torn down while it is shared")
+	}
+	c.Close()
+	if mock.flushes != 1 || mock.shutdowns != 0 {
+		t.Fatalf("Expected the existing amplitude client to be flushed but not shut down, got %d flushes and %d shutdowns", mock.flushes, mock.shutdowns)
+	}
+	if Initialize(apiKey, &Config{}) == c {
+		t.Fatalf("Expected Initialize to create a new client after the last Close")
+	}
+}
+
+func TestEvaluateTrustProvidedCohorts(t *testing.T) {
+	userFlag := createTestConditionFlag("user-cohort", &evaluation.Condition{
+		Selector: []string{"context", "user", "cohort_ids"}, Op: evaluation.OpSetContainsAny, Values: []string{CohortId},
+	})
+	groupFlag := createTestConditionFlag("group-cohort", &evaluation.Condition{
+		Selector: []string{"context", "groups", "team", "cohort_ids"}, Op: evaluation.OpSetContainsAny, Values: []string{"team-cohort"},
+	})
+	c := newTestClient(t, userFlag, groupFlag)
+	c.cohortStorage.putCohort(&Cohort{Id: CohortId, GroupType: userGroupType, Size: 1, MemberIds: []string{"member"}})
+	c.cohortStorage.putCohort(&Cohort{Id: "team-cohort", GroupType: "team", Size: 1, MemberIds: []string{"a"}})
+	tests := []struct {
+		name     string
+		user     *experiment.User
+		trust    bool
+		expected map[string]string
+	}{
+		{"looked up", &experiment.User{UserId: "member", Groups: map[string][]string{"team": {"a"}}}, true,
+			map[string]string{"user-cohort": "on", "group-cohort": "on"}},
+		{"provided not trusted", &experiment.User{UserId: "other", CohortIds: map[string]struct{}{CohortId: {}}}, false,
+			map[string]string{"user-cohort": ""}},
+		{"provided", &experiment.User{UserId: "other", CohortIds: map[string]struct{}{CohortId: {}}}, true,
+			map[string]string{"user-cohort": "on"}},
+		{"provided empty", &experiment.User{UserId: "member", CohortIds: map[string]struct{}{}}, true,
+			map[string]string{"user-cohort": ""}},
+		{"provided group", &experiment.User{
+			Groups:         map[string][]string{"team": {"b"}},
+			GroupCohortIds: map[string]map[string]map[string]struct{}{"team": {"b": {"team-cohort": {}}}},
+		}, true, map[string]string{"group-cohort": "on"}},
+		{"provided other group", &experiment.User{
+			Groups:         map[string][]string{"team": {"a"}},
+			GroupCohortIds: map[string]map[string]map[string]struct{}{"team": {"b": {"team-cohort": {}}}},
+		}, true, map[string]string{"group-cohort": "on"}},
+	}
+	for _, test := range tests {
+		result, err := c.EvaluateV2WithOptions(test.user, nil, EvaluateOptions{TrustProvidedCohorts: test.trust})
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", test.name, err)
+		}
+		for flagKey, expected := range test.expected {
+			if result[flagKey].Key != expected {
+				t.Fatalf("%s: unexpected variant %v for flag %s", test.name, result[flagKey], flagKey)
+			}
+		}
+	}
+}
+
+func TestEvaluateStream(t *testing.T) {
+	flag := createTestConditionFlag("flag", &evaluation.Condition{
+		Selector: []string{"context", "user", "user_id"}, Op: evaluation.OpIs, Values: []string{"user-0", "user-2"},
+	})
+	c := newTestClient(t, flag, createTestVariantFlag("dependent", nil, "flag"))
+	c.config.EvaluationConcurrency = 4
+	users := make(chan *experiment.User)
+	go func() {
+		for i := 0; i < 100; i++ {
+			users <- &experiment.User{UserId: fmt.Sprintf("user-%d", i)}
+		}
+		close(users)
+	}()
+	variants := make(map[string]string)
+	for result := range c.EvaluateStream(users, []string{"flag"}) {
+		if result.Err != nil {
+			t.Fatalf("Unexpected error %v", result.Err)
+		}
+		if _, ok := result.Variants["dependent"]; ok {
+			t.Fatalf("Unexpected variant of a flag which was not requested")
+		}
+		variants[result.User.UserId] = result.Variants["flag"].Key
+	}
+	if len(variants) != 100 {
+		t.Fatalf("Received %d results, expected %d", len(variants), 100)
+	}
+	if variants["user-0"] != "on" || variants["user-1"] != "" || variants["user-2"] != "on" {
+		t.Fatalf("Unexpected variants %v", variants)
+	}
+}
+
+func TestEvaluateStreamSortError(t *testing.T) {
+	c := newTestClient(t, createTestVariantFlag("a", nil, "b"), createTestVariantFlag("b", nil, "a"))
+	users := make(chan *experiment.User, 2)
+	users <- &experiment.User{UserId: "user-1"}
+	users <- &experiment.User{UserId: "user-2"}
+	close(users)
+	count := 0
+	for result := range c.EvaluateStream(users, nil) {
+		if result.Err == nil {
+			t.Fatalf("Expected the cycle error for %v", result.User)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("Received %d results, expected %d", count, 2)
+	}
+}
+
+func TestEmptyKeysMeansNone(t *testing.T) {
+	c := newTestClient(t, createTestVariantFlag("flag", nil))
+	user := &experiment.User{UserId: "test_user"}
+	result, err := c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("Expected all flags to be evaluated, got %v", result)
+	}
+	c.config.EmptyKeysMeansNone = true
+	result, err = c.EvaluateV2(user, []string{})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(result) != 0 {
+		t.Fatalf("Expected no flags to be evaluated, got %v", result)
+	}
+	entries, err := c.EvaluateOrdered(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expected no flags to be evaluated, got %v", entries)
+	}
+	result, err = c.EvaluateV2(user, []string{"flag"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["flag"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["flag"])
+	}
+}
+
+func TestDrain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+	c := Initialize("test-"+t.Name(), &Config{
+		// Block the first evaluation until released.
+		CohortMembershipResolver: func(userId string, cohortIds map[string]struct{}) map[string]struct{} {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(started)
+				<-release
+			}
+			return cohortIds
+		},
+	})
+	c.flagConfigStorage.putFlagConfig(createTestFlag())
+	user := &experiment.User{UserId: "test_user"}
+
+	inFlight := make(chan error, 1)
+	go func() {
+		_, err := c.EvaluateV2(user, nil)
+		inFlight <- err
+	}()
+	<-started
+	drained := make(chan struct{})
+	go func() {
+		c.Drain()
+		close(drained)
+	}()
+	// Wait for Drain to stop new evaluations.
+	for {
+		if _, err := c.EvaluateV2(user, nil); err == ErrDraining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-drained:
+		t.Fatalf("Expected Drain to wait for the evaluation in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-inFlight; err != nil {
+		t.Fatalf("Unexpected error from evaluation in progress %v", err)
+	}
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Drain to return after the evaluation in progress completed")
+	}
+	if _, err := c.EvaluateV2WithDeadline(time.Now().Add(time.Second), user, nil); err != ErrDraining {
+		t.Fatalf("Expected ErrDraining, got %v", err)
+	}
+}
+
+func TestEvaluateOrdered(t *testing.T) {
+	c := newTestClient(t,
+		createTestVariantFlag("c", nil, "d"),
+		createTestVariantFlag("a", nil),
+		createTestVariantFlag("d", nil),
+		createTestVariantFlag("b", nil, "c"),
+	)
+	user := &experiment.User{UserId: "test_user"}
+	tests := []struct {
+		flagKeys []string
+		expected []string
+	}{
+		{nil, []string{"a", "d", "c", "b"}},
+		{[]string{"b", "a"}, []string{"d", "c", "b", "a"}},
+	}
+	for _, tt := range tests {
+		// Evaluate repeatedly, as map iteration order differs between iterations.
+		for i := 0; i < 10; i++ {
+			entries, err := c.EvaluateOrdered(user, tt.flagKeys)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			keys := make([]string, len(entries))
+			for j, entry := range entries {
+				if entry.Variant.Key != "on" {
+					t.Fatalf("Unexpected variant %v for %s", entry.Variant, entry.FlagKey)
+				}
+				keys[j] = entry.FlagKey
+			}
+			if !reflect.DeepEqual(keys, tt.expected) {
+				t.Fatalf("Unexpected order %v for flag keys %v, expected %v", keys, tt.flagKeys, tt.expected)
+			}
+		}
+	}
+}
+
+// createTestClientTLS returns the TLS config of a server which requires client certificates signed
+// by a test certificate authority, and a client TLS config with such a certificate.
+func createTestClientTLS(t *testing.T) (serverTLS *tls.Config, clientCert tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	serverTLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	return serverTLS, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSConfig(t *testing.T) {
+	serverTLS, clientCert := createTestClientTLS(t)
+	flagsJSON := `[{"key":"flag","variants":{"on":{"key":"on"}},"segments":[{"conditions":[[{"selector":["context","user","cohort_ids"],"op":"set contains any","values":["1234"]}]],"variant":"on"}]}]`
+	done := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sdk/v2/flags":
+			_, _ = w.Write([]byte(flagsJSON))
+		case "/sdk/v1/cohort/1234":
+			_, _ = w.Write([]byte(`{"cohortId":"1234","groupType":"User","size":1,"memberIds":["test_user"]}`))
+		case "/sdk/stream/v1/flags":
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte("data: " + flagsJSON + "\n\n"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-done:
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	server.TLS = serverTLS
+	server.StartTLS()
+	defer server.Close()
+	defer close(done)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	config := &Config{
+		ServerUrl:           server.URL,
+		StreamUpdates:       true,
+		StreamServerUrl:     server.URL,
+		InitialLoadStrategy: StreamOnly,
+		CohortSyncConfig: &CohortSyncConfig{
+			ApiKey:          "api",
+			SecretKey:       "secret",
+			CohortServerUrl: server.URL,
+		},
+	}
+	user := &experiment.User{UserId: "test_user"}
+
+	// Without a client certificate, the server rejects connections.
+	config.TLSConfig = &tls.Config{RootCAs: roots}
+	if err := Initialize("test-"+t.Name()+"-no-cert", config).Start(); err == nil {
+		t.Fatalf("Expected an error without a client certificate")
+	}
+	if _, err := FetchAndEvaluate(context.Background(), "test", user, nil, config); err == nil {
+		t.Fatalf("Expected an error without a client certificate")
+	}
+
+	config.TLSConfig = &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}
+	// The stream and cohort download use the client certificate.
+	c := Initialize("test-"+t.Name(), config)
+	if err := c.Start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	result, err := c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["flag"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["flag"])
+	}
+	// Flag config requests use the client certificate.
+	if _, err := FetchAndEvaluate(context.Background(), "test", user, nil, config); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestStartConcurrently(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+	var wg sync.WaitGroup
+	clients := make([]*Client, 20)
+	errs := make([]error, len(clients))
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clients[i] = Initialize("test-"+t.Name(), &Config{ServerUrl: server.URL})
+			errs[i] = clients[i].Start()
+		}(i)
+	}
+	wg.Wait()
+	for i := range clients {
+		if errs[i] != nil {
+			t.Fatalf("Unexpected error %v", errs[i])
+		}
+		if clients[i] != clients[0] {
+			t.Fatalf("Expected Initialize to return the same client")
+		}
+	}
+	if count := atomic.LoadInt32(&requests); count != 1 {
+		t.Fatalf("Expected the client to start once, got %d flag config requests", count)
+	}
+}
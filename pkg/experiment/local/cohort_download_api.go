@@ -1,6 +1,7 @@
 package local
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -13,92 +14,165 @@ import (
 
 const cohortRequestDelay = 100 * time.Millisecond
 
+// maxCohortRetryAfter is the longest Retry-After delay a cohort download waits for before retrying.
+// Flag config updates may wait for cohort downloads, so downloads asked to wait longer fail, and
+// the cohort is downloaded again on the next cohort poll.
+const maxCohortRetryAfter = 20 * cohortRequestDelay
+
 type cohortDownloadApi interface {
 	getCohort(cohortID string, cohort *Cohort) (*Cohort, error)
 }
 
 type directCohortDownloadApi struct {
-	ApiKey        string
-	SecretKey     string
-	MaxCohortSize int
-	ServerUrl     string
-	Debug         bool
-	log           *logger.Log
+	ApiKey         string
+	SecretKey      string
+	MaxCohortSize  int
+	MaxCohortBytes int64
+	ServerUrl      string
+	RequestTimeout time.Duration
+	Debug          bool
+	log            *logger.Log
+	// retryBudget limits retries of failed requests. When it is exhausted the download fails, and
+	// the cohort is downloaded again on the next cohort poll.
+	retryBudget *retryBudget
+	// client, if set, is used for requests instead of a default client.
+	client *http.Client
 }
 
-func newDirectCohortDownloadApi(apiKey, secretKey string, maxCohortSize int, serverUrl string, debug bool) *directCohortDownloadApi {
+func newDirectCohortDownloadApi(apiKey, secretKey string, maxCohortSize int, maxCohortBytes int64, serverUrl string, requestTimeout time.Duration, debug bool) *directCohortDownloadApi {
 	api := &directCohortDownloadApi{
-		ApiKey:        apiKey,
-		SecretKey:     secretKey,
-		MaxCohortSize: maxCohortSize,
-		ServerUrl:     serverUrl,
-		Debug:         debug,
-		log:           logger.New(debug),
+		ApiKey:         apiKey,
+		SecretKey:      secretKey,
+		MaxCohortSize:  maxCohortSize,
+		MaxCohortBytes: maxCohortBytes,
+		ServerUrl:      serverUrl,
+		RequestTimeout: requestTimeout,
+		Debug:          debug,
+		log:            logger.New(debug),
 	}
 	return api
 }
 
 func (api *directCohortDownloadApi) getCohort(cohortID string, cohort *Cohort) (*Cohort, error) {
+	return api.getCohortWithContext(context.Background(), cohortID, cohort)
+}
+
+// getCohortWithContext downloads the cohort like getCohort, giving up when the context is done,
+// including while waiting to retry.
+func (api *directCohortDownloadApi) getCohortWithContext(ctx context.Context, cohortID string, cohort *Cohort) (*Cohort, error) {
 	api.log.Debug("getCohortMembers(%s): start", cohortID)
 	errors := 0
-	client := &http.Client{}
+	client := api.client
+	if client == nil {
+		client = &http.Client{}
+	}
 
 	for {
-		response, err := api.getCohortMembersRequest(client, cohortID, cohort)
-		if err != nil {
-			api.log.Error("getCohortMembers(%s): request-status error %d - %v", cohortID, errors, err)
-			errors++
-			if errors >= 3 || func(err error) bool {
-				switch err.(type) {
-				case *cohortTooLargeException:
-					return true
-				default:
-					return false
-				}
-			}(err) {
-				return nil, err
-			}
-			time.Sleep(cohortRequestDelay)
-			continue
+		result, err := api.getCohortAttempt(ctx, client, cohortID, cohort)
+		if err == nil {
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		api.log.Error("getCohortMembers(%s): request-status error %d - %v", cohortID, errors, err)
+		errors++
+		// Rate limited requests are retried when the server asks to be retried.
+		delay, rateLimited := rateLimitRetryAfter(err)
+		if errors >= 3 || !(rateLimited || isRetryableCohortError(err)) {
+			return nil, err
 		}
+		if !rateLimited {
+			delay = cohortRequestDelay
+		} else if delay > maxCohortRetryAfter {
+			api.log.Debug("getCohortMembers(%s): retry after %v exceeds %v", cohortID, delay, maxCohortRetryAfter)
+			return nil, err
+		}
+		if !api.retryBudget.tryAcquire() {
+			api.log.Debug("getCohortMembers(%s): retry budget exhausted", cohortID)
+			return nil, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
 
-		if response.StatusCode == http.StatusOK {
-			var cohortInfo struct {
-				Id           string   `json:"cohortId"`
-				LastModified int64    `json:"lastModified"`
-				Size         int      `json:"size"`
-				MemberIds    []string `json:"memberIds"`
-				GroupType    string   `json:"groupType"`
-			}
-			if err := json.NewDecoder(response.Body).Decode(&cohortInfo); err != nil {
-				return nil, err
-			}
-			api.log.Debug("getCohortMembers(%s): end - resultSize=%d", cohortID, cohortInfo.Size)
-			return &Cohort{
-				Id:           cohortInfo.Id,
-				LastModified: cohortInfo.LastModified,
-				Size:         cohortInfo.Size,
-				MemberIds:    cohortInfo.MemberIds,
-				GroupType: func() string {
-					if cohortInfo.GroupType == "" {
-						return userGroupType
-					}
-					return cohortInfo.GroupType
-				}(),
-			}, nil
-		} else if response.StatusCode == http.StatusNoContent {
-			api.log.Debug("getCohortMembers(%s): Cohort not modified", cohortID)
-			return nil, nil
-		} else if response.StatusCode == http.StatusRequestEntityTooLarge {
-			return nil, &cohortTooLargeException{Message: "Cohort exceeds max cohort size of " + strconv.Itoa(api.MaxCohortSize)}
-		} else {
-			return nil, &httpErrorResponseException{StatusCode: response.StatusCode, Message: "Unexpected response code"}
+// getCohortAttempt makes one request for the cohort. The cohort is returned only once the whole
+// response is read and has as many members as the server says the cohort has, so an interrupted
+// download is never applied as the cohort's full membership.
+func (api *directCohortDownloadApi) getCohortAttempt(ctx context.Context, client *http.Client, cohortID string, cohort *Cohort) (*Cohort, error) {
+	// The timeout covers reading the response body, so the context is only canceled once the cohort is decoded.
+	ctx, cancel := api.requestContext(ctx)
+	defer cancel()
+	response, err := api.getCohortMembersRequest(ctx, client, cohortID, cohort)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusOK {
+		var cohortInfo struct {
+			Id           string   `json:"cohortId"`
+			LastModified int64    `json:"lastModified"`
+			Size         int      `json:"size"`
+			MemberIds    []string `json:"memberIds"`
+			GroupType    string   `json:"groupType"`
 		}
+		if err := json.NewDecoder(newLimitedReader(response.Body, api.MaxCohortBytes)).Decode(&cohortInfo); err != nil {
+			return nil, err
+		}
+		// A size of zero may mean the server didn't send one, so only a non-zero size is checked.
+		if cohortInfo.Size != 0 && cohortInfo.Size != len(cohortInfo.MemberIds) {
+			return nil, &cohortIncompleteException{Size: cohortInfo.Size, Received: len(cohortInfo.MemberIds)}
+		}
+		api.log.Debug("getCohortMembers(%s): end - resultSize=%d", cohortID, cohortInfo.Size)
+		return &Cohort{
+			Id:           cohortInfo.Id,
+			LastModified: cohortInfo.LastModified,
+			Size:         cohortInfo.Size,
+			MemberIds:    cohortInfo.MemberIds,
+			GroupType: func() string {
+				if cohortInfo.GroupType == "" {
+					return userGroupType
+				}
+				return cohortInfo.GroupType
+			}(),
+		}, nil
+	} else if response.StatusCode == http.StatusNoContent {
+		api.log.Debug("getCohortMembers(%s): Cohort not modified", cohortID)
+		return nil, nil
+	} else if response.StatusCode == http.StatusRequestEntityTooLarge {
+		return nil, &cohortTooLargeException{Message: "Cohort exceeds max cohort size of " + strconv.Itoa(api.MaxCohortSize)}
+	} else {
+		return nil, &httpErrorResponseException{StatusCode: response.StatusCode, Message: "Unexpected response code", response: response}
+	}
+}
+
+// isRetryableCohortError returns true for failed requests and incomplete responses, which may
+// succeed if retried, and false for responses which would be the same if retried.
+func isRetryableCohortError(err error) bool {
+	switch err.(type) {
+	case *cohortTooLargeException, *responseTooLargeException, *httpErrorResponseException:
+		return false
+	default:
+		return true
+	}
+}
+
+func (api *directCohortDownloadApi) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if api.RequestTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, api.RequestTimeout)
 }
 
-func (api *directCohortDownloadApi) getCohortMembersRequest(client *http.Client, cohortID string, cohort *Cohort) (*http.Response, error) {
-	req, err := http.NewRequest("GET", api.buildCohortURL(cohortID, cohort), nil)
+func (api *directCohortDownloadApi) getCohortMembersRequest(ctx context.Context, client *http.Client, cohortID string, cohort *Cohort) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", api.buildCohortURL(cohortID, cohort), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -2,7 +2,11 @@ package local
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/assert"
@@ -33,7 +37,7 @@ func TestCohortDownloadApi(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
-	api := newDirectCohortDownloadApi("api", "secret", 15000, "https://server.amplitude.com", false)
+	api := newDirectCohortDownloadApi("api", "secret", 15000, 0, "https://server.amplitude.com", DefaultCohortSyncConfig.RequestTimeout, false)
 
 	t.Run("test_cohort_download_success", func(t *testing.T) {
 		cohort := &Cohort{Id: "1234", LastModified: 0, Size: 1, MemberIds: []string{"user"}, GroupType: "userGroupType"}
@@ -219,3 +223,146 @@ func TestCohortDownloadApi(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestCohortDownloadApiRequestTimeout(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	api := newDirectCohortDownloadApi("api", "secret", 15000, 0, server.URL, 100*time.Millisecond, false)
+
+	start := time.Now()
+	result, err := api.getCohort("1234", nil)
+	assert.Nil(t, result)
+	assert.Error(t, err)
+	// 3 attempts with a request delay between each.
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+}
+
+func TestCohortDownloadApiMaxCohortBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"cohortId":"1234","lastModified":0,"size":2,"memberIds":["user1","user2"]}`))
+	}))
+	defer server.Close()
+
+	api := newDirectCohortDownloadApi("api", "secret", 15000, 32, server.URL, DefaultCohortSyncConfig.RequestTimeout, false)
+	result, err := api.getCohort("1234", nil)
+	assert.Nil(t, result)
+	assert.IsType(t, &responseTooLargeException{}, err)
+
+	api = newDirectCohortDownloadApi("api", "secret", 15000, 1024, server.URL, DefaultCohortSyncConfig.RequestTimeout, false)
+	result, err = api.getCohort("1234", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user1", "user2"}, result.MemberIds)
+}
+
+func TestCohortDownloadApiTruncatedResponse(t *testing.T) {
+	body := `{"cohortId":"1234","lastModified":0,"size":2,"memberIds":["user1","user2"]}`
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// The connection is closed after part of the body.
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			_, _ = w.Write([]byte(body[:len(body)/2]))
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	api := newDirectCohortDownloadApi("api", "secret", 15000, 0, server.URL, DefaultCohortSyncConfig.RequestTimeout, false)
+	result, err := api.getCohort("1234", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user1", "user2"}, result.MemberIds)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestCohortDownloadApiIncompleteResponseKeepsCohort(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`{"cohortId":"1234","lastModified":1,"size":3,"memberIds":["user1"]}`))
+	}))
+	defer server.Close()
+
+	api := newDirectCohortDownloadApi("api", "secret", 15000, 0, server.URL, DefaultCohortSyncConfig.RequestTimeout, false)
+	storage := newInMemoryCohortStorage()
+	prior := &Cohort{Id: "1234", LastModified: 0, Size: 2, MemberIds: []string{"user1", "user2"}, GroupType: userGroupType}
+	storage.putCohort(prior)
+	loader := newCohortLoader(api, storage, false)
+
+	err := loader.loadCohort("1234").wait()
+	assert.IsType(t, &cohortIncompleteException{}, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.True(t, CohortEquals(prior, storage.getCohort("1234")))
+}
+
+func TestCohortDownloadApiHonorsRetryAfter(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// Clearly below maxCohortRetryAfter.
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(`{"cohortId":"1234","lastModified":0,"size":1,"memberIds":["user1"]}`))
+	}))
+	defer server.Close()
+
+	api := newDirectCohortDownloadApi("api", "secret", 15000, 0, server.URL, DefaultCohortSyncConfig.RequestTimeout, false)
+	start := time.Now()
+	result, err := api.getCohort("1234", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user1"}, result.MemberIds)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(900*time.Millisecond))
+}
+
+func TestCohortDownloadApiRetryAfterTooLong(t *testing.T) {
+	// Clearly above maxCohortRetryAfter, as delta seconds and as an HTTP date.
+	retryAfters := []func() string{
+		func() string { return "60" },
+		func() string { return time.Now().Add(time.Minute).UTC().Format(http.TimeFormat) },
+	}
+	for _, retryAfter := range retryAfters {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.Header().Set("Retry-After", retryAfter())
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+
+		api := newDirectCohortDownloadApi("api", "secret", 15000, 0, server.URL, DefaultCohortSyncConfig.RequestTimeout, false)
+		start := time.Now()
+		_, err := api.getCohort("1234", nil)
+		assert.IsType(t, &httpErrorResponseException{}, err)
+		// The download failed because the delay exceeds the cap, not because it wasn't parsed.
+		delay, rateLimited := rateLimitRetryAfter(err)
+		assert.True(t, rateLimited)
+		assert.Greater(t, int64(delay), int64(maxCohortRetryAfter))
+		assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+		assert.Less(t, int64(time.Since(start)), int64(maxCohortRetryAfter))
+		server.Close()
+	}
+}
+
+func TestCohortDownloadApiRateLimitedWithoutRetryAfter(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	api := newDirectCohortDownloadApi("api", "secret", 15000, 0, server.URL, DefaultCohortSyncConfig.RequestTimeout, false)
+	_, err := api.getCohort("1234", nil)
+	assert.IsType(t, &httpErrorResponseException{}, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,88 @@
+package local
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// cohortExport is the format of ExportCohorts.
+type cohortExport struct {
+	// ExportedAt is the time of the export in milliseconds since the Unix epoch.
+	ExportedAt int64                `json:"exportedAt"`
+	Cohorts    []cohortExportCohort `json:"cohorts"`
+}
+
+type cohortExportCohort struct {
+	Id string `json:"id"`
+	// LastModified is the cohort's version, in milliseconds since the Unix epoch.
+	LastModified int64    `json:"lastModified"`
+	Size         int      `json:"size"`
+	GroupType    string   `json:"groupType"`
+	MemberIds    []string `json:"memberIds"`
+}
+
+// ExportCohorts returns the cohorts in storage as JSON, which ImportCohorts restores, e.g. to persist
+// the cohorts on shutdown and restore them on boot rather than waiting for them to download. The JSON
+// object has the time of the export in milliseconds since the Unix epoch, "exportedAt", for
+// staleness checks, and the cohorts, "cohorts", each with its "id", "groupType", "size",
+// "memberIds", and version, "lastModified".
+func (c *Client) ExportCohorts() ([]byte, error) {
+	cohorts := c.cohortStorage.getCohortsWithMembers()
+	ids := make([]string, 0, len(cohorts))
+	for id := range cohorts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	export := cohortExport{ExportedAt: time.Now().UnixMilli(), Cohorts: make([]cohortExportCohort, 0, len(ids))}
+	for _, id := range ids {
+		cohort := cohorts[id]
+		export.Cohorts = append(export.Cohorts, cohortExportCohort{
+			Id:           cohort.Id,
+			LastModified: cohort.LastModified,
+			Size:         cohort.Size,
+			GroupType:    cohort.GroupType,
+			MemberIds:    cohort.MemberIds,
+		})
+	}
+	return json.Marshal(export)
+}
+
+// ImportCohorts stores the cohorts exported by ExportCohorts. Cohorts in storage which were modified
+// after the exported cohorts are kept. Import before Start, so the cohorts are then only downloaded
+// if they changed since they were exported. If the data is malformed, no cohorts are stored.
+func (c *Client) ImportCohorts(data []byte) error {
+	var export cohortExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return err
+	}
+	for i, cohort := range export.Cohorts {
+		if cohort.Id == "" {
+			return fmt.Errorf("cohort %d: empty cohort ID", i)
+		}
+		if cohort.GroupType == "" {
+			return fmt.Errorf("cohort %s: empty group type", cohort.Id)
+		}
+	}
+	if export.Cohorts == nil {
+		return errors.New("missing cohorts")
+	}
+	for _, cohort := range export.Cohorts {
+		if stored := c.cohortStorage.getCohort(cohort.Id); stored != nil && stored.LastModified > cohort.LastModified {
+			continue
+		}
+		c.cohortStorage.putCohort(&Cohort{
+			Id:           cohort.Id,
+			LastModified: cohort.LastModified,
+			Size:         cohort.Size,
+			MemberIds:    cohort.MemberIds,
+			GroupType:    cohort.GroupType,
+		})
+	}
+	if c.cohortLoader != nil {
+		c.cohortLoader.checkCohortsLoaded()
+	}
+	return nil
+}
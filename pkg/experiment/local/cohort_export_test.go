@@ -0,0 +1,50 @@
+package local
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImportCohorts(t *testing.T) {
+	for _, indexByMember := range []bool{false, true} {
+		cohortSyncConfig := &CohortSyncConfig{ApiKey: "api", SecretKey: "secret", IndexCohortsByMember: indexByMember}
+		name := t.Name()
+		if indexByMember {
+			name += "-index"
+		}
+		c := Initialize("test-"+name, &Config{CohortSyncConfig: cohortSyncConfig})
+		c.cohortStorage.putCohort(&Cohort{Id: "a", LastModified: 10, Size: 2, MemberIds: []string{"u2", "u1"}, GroupType: userGroupType})
+		c.cohortStorage.putCohort(&Cohort{Id: "b", LastModified: 20, Size: 1, MemberIds: []string{"org"}, GroupType: "org"})
+		data, err := c.ExportCohorts()
+		assert.NoError(t, err)
+
+		restored := Initialize("test-"+name+"-restored", &Config{CohortSyncConfig: cohortSyncConfig})
+		assert.NoError(t, restored.ImportCohorts(data))
+		assert.Equal(t, map[string]struct{}{"a": {}, "b": {}}, restored.cohortStorage.getCohortIds())
+		assert.Equal(t, int64(20), restored.cohortStorage.getCohort("b").LastModified)
+		assert.Equal(t, map[string]struct{}{"a": {}}, restored.cohortStorage.getCohortsForUser("u1", map[string]struct{}{"a": {}}))
+		assert.Equal(t, map[string]struct{}{"b": {}}, restored.cohortStorage.getCohortsForGroup("org", "org", map[string]struct{}{"b": {}}))
+		assert.ElementsMatch(t, []string{"u1", "u2"}, restored.cohortStorage.getCohortsWithMembers()["a"].MemberIds)
+	}
+}
+
+func TestImportCohortsKeepsNewerCohorts(t *testing.T) {
+	c := newTestClient(t)
+	c.cohortStorage.putCohort(&Cohort{Id: CohortId, LastModified: 10, Size: 1, MemberIds: []string{"old"}, GroupType: userGroupType})
+	data, err := c.ExportCohorts()
+	assert.NoError(t, err)
+	c.cohortStorage.putCohort(&Cohort{Id: CohortId, LastModified: 20, Size: 1, MemberIds: []string{"new"}, GroupType: userGroupType})
+	assert.NoError(t, c.ImportCohorts(data))
+	assert.Equal(t, int64(20), c.cohortStorage.getCohort(CohortId).LastModified)
+	assert.Equal(t, map[string]struct{}{CohortId: {}}, c.cohortStorage.getCohortsForUser("new", map[string]struct{}{CohortId: {}}))
+}
+
+func TestImportCohortsMalformed(t *testing.T) {
+	c := newTestClient(t)
+	assert.Error(t, c.ImportCohorts([]byte("not json")))
+	assert.Error(t, c.ImportCohorts([]byte("{}")))
+	assert.Error(t, c.ImportCohorts([]byte(`{"cohorts":[{"id":"a","groupType":"User"},{"id":"","groupType":"User"}]}`)))
+	assert.Error(t, c.ImportCohorts([]byte(`{"cohorts":[{"id":"a"}]}`)))
+	assert.Empty(t, c.cohortStorage.getCohortIds())
+}
@@ -0,0 +1,72 @@
+package local
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// loadCohortFile reads user cohorts from a file, for local development without cohort downloads.
+// Files with a .json extension contain a JSON object of member user IDs keyed by cohort ID, e.g.
+// {"cohort-1": ["user-1", "user-2"]}. Other files contain CSV rows of a cohort ID and a member user
+// ID, without a header row. Malformed rows fail with their line number.
+func loadCohortFile(path string) ([]*Cohort, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var members map[string][]string
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.NewDecoder(file).Decode(&members)
+	} else {
+		members, err = parseCohortCSV(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	cohortIDs := make([]string, 0, len(members))
+	for cohortID := range members {
+		cohortIDs = append(cohortIDs, cohortID)
+	}
+	sort.Strings(cohortIDs)
+	cohorts := make([]*Cohort, 0, len(cohortIDs))
+	for _, cohortID := range cohortIDs {
+		if cohortID == "" {
+			return nil, fmt.Errorf("%s: empty cohort ID", path)
+		}
+		cohorts = append(cohorts, &Cohort{
+			Id:        cohortID,
+			Size:      len(members[cohortID]),
+			MemberIds: members[cohortID],
+			GroupType: userGroupType,
+		})
+	}
+	return cohorts, nil
+}
+
+func parseCohortCSV(r io.Reader) (map[string][]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	members := make(map[string][]string)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record[0] == "" || record[1] == "" {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("line %d: expected a cohort ID and a user ID", line)
+		}
+		members[record[0]] = append(members[record[0]], record[1])
+	}
+}
@@ -0,0 +1,61 @@
+package local
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCohortFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	return path
+}
+
+func TestLoadCohortFile(t *testing.T) {
+	expected := []*Cohort{
+		{Id: "a", Size: 2, MemberIds: []string{"u1", "u2"}, GroupType: userGroupType},
+		{Id: "b", Size: 1, MemberIds: []string{"u2"}, GroupType: userGroupType},
+	}
+	cohorts, err := loadCohortFile(writeCohortFile(t, "cohorts.csv", "a,u1\nb, u2\na,u2\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, cohorts)
+
+	cohorts, err = loadCohortFile(writeCohortFile(t, "cohorts.json", `{"a":["u1","u2"],"b":["u2"]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, cohorts)
+}
+
+func TestLoadCohortFileMalformed(t *testing.T) {
+	_, err := loadCohortFile(writeCohortFile(t, "cohorts.csv", "a,u1\na,u2,u3\n"))
+	assert.Contains(t, err.Error(), "line 2")
+	_, err = loadCohortFile(writeCohortFile(t, "cohorts.csv", "a,u1\na,u2\n,u3\n"))
+	assert.Contains(t, err.Error(), "line 3: expected a cohort ID and a user ID")
+	_, err = loadCohortFile(writeCohortFile(t, "cohorts.json", `["a"]`))
+	assert.Error(t, err)
+	_, err = loadCohortFile(filepath.Join(t.TempDir(), "missing.csv"))
+	assert.Error(t, err)
+}
+
+func TestCohortFilePath(t *testing.T) {
+	path := writeCohortFile(t, "cohorts.csv", "1234,member\n")
+	c := Initialize("test-"+t.Name(), &Config{CohortFilePath: path})
+	c.flagConfigStorage.putFlagConfig(createTestConditionFlag("flag", &evaluation.Condition{
+		Selector: []string{"context", "user", "cohort_ids"}, Op: evaluation.OpSetContainsAny, Values: []string{"1234"},
+	}))
+	variants, err := c.EvaluateV2(&experiment.User{UserId: "member"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "on", variants["flag"].Key)
+	variants, err = c.EvaluateV2(&experiment.User{UserId: "other"}, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, variants["flag"].Key)
+
+	_, err = InitializeWithError("test-"+t.Name()+"-malformed", &Config{CohortFilePath: writeCohortFile(t, "cohorts.csv", "1234\n")})
+	assert.IsType(t, &ConfigError{}, err)
+}
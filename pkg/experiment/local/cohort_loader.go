@@ -1,6 +1,7 @@
 package local
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"sync"
@@ -13,40 +14,61 @@ type cohortLoader struct {
 	log               *logger.Log
 	cohortDownloadApi cohortDownloadApi
 	cohortStorage     cohortStorage
-	jobs              sync.Map
-	executor          *sync.Pool
-	lockJobs          sync.Mutex
+	// jobs are the in-flight cohort downloads keyed by cohort ID, which concurrent loads of the same
+	// cohort share.
+	jobs     sync.Map
+	lockJobs sync.Mutex
+	// flagConfigStorage, if set, is used to check whether the cohorts referenced by the flag configs
+	// are loaded.
+	flagConfigStorage flagConfigStorage
+	listenersLock     sync.Mutex
+	loadedListeners   []func()
+	// loadedCohortIDs are the referenced cohort IDs when the listeners were last called, or nil if
+	// they have not been called.
+	loadedCohortIDs map[string]struct{}
+	// goroutines, if set, counts the goroutines of cohort downloads.
+	goroutines *goroutineCounter
+	// ctx is the context of cohort downloads, which cancel cancels, e.g. when the deployment runner
+	// stops. It is created on first use after each cancel, and guarded by ctxLock.
+	ctxLock   sync.Mutex
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+}
+
+// contextCohortDownloadApi is implemented by cohort download APIs whose downloads can be canceled.
+type contextCohortDownloadApi interface {
+	getCohortWithContext(ctx context.Context, cohortID string, cohort *Cohort) (*Cohort, error)
 }
 
 func newCohortLoader(cohortDownloadApi cohortDownloadApi, cohortStorage cohortStorage, debug bool) *cohortLoader {
 	return &cohortLoader{
 		cohortDownloadApi: cohortDownloadApi,
 		cohortStorage:     cohortStorage,
-		executor: &sync.Pool{
-			New: func() interface{} {
-				return &CohortLoaderTask{}
-			},
-		},
-		log: logger.New(debug),
+		log:               logger.New(debug),
 	}
 }
 
+// loadCohort downloads the cohort, or returns the in-flight download of the cohort if there is one,
+// so concurrent loads of the same cohort make one request.
 func (cl *cohortLoader) loadCohort(cohortId string) *CohortLoaderTask {
 	cl.lockJobs.Lock()
 	defer cl.lockJobs.Unlock()
 
 	task, ok := cl.jobs.Load(cohortId)
 	if !ok {
-		task = cl.executor.Get().(*CohortLoaderTask)
+		// Tasks aren't reused, as callers may still be waiting on a finished task.
+		task = &CohortLoaderTask{}
 		task.(*CohortLoaderTask).init(cl, cohortId)
 		cl.jobs.Store(cohortId, task)
-		go task.(*CohortLoaderTask).run()
+		cl.goroutines.run(task.(*CohortLoaderTask).run)
 	}
 
 	return task.(*CohortLoaderTask)
 }
 
 func (cl *cohortLoader) removeJob(cohortId string) {
+	cl.lockJobs.Lock()
+	defer cl.lockJobs.Unlock()
 	cl.jobs.Delete(cohortId)
 }
 
@@ -67,8 +89,6 @@ func (task *CohortLoaderTask) init(loader *cohortLoader, cohortId string) {
 }
 
 func (task *CohortLoaderTask) run() {
-	defer task.loader.executor.Put(task)
-
 	cohort, err := task.loader.downloadCohort(task.cohortId)
 	if err != nil {
 		task.err = err
@@ -90,28 +110,82 @@ func (task *CohortLoaderTask) wait() error {
 
 func (cl *cohortLoader) downloadCohort(cohortID string) (*Cohort, error) {
 	cohort := cl.cohortStorage.getCohort(cohortID)
+	return cl.getCohort(cohortID, cohort)
+}
+
+// getCohort downloads the cohort, canceling the download when cancel is called if the cohort
+// download API supports it.
+func (cl *cohortLoader) getCohort(cohortID string, cohort *Cohort) (*Cohort, error) {
+	return cl.getCohortWithContext(cl.context(), cohortID, cohort)
+}
+
+// getCohortWithContext downloads the cohort, giving up when ctx is done if the cohort download API
+// supports it.
+func (cl *cohortLoader) getCohortWithContext(ctx context.Context, cohortID string, cohort *Cohort) (*Cohort, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if api, ok := cl.cohortDownloadApi.(contextCohortDownloadApi); ok {
+		return api.getCohortWithContext(ctx, cohortID, cohort)
+	}
 	return cl.cohortDownloadApi.getCohort(cohortID, cohort)
 }
 
+func (cl *cohortLoader) context() context.Context {
+	cl.ctxLock.Lock()
+	defer cl.ctxLock.Unlock()
+	if cl.ctx == nil {
+		cl.ctx, cl.cancelCtx = context.WithCancel(context.Background())
+	}
+	return cl.ctx
+}
+
+// cancel cancels the cohort downloads in progress, which fail with the context's error. Later
+// downloads are not canceled.
+func (cl *cohortLoader) cancel() {
+	cl.ctxLock.Lock()
+	defer cl.ctxLock.Unlock()
+	if cl.cancelCtx != nil {
+		cl.cancelCtx()
+	}
+	cl.ctx = nil
+	cl.cancelCtx = nil
+}
+
+// refreshCohort downloads the whole cohort, rather than only changes since the stored cohort was
+// last modified, and stores it. The download gives up when ctx is done, and nothing is stored.
+func (cl *cohortLoader) refreshCohort(ctx context.Context, cohortId string) error {
+	cohort, err := cl.getCohortWithContext(ctx, cohortId, nil)
+	if err != nil {
+		return err
+	}
+	if cohort != nil {
+		cl.cohortStorage.putCohort(cohort)
+	}
+	cl.checkCohortsLoaded()
+	return nil
+}
+
 func (cl *cohortLoader) downloadCohorts(cohortIDs map[string]struct{}) {
 	var wg sync.WaitGroup
 	errorChan := make(chan error, len(cohortIDs))
 
 	for cohortID := range cohortIDs {
 		wg.Add(1)
-		go func(id string) {
+		id := cohortID
+		cl.goroutines.run(func() {
 			defer wg.Done()
 			task := cl.loadCohort(id)
 			if err := task.wait(); err != nil {
 				errorChan <- fmt.Errorf("cohort %s: %v", id, err)
 			}
-		}(cohortID)
+		})
 	}
 
-	go func() {
+	cl.goroutines.run(func() {
 		wg.Wait()
 		close(errorChan)
-	}()
+	})
 
 	var errorMessages []string
 	for err := range errorChan {
@@ -122,4 +196,36 @@ func (cl *cohortLoader) downloadCohorts(cohortIDs map[string]struct{}) {
 	if len(errorMessages) > 0 {
 		cl.log.Error("One or more cohorts failed to download:\n%s", strings.Join(errorMessages, "\n"))
 	}
+	cl.checkCohortsLoaded()
+}
+
+func (cl *cohortLoader) onCohortsLoaded(fn func()) {
+	cl.listenersLock.Lock()
+	defer cl.listenersLock.Unlock()
+	cl.loadedListeners = append(cl.loadedListeners, fn)
+}
+
+// checkCohortsLoaded calls the cohorts loaded listeners if all cohorts referenced by the flag
+// configs in storage are loaded, and they were not already called for the same cohorts.
+func (cl *cohortLoader) checkCohortsLoaded() {
+	if cl.flagConfigStorage == nil || cl.flagConfigStorage.getLastUpdated().IsZero() {
+		return
+	}
+	referencedCohortIDs := getAllCohortIDsFromFlags(cl.flagConfigStorage.getFlagConfigsArray())
+	if len(difference(referencedCohortIDs, cl.cohortStorage.getCohortIds())) != 0 {
+		return
+	}
+	cl.listenersLock.Lock()
+	if cl.loadedCohortIDs != nil && len(difference(referencedCohortIDs, cl.loadedCohortIDs)) == 0 &&
+		len(difference(cl.loadedCohortIDs, referencedCohortIDs)) == 0 {
+		cl.listenersLock.Unlock()
+		return
+	}
+	cl.loadedCohortIDs = referencedCohortIDs
+	listeners := append([]func(){}, cl.loadedListeners...)
+	cl.listenersLock.Unlock()
+	cl.log.Debug("Loaded all %d referenced cohorts", len(referencedCohortIDs))
+	for _, listener := range listeners {
+		listener()
+	}
 }
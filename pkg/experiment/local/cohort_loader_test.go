@@ -1,8 +1,14 @@
 package local
 
 import (
+	"context"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -118,3 +124,75 @@ func TestLoadDownloadFailureThrows(t *testing.T) {
 		t.Errorf("Expected cohorts for user '1': %+v, but got: %+v", expectedCohorts, actualCohorts)
 	}
 }
+
+func TestLoadCohortConcurrentlyDownloadsOnce(t *testing.T) {
+	var downloads int32
+	release := make(chan struct{})
+	api := &mockCohortDownloadApi{getCohortFunc: func(cohortID string, cohort *Cohort) (*Cohort, error) {
+		atomic.AddInt32(&downloads, 1)
+		<-release
+		return &Cohort{Id: cohortID, Size: 1, MemberIds: []string{"1"}, GroupType: userGroupType}, nil
+	}}
+	storage := newInMemoryCohortStorage()
+	loader := newCohortLoader(api, storage, false)
+
+	// Hold the download until all goroutines have requested the cohort.
+	var requested, done sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		requested.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			task := loader.loadCohort("a")
+			requested.Done()
+			errs <- task.wait()
+		}()
+	}
+	requested.Wait()
+	close(release)
+	done.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("wait() returned error: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("Expected 1 download, got %d", n)
+	}
+	if storage.getCohort("a") == nil {
+		t.Errorf("Cohort a not stored")
+	}
+}
+
+func TestCancelCohortDownloads(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	api := newDirectCohortDownloadApi("api", "secret", 15000, 0, server.URL, time.Minute, false)
+	loader := newCohortLoader(api, newInMemoryCohortStorage(), false)
+
+	task := loader.loadCohort("1234")
+	<-requested
+	loader.cancel()
+	done := make(chan error)
+	go func() { done <- task.wait() }()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the download to be canceled")
+	}
+
+	// Downloads after cancel are not canceled.
+	if loader.context().Err() != nil {
+		t.Fatalf("Expected a new context after cancel")
+	}
+}
@@ -1,6 +1,7 @@
 package local
 
 import (
+	"sort"
 	"sync"
 )
 
@@ -12,6 +13,8 @@ type cohortStorage interface {
 	putCohort(cohort *Cohort)
 	deleteCohort(groupType, cohortID string)
 	getCohortIds() map[string]struct{}
+	// getCohortsWithMembers returns the stored cohorts, keyed by cohort ID, with their member IDs.
+	getCohortsWithMembers() map[string]*Cohort
 }
 
 type inMemoryCohortStorage struct {
@@ -95,6 +98,10 @@ func (s *inMemoryCohortStorage) deleteCohort(groupType, cohortID string) {
 	delete(s.cohortStore, cohortID)
 }
 
+func (s *inMemoryCohortStorage) getCohortsWithMembers() map[string]*Cohort {
+	return s.getCohorts()
+}
+
 func (s *inMemoryCohortStorage) getCohortIds() map[string]struct{} {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
@@ -104,3 +111,150 @@ func (s *inMemoryCohortStorage) getCohortIds() map[string]struct{} {
 	}
 	return cohortIds
 }
+
+// memberIndexCohortStorage indexes cohorts by member, storing the IDs of the cohorts each member
+// is in rather than the members of each cohort. Each member ID is stored once however many cohorts
+// it's in, and looking up a member's cohorts doesn't scan cohort members, so it uses less memory
+// and is faster when many large cohorts overlap. Stored cohorts don't include their MemberIds.
+// Putting and deleting cohorts scans the index of the cohort's group type.
+type memberIndexCohortStorage struct {
+	lock sync.RWMutex
+	// memberCohorts maps group type to member ID to the IDs of the cohorts the member is in.
+	memberCohorts map[string]map[string][]string
+	cohortStore   map[string]*Cohort
+}
+
+func newMemberIndexCohortStorage() *memberIndexCohortStorage {
+	return &memberIndexCohortStorage{
+		memberCohorts: make(map[string]map[string][]string),
+		cohortStore:   make(map[string]*Cohort),
+	}
+}
+
+func (s *memberIndexCohortStorage) getCohort(cohortID string) *Cohort {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.cohortStore[cohortID]
+}
+
+func (s *memberIndexCohortStorage) getCohorts() map[string]*Cohort {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	cohorts := make(map[string]*Cohort)
+	for id, cohort := range s.cohortStore {
+		cohorts[id] = cohort
+	}
+	return cohorts
+}
+
+func (s *memberIndexCohortStorage) getCohortsForUser(userID string, cohortIDs map[string]struct{}) map[string]struct{} {
+	return s.getCohortsForGroup(userGroupType, userID, cohortIDs)
+}
+
+func (s *memberIndexCohortStorage) getCohortsForGroup(groupType, groupName string, cohortIDs map[string]struct{}) map[string]struct{} {
+	result := make(map[string]struct{})
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, cohortID := range s.memberCohorts[groupType][groupName] {
+		if _, ok := cohortIDs[cohortID]; ok {
+			result[cohortID] = struct{}{}
+		}
+	}
+	return result
+}
+
+func (s *memberIndexCohortStorage) putCohort(cohort *Cohort) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if existing, ok := s.cohortStore[cohort.Id]; ok {
+		s.removeFromIndex(existing.GroupType, existing.Id)
+	}
+	members := s.memberCohorts[cohort.GroupType]
+	if members == nil {
+		members = make(map[string][]string)
+		s.memberCohorts[cohort.GroupType] = members
+	}
+	for _, memberID := range cohort.MemberIds {
+		// The cohort's existing entries were removed, so a member listed more than once already
+		// ends with the cohort.
+		memberCohortIDs := members[memberID]
+		if len(memberCohortIDs) > 0 && memberCohortIDs[len(memberCohortIDs)-1] == cohort.Id {
+			continue
+		}
+		members[memberID] = append(memberCohortIDs, cohort.Id)
+	}
+	s.cohortStore[cohort.Id] = &Cohort{
+		Id:           cohort.Id,
+		LastModified: cohort.LastModified,
+		Size:         cohort.Size,
+		GroupType:    cohort.GroupType,
+	}
+}
+
+func (s *memberIndexCohortStorage) deleteCohort(groupType, cohortID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.removeFromIndex(groupType, cohortID)
+	delete(s.cohortStore, cohortID)
+}
+
+func (s *memberIndexCohortStorage) removeFromIndex(groupType, cohortID string) {
+	members := s.memberCohorts[groupType]
+	for memberID, memberCohortIDs := range members {
+		// Remove every occurrence, in case the cohort was indexed with duplicate members.
+		kept := memberCohortIDs[:0]
+		for _, id := range memberCohortIDs {
+			if id != cohortID {
+				kept = append(kept, id)
+			}
+		}
+		memberCohortIDs = kept
+		if len(memberCohortIDs) == 0 {
+			delete(members, memberID)
+		} else {
+			members[memberID] = memberCohortIDs
+		}
+	}
+	if len(members) == 0 {
+		delete(s.memberCohorts, groupType)
+	}
+}
+
+func (s *memberIndexCohortStorage) getCohortIds() map[string]struct{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	cohortIds := make(map[string]struct{})
+	for id := range s.cohortStore {
+		cohortIds[id] = struct{}{}
+	}
+	return cohortIds
+}
+
+// getCohortsWithMembers rebuilds the member IDs of the cohorts from the index, in sorted order.
+func (s *memberIndexCohortStorage) getCohortsWithMembers() map[string]*Cohort {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	cohorts := make(map[string]*Cohort, len(s.cohortStore))
+	for id, cohort := range s.cohortStore {
+		cohorts[id] = &Cohort{
+			Id:           cohort.Id,
+			LastModified: cohort.LastModified,
+			Size:         cohort.Size,
+			MemberIds:    []string{},
+			GroupType:    cohort.GroupType,
+		}
+	}
+	for groupType, members := range s.memberCohorts {
+		for memberID, cohortIDs := range members {
+			for _, cohortID := range cohortIDs {
+				if cohort := cohorts[cohortID]; cohort != nil && cohort.GroupType == groupType {
+					cohort.MemberIds = append(cohort.MemberIds, memberID)
+				}
+			}
+		}
+	}
+	for _, cohort := range cohorts {
+		sort.Strings(cohort.MemberIds)
+	}
+	return cohorts
+}
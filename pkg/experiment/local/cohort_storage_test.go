@@ -0,0 +1,139 @@
+package local
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cohortIDSet(ids ...string) map[string]struct{} {
+	set := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+func TestCohortStorage(t *testing.T) {
+	storages := map[string]func() cohortStorage{
+		"in memory":    func() cohortStorage { return newInMemoryCohortStorage() },
+		"member index": func() cohortStorage { return newMemberIndexCohortStorage() },
+	}
+	for name, newStorage := range storages {
+		t.Run(name, func(t *testing.T) {
+			s := newStorage()
+			s.putCohort(&Cohort{Id: "a", GroupType: userGroupType, LastModified: 1, MemberIds: []string{"u1", "u2"}})
+			s.putCohort(&Cohort{Id: "b", GroupType: userGroupType, MemberIds: []string{"u2", "u3"}})
+			s.putCohort(&Cohort{Id: "c", GroupType: "org", MemberIds: []string{"o1"}})
+
+			all := cohortIDSet("a", "b", "c")
+			assert.Equal(t, cohortIDSet("a"), s.getCohortsForUser("u1", all))
+			assert.Equal(t, cohortIDSet("a", "b"), s.getCohortsForUser("u2", all))
+			assert.Equal(t, cohortIDSet("b"), s.getCohortsForUser("u2", cohortIDSet("b")))
+			assert.Equal(t, cohortIDSet(), s.getCohortsForUser("o1", all))
+			assert.Equal(t, cohortIDSet("c"), s.getCohortsForGroup("org", "o1", all))
+			assert.Equal(t, int64(1), s.getCohort("a").LastModified)
+			assert.Equal(t, all, s.getCohortIds())
+
+			// Replacing a cohort replaces its members.
+			s.putCohort(&Cohort{Id: "a", GroupType: userGroupType, LastModified: 2, MemberIds: []string{"u3"}})
+			assert.Equal(t, cohortIDSet(), s.getCohortsForUser("u1", all))
+			assert.Equal(t, cohortIDSet("a", "b"), s.getCohortsForUser("u3", all))
+
+			s.deleteCohort(userGroupType, "b")
+			assert.Equal(t, cohortIDSet(), s.getCohortsForUser("u2", all))
+			assert.Equal(t, cohortIDSet("a"), s.getCohortsForUser("u3", all))
+			assert.Nil(t, s.getCohort("b"))
+			assert.Equal(t, cohortIDSet("a", "c"), s.getCohortIds())
+		})
+	}
+}
+
+func TestMemberIndexCohortStorageDuplicateMembers(t *testing.T) {
+	s := newMemberIndexCohortStorage()
+	all := cohortIDSet("a", "b")
+	s.putCohort(&Cohort{Id: "b", GroupType: userGroupType, MemberIds: []string{"u1"}})
+	s.putCohort(&Cohort{Id: "a", GroupType: userGroupType, MemberIds: []string{"u1", "u2", "u1"}})
+	assert.Equal(t, []string{"u1", "u2"}, s.getCohortsWithMembers()["a"].MemberIds)
+	assert.Equal(t, cohortIDSet("a", "b"), s.getCohortsForUser("u1", all))
+
+	// Replacing the cohort removes the duplicate member.
+	s.putCohort(&Cohort{Id: "a", GroupType: userGroupType, MemberIds: []string{"u2", "u2"}})
+	assert.Equal(t, cohortIDSet("b"), s.getCohortsForUser("u1", all))
+	assert.Equal(t, []string{"u2"}, s.getCohortsWithMembers()["a"].MemberIds)
+
+	// Deleting the cohort removes every entry of it from the index.
+	s.memberCohorts[userGroupType]["u1"] = []string{"b", "a", "a"}
+	s.deleteCohort(userGroupType, "a")
+	assert.Equal(t, cohortIDSet("b"), s.getCohortsForUser("u1", all))
+	assert.Equal(t, cohortIDSet(), s.getCohortsForUser("u2", all))
+	assert.Equal(t, map[string][]string{"u1": {"b"}}, s.memberCohorts[userGroupType])
+}
+
+// createOverlappingCohorts creates cohorts whose members are drawn from a shared pool of users, so
+// most users are in many cohorts.
+func createOverlappingCohorts(cohortCount, cohortSize, userCount int) []*Cohort {
+	r := rand.New(rand.NewSource(1))
+	cohorts := make([]*Cohort, cohortCount)
+	for i := range cohorts {
+		members := make([]string, cohortSize)
+		for j := range members {
+			// Format each member separately, as when decoding a cohort download.
+			members[j] = fmt.Sprintf("user-%d", r.Intn(userCount))
+		}
+		cohorts[i] = &Cohort{Id: fmt.Sprintf("cohort-%d", i), GroupType: userGroupType, Size: cohortSize, MemberIds: members}
+	}
+	return cohorts
+}
+
+func benchmarkCohortStorageMemory(b *testing.B, newStorage func() cohortStorage) {
+	var storage cohortStorage
+	var total uint64
+	for i := 0; i < b.N; i++ {
+		storage = nil
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		storage = newStorage()
+		// Only what the storage retains of the downloaded cohorts survives the GC below.
+		for _, cohort := range createOverlappingCohorts(200, 10000, 50000) {
+			storage.putCohort(cohort)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		total += after.HeapAlloc - before.HeapAlloc
+	}
+	runtime.KeepAlive(storage)
+	b.ReportMetric(float64(total)/float64(b.N), "heap-bytes/storage")
+}
+
+func BenchmarkInMemoryCohortStorageMemory(b *testing.B) {
+	benchmarkCohortStorageMemory(b, func() cohortStorage { return newInMemoryCohortStorage() })
+}
+
+func BenchmarkMemberIndexCohortStorageMemory(b *testing.B) {
+	benchmarkCohortStorageMemory(b, func() cohortStorage { return newMemberIndexCohortStorage() })
+}
+
+func benchmarkGetCohortsForUser(b *testing.B, storage cohortStorage) {
+	cohortIDs := make(map[string]struct{})
+	for _, cohort := range createOverlappingCohorts(200, 10000, 50000) {
+		storage.putCohort(cohort)
+		cohortIDs[cohort.Id] = struct{}{}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		storage.getCohortsForUser(fmt.Sprintf("user-%d", i%50000), cohortIDs)
+	}
+}
+
+func BenchmarkInMemoryCohortStorageGetCohortsForUser(b *testing.B) {
+	benchmarkGetCohortsForUser(b, newInMemoryCohortStorage())
+}
+
+func BenchmarkMemberIndexCohortStorageGetCohortsForUser(b *testing.B) {
+	benchmarkGetCohortsForUser(b, newMemberIndexCohortStorage())
+}
@@ -1,10 +1,18 @@
 package local
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/amplitude/analytics-go/amplitude"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
 )
 
 const EUFlagServerUrl = "https://flag.lab.eu.amplitude.com"
@@ -18,6 +26,32 @@ const (
 	EUServerZone
 )
 
+// InitialLoadStrategy controls how Client.Start loads the first flag configs.
+type InitialLoadStrategy int
+
+const (
+	// StreamWithPollFallback connects to the stream if StreamUpdates is enabled, and polls if the
+	// stream fails to connect or StreamUpdates is disabled. Start returns once the first flag configs
+	// are loaded. Cold start latency is that of the stream connection, plus the poll request if the
+	// stream fails, up to StreamFlagConnTimeout.
+	StreamWithPollFallback InitialLoadStrategy = iota
+	// PollOnceThenStream fetches the flag configs with a single poll request, then connects to the
+	// stream as with StreamWithPollFallback. Cold start latency is that of both the poll request and
+	// the stream connection, but the first flag configs come from the flag config API even if the
+	// stream is degraded, and are equally up to date.
+	PollOnceThenStream
+	// StreamOnly loads flag configs from the stream only, without falling back to polling. Start
+	// fails if the stream fails to connect, and while the stream reconnects the flag configs may be
+	// stale. Requires StreamUpdates.
+	StreamOnly
+	// BootstrapThenStream loads the flag configs in Config.BootstrapFlagConfigs and returns from
+	// Start immediately, then loads up-to-date flag configs in the background as with
+	// StreamWithPollFallback, retrying until they load. Cold start latency is minimal, but users are
+	// evaluated against the bootstrap flag configs, and without their cohorts, until the first update.
+	// The bootstrap flag configs count as loaded for IsReady and MaxConfigStaleness.
+	BootstrapThenStream
+)
+
 type Config struct {
 	Debug                          bool
 	ServerUrl                      string
@@ -29,11 +63,179 @@ type Config struct {
 	StreamFlagConnTimeout          time.Duration
 	AssignmentConfig               *AssignmentConfig
 	CohortSyncConfig               *CohortSyncConfig
+	// StreamLenientInitParse skips initial stream messages which are not a valid flag config
+	// snapshot, e.g. empty keepalive messages, and waits up to StreamFlagConnTimeout for a valid
+	// snapshot, rather than failing to connect on the first invalid message.
+	StreamLenientInitParse bool
+	// StreamMaxReconnectJitter is the maximum random delay added to StreamReconnectInterval, which
+	// spreads the reconnects of streams which connected together. Zero uses the default of 5
+	// seconds, and a negative value reconnects exactly on the interval.
+	StreamMaxReconnectJitter time.Duration
+	// StreamKeepaliveTimeout is the time without a message or keepalive from the stream after which
+	// the connection is considered lost. It should be longer than the server's keepalive interval.
+	// StreamFlagConnTimeout is the timeout for connecting and receiving the initial flag configs.
+	// Zero or a negative value uses the default of 17 seconds.
+	StreamKeepaliveTimeout time.Duration
+	// StreamReconnectInterval is the time after which the stream connection is replaced with a new
+	// connection, plus a random jitter of up to StreamMaxReconnectJitter. Zero or a negative value
+	// uses the default of 15 minutes.
+	StreamReconnectInterval time.Duration
+	// StreamConnectRetries is the number of times the initial stream connection is retried if it
+	// fails with a timeout or connection error, waiting 500 milliseconds before the first retry and
+	// doubling the wait for each further retry, up to 30 seconds. Authorization failures, and
+	// failures whose retry is delayed longer than 30 seconds, e.g. by a Retry-After header, are not
+	// retried. See RetryClassifier. Zero fails on the first error, e.g. to fall back to polling sooner.
+	StreamConnectRetries int
+	// MaxConfigStaleness is the maximum time since the last successful flag config update before
+	// the client is no longer considered ready. Zero disables the staleness check. When streaming,
+	// this should be longer than StreamReconnectInterval.
+	MaxConfigStaleness time.Duration
+	// FailEvaluationOnStaleConfig makes evaluation return ErrStaleFlagConfigs instead of evaluating
+	// stale flag configs. Has no effect unless MaxConfigStaleness is set.
+	FailEvaluationOnStaleConfig bool
+	// CohortMembershipResolver, if set, resolves which of the given user cohorts the user is a member of,
+	// replacing the lookup in downloaded cohorts. Group cohorts are unaffected.
+	CohortMembershipResolver func(userId string, cohortIds map[string]struct{}) map[string]struct{}
+	// UserResolver resolves a token, e.g. a JWT, to the user to evaluate. Used by EvaluateToken.
+	UserResolver func(token string) (*experiment.User, error)
+	// MultiValueGroups evaluates all group names of each group type rather than only the first. Cohorts
+	// are resolved for every group name, and cohort targeting matches if any of the user's groups of
+	// the type is a member. Bucketing and group properties still use the first group name.
+	MultiValueGroups bool
+	// MaxFlagConfigBytes is the maximum size of a flag config response. Larger responses fail rather
+	// than being read into memory. Zero uses the default of 64 MiB, and a negative value disables the limit.
+	MaxFlagConfigBytes int64
+	// FlagsApiVersion is the version of the flags endpoint, i.e. sdk/v<version>/flags, which flag
+	// configs are polled from, e.g. to opt into a new version during a migration, or out of it if it
+	// misbehaves. Defaults to 2, which is currently the only supported version, as version 1 serves
+	// the deprecated flag format. The stream and FlagsV2 are not affected.
+	FlagsApiVersion int
+	// EvaluationConcurrency is the maximum number of goroutines used to evaluate flags which do not
+	// depend on each other. Values less than 2 evaluate all flags on the calling goroutine, which is
+	// faster unless a very large number of flags is evaluated at once.
+	EvaluationConcurrency int
+	// StickyBucketStore, if set, keeps users in the variant they were first assigned for each
+	// experiment, even if the experiment's allocation changes. Stored variants take precedence over
+	// targeting, so users stay in their variant until it is removed from the flag or the store. Flags
+	// which depend on an experiment see its evaluated rather than stored variant. Assignment events
+	// are tracked with the stored variant.
+	StickyBucketStore StickyBucketStore
+	// LogThrottleInterval is the minimum time between logs of the same flag config fetch or stream
+	// error. Repeats within the interval are counted and the count is logged with the next occurrence.
+	// Zero uses the default of 30 seconds, and a negative value logs every error.
+	LogThrottleInterval time.Duration
+	// InitialLoadStrategy controls how Start loads the first flag configs. Defaults to
+	// StreamWithPollFallback.
+	InitialLoadStrategy InitialLoadStrategy
+	// BootstrapFlagConfigs are the flag configs loaded on Start with the BootstrapThenStream
+	// strategy, in BootstrapFlagConfigsFormat.
+	BootstrapFlagConfigs string
+	// BootstrapFlagConfigsFormat is the format of BootstrapFlagConfigs. Defaults to
+	// FlagConfigFormatJSON, a JSON array or the JSON object returned by Client.FlagsV2.
+	BootstrapFlagConfigsFormat FlagConfigFormat
+	// FlagConfigCacheFile, if set, is a file to which the flag configs, with their version and a hash
+	// of the deployment key, are saved after each successful update. If the file exists on Start and
+	// was saved with the deployment key, its flag configs are loaded and Start returns without
+	// waiting for flag configs from the network, which are then loaded in the background, so the
+	// client can start while Amplitude is unreachable. The cached flag configs count as last updated
+	// when they were saved, e.g. for MaxConfigStaleness. A cache file takes precedence over
+	// InitialLoadStrategy's initial load.
+	FlagConfigCacheFile string
+	// ControlPlaneRetryBudget, if set, bounds the retries of flag config polling and streaming and of
+	// cohort downloads, which otherwise retry independently. See RetryBudgetConfig.
+	ControlPlaneRetryBudget *RetryBudgetConfig
+	// BucketingSeedOverride, if set, replaces the salt of every flag's bucketing, so users are
+	// bucketed the same way across runs regardless of the flag configs' salts. For testing only, e.g.
+	// reproducible load tests; overriding the salt changes which variant users are assigned.
+	BucketingSeedOverride string
+	// CaseInsensitivePropertyMatch compares string property values with targeting values
+	// case-insensitively, e.g. a country of "us" matches "US". Only the is, is not, and set
+	// operators are affected; contains already ignores case, and other operators are unchanged.
+	CaseInsensitivePropertyMatch bool
+	// TLSConfig, if set, configures TLS for all connections to Amplitude, i.e. flag config requests,
+	// the flag config stream, and cohort downloads, e.g. to present a client certificate to a proxy
+	// which requires mutual TLS, or to trust a custom certificate authority.
+	TLSConfig *tls.Config
+	// DialContext, if set, opens all connections to Amplitude, i.e. flag config requests, the flag
+	// config stream, and cohort downloads, e.g. to pin the hosts to specific addresses or to resolve
+	// them with a custom resolver. The stream's connection timeout still applies to its connections.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// CohortFilePath, if set, is a file of user cohort members loaded into cohort storage on
+	// initialization, e.g. to reproduce cohort targeting locally without cohort download credentials.
+	// Files with a .json extension contain a JSON object of member user IDs keyed by cohort ID, and
+	// other files contain CSV rows of a cohort ID and a member user ID, without a header row. Cohorts
+	// downloaded with CohortSyncConfig replace loaded cohorts with the same ID, and like downloaded
+	// cohorts, loaded cohorts which the flag configs don't target are removed on flag config updates.
+	CohortFilePath string
+	// FallbackIdentityProperty, if set, is the name of a user property, e.g. an external ID, which
+	// identifies users who have neither a user ID nor a device ID. The identity is resolved in order
+	// of precedence: the user ID or device ID if either is set, otherwise the property's value if it
+	// is a non-empty string, otherwise none, and the user is evaluated without an identity, as
+	// before. Users identified by the property are evaluated with its value as both their user ID and
+	// device ID, so it buckets them whichever ID flags bucket by, and resolves their user cohorts.
+	// Their sticky buckets and assignment events use the same identity, while the users returned by
+	// EvaluateV2WithUser and passed to listeners keep their own, empty, IDs. User.BucketingKey, if
+	// set, still replaces the identity for bucketing.
+	FallbackIdentityProperty string
+	// EmptyKeysMeansNone evaluates no flags when evaluating an empty list of flag keys, rather than
+	// all flags, to catch a list of flag keys which is empty by mistake. All flags may still be
+	// evaluated by listing their keys.
+	EmptyKeysMeansNone bool
+	// RecordFlagAccess counts the evaluations of each flag, which Client.AccessedFlagKeys returns, e.g.
+	// to find flags which are no longer evaluated.
+	RecordFlagAccess bool
+	// StrictUserValidation validates users with ValidateUser before evaluating them, and returns the
+	// *UserValidationError rather than evaluating invalid users.
+	StrictUserValidation bool
+	// FlagConfigQueryParams are added to the query of flag config requests, i.e. polling and FlagsV2,
+	// e.g. to negotiate features with the flag config API. They replace the SDK's query parameters of
+	// the same name.
+	FlagConfigQueryParams map[string]string
+	// StreamQueryParams are added to the query of flag config stream connections, replacing the SDK's
+	// query parameters of the same name.
+	StreamQueryParams map[string]string
+	// Metrics receives measurements of evaluations, flag config fetches, cohort lookups, and the stream.
+	Metrics Metrics
+	// PayloadDecoder, if set, transforms the payload of each evaluated variant, e.g. to decode,
+	// decrypt, or validate it. If it returns an error, the raw payload is returned and the error is
+	// logged. It is not called for variants without a payload.
+	PayloadDecoder func(raw interface{}) (interface{}, error)
+	// RetryClassifier decides whether and when failed flag config polls and stream connections are
+	// retried, given the unsuccessful response, if any, and the error. A failed poll is retried up to
+	// twice, and a failed stream connection up to StreamConnectRetries times. Polls and connections
+	// which are not retried fail, and are attempted again on the next poll or stream reconnect. A poll
+	// retry which would wait longer than FlagConfigPollerInterval instead skips polls until the delay
+	// has passed. Defaults to DefaultRetryClassifier.
+	RetryClassifier func(resp *http.Response, err error) RetryDecision
 }
 
 type AssignmentConfig struct {
 	amplitude.Config
 	CacheCapacity int
+	// InsertIDHash hashes the canonicalized assignment into the event insert ID used for deduplication.
+	// Defaults to the 32 bit hash used by the other server SDKs. See FNV1aHash for a 64 bit alternative.
+	InsertIDHash func(canonical string) uint64
+	// Client is an existing amplitude client to track assignment events with. If set, it is used
+	// instead of constructing a new client from the embedded amplitude.Config. Client.Close flushes
+	// but doesn't shut down an existing client.
+	Client *amplitude.Client
+	// OnTrackError is called when an assignment event fails to be sent, after the amplitude client
+	// has given up retrying. It is not called when Client is set, since the delivery results are
+	// only reported to the ExecuteCallback of the client's own config.
+	OnTrackError func(assignment *Assignment, err error)
+	// DisableUserProperties tracks assignment events with event properties only, without setting and
+	// unsetting the "[Experiment] <flag key>" user properties, to limit user property churn when
+	// many flags are evaluated.
+	DisableUserProperties bool
+	// TestSink, if set, receives the assignment and exposure events instead of an amplitude client,
+	// so tests can assert on the tracked events without sending them. It takes precedence over
+	// Client and the embedded amplitude.Config.
+	TestSink func(event amplitude.Event)
+	// EventType is the event type of assignment events. Empty uses "[Experiment] Assignment".
+	EventType string
+	// PropertyPrefix is prepended to the flag key to name the user property set to the assigned
+	// variant. Empty uses "[Experiment] ", i.e. "[Experiment] <flag key>".
+	PropertyPrefix string
 }
 
 type CohortSyncConfig struct {
@@ -42,6 +244,36 @@ type CohortSyncConfig struct {
 	MaxCohortSize         int
 	CohortPollingInterval time.Duration
 	CohortServerUrl       string
+	// RequestTimeout is the timeout for each cohort download request, including reading the response.
+	RequestTimeout time.Duration
+	// MaxCohortBytes is the maximum size of a cohort download response. Larger responses fail rather
+	// than being read into memory. Zero disables the limit, leaving cohorts bounded by MaxCohortSize.
+	MaxCohortBytes int64
+	// UpdateGracePeriod is the maximum time a flag config update waits for newly referenced cohorts
+	// to download before it is applied. Cohorts which are still downloading are added to storage
+	// when they complete. Zero waits until all downloads complete or fail.
+	UpdateGracePeriod time.Duration
+	// IndexCohortsByMember stores downloaded cohorts indexed by member, i.e. as the cohorts each user
+	// or group is in, rather than as the members of each cohort. This uses less memory and makes
+	// evaluation faster when many large cohorts share members, but makes cohort updates slower.
+	IndexCohortsByMember bool
+}
+
+// RetryBudgetConfig configures a retry budget shared by all requests to Amplitude. The budget holds
+// up to MaxRetries retries, and one retry is regained every RefillInterval, so after a burst of
+// MaxRetries retries, at most one retry is made per RefillInterval across all operations. When the
+// budget is exhausted, cohort downloads are not retried until the next cohort poll, and flag config
+// updaters delay their retries until the budget has refilled.
+type RetryBudgetConfig struct {
+	// MaxRetries is the capacity of the budget. Defaults to 10.
+	MaxRetries int
+	// RefillInterval is the time to regain one retry. Defaults to 10 seconds.
+	RefillInterval time.Duration
+}
+
+var DefaultRetryBudgetConfig = &RetryBudgetConfig{
+	MaxRetries:     10,
+	RefillInterval: 10 * time.Second,
 }
 
 var DefaultConfig = &Config{
@@ -53,6 +285,13 @@ var DefaultConfig = &Config{
 	StreamUpdates:                  false,
 	StreamServerUrl:                "https://stream.lab.amplitude.com",
 	StreamFlagConnTimeout:          1500 * time.Millisecond,
+	StreamMaxReconnectJitter:       5 * time.Second,
+	StreamKeepaliveTimeout:         17 * time.Second,
+	StreamReconnectInterval:        15 * time.Minute,
+	MaxFlagConfigBytes:             64 << 20,
+	FlagsApiVersion:                flagsApiVersion,
+	LogThrottleInterval:            30 * time.Second,
+	RetryClassifier:                DefaultRetryClassifier,
 }
 
 var DefaultAssignmentConfig = &AssignmentConfig{
@@ -63,6 +302,7 @@ var DefaultCohortSyncConfig = &CohortSyncConfig{
 	MaxCohortSize:         math.MaxInt32,
 	CohortPollingInterval: 60 * time.Second,
 	CohortServerUrl:       "https://cohort-v2.lab.amplitude.com",
+	RequestTimeout:        60 * time.Second,
 }
 
 func fillConfigDefaults(c *Config) *Config {
@@ -86,12 +326,39 @@ func fillConfigDefaults(c *Config) *Config {
 	if c.FlagConfigPollerInterval == 0 {
 		c.FlagConfigPollerInterval = DefaultConfig.FlagConfigPollerInterval
 	}
+	if c.MaxFlagConfigBytes == 0 {
+		c.MaxFlagConfigBytes = DefaultConfig.MaxFlagConfigBytes
+	}
+	if c.StreamMaxReconnectJitter == 0 {
+		c.StreamMaxReconnectJitter = DefaultConfig.StreamMaxReconnectJitter
+	}
+	if c.StreamKeepaliveTimeout <= 0 {
+		c.StreamKeepaliveTimeout = DefaultConfig.StreamKeepaliveTimeout
+	}
+	if c.StreamReconnectInterval <= 0 {
+		c.StreamReconnectInterval = DefaultConfig.StreamReconnectInterval
+	}
+	if c.LogThrottleInterval == 0 {
+		c.LogThrottleInterval = DefaultConfig.LogThrottleInterval
+	}
+	if c.FlagsApiVersion == 0 {
+		c.FlagsApiVersion = DefaultConfig.FlagsApiVersion
+	}
+	if c.RetryClassifier == nil {
+		c.RetryClassifier = DefaultConfig.RetryClassifier
+	}
 	if c.FlagConfigPollerRequestTimeout == 0 {
 		c.FlagConfigPollerRequestTimeout = DefaultConfig.FlagConfigPollerRequestTimeout
 	}
 	if c.StreamFlagConnTimeout == 0 {
 		c.StreamFlagConnTimeout = DefaultConfig.StreamFlagConnTimeout
 	}
+	if c.ControlPlaneRetryBudget != nil && c.ControlPlaneRetryBudget.MaxRetries == 0 {
+		c.ControlPlaneRetryBudget.MaxRetries = DefaultRetryBudgetConfig.MaxRetries
+	}
+	if c.ControlPlaneRetryBudget != nil && c.ControlPlaneRetryBudget.RefillInterval == 0 {
+		c.ControlPlaneRetryBudget.RefillInterval = DefaultRetryBudgetConfig.RefillInterval
+	}
 	if c.AssignmentConfig != nil && c.AssignmentConfig.CacheCapacity == 0 {
 		c.AssignmentConfig.CacheCapacity = DefaultAssignmentConfig.CacheCapacity
 	}
@@ -104,8 +371,16 @@ func fillConfigDefaults(c *Config) *Config {
 		c.CohortSyncConfig.CohortPollingInterval = DefaultCohortSyncConfig.CohortPollingInterval
 	}
 
+	if c.CohortSyncConfig != nil && c.CohortSyncConfig.RequestTimeout == 0 {
+		c.CohortSyncConfig.RequestTimeout = DefaultCohortSyncConfig.RequestTimeout
+	}
+
 	if c.CohortSyncConfig != nil && c.CohortSyncConfig.CohortServerUrl == "" {
-		switch c.ServerZone {
+		zone := c.ServerZone
+		if urlZone, ok := serverUrlZone(c.ServerUrl); ok {
+			zone = urlZone
+		}
+		switch zone {
 		case USServerZone:
 			c.CohortSyncConfig.CohortServerUrl = DefaultCohortSyncConfig.CohortServerUrl
 		case EUServerZone:
@@ -115,3 +390,92 @@ func fillConfigDefaults(c *Config) *Config {
 
 	return c
 }
+
+// serverUrlZone returns the server zone of an Amplitude server URL. The zone of other URLs, e.g. of
+// a proxy, is unknown.
+func serverUrlZone(serverUrl string) (ServerZone, bool) {
+	u, err := url.Parse(serverUrl)
+	if err != nil {
+		return 0, false
+	}
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case strings.HasSuffix(host, ".eu.amplitude.com"):
+		return EUServerZone, true
+	case strings.HasSuffix(host, ".amplitude.com"):
+		return USServerZone, true
+	}
+	return 0, false
+}
+
+// cohortServerZoneMismatch returns whether the cohort server is known to be in a different server
+// zone than the flag server, in which case the cohorts of the flags are downloaded empty.
+func cohortServerZoneMismatch(c *Config) bool {
+	if c.CohortSyncConfig == nil {
+		return false
+	}
+	flagZone, ok := serverUrlZone(c.ServerUrl)
+	if !ok {
+		return false
+	}
+	cohortZone, ok := serverUrlZone(c.CohortSyncConfig.CohortServerUrl)
+	return ok && cohortZone != flagZone
+}
+
+// validateConfig returns a ConfigError for configurations which would otherwise fail silently.
+// The config must have its defaults filled.
+func validateConfig(c *Config) error {
+	if err := validateUrl("ServerUrl", c.ServerUrl); err != nil {
+		return err
+	}
+	if c.StreamUpdates {
+		if c.StreamServerUrl == "" {
+			return &ConfigError{Message: "StreamUpdates is enabled without a StreamServerUrl, which must be set when ServerUrl is set"}
+		}
+		if err := validateUrl("StreamServerUrl", c.StreamServerUrl); err != nil {
+			return err
+		}
+	}
+	if c.FlagConfigPollerInterval < 0 || c.FlagConfigPollerRequestTimeout < 0 || c.StreamFlagConnTimeout < 0 {
+		return &ConfigError{Message: "FlagConfigPollerInterval, FlagConfigPollerRequestTimeout, and StreamFlagConnTimeout must not be negative"}
+	}
+	if !supportedFlagsApiVersions[c.FlagsApiVersion] {
+		return &ConfigError{Message: fmt.Sprintf("FlagsApiVersion %d is not supported", c.FlagsApiVersion)}
+	}
+	if c.FailEvaluationOnStaleConfig && c.MaxConfigStaleness <= 0 {
+		return &ConfigError{Message: "FailEvaluationOnStaleConfig has no effect without MaxConfigStaleness"}
+	}
+	if c.InitialLoadStrategy == StreamOnly && !c.StreamUpdates {
+		return &ConfigError{Message: "InitialLoadStrategy StreamOnly requires StreamUpdates"}
+	}
+	if c.InitialLoadStrategy == BootstrapThenStream {
+		if _, err := parseFlagConfigs(c.BootstrapFlagConfigs, c.BootstrapFlagConfigsFormat); err != nil {
+			return &ConfigError{Message: "InitialLoadStrategy BootstrapThenStream requires valid BootstrapFlagConfigs: " + err.Error()}
+		}
+	}
+	if c.AssignmentConfig != nil && c.AssignmentConfig.Client == nil && c.AssignmentConfig.TestSink == nil && c.AssignmentConfig.APIKey == "" {
+		return &ConfigError{Message: "AssignmentConfig requires an APIKey, Client, or TestSink, otherwise assignments are not tracked"}
+	}
+	if c.CohortFilePath != "" {
+		if _, err := loadCohortFile(c.CohortFilePath); err != nil {
+			return &ConfigError{Message: "CohortFilePath could not be loaded: " + err.Error()}
+		}
+	}
+	if c.CohortSyncConfig != nil {
+		if c.CohortSyncConfig.ApiKey == "" || c.CohortSyncConfig.SecretKey == "" {
+			return &ConfigError{Message: "CohortSyncConfig requires an ApiKey and SecretKey to download cohorts"}
+		}
+		if err := validateUrl("CohortSyncConfig.CohortServerUrl", c.CohortSyncConfig.CohortServerUrl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateUrl(name, value string) error {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return &ConfigError{Message: fmt.Sprintf("%s %q is not an absolute URL", name, value)}
+	}
+	return nil
+}
@@ -3,6 +3,8 @@ package local
 import (
 	"testing"
 	"time"
+
+	"github.com/amplitude/analytics-go/amplitude"
 )
 
 func TestFillConfigDefaults_ServerZoneAndServerUrl(t *testing.T) {
@@ -105,6 +107,23 @@ func TestFillConfigDefaults_CohortSyncConfig(t *testing.T) {
 			},
 			expectedUrl: "https://custom-cohort.url/",
 		},
+		{
+			name: "CohortSyncConfig with EU ServerUrl",
+			input: &Config{
+				ServerUrl:        EUFlagServerUrl,
+				CohortSyncConfig: &CohortSyncConfig{},
+			},
+			expectedUrl: EUCohortSyncUrl,
+		},
+		{
+			name: "CohortSyncConfig with proxy ServerUrl",
+			input: &Config{
+				ServerZone:       EUServerZone,
+				ServerUrl:        "https://proxy.example.com",
+				CohortSyncConfig: &CohortSyncConfig{},
+			},
+			expectedUrl: EUCohortSyncUrl,
+		},
 	}
 
 	for _, tt := range tests {
@@ -126,6 +145,48 @@ func TestFillConfigDefaults_CohortSyncConfig(t *testing.T) {
 	}
 }
 
+func TestCohortServerZoneMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    *Config
+		mismatch bool
+	}{
+		{
+			name:     "Nil CohortSyncConfig",
+			input:    &Config{ServerUrl: EUFlagServerUrl},
+			mismatch: false,
+		},
+		{
+			name:     "Same region",
+			input:    &Config{ServerUrl: EUFlagServerUrl, CohortSyncConfig: &CohortSyncConfig{CohortServerUrl: EUCohortSyncUrl}},
+			mismatch: false,
+		},
+		{
+			name:     "EU flags and US cohorts",
+			input:    &Config{ServerUrl: EUFlagServerUrl, CohortSyncConfig: &CohortSyncConfig{CohortServerUrl: DefaultCohortSyncConfig.CohortServerUrl}},
+			mismatch: true,
+		},
+		{
+			name:     "US flags and EU cohorts",
+			input:    &Config{ServerUrl: DefaultConfig.ServerUrl, CohortSyncConfig: &CohortSyncConfig{CohortServerUrl: EUCohortSyncUrl}},
+			mismatch: true,
+		},
+		{
+			name:     "Proxy cohort server",
+			input:    &Config{ServerUrl: EUFlagServerUrl, CohortSyncConfig: &CohortSyncConfig{CohortServerUrl: "https://proxy.example.com"}},
+			mismatch: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if mismatch := cohortServerZoneMismatch(tt.input); mismatch != tt.mismatch {
+				t.Errorf("expected mismatch %v, got %v", tt.mismatch, mismatch)
+			}
+		})
+	}
+}
+
 func TestFillConfigDefaults_DefaultValues(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -188,3 +249,133 @@ func TestFillConfigDefaults_DefaultValues(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   *Config
+		wantErr bool
+	}{
+		{
+			name:  "Nil config",
+			input: nil,
+		},
+		{
+			name:  "Streaming with default urls",
+			input: &Config{StreamUpdates: true},
+		},
+		{
+			name:    "Streaming with custom ServerUrl and no StreamServerUrl",
+			input:   &Config{StreamUpdates: true, ServerUrl: "https://custom.url/"},
+			wantErr: true,
+		},
+		{
+			name:    "StreamOnly without streaming",
+			input:   &Config{InitialLoadStrategy: StreamOnly},
+			wantErr: true,
+		},
+		{
+			name:    "BootstrapThenStream with invalid bootstrap",
+			input:   &Config{InitialLoadStrategy: BootstrapThenStream, BootstrapFlagConfigs: "not json"},
+			wantErr: true,
+		},
+		{
+			name:  "BootstrapThenStream with bootstrap",
+			input: &Config{InitialLoadStrategy: BootstrapThenStream, BootstrapFlagConfigs: "[]"},
+		},
+		{
+			name:  "BootstrapThenStream with YAML bootstrap",
+			input: &Config{InitialLoadStrategy: BootstrapThenStream, BootstrapFlagConfigs: "- key: flag\n", BootstrapFlagConfigsFormat: FlagConfigFormatYAML},
+		},
+		{
+			name:    "BootstrapThenStream with invalid YAML bootstrap",
+			input:   &Config{InitialLoadStrategy: BootstrapThenStream, BootstrapFlagConfigs: "- key: [flag]\n", BootstrapFlagConfigsFormat: FlagConfigFormatYAML},
+			wantErr: true,
+		},
+		{
+			name:    "Relative ServerUrl",
+			input:   &Config{ServerUrl: "custom.url"},
+			wantErr: true,
+		},
+		{
+			name:    "FailEvaluationOnStaleConfig without MaxConfigStaleness",
+			input:   &Config{FailEvaluationOnStaleConfig: true},
+			wantErr: true,
+		},
+		{
+			name:  "Negative StreamKeepaliveTimeout uses the default",
+			input: &Config{StreamKeepaliveTimeout: -time.Second},
+		},
+		{
+			name:    "Unsupported FlagsApiVersion",
+			input:   &Config{FlagsApiVersion: 1},
+			wantErr: true,
+		},
+		{
+			name:  "FlagsApiVersion 2",
+			input: &Config{FlagsApiVersion: 2},
+		},
+		{
+			name:    "AssignmentConfig without APIKey",
+			input:   &Config{AssignmentConfig: &AssignmentConfig{}},
+			wantErr: true,
+		},
+		{
+			name:  "AssignmentConfig with TestSink",
+			input: &Config{AssignmentConfig: &AssignmentConfig{TestSink: func(amplitude.Event) {}}},
+		},
+		{
+			name:    "CohortSyncConfig without SecretKey",
+			input:   &Config{CohortSyncConfig: &CohortSyncConfig{ApiKey: "api"}},
+			wantErr: true,
+		},
+		{
+			name:  "CohortSyncConfig",
+			input: &Config{CohortSyncConfig: &CohortSyncConfig{ApiKey: "api", SecretKey: "secret"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(fillConfigDefaults(tt.input))
+			if tt.wantErr && err == nil {
+				t.Errorf("expected error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			if _, ok := err.(*ConfigError); err != nil && !ok {
+				t.Errorf("expected ConfigError, got %T", err)
+			}
+		})
+	}
+}
+
+func TestInitializeWithError(t *testing.T) {
+	_, err := InitializeWithError("", nil)
+	if _, ok := err.(*ConfigError); !ok {
+		t.Errorf("expected ConfigError, got %v", err)
+	}
+	_, err = InitializeWithError("test-"+t.Name(), &Config{StreamUpdates: true, ServerUrl: "https://custom.url/"})
+	if _, ok := err.(*ConfigError); !ok {
+		t.Errorf("expected ConfigError, got %v", err)
+	}
+	client, err := InitializeWithError("test-"+t.Name(), &Config{})
+	if err != nil || client == nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestFillConfigDefaults_NegativeStreamDurations(t *testing.T) {
+	result := fillConfigDefaults(&Config{StreamKeepaliveTimeout: -time.Second, StreamReconnectInterval: -time.Second, StreamMaxReconnectJitter: -time.Second})
+	if result.StreamKeepaliveTimeout != DefaultConfig.StreamKeepaliveTimeout {
+		t.Errorf("expected StreamKeepaliveTimeout %v, got %v", DefaultConfig.StreamKeepaliveTimeout, result.StreamKeepaliveTimeout)
+	}
+	if result.StreamReconnectInterval != DefaultConfig.StreamReconnectInterval {
+		t.Errorf("expected StreamReconnectInterval %v, got %v", DefaultConfig.StreamReconnectInterval, result.StreamReconnectInterval)
+	}
+	// A negative jitter disables jitter, and must stay negative if defaults are filled again.
+	if fillConfigDefaults(result).StreamMaxReconnectJitter != -time.Second {
+		t.Errorf("expected StreamMaxReconnectJitter %v, got %v", -time.Second, result.StreamMaxReconnectJitter)
+	}
+}
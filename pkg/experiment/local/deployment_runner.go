@@ -1,6 +1,8 @@
 package local
 
 import (
+	"errors"
+	"os"
 	"sync"
 	"time"
 
@@ -11,10 +13,20 @@ type deploymentRunner struct {
 	config            *Config
 	flagConfigStorage flagConfigStorage
 	flagConfigUpdater flagConfigUpdater
+	flagConfigPoller  *flagConfigPoller
+	streamUpdater     *flagConfigFallbackRetryWrapper
+	retryBudget       *retryBudget
 	cohortLoader      *cohortLoader
+	updateListeners   *flagConfigUpdateListeners
 	poller            *poller
 	lock              sync.Mutex
 	log               *logger.Log
+	// started is true once start succeeds, after which start does nothing until stop.
+	started bool
+	// goroutines counts the background goroutines of the runner's updaters and cohort loader.
+	goroutines *goroutineCounter
+	// deploymentKey, if set, returns the current deployment key, which the flag config cache is tied to.
+	deploymentKey func() string
 }
 
 const streamUpdaterRetryDelay = 15 * time.Second
@@ -28,34 +40,196 @@ func newDeploymentRunner(
 	cohortStorage cohortStorage,
 	cohortLoader *cohortLoader,
 ) *deploymentRunner {
-	flagConfigUpdater := newflagConfigFallbackRetryWrapper(newFlagConfigPoller(flagConfigApi, config, flagConfigStorage, cohortStorage, cohortLoader), nil, config.FlagConfigPollerInterval, updaterRetryMaxJitter, 0, 0, config.Debug)
+	retryBudget := newRetryBudget(config.ControlPlaneRetryBudget)
+	updateListeners := &flagConfigUpdateListeners{}
+	goroutines := &goroutineCounter{}
+	flagConfigPoller := newFlagConfigPoller(flagConfigApi, config, flagConfigStorage, cohortStorage, cohortLoader).(*flagConfigPoller)
+	flagConfigPoller.updateListeners = updateListeners
+	flagConfigPoller.goroutines = goroutines
+	flagConfigPoller.retryBudget = retryBudget
+	flagConfigUpdater := newflagConfigFallbackRetryWrapper(flagConfigPoller, nil, config.FlagConfigPollerInterval, updaterRetryMaxJitter, 0, 0, config.Debug)
+	flagConfigUpdater.retryBudget = retryBudget
+	var streamUpdater *flagConfigFallbackRetryWrapper
 	if flagConfigStreamApi != nil {
-		flagConfigUpdater = newflagConfigFallbackRetryWrapper(newFlagConfigStreamer(flagConfigStreamApi, config, flagConfigStorage, cohortStorage, cohortLoader), flagConfigUpdater, streamUpdaterRetryDelay, updaterRetryMaxJitter, config.FlagConfigPollerInterval, 0, config.Debug)
+		streamer := newFlagConfigStreamer(flagConfigStreamApi, config, flagConfigStorage, cohortStorage, cohortLoader)
+		streamer.(*flagConfigStreamer).updateListeners = updateListeners
+		streamer.(*flagConfigStreamer).goroutines = goroutines
+		flagConfigStreamApi.goroutines = goroutines
+		if config.InitialLoadStrategy == StreamOnly {
+			streamUpdater = newflagConfigFallbackRetryWrapper(streamer, nil, streamUpdaterRetryDelay, updaterRetryMaxJitter, 0, 0, config.Debug)
+		} else {
+			streamUpdater = newflagConfigFallbackRetryWrapper(streamer, flagConfigUpdater, streamUpdaterRetryDelay, updaterRetryMaxJitter, config.FlagConfigPollerInterval, 0, config.Debug)
+		}
+		streamUpdater.retryBudget = retryBudget
+		flagConfigUpdater = streamUpdater
 	}
 	dr := &deploymentRunner{
 		config:            config,
 		flagConfigStorage: flagConfigStorage,
 		cohortLoader:      cohortLoader,
+		updateListeners:   updateListeners,
 		flagConfigUpdater: flagConfigUpdater,
-		poller:            newPoller(),
+		flagConfigPoller:  flagConfigPoller,
+		retryBudget:       retryBudget,
+		streamUpdater:     streamUpdater,
 		log:               logger.New(config.Debug),
+		goroutines:        goroutines,
+	}
+	if cohortLoader != nil {
+		cohortLoader.flagConfigStorage = flagConfigStorage
+		cohortLoader.goroutines = goroutines
+	}
+	dr.poller = dr.newCohortPoller()
+	if config.FlagConfigCacheFile != "" {
+		updateListeners.addRefresh(dr.saveFlagConfigCache)
 	}
 	return dr
 }
 
+func (dr *deploymentRunner) newCohortPoller() *poller {
+	p := newPoller()
+	p.log = dr.log
+	p.metrics = metricsOrNoop(dr.config.Metrics)
+	p.goroutines = dr.goroutines
+	return p
+}
+
+// start loads the flag configs and starts updating them and cohorts in the background. Once start
+// succeeds, later calls return nil without starting again, so concurrent callers may share a
+// runner. If start fails, it may be called again.
 func (dr *deploymentRunner) start() error {
 	dr.lock.Lock()
 	defer dr.lock.Unlock()
+	if dr.started {
+		return nil
+	}
+	if dr.config.FlagConfigCacheFile != "" && dr.loadFlagConfigCache() {
+		dr.startInBackground()
+		return nil
+	}
+	switch dr.config.InitialLoadStrategy {
+	case PollOnceThenStream:
+		if dr.streamUpdater != nil {
+			// On failure the stream, or the poller it falls back to, still loads the flag configs.
+			if err := dr.flagConfigPoller.updateFlagConfigs(); err != nil {
+				dr.log.Error("Initial flag config poll failed, loading from the stream: %v", err)
+			}
+		}
+	case BootstrapThenStream:
+		flagConfigs, err := parseFlagConfigs(dr.config.BootstrapFlagConfigs, dr.config.BootstrapFlagConfigsFormat)
+		if err != nil {
+			return err
+		}
+		dr.flagConfigStorage.replaceFlagConfigs(flagConfigs)
+		dr.flagConfigStorage.setLastUpdated(time.Now())
+		dr.startInBackground()
+		return nil
+	}
 	err := dr.flagConfigUpdater.Start(nil)
 	if err != nil {
 		return err
 	}
 
+	dr.startCohortPoller()
+	dr.started = true
+	return nil
+}
+
+// startInBackground starts updating the flag configs in the background, once flag configs were
+// loaded without the updater.
+func (dr *deploymentRunner) startInBackground() {
+	dr.goroutines.run(dr.startUpdaterUntilStarted)
+	dr.startCohortPoller()
+	dr.started = true
+}
+
+// loadFlagConfigCache loads the flag configs saved in Config.FlagConfigCacheFile, returning false if
+// there are none. The flag configs were last updated when they were saved.
+func (dr *deploymentRunner) loadFlagConfigCache() bool {
+	flagConfigs, savedAt, err := loadFlagConfigCache(dr.config.FlagConfigCacheFile, dr.getDeploymentKey())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dr.log.Error("Failed to load flag configs from %s: %v", dr.config.FlagConfigCacheFile, err)
+		}
+		return false
+	}
+	dr.flagConfigStorage.replaceFlagConfigs(flagConfigs)
+	dr.flagConfigStorage.setLastUpdated(savedAt)
+	dr.log.Debug("Loaded %d flag configs saved at %v from %s", len(flagConfigs), savedAt, dr.config.FlagConfigCacheFile)
+	return true
+}
+
+// saveFlagConfigCache saves the flag configs to Config.FlagConfigCacheFile after each successful
+// update, even if it changed nothing, so the saved time is the time they were last confirmed.
+func (dr *deploymentRunner) saveFlagConfigCache() {
+	flagConfigs, version := dr.flagConfigStorage.getFlagConfigsWithVersion()
+	if err := saveFlagConfigCache(dr.config.FlagConfigCacheFile, dr.getDeploymentKey(), flagConfigs, version); err != nil {
+		dr.log.Error("Failed to save flag configs to %s: %v", dr.config.FlagConfigCacheFile, err)
+	}
+}
+
+func (dr *deploymentRunner) getDeploymentKey() string {
+	if dr.deploymentKey == nil {
+		return ""
+	}
+	return dr.deploymentKey()
+}
+
+// isStarted returns whether the runner is started, i.e. start succeeded and stop wasn't called since.
+func (dr *deploymentRunner) isStarted() bool {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+	return dr.started
+}
+
+// stop stops updating flag configs and cohorts in the background. The runner may be started again.
+func (dr *deploymentRunner) stop() {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+	if !dr.started {
+		return
+	}
+	if dr.cohortLoader != nil {
+		dr.cohortLoader.cancel()
+	}
+	dr.flagConfigUpdater.Stop()
+	close(dr.poller.shutdown)
+	dr.poller = dr.newCohortPoller()
+	dr.started = false
+}
+
+// startUpdaterUntilStarted starts the flag config updater, retrying every poller interval until
+// it starts or the runner is stopped.
+func (dr *deploymentRunner) startUpdaterUntilStarted() {
+	for {
+		if !dr.isStarted() {
+			return
+		}
+		err := dr.flagConfigUpdater.Start(nil)
+		if err == nil {
+			if !dr.isStarted() {
+				dr.flagConfigUpdater.Stop()
+			}
+			return
+		}
+		dr.log.Error("Failed to load flag configs after bootstrap, retrying in %v: %v", dr.config.FlagConfigPollerInterval, err)
+		time.Sleep(dr.config.FlagConfigPollerInterval)
+	}
+}
+
+func (dr *deploymentRunner) startCohortPoller() {
 	if dr.config.CohortSyncConfig != nil {
 		dr.poller.Poll(dr.config.CohortSyncConfig.CohortPollingInterval, func() {
 			cohortIDs := getAllCohortIDsFromFlags(dr.flagConfigStorage.getFlagConfigsArray())
 			dr.cohortLoader.downloadCohorts(cohortIDs)
 		})
 	}
-	return nil
+}
+
+// reconnectStream closes the flag config stream and connects it again.
+func (dr *deploymentRunner) reconnectStream() error {
+	if dr.streamUpdater == nil {
+		return errors.New("stream updates are not enabled")
+	}
+	return dr.streamUpdater.restartMain()
 }
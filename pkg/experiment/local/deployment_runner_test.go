@@ -3,7 +3,13 @@ package local
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/amplitude/experiment-go-server/internal/evaluation"
 )
@@ -105,3 +111,304 @@ func createTestFlag() *evaluation.Flag {
 		},
 	}
 }
+
+func TestReconnectStreamFailsIfStreamNotEnabled(t *testing.T) {
+	flagAPI := &mockFlagConfigApi{getFlagConfigsFunc: func() (map[string]*evaluation.Flag, error) {
+		return map[string]*evaluation.Flag{}, nil
+	}}
+	flagConfigStorage := newInMemoryFlagConfigStorage()
+	cohortStorage := newInMemoryCohortStorage()
+
+	runner := newDeploymentRunner(
+		DefaultConfig,
+		flagAPI,
+		nil,
+		flagConfigStorage,
+		cohortStorage,
+		nil,
+	)
+
+	err := runner.reconnectStream()
+
+	if err == nil {
+		t.Error("Expected error but got nil")
+	}
+}
+
+func TestStartPollOnceThenStream(t *testing.T) {
+	polls := 0
+	flagAPI := &mockFlagConfigApi{getFlagConfigsFunc: func() (map[string]*evaluation.Flag, error) {
+		polls++
+		return map[string]*evaluation.Flag{"flag": createTestFlag()}, nil
+	}}
+	sse := mockSseStream{chConnected: make(chan bool)}
+	streamAPI := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	streamAPI.newSseStreamFactory = sse.newSseStreamFactory
+	flagConfigStorage := newInMemoryFlagConfigStorage()
+	runner := newDeploymentRunner(
+		fillConfigDefaults(&Config{InitialLoadStrategy: PollOnceThenStream}),
+		flagAPI,
+		streamAPI,
+		flagConfigStorage,
+		newInMemoryCohortStorage(),
+		nil,
+	)
+
+	go func() {
+		<-sse.chConnected
+		if flagConfigStorage.getFlagConfigs()["flag"] == nil {
+			t.Error("Expected polled flag configs before the stream connected")
+		}
+		sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	}()
+	if err := runner.start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if polls != 1 {
+		t.Errorf("Expected 1 poll but got %d", polls)
+	}
+	if flagConfigStorage.getFlagConfigs()["flagkey"] == nil {
+		t.Errorf("Expected streamed flag configs")
+	}
+	streamAPI.Close()
+}
+
+func TestStartStreamOnlyDoesNotPoll(t *testing.T) {
+	flagAPI := &mockFlagConfigApi{getFlagConfigsFunc: func() (map[string]*evaluation.Flag, error) {
+		t.Error("Unexpected poll")
+		return map[string]*evaluation.Flag{"flag": createTestFlag()}, nil
+	}}
+	sse := mockSseStream{chConnected: make(chan bool)}
+	streamAPI := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 100*time.Millisecond)
+	streamAPI.newSseStreamFactory = sse.newSseStreamFactory
+	runner := newDeploymentRunner(
+		fillConfigDefaults(&Config{InitialLoadStrategy: StreamOnly, StreamUpdates: true}),
+		flagAPI,
+		streamAPI,
+		newInMemoryFlagConfigStorage(),
+		newInMemoryCohortStorage(),
+		nil,
+	)
+
+	go func() { <-sse.chConnected }()
+	if err := runner.start(); err == nil {
+		t.Error("Expected error but got nil")
+	}
+}
+
+func TestStartBootstrapThenStream(t *testing.T) {
+	flagAPI := &mockFlagConfigApi{getFlagConfigsFunc: func() (map[string]*evaluation.Flag, error) {
+		return nil, errors.New("test")
+	}}
+	flagConfigStorage := newInMemoryFlagConfigStorage()
+	runner := newDeploymentRunner(
+		fillConfigDefaults(&Config{InitialLoadStrategy: BootstrapThenStream, BootstrapFlagConfigs: string(FLAG_1_STR)}),
+		flagAPI,
+		nil,
+		flagConfigStorage,
+		newInMemoryCohortStorage(),
+		nil,
+	)
+
+	if err := runner.start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if flagConfigStorage.getFlagConfigs()["flagkey"] == nil {
+		t.Errorf("Expected bootstrap flag configs")
+	}
+	if flagConfigStorage.getLastUpdated().IsZero() {
+		t.Errorf("Expected bootstrap flag configs to count as loaded")
+	}
+}
+
+func TestOnCohortsLoaded(t *testing.T) {
+	var lock sync.Mutex
+	flags := map[string]*evaluation.Flag{"flag": createTestFlag()}
+	flagAPI := &mockFlagConfigApi{getFlagConfigsFunc: func() (map[string]*evaluation.Flag, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return flags, nil
+	}}
+	downloadFails := true
+	cohortDownloadAPI := &mockCohortDownloadApi{getCohortFunc: func(cohortID string, cohort *Cohort) (*Cohort, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if downloadFails {
+			return nil, errors.New("test")
+		}
+		return &Cohort{Id: cohortID, GroupType: userGroupType, MemberIds: []string{}}, nil
+	}}
+	flagConfigStorage := newInMemoryFlagConfigStorage()
+	cohortStorage := newInMemoryCohortStorage()
+	cohortLoader := newCohortLoader(cohortDownloadAPI, cohortStorage, true)
+	runner := newDeploymentRunner(DefaultConfig, flagAPI, nil, flagConfigStorage, cohortStorage, cohortLoader)
+	var loaded int32
+	cohortLoader.onCohortsLoaded(func() {
+		atomic.AddInt32(&loaded, 1)
+	})
+
+	if err := runner.start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if count := atomic.LoadInt32(&loaded); count != 0 {
+		t.Fatalf("Expected no call while a cohort is missing, got %d", count)
+	}
+
+	lock.Lock()
+	downloadFails = false
+	lock.Unlock()
+	_ = runner.flagConfigPoller.updateFlagConfigs()
+	if count := atomic.LoadInt32(&loaded); count != 1 {
+		t.Fatalf("Expected a call once cohorts are loaded, got %d", count)
+	}
+
+	_ = runner.flagConfigPoller.updateFlagConfigs()
+	if count := atomic.LoadInt32(&loaded); count != 1 {
+		t.Fatalf("Expected no call when the cohorts are unchanged, got %d", count)
+	}
+
+	flag := createTestFlag()
+	flag.Key = "flag-2"
+	flag.Segments[0].Conditions[0][0].Values = []string{"5678"}
+	lock.Lock()
+	flags = map[string]*evaluation.Flag{"flag": createTestFlag(), "flag-2": flag}
+	lock.Unlock()
+	_ = runner.flagConfigPoller.updateFlagConfigs()
+	if count := atomic.LoadInt32(&loaded); count != 2 {
+		t.Fatalf("Expected a call once new cohorts are loaded, got %d", count)
+	}
+}
+
+func TestOnFlagConfigUpdate(t *testing.T) {
+	var lock sync.Mutex
+	flags := map[string]*evaluation.Flag{
+		"a": createTestVariantFlag("a", nil),
+		"b": createTestVariantFlag("b", nil),
+	}
+	flagAPI := &mockFlagConfigApi{getFlagConfigsFunc: func() (map[string]*evaluation.Flag, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return flags, nil
+	}}
+	runner := newDeploymentRunner(DefaultConfig, flagAPI, nil, newInMemoryFlagConfigStorage(), newInMemoryCohortStorage(), nil)
+	var updates [][]string
+	runner.updateListeners.add(func(changedKeys []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		updates = append(updates, changedKeys)
+	})
+
+	if err := runner.start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	_ = runner.flagConfigPoller.updateFlagConfigs()
+
+	changed := createTestVariantFlag("b", map[string]interface{}{"team": "a"})
+	lock.Lock()
+	flags = map[string]*evaluation.Flag{"b": changed, "c": createTestVariantFlag("c", nil)}
+	lock.Unlock()
+	_ = runner.flagConfigPoller.updateFlagConfigs()
+
+	lock.Lock()
+	defer lock.Unlock()
+	expected := [][]string{{"a", "b"}, {"a", "b", "c"}}
+	if !reflect.DeepEqual(updates, expected) {
+		t.Fatalf("Expected updates %v, got %v", expected, updates)
+	}
+}
+
+func TestOnMissingDependencies(t *testing.T) {
+	flags := map[string]*evaluation.Flag{
+		"flag":       createTestVariantFlag("flag", nil, "missing-b", "dependency", "missing-a"),
+		"dependency": createTestVariantFlag("dependency", nil),
+	}
+	flagAPI := &mockFlagConfigApi{getFlagConfigsFunc: func() (map[string]*evaluation.Flag, error) {
+		return flags, nil
+	}}
+	runner := newDeploymentRunner(DefaultConfig, flagAPI, nil, newInMemoryFlagConfigStorage(), newInMemoryCohortStorage(), nil)
+	var reports []map[string][]string
+	runner.updateListeners.addMissingDependencies(func(missing map[string][]string) {
+		reports = append(reports, missing)
+	})
+
+	if err := runner.start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := []map[string][]string{{"flag": {"missing-a", "missing-b"}}}
+	if !reflect.DeepEqual(reports, expected) {
+		t.Fatalf("Expected reports %v, got %v", expected, reports)
+	}
+}
+
+func TestStartFromFlagConfigCache(t *testing.T) {
+	config := fillConfigDefaults(&Config{FlagConfigCacheFile: filepath.Join(t.TempDir(), "flags.json")})
+	flagAPI := &mockFlagConfigApi{getFlagConfigsFunc: func() (map[string]*evaluation.Flag, error) {
+		return parseData(FLAG_1_STR)
+	}}
+	runner := newDeploymentRunner(config, flagAPI, nil, newInMemoryFlagConfigStorage(), newInMemoryCohortStorage(), nil)
+	if err := runner.start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	runner.stop()
+	if _, err := os.Stat(config.FlagConfigCacheFile); err != nil {
+		t.Fatalf("Expected the flag configs to be saved: %v", err)
+	}
+
+	// Start while the flag configs can't be fetched.
+	flagAPI = &mockFlagConfigApi{getFlagConfigsFunc: func() (map[string]*evaluation.Flag, error) {
+		return nil, errors.New("test")
+	}}
+	flagConfigStorage := newInMemoryFlagConfigStorage()
+	runner = newDeploymentRunner(config, flagAPI, nil, flagConfigStorage, newInMemoryCohortStorage(), nil)
+	if err := runner.start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer runner.stop()
+	if flagConfigStorage.getFlagConfigs()["flagkey"] == nil {
+		t.Errorf("Expected cached flag configs")
+	}
+	if flagConfigStorage.getLastUpdated().IsZero() {
+		t.Errorf("Expected cached flag configs to count as loaded")
+	}
+}
+
+func TestFlagConfigCacheSavedOnUnchangedUpdate(t *testing.T) {
+	config := fillConfigDefaults(&Config{FlagConfigCacheFile: filepath.Join(t.TempDir(), "flags.json")})
+	flagAPI := &mockFlagConfigApi{getFlagConfigsFunc: func() (map[string]*evaluation.Flag, error) {
+		return parseData(FLAG_1_STR)
+	}}
+	runner := newDeploymentRunner(config, flagAPI, nil, newInMemoryFlagConfigStorage(), newInMemoryCohortStorage(), nil)
+	runner.deploymentKey = func() string { return "key" }
+	if err := runner.start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer runner.stop()
+	_, savedAt, err := loadFlagConfigCache(config.FlagConfigCacheFile, "key")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	flagConfigs, _ := parseData(FLAG_1_STR)
+	if err := runner.flagConfigPoller.update(flagConfigs); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	_, resavedAt, err := loadFlagConfigCache(config.FlagConfigCacheFile, "key")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !resavedAt.After(savedAt) {
+		t.Errorf("Expected the flag configs to be saved again, saved at %v and %v", savedAt, resavedAt)
+	}
+
+	// The cache isn't loaded for another deployment key.
+	flagAPI = &mockFlagConfigApi{getFlagConfigsFunc: func() (map[string]*evaluation.Flag, error) {
+		return nil, errors.New("test")
+	}}
+	other := newDeploymentRunner(config, flagAPI, nil, newInMemoryFlagConfigStorage(), newInMemoryCohortStorage(), nil)
+	other.deploymentKey = func() string { return "other-key" }
+	if err := other.start(); err == nil {
+		other.stop()
+		t.Fatalf("Expected start to fail without the flag configs of another deployment")
+	}
+}
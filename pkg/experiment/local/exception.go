@@ -1,14 +1,49 @@
 package local
 
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrStaleFlagConfigs is returned by evaluation when Config.FailEvaluationOnStaleConfig is set and the flag
+// configs have not been updated within Config.MaxConfigStaleness.
+var ErrStaleFlagConfigs = errors.New("flag configs are stale")
+
+// ErrDraining is returned by evaluation after Client.Drain is called.
+var ErrDraining = errors.New("client is draining")
+
 type httpErrorResponseException struct {
 	StatusCode int
 	Message    string
+	// response, if set, is the unsuccessful response, whose body is closed.
+	response *http.Response
 }
 
 func (e *httpErrorResponseException) Error() string {
 	return e.Message
 }
 
+type responseTooLargeException struct {
+	Limit int64
+}
+
+func (e *responseTooLargeException) Error() string {
+	return fmt.Sprintf("response exceeds maximum size of %d bytes", e.Limit)
+}
+
+// cohortIncompleteException is returned when a cohort download has fewer or more members than the
+// size of the cohort, e.g. because the response was truncated.
+type cohortIncompleteException struct {
+	Size     int
+	Received int
+}
+
+func (e *cohortIncompleteException) Error() string {
+	return fmt.Sprintf("cohort download incomplete: received %d of %d members", e.Received, e.Size)
+}
+
 type cohortTooLargeException struct {
 	Message string
 }
@@ -16,3 +51,51 @@ type cohortTooLargeException struct {
 func (e *cohortTooLargeException) Error() string {
 	return e.Message
 }
+
+// ConfigError is returned by InitializeWithError when the config is invalid or inconsistent.
+type ConfigError struct {
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid config: " + e.Message
+}
+
+// UserResolverError is returned by EvaluateToken when Config.UserResolver fails to resolve the token to a user.
+type UserResolverError struct {
+	Err error
+}
+
+func (e *UserResolverError) Error() string {
+	return "failed to resolve user from token: " + e.Err.Error()
+}
+
+func (e *UserResolverError) Unwrap() error {
+	return e.Err
+}
+
+// FlagValidationError is returned by ValidateFlags with every problem found in the flag configs.
+type FlagValidationError struct {
+	Errors []error
+}
+
+func (e *FlagValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return "invalid flag configs: " + strings.Join(messages, "; ")
+}
+
+// UserValidationError is returned by ValidateUser with every problem found in the user.
+type UserValidationError struct {
+	Errors []error
+}
+
+func (e *UserValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return "invalid user: " + strings.Join(messages, "; ")
+}
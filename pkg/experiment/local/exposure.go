@@ -0,0 +1,41 @@
+package local
+
+import (
+	"fmt"
+
+	"github.com/amplitude/analytics-go/amplitude"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+)
+
+const exposureEventType = "$exposure"
+
+// An exposure is tracked per flag, so it's represented as an assignment with a single result.
+func newExposure(user *experiment.User, flagKey string, variant experiment.Variant) *assignment {
+	return newAssignment(user, map[string]experiment.Variant{flagKey: variant})
+}
+
+// Returns true if the variant should be exposed. Default variants, and variants of flags that don't
+// serve variants to users directly, are not exposed.
+func isExposable(variant experiment.Variant) bool {
+	flagType, _ := variant.Metadata[experiment.MetadataFlagType].(string)
+	isDefault, _ := variant.Metadata[experiment.MetadataDefault].(bool)
+	return !isDefault && flagType != flagTypeMutualExclusionGroup
+}
+
+func toExposureEvent(exposure *assignment, insertIDHash func(string) uint64) amplitude.Event {
+	event := amplitude.Event{
+		EventType:       exposureEventType,
+		UserID:          exposure.user.UserId,
+		DeviceID:        exposure.user.DeviceId,
+		EventProperties: make(map[string]interface{}),
+	}
+	for flagKey, result := range exposure.results {
+		event.EventProperties["flag_key"] = flagKey
+		event.EventProperties["variant"] = result.Key
+		if experimentKey, ok := result.Metadata[experiment.MetadataExperimentKey].(string); ok && len(experimentKey) > 0 {
+			event.EventProperties["experiment_key"] = experimentKey
+		}
+	}
+	event.InsertID = fmt.Sprintf("%s %s %d %d", event.UserID, event.DeviceID, insertIDHash(exposure.Canonicalize()), exposure.timestamp/dayMillis)
+	return event
+}
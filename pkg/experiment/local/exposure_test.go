@@ -0,0 +1,73 @@
+package local
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/amplitude/analytics-go/amplitude"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+)
+
+func TestToExposureEvent(t *testing.T) {
+	user := &experiment.User{
+		UserId:   "user",
+		DeviceId: "device",
+	}
+	exposure := newExposure(user, "flag-key", experiment.Variant{
+		Key:      "on",
+		Metadata: map[string]interface{}{"experimentKey": "exp-1"},
+	})
+	event := toExposureEvent(exposure, defaultInsertIDHash)
+	expectedInsertID := fmt.Sprintf("user device %d %d", hashCode("user device flag-key on "), exposure.timestamp/dayMillis)
+	if event.EventType != "$exposure" {
+		t.Errorf("EventType was %s, expected %s", event.EventType, "$exposure")
+	}
+	if event.EventProperties["flag_key"] != "flag-key" {
+		t.Errorf("Unexpected flag_key %v", event.EventProperties["flag_key"])
+	}
+	if event.EventProperties["variant"] != "on" {
+		t.Errorf("Unexpected variant %v", event.EventProperties["variant"])
+	}
+	if event.EventProperties["experiment_key"] != "exp-1" {
+		t.Errorf("Unexpected experiment_key %v", event.EventProperties["experiment_key"])
+	}
+	if event.InsertID != expectedInsertID {
+		t.Errorf("InsertID was %s, expected %s", event.InsertID, expectedInsertID)
+	}
+}
+
+func TestEvaluateAndExpose(t *testing.T) {
+	mock := &mockAmplitudeClient{}
+	var amplitudeClient amplitude.Client = mock
+	c := Initialize("test-"+t.Name(), &Config{AssignmentConfig: &AssignmentConfig{Client: &amplitudeClient}})
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("flag", nil))
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("default-flag", map[string]interface{}{"default": true}))
+	user := &experiment.User{UserId: "user"}
+
+	for i := 0; i < 2; i++ {
+		_, err := c.EvaluateAndExpose(user, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+
+	exposures := 0
+	assignments := 0
+	for _, event := range mock.trackedEvents() {
+		switch event.EventType {
+		case exposureEventType:
+			exposures++
+			if event.EventProperties["flag_key"] != "flag" {
+				t.Errorf("Unexpected exposure %v", event.EventProperties)
+			}
+		case "[Experiment] Assignment":
+			assignments++
+		}
+	}
+	if exposures != 1 {
+		t.Errorf("Tracked %d exposures, expected %d", exposures, 1)
+	}
+	if assignments != 1 {
+		t.Errorf("Tracked %d assignments, expected %d", assignments, 1)
+	}
+}
@@ -0,0 +1,44 @@
+package local
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/amplitude/experiment-go-server/internal/logger"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+)
+
+// FetchAndEvaluate fetches flag configs once and evaluates the user, for short-lived processes
+// such as CLI tools and serverless functions. Unlike Initialize and Start, it starts no background
+// pollers, streams, or cohort downloads, and does not cache the client or flag configs.
+//
+// Cohorts are not downloaded, so users are not members of any cohort unless
+// Config.CohortMembershipResolver is set. Assignments are not tracked.
+func FetchAndEvaluate(ctx context.Context, apiKey string, user *experiment.User, flagKeys []string, config *Config) (map[string]experiment.Variant, error) {
+	config = fillConfigDefaults(config)
+	httpClient := newHttpClient(config.TLSConfig, config.DialContext)
+	defer httpClient.CloseIdleConnections()
+	api := newFlagConfigApiV2(apiKey, config.ServerUrl, config.FlagConfigPollerRequestTimeout, httpClient, config.MaxFlagConfigBytes)
+	api.queryParams = config.FlagConfigQueryParams
+	api.version = config.FlagsApiVersion
+	flagConfigs, err := api.getFlagConfigsWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log := logger.New(config.Debug)
+	c := &Client{
+		log:               log,
+		apiKey:            apiKey,
+		config:            config,
+		client:            httpClient,
+		flagsMutex:        &sync.RWMutex{},
+		engine:            evaluation.NewEngineWithOptions(log, engineOptions(config)),
+		cohortStorage:     newInMemoryCohortStorage(),
+		flagConfigStorage: newInMemoryFlagConfigStorage(),
+		metrics:           metricsOrNoop(config.Metrics),
+	}
+	c.flagConfigStorage.setLastUpdated(time.Now())
+	return c.evaluate(user, flagConfigs, flagKeys)
+}
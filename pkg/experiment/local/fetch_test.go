@@ -0,0 +1,62 @@
+package local
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+)
+
+func TestFetchAndEvaluate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sdk/v2/flags" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		_, _ = w.Write([]byte(`[{"key":"flag","variants":{"on":{"key":"on","value":"on"}},"segments":[{"variant":"on"}]}]`))
+	}))
+	defer server.Close()
+
+	user := &experiment.User{UserId: "test_user"}
+	result, err := FetchAndEvaluate(context.Background(), "test-"+t.Name(), user, nil, &Config{ServerUrl: server.URL})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["flag"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["flag"])
+	}
+	if _, ok := clients["test-"+t.Name()]; ok {
+		t.Fatalf("Expected client not to be cached")
+	}
+}
+
+func TestFetchAndEvaluateCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := FetchAndEvaluate(ctx, "test-"+t.Name(), &experiment.User{UserId: "test_user"}, nil, &Config{ServerUrl: server.URL})
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+func TestFetchAndEvaluateQueryParams(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if query := r.URL.RawQuery; query != "capabilities=delta&v=1" {
+			t.Errorf("Unexpected query %s", query)
+		}
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	config := &Config{ServerUrl: server.URL, FlagConfigQueryParams: map[string]string{"capabilities": "delta", "v": "1"}}
+	_, err := FetchAndEvaluate(context.Background(), "test-"+t.Name(), &experiment.User{UserId: "test_user"}, nil, config)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
@@ -4,15 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/amplitude/experiment-go-server/internal/evaluation"
 	"github.com/amplitude/experiment-go-server/pkg/experiment"
 )
 
+// flagsApiVersion is the default version of the flags endpoint.
+const flagsApiVersion = 2
+
+// supportedFlagsApiVersions are the versions of the flags endpoint which serve flag configs in the
+// evaluation engine's format. Version 1 serves the deprecated flag format.
+var supportedFlagsApiVersions = map[int]bool{flagsApiVersion: true}
+
 type flagConfigApi interface {
 	getFlagConfigs() (map[string]*evaluation.Flag, error)
 }
@@ -21,40 +28,74 @@ type flagConfigApiV2 struct {
 	DeploymentKey                        string
 	ServerURL                            string
 	FlagConfigPollerRequestTimeoutMillis time.Duration
+	client                               *http.Client
+	maxBytes                             int64
+	queryParams                          map[string]string
+	// keyLock guards DeploymentKey, which setDeploymentKey may change while requests are made.
+	keyLock sync.RWMutex
+	// version is the version of the flags endpoint.
+	version int
 }
 
-func newFlagConfigApiV2(deploymentKey, serverURL string, flagConfigPollerRequestTimeoutMillis time.Duration) *flagConfigApiV2 {
+func newFlagConfigApiV2(deploymentKey, serverURL string, flagConfigPollerRequestTimeoutMillis time.Duration, client *http.Client, maxBytes int64) *flagConfigApiV2 {
 	return &flagConfigApiV2{
 		DeploymentKey:                        deploymentKey,
 		ServerURL:                            serverURL,
 		FlagConfigPollerRequestTimeoutMillis: flagConfigPollerRequestTimeoutMillis,
+		client:                               client,
+		maxBytes:                             maxBytes,
+		version:                              flagsApiVersion,
 	}
 }
 
+func (a *flagConfigApiV2) deploymentKey() string {
+	a.keyLock.RLock()
+	defer a.keyLock.RUnlock()
+	return a.DeploymentKey
+}
+
+func (a *flagConfigApiV2) setDeploymentKey(deploymentKey string) {
+	a.keyLock.Lock()
+	defer a.keyLock.Unlock()
+	a.DeploymentKey = deploymentKey
+}
+
 func (a *flagConfigApiV2) getFlagConfigs() (map[string]*evaluation.Flag, error) {
-	client := &http.Client{}
+	return a.getFlagConfigsWithContext(context.Background())
+}
+
+// getFlagConfigsWithContext fetches flag configs, canceling the request when the context is done or the request times out.
+func (a *flagConfigApiV2) getFlagConfigsWithContext(ctx context.Context) (map[string]*evaluation.Flag, error) {
 	endpoint, err := url.Parse(a.ServerURL)
 	if err != nil {
 		return nil, err
 	}
-	endpoint.Path = "sdk/v2/flags"
+	endpoint.Path = fmt.Sprintf("sdk/v%d/flags", a.version)
 	endpoint.RawQuery = "v=0"
-	ctx, cancel := context.WithTimeout(context.Background(), a.FlagConfigPollerRequestTimeoutMillis)
+	setQueryParams(endpoint, a.queryParams)
+	ctx, cancel := context.WithTimeout(ctx, a.FlagConfigPollerRequestTimeoutMillis)
 	defer cancel()
 	req, err := http.NewRequest("GET", endpoint.String(), nil)
 	if err != nil {
 		return nil, err
 	}
 	req = req.WithContext(ctx)
-	req.Header.Set("Authorization", fmt.Sprintf("Api-Key %s", a.DeploymentKey))
+	req.Header.Set("Authorization", fmt.Sprintf("Api-Key %s", a.deploymentKey()))
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("X-Amp-Exp-Library", fmt.Sprintf("experiment-go-server/%v", experiment.VERSION))
-	resp, err := client.Do(req)
+	resp, err := a.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpErrorResponseException{
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("could not fetch flag configs: %s", http.StatusText(resp.StatusCode)),
+			response:   resp,
+		}
+	}
+	body, err := readAllLimited(resp.Body, a.maxBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,97 @@
+package local
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+)
+
+// flagConfigCache is the format of Config.FlagConfigCacheFile.
+type flagConfigCache struct {
+	// Version is the version of the flag configs. See flagConfigsVersion.
+	Version string `json:"version"`
+	// DeploymentKeyHash is the SHA-256 hash of the deployment key the flag configs were fetched
+	// with, so the flag configs of another deployment are never loaded.
+	DeploymentKeyHash string `json:"deploymentKeyHash"`
+	// SavedAt is the time the flag configs were saved in milliseconds since the Unix epoch.
+	SavedAt int64              `json:"savedAt"`
+	Flags   []*evaluation.Flag `json:"flags"`
+}
+
+// saveFlagConfigCache writes the flag configs to the cache file. The file is replaced at once, so it
+// is never left partially written.
+func saveFlagConfigCache(path, deploymentKey string, flagConfigs map[string]*evaluation.Flag, version string) error {
+	keys := make([]string, 0, len(flagConfigs))
+	for key := range flagConfigs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	cache := flagConfigCache{
+		Version:           version,
+		DeploymentKeyHash: hashDeploymentKey(deploymentKey),
+		SavedAt:           time.Now().UnixMilli(),
+		Flags:             make([]*evaluation.Flag, 0, len(keys)),
+	}
+	for _, key := range keys {
+		cache.Flags = append(cache.Flags, flagConfigs[key])
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// loadFlagConfigCache reads the flag configs from the cache file with the time they were saved. It
+// fails if they were saved with another deployment key or don't match the saved version.
+func loadFlagConfigCache(path, deploymentKey string) (map[string]*evaluation.Flag, time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var cache flagConfigCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, time.Time{}, err
+	}
+	if cache.DeploymentKeyHash != hashDeploymentKey(deploymentKey) {
+		return nil, time.Time{}, fmt.Errorf("flag configs were saved with another deployment key")
+	}
+	flagConfigs := make(map[string]*evaluation.Flag, len(cache.Flags))
+	for _, flag := range cache.Flags {
+		if flag == nil || flag.Key == "" {
+			return nil, time.Time{}, fmt.Errorf("flag without a key")
+		}
+		flagConfigs[flag.Key] = flag
+	}
+	if version := flagConfigsVersion(flagConfigs); version != cache.Version {
+		return nil, time.Time{}, fmt.Errorf("flag configs version %s doesn't match the saved version %s", version, cache.Version)
+	}
+	return flagConfigs, time.UnixMilli(cache.SavedAt), nil
+}
+
+func hashDeploymentKey(deploymentKey string) string {
+	hash := sha256.Sum256([]byte(deploymentKey))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,51 @@
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlagConfigCacheRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.json")
+	flagConfigs := map[string]*evaluation.Flag{"a": createTestVariantFlag("a", nil), "b": createTestVariantFlag("b", nil)}
+	before := time.Now().Truncate(time.Millisecond)
+	assert.NoError(t, saveFlagConfigCache(path, "key", flagConfigs, flagConfigsVersion(flagConfigs)))
+
+	loaded, savedAt, err := loadFlagConfigCache(path, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, flagConfigs, loaded)
+	assert.False(t, savedAt.Before(before))
+	files, _ := ioutil.ReadDir(filepath.Dir(path))
+	assert.Len(t, files, 1)
+}
+
+func TestFlagConfigCacheVersionMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.json")
+	flagConfigs := map[string]*evaluation.Flag{"a": createTestVariantFlag("a", nil)}
+	assert.NoError(t, saveFlagConfigCache(path, "key", flagConfigs, "stale"))
+
+	_, _, err := loadFlagConfigCache(path, "key")
+	assert.Contains(t, err.Error(), "doesn't match the saved version stale")
+}
+
+func TestFlagConfigCacheMissing(t *testing.T) {
+	_, _, err := loadFlagConfigCache(filepath.Join(t.TempDir(), "flags.json"), "key")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFlagConfigCacheDeploymentKeyMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.json")
+	flagConfigs := map[string]*evaluation.Flag{"a": createTestVariantFlag("a", nil)}
+	assert.NoError(t, saveFlagConfigCache(path, "server-deployment-key", flagConfigs, flagConfigsVersion(flagConfigs)))
+	data, _ := ioutil.ReadFile(path)
+	assert.NotContains(t, string(data), "server-deployment-key")
+
+	_, _, err := loadFlagConfigCache(path, "other-key")
+	assert.Contains(t, err.Error(), "another deployment key")
+}
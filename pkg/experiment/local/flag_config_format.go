@@ -0,0 +1,135 @@
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"gopkg.in/yaml.v3"
+)
+
+// FlagConfigFormat is the format of developer provided flag configs, e.g. bootstrap flag configs or
+// test fixtures. Flag configs from the flag config API and stream are always JSON.
+type FlagConfigFormat int
+
+const (
+	// FlagConfigFormatJSON is a JSON array of flag configs, or the JSON object of flag configs keyed
+	// by flag key returned by Client.FlagsV2.
+	FlagConfigFormatJSON FlagConfigFormat = iota
+	// FlagConfigFormatYAML is the YAML equivalent of FlagConfigFormatJSON, with the same field names.
+	FlagConfigFormatYAML
+)
+
+// flagConfigFormatFromPath returns FlagConfigFormatYAML for files with a .yaml or .yml extension,
+// and FlagConfigFormatJSON otherwise.
+func flagConfigFormatFromPath(path string) FlagConfigFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FlagConfigFormatYAML
+	default:
+		return FlagConfigFormatJSON
+	}
+}
+
+func parseFlagConfigs(flags string, format FlagConfigFormat) (map[string]*evaluation.Flag, error) {
+	switch format {
+	case FlagConfigFormatJSON:
+		return parseFlagConfigsJSON(flags)
+	case FlagConfigFormatYAML:
+		return parseFlagConfigsYAML(flags)
+	default:
+		return nil, fmt.Errorf("unknown flag config format %d", format)
+	}
+}
+
+// parseFlagConfigsYAML parses either a YAML map of flag configs keyed by flag key or a YAML list of
+// flag configs. Each flag config is converted through JSON, so values have the same types as flag
+// configs from the flag config API, and errors name the flag and field which failed to convert.
+func parseFlagConfigsYAML(flagsYAML string) (map[string]*evaluation.Flag, error) {
+	var root interface{}
+	if err := yaml.Unmarshal([]byte(flagsYAML), &root); err != nil {
+		return nil, err
+	}
+	flagConfigs := make(map[string]*evaluation.Flag)
+	switch value := root.(type) {
+	case nil:
+		return flagConfigs, nil
+	case []interface{}:
+		for i, element := range value {
+			flag, err := convertYAMLFlagConfig(element)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]%v", i, err)
+			}
+			flagConfigs[flag.Key] = flag
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			flag, err := convertYAMLFlagConfig(value[key])
+			if err != nil {
+				return nil, fmt.Errorf("%s%v", key, err)
+			}
+			flagConfigs[key] = flag
+		}
+	default:
+		return nil, fmt.Errorf("expected a list or map of flag configs, got %T", root)
+	}
+	return flagConfigs, nil
+}
+
+// convertYAMLFlagConfig converts a decoded YAML flag config. Errors start with the path of the field
+// which failed to convert, relative to the flag config, e.g. ".segments.bucket.salt: ...".
+func convertYAMLFlagConfig(value interface{}) (*evaluation.Flag, error) {
+	if err := checkYAMLKeys(value, ""); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf(": %v", err)
+	}
+	var flag evaluation.Flag
+	if err := json.Unmarshal(data, &flag); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			path := ""
+			if typeErr.Field != "" {
+				path = "." + typeErr.Field
+			}
+			return nil, fmt.Errorf("%s: cannot convert %s to %v", path, typeErr.Value, typeErr.Type)
+		}
+		return nil, fmt.Errorf(": %v", err)
+	}
+	return &flag, nil
+}
+
+// checkYAMLKeys returns an error for YAML maps with keys which aren't strings, which can't be
+// converted to JSON.
+func checkYAMLKeys(value interface{}, path string) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, element := range v {
+			if err := checkYAMLKeys(element, path+"."+key); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for key := range v {
+			if _, ok := key.(string); !ok {
+				return fmt.Errorf("%s: map key %v is not a string", path, key)
+			}
+		}
+	case []interface{}:
+		for i, element := range v {
+			if err := checkYAMLKeys(element, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package local
 
 import (
 	"sync"
+	"time"
 
 	"github.com/amplitude/experiment-go-server/internal/evaluation"
 )
@@ -9,14 +10,28 @@ import (
 type flagConfigStorage interface {
 	getFlagConfig(key string) *evaluation.Flag
 	getFlagConfigs() map[string]*evaluation.Flag
+	// Returns the flag configs and their version, a hash of the flag configs.
+	getFlagConfigsWithVersion() (map[string]*evaluation.Flag, string)
+	// Returns the flag config with the key and the flag configs it depends on, directly or
+	// indirectly, keyed by flag key. Empty if there is no flag config with the key.
+	getFlagConfigWithDependencies(key string) map[string]*evaluation.Flag
 	getFlagConfigsArray() []*evaluation.Flag
 	putFlagConfig(flagConfig *evaluation.Flag)
 	removeIf(condition func(*evaluation.Flag) bool)
+	// Replaces all flag configs at once, so readers never see a partially applied update.
+	replaceFlagConfigs(flagConfigs map[string]*evaluation.Flag)
+	// The time of the last successful flag config update. Zero if never updated.
+	getLastUpdated() time.Time
+	setLastUpdated(lastUpdated time.Time)
 }
 
 type inMemoryFlagConfigStorage struct {
 	flagConfigs     map[string]*evaluation.Flag
 	flagConfigsLock sync.Mutex
+	lastUpdated     time.Time
+	// version is the version of the flag configs, computed when first read after they change, or
+	// empty if it has not been computed.
+	version string
 }
 
 func newInMemoryFlagConfigStorage() *inMemoryFlagConfigStorage {
@@ -45,6 +60,37 @@ func (storage *inMemoryFlagConfigStorage) getFlagConfigs() map[string]*evaluatio
 	return copyFlagConfigs
 }
 
+func (storage *inMemoryFlagConfigStorage) getFlagConfigsWithVersion() (map[string]*evaluation.Flag, string) {
+	storage.flagConfigsLock.Lock()
+	defer storage.flagConfigsLock.Unlock()
+	copyFlagConfigs := make(map[string]*evaluation.Flag, len(storage.flagConfigs))
+	for key, value := range storage.flagConfigs {
+		copyFlagConfigs[key] = value
+	}
+	if storage.version == "" {
+		storage.version = flagConfigsVersion(copyFlagConfigs)
+	}
+	return copyFlagConfigs, storage.version
+}
+
+func (storage *inMemoryFlagConfigStorage) getFlagConfigWithDependencies(key string) map[string]*evaluation.Flag {
+	storage.flagConfigsLock.Lock()
+	defer storage.flagConfigsLock.Unlock()
+	result := make(map[string]*evaluation.Flag)
+	keys := []string{key}
+	for len(keys) > 0 {
+		key, keys = keys[0], keys[1:]
+		if _, ok := result[key]; ok {
+			continue
+		}
+		if flag, ok := storage.flagConfigs[key]; ok {
+			result[key] = flag
+			keys = append(keys, flag.Dependencies...)
+		}
+	}
+	return result
+}
+
 func (storage *inMemoryFlagConfigStorage) getFlagConfigsArray() []*evaluation.Flag {
 	storage.flagConfigsLock.Lock()
 	defer storage.flagConfigsLock.Unlock()
@@ -60,6 +106,7 @@ func (storage *inMemoryFlagConfigStorage) putFlagConfig(flagConfig *evaluation.F
 	storage.flagConfigsLock.Lock()
 	defer storage.flagConfigsLock.Unlock()
 	storage.flagConfigs[flagConfig.Key] = flagConfig
+	storage.version = ""
 }
 
 func (storage *inMemoryFlagConfigStorage) removeIf(condition func(*evaluation.Flag) bool) {
@@ -68,6 +115,30 @@ func (storage *inMemoryFlagConfigStorage) removeIf(condition func(*evaluation.Fl
 	for key, value := range storage.flagConfigs {
 		if condition(value) {
 			delete(storage.flagConfigs, key)
+			storage.version = ""
 		}
 	}
 }
+
+func (storage *inMemoryFlagConfigStorage) replaceFlagConfigs(flagConfigs map[string]*evaluation.Flag) {
+	copyFlagConfigs := make(map[string]*evaluation.Flag, len(flagConfigs))
+	for key, value := range flagConfigs {
+		copyFlagConfigs[key] = value
+	}
+	storage.flagConfigsLock.Lock()
+	defer storage.flagConfigsLock.Unlock()
+	storage.flagConfigs = copyFlagConfigs
+	storage.version = ""
+}
+
+func (storage *inMemoryFlagConfigStorage) getLastUpdated() time.Time {
+	storage.flagConfigsLock.Lock()
+	defer storage.flagConfigsLock.Unlock()
+	return storage.lastUpdated
+}
+
+func (storage *inMemoryFlagConfigStorage) setLastUpdated(lastUpdated time.Time) {
+	storage.flagConfigsLock.Lock()
+	defer storage.flagConfigsLock.Unlock()
+	storage.lastUpdated = lastUpdated
+}
@@ -0,0 +1,39 @@
+package local
+
+import (
+	"testing"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetFlagConfigWithDependencies(t *testing.T) {
+	storage := newInMemoryFlagConfigStorage()
+	a := &evaluation.Flag{Key: "a", Dependencies: []string{"b", "missing"}}
+	b := &evaluation.Flag{Key: "b", Dependencies: []string{"c"}}
+	c := &evaluation.Flag{Key: "c", Dependencies: []string{"a"}}
+	storage.replaceFlagConfigs(map[string]*evaluation.Flag{"a": a, "b": b, "c": c, "d": {Key: "d"}})
+	assert.Equal(t, map[string]*evaluation.Flag{"a": a, "b": b, "c": c}, storage.getFlagConfigWithDependencies("a"))
+	assert.Empty(t, storage.getFlagConfigWithDependencies("missing"))
+}
+
+func TestGetFlagConfigsWithVersion(t *testing.T) {
+	a := newInMemoryFlagConfigStorage()
+	b := newInMemoryFlagConfigStorage()
+	flag := &evaluation.Flag{Key: "flag", Variants: map[string]*evaluation.Variant{"on": {Key: "on"}}}
+	a.replaceFlagConfigs(map[string]*evaluation.Flag{"flag": flag, "other": {Key: "other"}})
+	b.putFlagConfig(&evaluation.Flag{Key: "other"})
+	b.putFlagConfig(&evaluation.Flag{Key: "flag", Variants: map[string]*evaluation.Variant{"on": {Key: "on"}}})
+	flags, version := a.getFlagConfigsWithVersion()
+	_, otherVersion := b.getFlagConfigsWithVersion()
+	assert.Len(t, flags, 2)
+	assert.NotEmpty(t, version)
+	assert.Equal(t, version, otherVersion)
+
+	b.putFlagConfig(&evaluation.Flag{Key: "flag", Variants: map[string]*evaluation.Variant{"off": {Key: "off"}}})
+	_, changedVersion := b.getFlagConfigsWithVersion()
+	assert.NotEqual(t, version, changedVersion)
+	b.removeIf(func(f *evaluation.Flag) bool { return f.Key == "other" })
+	_, removedVersion := b.getFlagConfigsWithVersion()
+	assert.NotEqual(t, changedVersion, removedVersion)
+}
@@ -1,34 +1,101 @@
 package local
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
 	"net/url"
 	"sync"
 	"time"
 
 	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/amplitude/experiment-go-server/internal/logger"
 )
 
 const streamApiMaxJitter = 5 * time.Second
 const streamApiKeepaliveTimeout = 17 * time.Second
 const streamApiReconnInterval = 15 * time.Minute
+const streamApiUpdateBufferSize = 16
+const streamApiConnectRetryDelay = 500 * time.Millisecond
+
+// streamApiMaxConnectRetryDelay is the longest a failed connection waits before it is retried. A
+// connection whose retry is delayed longer, e.g. by a Retry-After header, fails, so flag configs are
+// polled meanwhile.
+const streamApiMaxConnectRetryDelay = 30 * time.Second
+
+const flagConfigChangeOpPut = "put"
+const flagConfigChangeOpDelete = "delete"
+
+// flagConfigDelta is a stream message which changes only some flags. Full snapshots are sent as a
+// JSON array of flags, while deltas are sent as a JSON object:
+//
+//	{"type": "delta", "changes": [{"op": "put", "flag": {...}}, {"op": "delete", "key": "flag-key"}]}
+//
+// Put adds or replaces the flag with the flag's key, and delete removes the flag with the key.
+type flagConfigDelta struct {
+	Type    string             `json:"type"`
+	Changes []flagConfigChange `json:"changes"`
+}
+
+type flagConfigChange struct {
+	Op   string           `json:"op"`
+	Key  string           `json:"key,omitempty"`
+	Flag *evaluation.Flag `json:"flag,omitempty"`
+}
+
+// apply returns a copy of the flags with the delta's changes applied.
+func (d *flagConfigDelta) apply(flags map[string]*evaluation.Flag) map[string]*evaluation.Flag {
+	result := make(map[string]*evaluation.Flag, len(flags))
+	for key, flag := range flags {
+		result[key] = flag
+	}
+	for _, change := range d.Changes {
+		switch change.Op {
+		case flagConfigChangeOpPut:
+			result[change.Flag.Key] = change.Flag
+		case flagConfigChangeOpDelete:
+			delete(result, change.Key)
+		}
+	}
+	return result
+}
 
 type flagConfigStreamApi interface {
+	// Connect connects to the stream. The first message must be a full snapshot of the flag configs,
+	// which is passed to onInitUpdate. Later snapshots are passed to onUpdate, and delta updates to
+	// onDelta. If onDelta is nil, delta updates are applied to the latest flag configs, which are
+	// passed to onUpdate. Updates are delivered in order.
 	Connect(
 		onInitUpdate func(map[string]*evaluation.Flag) error,
 		onUpdate func(map[string]*evaluation.Flag) error,
+		onDelta func(*flagConfigDelta) error,
 		onError func(error),
 	) error
 	Close()
 }
 
 type flagConfigStreamApiV2 struct {
-	DeploymentKey       string
-	ServerURL           string
-	connectionTimeout   time.Duration
-	stopCh              chan bool
-	lock                sync.Mutex
+	DeploymentKey     string
+	ServerURL         string
+	connectionTimeout time.Duration
+	keepaliveTimeout  time.Duration
+	reconnInterval    time.Duration
+	maxJitter         time.Duration
+	stopCh            chan bool
+	lock              sync.Mutex
+	log               *logger.Log
+	metrics           Metrics
+	// lenientInitParse skips initial messages which are not a valid flag config snapshot rather
+	// than failing to connect.
+	lenientInitParse bool
+	// queryParams are added to the stream URL's query.
+	queryParams map[string]string
+	// connectRetries is the number of times a failed initial connection is retried, waiting
+	// connectRetryDelay before the first retry and doubling the delay for each further retry.
+	connectRetries      int
+	connectRetryDelay   time.Duration
 	newSseStreamFactory func(
 		authToken,
 		url string,
@@ -37,6 +104,22 @@ type flagConfigStreamApiV2 struct {
 		reconnInterval time.Duration,
 		maxJitter time.Duration,
 	) stream
+	// goroutines, if set, counts the goroutines which receive and deliver stream messages.
+	goroutines *goroutineCounter
+	// retryClassifier, if set, decides whether and when failed connections are retried, rather
+	// than isRetryableStreamConnectError.
+	retryClassifier func(resp *http.Response, err error) RetryDecision
+	// attempted is whether a connection was attempted, and reconnectAttempts is the number of
+	// connection attempts since the stream was last connected. Both are guarded by lock.
+	attempted         bool
+	reconnectAttempts int
+	// lastMessage is the time the latest stream message was received, guarded by messageLock.
+	messageLock sync.Mutex
+	lastMessage time.Time
+	// connectCancel is closed by Close to stop Connect from waiting to retry a failed connection. It
+	// is guarded by cancelLock rather than lock, which Connect holds while waiting.
+	cancelLock    sync.Mutex
+	connectCancel chan struct{}
 }
 
 func newFlagConfigStreamApiV2(
@@ -48,8 +131,14 @@ func newFlagConfigStreamApiV2(
 		DeploymentKey:       deploymentKey,
 		ServerURL:           serverURL,
 		connectionTimeout:   connectionTimeout,
+		keepaliveTimeout:    streamApiKeepaliveTimeout,
+		reconnInterval:      streamApiReconnInterval,
+		maxJitter:           streamApiMaxJitter,
+		connectRetryDelay:   streamApiConnectRetryDelay,
 		stopCh:              nil,
 		lock:                sync.Mutex{},
+		log:                 logger.New(false),
+		metrics:             noopMetrics{},
 		newSseStreamFactory: newSseStream,
 	}
 }
@@ -57,6 +146,7 @@ func newFlagConfigStreamApiV2(
 func (api *flagConfigStreamApiV2) Connect(
 	onInitUpdate func(map[string]*evaluation.Flag) error,
 	onUpdate func(map[string]*evaluation.Flag) error,
+	onDelta func(*flagConfigDelta) error,
 	onError func(error),
 ) error {
 	api.lock.Lock()
@@ -70,50 +160,60 @@ func (api *flagConfigStreamApiV2) Connect(
 		return err
 	}
 	endpoint.Path = "sdk/stream/v1/flags"
+	setQueryParams(endpoint, api.queryParams)
 
-	// Create Stream.
-	stream := api.newSseStreamFactory("Api-Key "+api.DeploymentKey, endpoint.String(), api.connectionTimeout, streamApiKeepaliveTimeout, streamApiReconnInterval, streamApiMaxJitter)
-
-	streamMsgCh := make(chan streamEvent)
-	streamErrCh := make(chan error)
-
-	closeStream := func() {
-		stream.Cancel()
-		close(streamMsgCh)
-		close(streamErrCh)
-	}
-
-	// Connect.
-	stream.Connect(streamMsgCh, streamErrCh)
-
-	// Retrieve first flag configs and parse it.
-	// If any error here means init error.
-	select {
-	case msg := <-streamMsgCh:
-		// Parse message and verify data correct.
-		flags, err := parseData(msg.data)
-		if err != nil {
-			closeStream()
-			return errors.New("flag config stream api corrupt data, cause: " + err.Error())
+	var flags map[string]*evaluation.Flag
+	var streamMsgCh chan streamEvent
+	var streamErrCh chan error
+	var closeStream func()
+	cancelCh := make(chan struct{})
+	api.cancelLock.Lock()
+	api.connectCancel = cancelCh
+	api.cancelLock.Unlock()
+	defer func() {
+		api.cancelLock.Lock()
+		defer api.cancelLock.Unlock()
+		if api.connectCancel == cancelCh {
+			api.connectCancel = nil
 		}
-		if onInitUpdate != nil {
-			err = onInitUpdate(flags)
-		} else if onUpdate != nil {
-			err = onUpdate(flags)
+	}()
+	retryDelay := api.connectRetryDelay
+	for attempt := 0; ; attempt++ {
+		var retry RetryDecision
+		if api.attempted {
+			api.reconnectAttempts++
+			api.metrics.OnStreamReconnect(api.reconnectAttempts)
 		}
-		if err != nil {
-			closeStream()
+		api.attempted = true
+		flags, streamMsgCh, streamErrCh, closeStream, retry, err = api.connectInit(endpoint.String(), onInitUpdate, onUpdate)
+		if err == nil {
+			break
+		}
+		api.metrics.OnStreamError(err)
+		if !retry.Retry || attempt >= api.connectRetries {
 			return err
 		}
-	case err := <-streamErrCh:
-		// Error when creating the stream.
-		closeStream()
-		return err
-	case <-time.After(api.connectionTimeout):
-		// Timed out.
-		closeStream()
-		return errors.New("flag config stream api connect timeout")
+		delay := retryDelay
+		if retry.Delay > streamApiMaxConnectRetryDelay {
+			api.log.Debug("Not retrying flag config stream connection, retry requested in %v", retry.Delay)
+			return err
+		} else if retry.Delay > 0 {
+			delay = retry.Delay
+		} else if delay > streamApiMaxConnectRetryDelay {
+			delay = streamApiMaxConnectRetryDelay
+		}
+		api.log.Debug("Retrying flag config stream connection in %v, cause: %v", delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-cancelCh:
+			timer.Stop()
+			return errors.New("flag config stream connection closed, cause: " + err.Error())
+		}
+		retryDelay *= 2
 	}
+	api.reconnectAttempts = 0
+	api.metrics.OnStreamConnect()
 
 	// Prep procedures for stopping.
 	stopCh := make(chan bool)
@@ -129,43 +229,184 @@ func (api *flagConfigStreamApiV2) Connect(
 		close(stopCh)
 	}
 
+	// Recover panics in callbacks, so a panicking callback doesn't crash the process. Updates which
+	// panic are skipped like updates which return an error.
+	callUpdate := func(update func()) {
+		defer recoverPanic(api.log, api.metrics, "flag config stream update")
+		update()
+	}
+	callOnError := func(err error) {
+		defer recoverPanic(api.log, api.metrics, "flag config stream error callback")
+		if onError != nil {
+			onError(err)
+		}
+	}
+
+	// Deliver updates in order on a separate goroutine, so slow updates, e.g. waiting on cohort
+	// downloads, don't block the stream. Delta updates must be applied in order.
+	updateCh := make(chan func(), streamApiUpdateBufferSize)
+	api.goroutines.run(func() {
+		for {
+			select {
+			case <-stopCh:
+				return
+			case update := <-updateCh:
+				callUpdate(update)
+			}
+		}
+	})
+
 	// Retrieve and pass on message forever until stopCh closes.
-	go func() {
+	api.goroutines.run(func() {
 		for {
 			select {
 			case <-stopCh: // Channel returns immediately when closed. Note the local channel is referred here, so it's guaranteed to not be nil.
 				closeStream()
 				return
 			case msg := <-streamMsgCh:
+				api.onMessage()
 				// Parse message and verify data correct.
-				flags, err := parseData(msg.data)
+				snapshot, delta, err := parseStreamData(msg.data)
 				if err != nil {
 					// Error, close everything.
 					closeAll()
-					if onError != nil {
-						onError(errors.New("stream corrupt data, cause: " + err.Error()))
-					}
+					err = errors.New("stream corrupt data, cause: " + err.Error())
+					api.metrics.OnStreamError(err)
+					callOnError(err)
 					return
 				}
-				if onUpdate != nil {
-					// Deliver async. Don't care about any errors.
-					//nolint:errcheck
-					go func() { onUpdate(flags) }()
+				if delta != nil {
+					flags = delta.apply(flags)
+				} else {
+					flags = snapshot
+				}
+				var update func()
+				if delta != nil && onDelta != nil {
+					update = func() {
+						// Don't care about any errors.
+						//nolint:errcheck
+						onDelta(delta)
+					}
+				} else if onUpdate != nil {
+					latest := flags
+					update = func() {
+						// Don't care about any errors.
+						//nolint:errcheck
+						onUpdate(latest)
+					}
+				}
+				if update != nil {
+					select {
+					case updateCh <- update:
+					case <-stopCh:
+						closeStream()
+						return
+					}
 				}
 			case err := <-streamErrCh:
 				// Error, close everything.
 				closeAll()
-				if onError != nil {
-					onError(err)
-				}
+				api.metrics.OnStreamError(err)
+				callOnError(err)
 				return
 			}
 		}
-	}()
+	})
 
 	return nil
 }
 
+// connectInit connects a stream and waits for the first full snapshot of the flag configs, which is
+// passed to onInitUpdate. If the connection fails, the stream is closed and the error is returned
+// with whether and when to connect again. Corrupt data and failed updates would fail again, while
+// timeouts and connection errors are classified by classifyConnectError.
+func (api *flagConfigStreamApiV2) connectInit(
+	url string,
+	onInitUpdate func(map[string]*evaluation.Flag) error,
+	onUpdate func(map[string]*evaluation.Flag) error,
+) (map[string]*evaluation.Flag, chan streamEvent, chan error, func(), RetryDecision, error) {
+	var flags map[string]*evaluation.Flag
+	var err error
+
+	// Create Stream.
+	stream := api.newSseStreamFactory("Api-Key "+api.DeploymentKey, url, api.connectionTimeout, api.keepaliveTimeout, api.reconnInterval, api.maxJitter)
+
+	streamMsgCh := make(chan streamEvent)
+	streamErrCh := make(chan error)
+
+	closeStream := func() {
+		stream.Cancel()
+		close(streamMsgCh)
+		close(streamErrCh)
+	}
+
+	// Connect.
+	stream.Connect(streamMsgCh, streamErrCh)
+
+	// Retrieve first flag configs and parse it.
+	// If any error here means init error.
+	connectTimeout := time.After(api.connectionTimeout)
+	for flags == nil {
+		select {
+		case msg := <-streamMsgCh:
+			api.onMessage()
+			// Parse message and verify data correct.
+			var delta *flagConfigDelta
+			flags, delta, err = parseStreamData(msg.data)
+			if err == nil && delta != nil {
+				flags = nil
+				err = errors.New("first message is not a full snapshot")
+			}
+			if err != nil && api.lenientInitParse {
+				api.log.Debug("Skipping initial flag config stream message, cause: %v", err)
+				flags = nil
+				continue
+			}
+			if err != nil {
+				closeStream()
+				return nil, nil, nil, nil, RetryDecision{}, errors.New("flag config stream api corrupt data, cause: " + err.Error())
+			}
+			if onInitUpdate != nil {
+				err = onInitUpdate(flags)
+			} else if onUpdate != nil {
+				err = onUpdate(flags)
+			}
+			if err != nil {
+				closeStream()
+				return nil, nil, nil, nil, RetryDecision{}, err
+			}
+		case err := <-streamErrCh:
+			// Error when creating the stream.
+			closeStream()
+			return nil, nil, nil, nil, api.classifyConnectError(err), err
+		case <-connectTimeout:
+			// Timed out.
+			closeStream()
+			err = errors.New("flag config stream api connect timeout")
+			return nil, nil, nil, nil, api.classifyConnectError(err), err
+		}
+	}
+	return flags, streamMsgCh, streamErrCh, closeStream, RetryDecision{}, nil
+}
+
+// classifyConnectError returns whether and when to connect again after a timeout or stream error.
+func (api *flagConfigStreamApiV2) classifyConnectError(err error) RetryDecision {
+	if api.retryClassifier != nil {
+		return classifyRetry(api.retryClassifier, err)
+	}
+	return RetryDecision{Retry: isRetryableStreamConnectError(err)}
+}
+
+// isRetryableStreamConnectError returns false for responses which would be the same if the stream
+// connected again, i.e. client errors such as an unauthorized deployment key, other than request
+// timeouts and rate limiting.
+func isRetryableStreamConnectError(err error) bool {
+	if httpErr, ok := err.(*httpErrorResponseException); ok {
+		return isRetryableStatusCode(httpErr.StatusCode)
+	}
+	return true
+}
+
 func parseData(data []byte) (map[string]*evaluation.Flag, error) {
 
 	var flagsArray []*evaluation.Flag
@@ -181,6 +422,61 @@ func parseData(data []byte) (map[string]*evaluation.Flag, error) {
 	return flags, nil
 }
 
+// parseStreamData parses a stream message as either a full snapshot of flags or a delta.
+func parseStreamData(data []byte) (map[string]*evaluation.Flag, *flagConfigDelta, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		flags, err := parseData(data)
+		return flags, nil, err
+	}
+	var delta flagConfigDelta
+	if err := json.Unmarshal(trimmed, &delta); err != nil {
+		return nil, nil, err
+	}
+	if delta.Type != "delta" {
+		return nil, nil, fmt.Errorf("unknown message type %q", delta.Type)
+	}
+	for _, change := range delta.Changes {
+		switch change.Op {
+		case flagConfigChangeOpPut:
+			if change.Flag == nil || change.Flag.Key == "" {
+				return nil, nil, errors.New("put change without a flag")
+			}
+		case flagConfigChangeOpDelete:
+			if change.Key == "" {
+				return nil, nil, errors.New("delete change without a key")
+			}
+		default:
+			return nil, nil, fmt.Errorf("unknown change op %q", change.Op)
+		}
+	}
+	return nil, &delta, nil
+}
+
+// onMessage records the time a stream message was received.
+func (api *flagConfigStreamApiV2) onMessage() {
+	api.messageLock.Lock()
+	api.lastMessage = time.Now()
+	api.messageLock.Unlock()
+	api.metrics.OnStreamMessage()
+}
+
+// lastMessageTime returns the time the latest stream message was received, or the zero time if no
+// message was received.
+func (api *flagConfigStreamApiV2) lastMessageTime() time.Time {
+	api.messageLock.Lock()
+	defer api.messageLock.Unlock()
+	return api.lastMessage
+}
+
+// setDeploymentKey changes the deployment key of later connections. The current connection, if any,
+// keeps the key it connected with.
+func (api *flagConfigStreamApiV2) setDeploymentKey(deploymentKey string) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	api.DeploymentKey = deploymentKey
+}
+
 func (api *flagConfigStreamApiV2) closeInternal() {
 	if api.stopCh != nil {
 		close(api.stopCh)
@@ -188,6 +484,13 @@ func (api *flagConfigStreamApiV2) closeInternal() {
 	}
 }
 func (api *flagConfigStreamApiV2) Close() {
+	api.cancelLock.Lock()
+	if api.connectCancel != nil {
+		close(api.connectCancel)
+		api.connectCancel = nil
+	}
+	api.cancelLock.Unlock()
+
 	api.lock.Lock()
 	defer api.lock.Unlock()
 
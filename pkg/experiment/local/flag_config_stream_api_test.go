@@ -83,6 +83,7 @@ func TestFlagConfigStreamApi(t *testing.T) {
 			receivedMsgCh <- m
 			return nil
 		},
+		nil,
 		func(err error) { receivedErrCh <- err },
 	)
 	assert.Nil(t, err)
@@ -104,7 +105,7 @@ func TestFlagConfigStreamApiErrorNoInitialFlags(t *testing.T) {
 		// On connect.
 		<-sse.chConnected
 	}()
-	err := api.Connect(nil, nil, nil)
+	err := api.Connect(nil, nil, nil, nil)
 	assert.Equal(t, errors.New("flag config stream api connect timeout"), err)
 }
 
@@ -125,6 +126,7 @@ func TestFlagConfigStreamApiErrorCorruptInitialFlags(t *testing.T) {
 	err := api.Connect(
 		func(m map[string]*evaluation.Flag) error { receivedMsgCh <- m; return nil },
 		func(m map[string]*evaluation.Flag) error { receivedMsgCh <- m; return nil },
+		nil,
 		func(err error) { receivedErrCh <- err },
 	)
 	assert.Equal(t, "flag config stream api corrupt data", strings.Split(err.Error(), ", cause: ")[0])
@@ -147,6 +149,7 @@ func TestFlagConfigStreamApiErrorInitialFlagsUpdateFailStopsApi(t *testing.T) {
 	err := api.Connect(
 		func(m map[string]*evaluation.Flag) error { return errors.New("bad update") },
 		func(m map[string]*evaluation.Flag) error { receivedMsgCh <- m; return nil },
+		nil,
 		func(err error) { receivedErrCh <- err },
 	)
 	assert.Equal(t, errors.New("bad update"), err)
@@ -168,6 +171,7 @@ func TestFlagConfigStreamApiErrorInitialFlagsFutureUpdateFailDoesntStopApi(t *te
 	err := api.Connect(
 		func(m map[string]*evaluation.Flag) error { receivedMsgCh <- m; return nil },
 		func(m map[string]*evaluation.Flag) error { return errors.New("bad update") },
+		nil,
 		func(err error) { receivedErrCh <- err },
 	)
 	assert.Nil(t, err)
@@ -193,6 +197,7 @@ func TestFlagConfigStreamApiErrorDuringStreaming(t *testing.T) {
 	err := api.Connect(
 		func(m map[string]*evaluation.Flag) error { receivedMsgCh <- m; return nil },
 		func(m map[string]*evaluation.Flag) error { receivedMsgCh <- m; return nil },
+		nil,
 		func(err error) { receivedErrCh <- err },
 	)
 	assert.Nil(t, err)
@@ -205,3 +210,263 @@ func TestFlagConfigStreamApiErrorDuringStreaming(t *testing.T) {
 	sse.messageCh <- streamEvent{data: FLAG_1_STR}
 	assert.Fail(t, "Unexpected message after error")
 }
+
+var FLAG_DELTA_STR = []byte(`{"type":"delta","changes":[{"op":"put","flag":{"key":"flagkey2","variants":{},"segments":[]}},{"op":"delete","key":"flagkey"}]}`)
+
+func TestFlagConfigStreamApiDeltaFallsBackToUpdate(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	receivedMsgCh := make(chan map[string]*evaluation.Flag, 1)
+
+	go func() {
+		<-sse.chConnected
+		sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	}()
+	err := api.Connect(
+		nil,
+		func(m map[string]*evaluation.Flag) error { receivedMsgCh <- m; return nil },
+		nil,
+		nil,
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, FLAG_1, <-receivedMsgCh)
+
+	go func() { sse.messageCh <- streamEvent{data: FLAG_DELTA_STR} }()
+	flags := <-receivedMsgCh
+	assert.Equal(t, 1, len(flags))
+	assert.Equal(t, "flagkey2", flags["flagkey2"].Key)
+
+	api.Close()
+}
+
+func TestFlagConfigStreamApiDelta(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	receivedDeltaCh := make(chan *flagConfigDelta)
+
+	go func() {
+		<-sse.chConnected
+		sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	}()
+	err := api.Connect(
+		func(m map[string]*evaluation.Flag) error { return nil },
+		func(m map[string]*evaluation.Flag) error { return nil },
+		func(d *flagConfigDelta) error { receivedDeltaCh <- d; return nil },
+		nil,
+	)
+	assert.Nil(t, err)
+
+	go func() { sse.messageCh <- streamEvent{data: FLAG_DELTA_STR} }()
+	delta := <-receivedDeltaCh
+	assert.Equal(t, 2, len(delta.Changes))
+	assert.Equal(t, flagConfigChangeOpPut, delta.Changes[0].Op)
+	assert.Equal(t, "flagkey2", delta.Changes[0].Flag.Key)
+	assert.Equal(t, flagConfigChangeOpDelete, delta.Changes[1].Op)
+	assert.Equal(t, "flagkey", delta.Changes[1].Key)
+
+	api.Close()
+}
+
+func TestFlagConfigStreamApiErrorInitialDelta(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+
+	go func() {
+		<-sse.chConnected
+		sse.messageCh <- streamEvent{data: FLAG_DELTA_STR}
+	}()
+	err := api.Connect(nil, nil, nil, nil)
+	assert.Equal(t, "flag config stream api corrupt data", strings.Split(err.Error(), ", cause: ")[0])
+}
+
+func TestParseStreamDataInvalidDelta(t *testing.T) {
+	for _, data := range []string{
+		`{"type":"unknown","changes":[]}`,
+		`{"type":"delta","changes":[{"op":"put"}]}`,
+		`{"type":"delta","changes":[{"op":"delete"}]}`,
+		`{"type":"delta","changes":[{"op":"patch","key":"flagkey"}]}`,
+	} {
+		_, _, err := parseStreamData([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
+
+func TestFlagConfigStreamApiRecoversPanickingUpdate(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	metrics := &mockMetrics{}
+	api.metrics = metrics
+	receivedMsgCh := make(chan map[string]*evaluation.Flag)
+	updates := 0
+
+	go func() {
+		<-sse.chConnected
+		sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	}()
+	err := api.Connect(
+		func(m map[string]*evaluation.Flag) error { return nil },
+		func(m map[string]*evaluation.Flag) error {
+			updates++
+			if updates == 1 {
+				panic("update panic")
+			}
+			receivedMsgCh <- m
+			return nil
+		},
+		nil,
+		nil,
+	)
+	assert.Nil(t, err)
+
+	sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	assert.Equal(t, FLAG_1, <-receivedMsgCh)
+	assert.Equal(t, []string{"flag config stream update"}, metrics.panicSources())
+
+	api.Close()
+}
+
+func TestFlagConfigStreamApiLenientInitParse(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	api.lenientInitParse = true
+	receivedMsgCh := make(chan map[string]*evaluation.Flag, 1)
+
+	go func() {
+		<-sse.chConnected
+		sse.messageCh <- streamEvent{data: []byte("")}
+		sse.messageCh <- streamEvent{data: []byte("bad data")}
+		sse.messageCh <- streamEvent{data: FLAG_DELTA_STR}
+		sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	}()
+	err := api.Connect(
+		func(m map[string]*evaluation.Flag) error { receivedMsgCh <- m; return nil },
+		nil,
+		nil,
+		nil,
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, FLAG_1, <-receivedMsgCh)
+
+	api.Close()
+}
+
+func TestFlagConfigStreamApiLenientInitParseTimeout(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 100*time.Millisecond)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	api.lenientInitParse = true
+
+	go func() {
+		<-sse.chConnected
+		sse.messageCh <- streamEvent{data: []byte("bad data")}
+	}()
+	err := api.Connect(nil, nil, nil, nil)
+	assert.Equal(t, errors.New("flag config stream api connect timeout"), err)
+}
+
+func TestFlagConfigStreamApiQueryParams(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "https://stream.example.com", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	api.queryParams = map[string]string{"capabilities": "delta"}
+
+	go func() {
+		<-sse.chConnected
+		sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	}()
+	err := api.Connect(nil, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://stream.example.com/sdk/stream/v1/flags?capabilities=delta", sse.url)
+
+	api.Close()
+}
+
+func TestFlagConfigStreamApiRetriesInitialConnect(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	api.connectRetries = 2
+	api.connectRetryDelay = time.Millisecond
+	receivedMsgCh := make(chan map[string]*evaluation.Flag, 1)
+
+	go func() {
+		<-sse.chConnected
+		sse.errorCh <- errors.New("stream disconnected error")
+		<-sse.chConnected
+		sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	}()
+	err := api.Connect(
+		func(m map[string]*evaluation.Flag) error { receivedMsgCh <- m; return nil },
+		nil,
+		nil,
+		nil,
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, FLAG_1, <-receivedMsgCh)
+	api.Close()
+}
+
+func TestFlagConfigStreamApiDoesNotRetryUnauthorized(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	api.connectRetries = 2
+	api.connectRetryDelay = time.Millisecond
+	unauthorized := &httpErrorResponseException{StatusCode: http.StatusUnauthorized, Message: "could not connect to stream: Unauthorized"}
+
+	go func() {
+		<-sse.chConnected
+		sse.errorCh <- unauthorized
+	}()
+	err := api.Connect(nil, nil, nil, nil)
+	assert.Equal(t, unauthorized, err)
+}
+
+func TestIsRetryableStreamConnectError(t *testing.T) {
+	assert.True(t, isRetryableStreamConnectError(errors.New("stream connection timeout")))
+	assert.True(t, isRetryableStreamConnectError(&httpErrorResponseException{StatusCode: http.StatusServiceUnavailable}))
+	assert.True(t, isRetryableStreamConnectError(&httpErrorResponseException{StatusCode: http.StatusTooManyRequests}))
+	assert.False(t, isRetryableStreamConnectError(&httpErrorResponseException{StatusCode: http.StatusUnauthorized}))
+	assert.False(t, isRetryableStreamConnectError(&httpErrorResponseException{StatusCode: http.StatusForbidden}))
+}
+
+func TestFlagConfigStreamApiStreamTimeouts(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	api.keepaliveTimeout = 30 * time.Second
+	api.reconnInterval = 5 * time.Minute
+
+	go func() {
+		<-sse.chConnected
+		sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	}()
+	err := api.Connect(nil, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1*time.Second, sse.connectionTimeout)
+	assert.Equal(t, 30*time.Second, sse.keepaliveTimeout)
+	assert.Equal(t, 5*time.Minute, sse.reconnInterval)
+	api.Close()
+}
+
+func TestFlagConfigStreamApiSetDeploymentKey(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	api.setDeploymentKey("rotatedkey")
+
+	go func() {
+		<-sse.chConnected
+		sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	}()
+	err := api.Connect(nil, nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "Api-Key rotatedkey", sse.authToken)
+	api.Close()
+}
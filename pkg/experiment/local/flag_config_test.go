@@ -219,3 +219,20 @@ func getTestFlags() []*evaluation.Flag {
 		},
 	}
 }
+
+func TestDiffFlagConfigs(t *testing.T) {
+	previous := map[string]*evaluation.Flag{
+		"unchanged": {Key: "unchanged", Metadata: map[string]interface{}{"flagVersion": 1}},
+		"changed":   {Key: "changed", Metadata: map[string]interface{}{"flagVersion": 1}},
+		"removed":   {Key: "removed"},
+	}
+	next := map[string]*evaluation.Flag{
+		"unchanged": {Key: "unchanged", Metadata: map[string]interface{}{"flagVersion": 1}},
+		"changed":   {Key: "changed", Metadata: map[string]interface{}{"flagVersion": 2}},
+		"added":     {Key: "added"},
+	}
+	added, removed, changed := diffFlagConfigs(previous, next)
+	assert.Equal(t, []string{"added"}, added)
+	assert.Equal(t, []string{"removed"}, removed)
+	assert.Equal(t, []string{"changed"}, changed)
+}
@@ -1,6 +1,9 @@
 package local
 
 import (
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -24,6 +27,73 @@ type flagConfigUpdaterBase struct {
 	cohortStorage     cohortStorage
 	cohortLoader      *cohortLoader
 	log               *logger.Log
+	// errorLog throttles errors which repeat while the flag config source is unavailable.
+	errorLog          *logger.Throttled
+	metrics           Metrics
+	cohortGracePeriod time.Duration
+	// updateListeners, if set, are notified of the flags changed by each update.
+	updateListeners *flagConfigUpdateListeners
+	// goroutines, if set, counts the updater's goroutines.
+	goroutines *goroutineCounter
+}
+
+// flagConfigUpdateListeners are the listeners registered with Client.OnFlagConfigUpdate and
+// Client.OnMissingDependencies, shared by the poller and streamer. Refresh listeners are notified
+// of every successful update, even if it changed nothing.
+type flagConfigUpdateListeners struct {
+	lock                       sync.Mutex
+	listeners                  []func(changedKeys []string)
+	missingDependencyListeners []func(missing map[string][]string)
+	refreshListeners           []func()
+}
+
+func (l *flagConfigUpdateListeners) add(fn func(changedKeys []string)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.listeners = append(l.listeners, fn)
+}
+
+func (l *flagConfigUpdateListeners) notify(changedKeys []string) {
+	l.lock.Lock()
+	listeners := append([]func([]string){}, l.listeners...)
+	l.lock.Unlock()
+	for _, listener := range listeners {
+		listener(append([]string{}, changedKeys...))
+	}
+}
+
+func (l *flagConfigUpdateListeners) addRefresh(fn func()) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refreshListeners = append(l.refreshListeners, fn)
+}
+
+func (l *flagConfigUpdateListeners) notifyRefresh() {
+	l.lock.Lock()
+	listeners := append([]func(){}, l.refreshListeners...)
+	l.lock.Unlock()
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+func (l *flagConfigUpdateListeners) addMissingDependencies(fn func(missing map[string][]string)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.missingDependencyListeners = append(l.missingDependencyListeners, fn)
+}
+
+func (l *flagConfigUpdateListeners) notifyMissingDependencies(missing map[string][]string) {
+	l.lock.Lock()
+	listeners := append([]func(map[string][]string){}, l.missingDependencyListeners...)
+	l.lock.Unlock()
+	for _, listener := range listeners {
+		copied := make(map[string][]string, len(missing))
+		for key, dependencies := range missing {
+			copied[key] = append([]string{}, dependencies...)
+		}
+		listener(copied)
+	}
 }
 
 func newFlagConfigUpdaterBase(
@@ -32,35 +102,104 @@ func newFlagConfigUpdaterBase(
 	cohortLoader *cohortLoader,
 	config *Config,
 ) flagConfigUpdaterBase {
+	var cohortGracePeriod time.Duration
+	if config.CohortSyncConfig != nil {
+		cohortGracePeriod = config.CohortSyncConfig.UpdateGracePeriod
+	}
+	log := logger.New(config.Debug)
 	return flagConfigUpdaterBase{
 		flagConfigStorage: flagConfigStorage,
 		cohortStorage:     cohortStorage,
 		cohortLoader:      cohortLoader,
-		log:               logger.New(config.Debug),
+		log:               log,
+		errorLog:          logger.NewThrottled(log, config.LogThrottleInterval),
+		metrics:           metricsOrNoop(config.Metrics),
+		cohortGracePeriod: cohortGracePeriod,
 	}
 }
 
 // Updates the received flag configs into storage and download cohorts.
+// New cohorts are downloaded before the flag configs are swapped into storage, so that the first
+// evaluations of the updated flags see the cohorts they target.
 func (u *flagConfigUpdaterBase) update(flagConfigs map[string]*evaluation.Flag) error {
+	previousFlagConfigs := u.flagConfigStorage.getFlagConfigs()
 
-	flagKeys := make(map[string]struct{})
-	for _, flag := range flagConfigs {
-		flagKeys[flag.Key] = struct{}{}
+	if u.cohortLoader == nil {
+		u.log.Debug("Putting %d non-cohort flags", len(flagConfigs))
+		u.flagConfigStorage.replaceFlagConfigs(flagConfigs)
+		u.flagConfigStorage.setLastUpdated(time.Now())
+		u.onUpdated(previousFlagConfigs, flagConfigs)
+		u.onRefreshed()
+		return nil
 	}
 
-	u.flagConfigStorage.removeIf(func(f *evaluation.Flag) bool {
-		_, exists := flagKeys[f.Key]
-		return !exists
+	u.loadCohorts(flagConfigs)
+	u.flagConfigStorage.replaceFlagConfigs(flagConfigs)
+
+	// Delete unused cohorts
+	u.deleteUnusedCohorts()
+	u.log.Debug("Refreshed %d flag configs.", len(flagConfigs))
+	u.flagConfigStorage.setLastUpdated(time.Now())
+	u.onUpdated(previousFlagConfigs, flagConfigs)
+	u.onRefreshed()
+	u.cohortLoader.checkCohortsLoaded()
+
+	return nil
+}
+
+// Downloads the cohorts, waiting at most the cohort grace period if one is configured.
+func (u *flagConfigUpdaterBase) downloadCohorts(cohortIDs map[string]struct{}) {
+	if u.cohortGracePeriod <= 0 {
+		u.cohortLoader.downloadCohorts(cohortIDs)
+		return
+	}
+	done := make(chan struct{})
+	u.goroutines.run(func() {
+		u.cohortLoader.downloadCohorts(cohortIDs)
+		close(done)
 	})
+	timer := time.NewTimer(u.cohortGracePeriod)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		u.log.Error("Cohorts did not download within %v, applying flag config update", u.cohortGracePeriod)
+	}
+}
 
-	if u.cohortLoader == nil {
-		for _, flagConfig := range flagConfigs {
-			u.log.Debug("Putting non-cohort flag %s", flagConfig.Key)
-			u.flagConfigStorage.putFlagConfig(flagConfig)
+// Applies the changes of a delta update to the flag configs in storage, downloading cohorts
+// referenced by changed flags first. The updated flag configs are swapped into storage at once, so
+// evaluations never see a partially applied delta.
+func (u *flagConfigUpdaterBase) updateDelta(delta *flagConfigDelta) error {
+	previousFlagConfigs := u.flagConfigStorage.getFlagConfigs()
+	flagConfigs := delta.apply(previousFlagConfigs)
+
+	if u.cohortLoader != nil {
+		putFlagConfigs := make(map[string]*evaluation.Flag)
+		for _, change := range delta.Changes {
+			if change.Op == flagConfigChangeOpPut {
+				putFlagConfigs[change.Flag.Key] = change.Flag
+			}
 		}
-		return nil
+		u.loadCohorts(putFlagConfigs)
+	}
+	u.flagConfigStorage.replaceFlagConfigs(flagConfigs)
+	if u.cohortLoader != nil {
+		u.deleteUnusedCohorts()
 	}
+	u.log.Debug("Applied %d flag config changes.", len(delta.Changes))
+	u.flagConfigStorage.setLastUpdated(time.Now())
+	u.onUpdated(previousFlagConfigs, flagConfigs)
+	u.onRefreshed()
+	if u.cohortLoader != nil {
+		u.cohortLoader.checkCohortsLoaded()
+	}
+	return nil
+}
 
+// Downloads the cohorts referenced by the flag configs which are not in storage, and logs any
+// which failed to load.
+func (u *flagConfigUpdaterBase) loadCohorts(flagConfigs map[string]*evaluation.Flag) {
 	newCohortIDs := make(map[string]struct{})
 	for _, flagConfig := range flagConfigs {
 		for cohortID := range getAllCohortIDsFromFlag(flagConfig) {
@@ -72,7 +211,7 @@ func (u *flagConfigUpdaterBase) update(flagConfigs map[string]*evaluation.Flag)
 	cohortIDsToDownload := difference(newCohortIDs, existingCohortIDs)
 
 	// Download all new cohorts
-	u.cohortLoader.downloadCohorts(cohortIDsToDownload)
+	u.downloadCohorts(cohortIDsToDownload)
 
 	// Get updated set of cohort ids
 	updatedCohortIDs := u.cohortStorage.getCohortIds()
@@ -81,18 +220,43 @@ func (u *flagConfigUpdaterBase) update(flagConfigs map[string]*evaluation.Flag)
 		cohortIDs := getAllCohortIDsFromFlag(flagConfig)
 		missingCohorts := difference(cohortIDs, updatedCohortIDs)
 
-		u.flagConfigStorage.putFlagConfig(flagConfig)
 		u.log.Debug("Putting flag %s", flagConfig.Key)
 		if len(missingCohorts) != 0 {
 			u.log.Error("Flag %s - failed to load cohorts: %v", flagConfig.Key, missingCohorts)
 		}
 	}
+}
 
-	// Delete unused cohorts
-	u.deleteUnusedCohorts()
-	u.log.Debug("Refreshed %d flag configs.", len(flagConfigs))
+// Logs a one line info summary of the flags added, removed, and changed by an update, with the
+// version of the flag configs, and notifies the update listeners of the changed flag keys. Flags
+// which depend on flags which aren't loaded are logged and reported to the listeners. Nothing is
+// logged or notified if nothing changed.
+func (u *flagConfigUpdaterBase) onUpdated(previous, next map[string]*evaluation.Flag) {
+	added, removed, changed := diffFlagConfigs(previous, next)
+	if len(added) == 0 && len(removed) == 0 && len(changed) == 0 {
+		return
+	}
+	u.log.Info("Applied flag config update to version %s: %d added, %d removed, %d changed, %d total", flagConfigsVersion(next), len(added), len(removed), len(changed), len(next))
+	u.log.Debug("Flag config update added: %v, removed: %v, changed: %v", added, removed, changed)
+	if u.updateListeners != nil {
+		changedKeys := make([]string, 0, len(added)+len(removed)+len(changed))
+		changedKeys = append(append(append(changedKeys, added...), removed...), changed...)
+		sort.Strings(changedKeys)
+		u.updateListeners.notify(changedKeys)
+	}
+	if missing := getMissingDependencies(next); len(missing) > 0 {
+		u.log.Error("Flags depend on flags which are not loaded, and are evaluated as if the dependencies assigned no variant: %v", missing)
+		if u.updateListeners != nil {
+			u.updateListeners.notifyMissingDependencies(missing)
+		}
+	}
+}
 
-	return nil
+// Notifies the refresh listeners that the flag configs were successfully updated.
+func (u *flagConfigUpdaterBase) onRefreshed() {
+	if u.updateListeners != nil {
+		u.updateListeners.notifyRefresh()
+	}
 }
 
 func (u *flagConfigUpdaterBase) deleteUnusedCohorts() {
@@ -146,7 +310,11 @@ func (s *flagConfigStreamer) Start(onError func(error)) error {
 		func(flags map[string]*evaluation.Flag) error {
 			return s.update(flags)
 		},
+		func(delta *flagConfigDelta) error {
+			return s.updateDelta(delta)
+		},
 		func(err error) {
+			s.errorLog.Error("Flag config stream failed: %v", err)
 			s.Stop()
 			if onError != nil {
 				go func() {onError(err)}()
@@ -165,6 +333,11 @@ func (s *flagConfigStreamer) Stop() {
 	s.stopInternal()
 }
 
+// flagConfigPollRetries is the maximum number of retries of a failed poll, and flagConfigPollRetryDelay
+// the wait before the first retry, which doubles for each further retry.
+const flagConfigPollRetries = 2
+const flagConfigPollRetryDelay = 500 * time.Millisecond
+
 // The poller for flag configs. It polls every configured interval.
 // On start, it polls a set of flag configs. If failed, error is returned. If success, poller starts.
 type flagConfigPoller struct {
@@ -173,6 +346,12 @@ type flagConfigPoller struct {
 	config        *Config
 	poller        *poller
 	lock          sync.Mutex
+	// retryBudget limits retries of failed polls.
+	retryBudget *retryBudget
+	// pollsDelayedUntil is the time until which polls are skipped, as requested by a retry delay
+	// longer than the poll interval. It's guarded by delayLock.
+	delayLock         sync.Mutex
+	pollsDelayedUntil time.Time
 }
 
 func newFlagConfigPoller(
@@ -201,9 +380,12 @@ func (p *flagConfigPoller) Start(onError func(error)) error {
 	}
 
 	p.poller = newPoller()
+	p.poller.log = p.log
+	p.poller.metrics = p.metrics
+	p.poller.goroutines = p.goroutines
 	p.poller.Poll(p.config.FlagConfigPollerInterval, func() {
 		if err := p.periodicRefresh(); err != nil {
-			p.log.Error("Periodic updateFlagConfigs failed: %v", err)
+			p.errorLog.Error("Periodic updateFlagConfigs failed: %v", err)
 			p.Stop()
 			if (onError != nil) {
 				go func() {onError(err)}()
@@ -224,15 +406,57 @@ func (p *flagConfigPoller) periodicRefresh() error {
 
 func (p *flagConfigPoller) updateFlagConfigs() error {
 	p.log.Debug("Refreshing flag configs.")
-	flagConfigs, err := p.flagConfigApi.getFlagConfigs()
+	flagConfigs, err := p.fetchFlagConfigs()
 	if err != nil {
-		p.log.Error("Failed to fetch flag configs: %v", err)
 		return err
 	}
 
 	return p.update(flagConfigs)
 }
 
+// fetchFlagConfigs fetches the flag configs, retrying failed fetches as decided by
+// Config.RetryClassifier. If a retry would wait until after the next poll, e.g. because of a
+// Retry-After header, the fetch fails and polls are skipped until the retry delay has passed.
+func (p *flagConfigPoller) fetchFlagConfigs() (map[string]*evaluation.Flag, error) {
+	p.delayLock.Lock()
+	delayedUntil := p.pollsDelayedUntil
+	p.delayLock.Unlock()
+	if wait := time.Until(delayedUntil); wait > 0 {
+		return nil, fmt.Errorf("flag config polls are delayed for %v as requested by the server", wait.Round(time.Second))
+	}
+	retryDelay := flagConfigPollRetryDelay
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		flagConfigs, err := p.flagConfigApi.getFlagConfigs()
+		p.metrics.OnFlagConfigFetch(time.Since(start), err)
+		if err == nil {
+			return flagConfigs, nil
+		}
+		p.errorLog.Error("Failed to fetch flag configs: %v", err)
+		if attempt >= flagConfigPollRetries || p.config.RetryClassifier == nil {
+			return nil, err
+		}
+		decision := classifyRetry(p.config.RetryClassifier, err)
+		delay := retryDelay
+		if decision.Delay > 0 {
+			delay = decision.Delay
+		}
+		if decision.Retry && delay >= p.config.FlagConfigPollerInterval {
+			// Skip the polls which would be made before the retry.
+			p.delayLock.Lock()
+			p.pollsDelayedUntil = time.Now().Add(delay)
+			p.delayLock.Unlock()
+			return nil, err
+		}
+		if !decision.Retry || !p.retryBudget.tryAcquire() {
+			return nil, err
+		}
+		p.log.Debug("Retrying flag config fetch in %v", delay)
+		time.Sleep(delay)
+		retryDelay *= 2
+	}
+}
+
 func (p *flagConfigPoller) stopInternal() {
 	if p.poller != nil {
 		close(p.poller.shutdown)
@@ -258,6 +482,7 @@ type flagConfigFallbackRetryWrapper struct {
 	fallbackStartRetryDelay      time.Duration
 	fallbackStartRetryMaxJitter       time.Duration
 	fallbackStartRetryTimer *time.Timer
+	retryBudget     *retryBudget
 	lock            sync.Mutex
 	isRunning       bool
 }
@@ -270,7 +495,7 @@ func newflagConfigFallbackRetryWrapper(
 	fallbackStartRetryDelay      time.Duration,
 	fallbackStartRetryMaxJitter       time.Duration,
 	debug bool,
-) flagConfigUpdater {
+) *flagConfigFallbackRetryWrapper {
 	return &flagConfigFallbackRetryWrapper{
 		log:             logger.New(debug),
 		mainUpdater:     mainUpdater,
@@ -358,6 +583,45 @@ func (w *flagConfigFallbackRetryWrapper) Stop() {
 	}
 }
 
+// restartMain forces the main updater to restart, even if it's currently healthy.
+// Unlike Start, the main updater's start error is returned even when the fallback updater takes over.
+// On failure, the fallback is started and main enters the retry loop, same as an updating error.
+func (w *flagConfigFallbackRetryWrapper) restartMain() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.isRunning {
+		return errors.New("flag config updater is not running")
+	}
+
+	if w.retryTimer != nil {
+		w.retryTimer.Stop()
+		w.retryTimer = nil
+	}
+
+	w.log.Debug("main updater restart")
+	err := w.mainUpdater.Start(func(err error) {
+		w.log.Debug("main updater updating err, starting fallback if available. error: ", err)
+		go func() { w.scheduleRetry() }() // Don't care if poller start error or not, always retry.
+		go func() { w.fallbackStart() }()
+	})
+	if err == nil {
+		// Main start success, stop fallback.
+		if w.fallbackStartRetryTimer != nil {
+			w.fallbackStartRetryTimer.Stop()
+		}
+		if w.fallbackUpdater != nil {
+			w.fallbackUpdater.Stop()
+		}
+		return nil
+	}
+
+	w.log.Error("main updater restart err, starting fallback if available. error: %v", err)
+	go func() { w.scheduleRetry() }()
+	go func() { w.fallbackStart() }()
+	return err
+}
+
 func (w *flagConfigFallbackRetryWrapper) scheduleRetry() {
 	w.lock.Lock()
 	defer w.lock.Unlock()
@@ -370,7 +634,7 @@ func (w *flagConfigFallbackRetryWrapper) scheduleRetry() {
 		w.retryTimer.Stop()
 		w.retryTimer = nil
 	}
-	w.retryTimer = time.AfterFunc(randTimeDuration(w.retryDelay, w.maxJitter), func() {
+	w.retryTimer = time.AfterFunc(w.retryBudgetDelay(randTimeDuration(w.retryDelay, w.maxJitter)), func() {
 		w.lock.Lock()
 		defer w.lock.Unlock()
 
@@ -418,8 +682,18 @@ func (w *flagConfigFallbackRetryWrapper) fallbackStart() {
 	err := w.fallbackUpdater.Start(nil)
 	if (err != nil) {
 		w.log.Debug("fallback updater start failed and scheduling retry")
-		w.fallbackStartRetryTimer = time.AfterFunc(randTimeDuration(w.fallbackStartRetryDelay, w.fallbackStartRetryMaxJitter), func() {
+		w.fallbackStartRetryTimer = time.AfterFunc(w.retryBudgetDelay(randTimeDuration(w.fallbackStartRetryDelay, w.fallbackStartRetryMaxJitter)), func() {
 			w.fallbackStart()
 		})
 	}
 }
+
+// retryBudgetDelay takes a retry from the retry budget and returns the delay before retrying, which
+// is extended while the budget is exhausted.
+func (w *flagConfigFallbackRetryWrapper) retryBudgetDelay(delay time.Duration) time.Duration {
+	if wait := w.retryBudget.reserve(); wait > delay {
+		w.log.Debug("retry budget exhausted, delaying retry by %v", wait)
+		return wait
+	}
+	return delay
+}
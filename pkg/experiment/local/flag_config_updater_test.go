@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -111,6 +112,7 @@ type mockFlagConfigStreamApi struct {
 	connectFunc func(
 		func(map[string]*evaluation.Flag) error,
 		func(map[string]*evaluation.Flag) error,
+		func(*flagConfigDelta) error,
 		func(error),
 	) error
 	closeFunc func()
@@ -119,9 +121,10 @@ type mockFlagConfigStreamApi struct {
 func (api *mockFlagConfigStreamApi) Connect(
 	onInitUpdate func(map[string]*evaluation.Flag) error,
 	onUpdate func(map[string]*evaluation.Flag) error,
+	onDelta func(*flagConfigDelta) error,
 	onError func(error),
 ) error {
-	return api.connectFunc(onInitUpdate, onUpdate, onError)
+	return api.connectFunc(onInitUpdate, onUpdate, onDelta, onError)
 }
 func (api *mockFlagConfigStreamApi) Close() { api.closeFunc() }
 
@@ -144,6 +147,7 @@ func TestFlagConfigStreamer(t *testing.T) {
 	api.connectFunc = func(
 		onInitUpdate func(map[string]*evaluation.Flag) error,
 		onUpdate func(map[string]*evaluation.Flag) error,
+		onDelta func(*flagConfigDelta) error,
 		onError func(error),
 	) error {
 		err := onInitUpdate(FLAG_1)
@@ -189,6 +193,7 @@ func TestFlagConfigStreamerStartFail(t *testing.T) {
 	api.connectFunc = func(
 		onInitUpdate func(map[string]*evaluation.Flag) error,
 		onUpdate func(map[string]*evaluation.Flag) error,
+		onDelta func(*flagConfigDelta) error,
 		onError func(error),
 	) error {
 		return errors.New("api connect error")
@@ -214,6 +219,7 @@ func TestFlagConfigStreamerStreamingFail(t *testing.T) {
 	api.connectFunc = func(
 		onInitUpdate func(map[string]*evaluation.Flag) error,
 		onUpdate func(map[string]*evaluation.Flag) error,
+		onDelta func(*flagConfigDelta) error,
 		onError func(error),
 	) error {
 		err := onInitUpdate(FLAG_1)
@@ -565,3 +571,148 @@ func TestFlagConfigFallbackRetryWrapperMainOnly(t *testing.T) {
 
 	w.Stop()
 }
+
+func TestFlagConfigFallbackRetryWrapperRestartMain(t *testing.T) {
+	main := mockFlagConfigUpdater{}
+	mainStartCount := 0
+	main.startFunc = func(onError func(error)) error {
+		mainStartCount++
+		return nil
+	}
+	main.stopFunc = func() {}
+	fallback := mockFlagConfigUpdater{}
+	fallbackStartCh := make(chan bool)
+	fallback.startFunc = func(onError func(error)) error {
+		go func() { fallbackStartCh <- true }()
+		return nil
+	}
+	fallback.stopFunc = func() {}
+	w := newflagConfigFallbackRetryWrapper(&main, &fallback, 1*time.Second, 0, 1*time.Second, 0, true)
+
+	// Restart before start fails.
+	err := w.restartMain()
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, mainStartCount)
+
+	err = w.Start(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, mainStartCount)
+
+	// Restart success.
+	err = w.restartMain()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, mainStartCount)
+
+	// Restart fail returns main error and starts fallback.
+	main.startFunc = func(onError func(error)) error {
+		mainStartCount++
+		return errors.New("main restart error")
+	}
+	err = w.restartMain()
+	assert.Equal(t, errors.New("main restart error"), err)
+	assert.Equal(t, 3, mainStartCount)
+	<-fallbackStartCh
+
+	w.Stop()
+}
+
+func TestFlagConfigUpdateWaitsForNewCohorts(t *testing.T) {
+	c := newTestClient(t)
+	cohortDownloadAPI := &mockCohortDownloadApi{getCohortFunc: func(cohortID string, cohort *Cohort) (*Cohort, error) {
+		// The new flag must not be visible until its cohort has downloaded.
+		assert.Nil(t, c.flagConfigStorage.getFlagConfig("flag"))
+		time.Sleep(50 * time.Millisecond)
+		return &Cohort{Id: cohortID, GroupType: userGroupType, Size: 1, MemberIds: []string{"user"}}, nil
+	}}
+	cohortLoader := newCohortLoader(cohortDownloadAPI, c.cohortStorage, true)
+	updater := newFlagConfigUpdaterBase(c.flagConfigStorage, c.cohortStorage, cohortLoader, &Config{})
+
+	flag := createTestFlag()
+	flag.Variants = map[string]*evaluation.Variant{"on": {Key: "on"}}
+	flag.Segments[0].Variant = "on"
+	err := updater.update(map[string]*evaluation.Flag{flag.Key: flag})
+	assert.Nil(t, err)
+
+	result, err := c.EvaluateV2(&experiment.User{UserId: "user"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "on", result["flag"].Key)
+}
+
+func TestFlagConfigUpdateCohortGracePeriod(t *testing.T) {
+	flagConfigStorage := newInMemoryFlagConfigStorage()
+	cohortStorage := newInMemoryCohortStorage()
+	release := make(chan struct{})
+	defer close(release)
+	cohortDownloadAPI := &mockCohortDownloadApi{getCohortFunc: func(cohortID string, cohort *Cohort) (*Cohort, error) {
+		<-release
+		return nil, errors.New("test")
+	}}
+	cohortLoader := newCohortLoader(cohortDownloadAPI, cohortStorage, true)
+	updater := newFlagConfigUpdaterBase(flagConfigStorage, cohortStorage, cohortLoader, &Config{
+		CohortSyncConfig: &CohortSyncConfig{UpdateGracePeriod: 50 * time.Millisecond},
+	})
+
+	flag := createTestFlag()
+	start := time.Now()
+	err := updater.update(map[string]*evaluation.Flag{flag.Key: flag})
+	assert.Nil(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, flag, flagConfigStorage.getFlagConfig("flag"))
+}
+
+func TestFlagConfigUpdateDelta(t *testing.T) {
+	api, flagConfigStorage, cohortStorage, cohortLoader := createTestStreamerObjs()
+	api.closeFunc = func() {}
+	var onDelta func(*flagConfigDelta) error
+	api.connectFunc = func(
+		onInitUpdate func(map[string]*evaluation.Flag) error,
+		onUpdate func(map[string]*evaluation.Flag) error,
+		delta func(*flagConfigDelta) error,
+		onError func(error),
+	) error {
+		onDelta = delta
+		return onInitUpdate(map[string]*evaluation.Flag{"flagkey": FLAG_1["flagkey"], "unchanged": {Key: "unchanged"}})
+	}
+	streamer := newFlagConfigStreamer(&api, &Config{}, flagConfigStorage, cohortStorage, cohortLoader)
+	assert.Nil(t, streamer.Start(nil))
+
+	_, delta, err := parseStreamData(FLAG_DELTA_STR)
+	assert.Nil(t, err)
+	assert.Nil(t, onDelta(delta))
+
+	flags := flagConfigStorage.getFlagConfigs()
+	assert.Equal(t, 2, len(flags))
+	assert.Nil(t, flags["flagkey"])
+	assert.Equal(t, "flagkey2", flags["flagkey2"].Key)
+	assert.Equal(t, "unchanged", flags["unchanged"].Key)
+	streamer.Stop()
+}
+
+// replaceOnlyFlagConfigStorage fails the test if flag configs are put or removed one at a time.
+type replaceOnlyFlagConfigStorage struct {
+	flagConfigStorage
+	t *testing.T
+}
+
+func (s *replaceOnlyFlagConfigStorage) putFlagConfig(flagConfig *evaluation.Flag) {
+	s.t.Errorf("Unexpected put of flag config %s", flagConfig.Key)
+}
+
+func (s *replaceOnlyFlagConfigStorage) removeIf(func(*evaluation.Flag) bool) {
+	s.t.Errorf("Unexpected removal of flag configs")
+}
+
+func TestFlagConfigUpdateDeltaReplacesAtOnce(t *testing.T) {
+	_, flagConfigStorage, cohortStorage, cohortLoader := createTestStreamerObjs()
+	storage := &replaceOnlyFlagConfigStorage{flagConfigStorage: flagConfigStorage, t: t}
+	storage.replaceFlagConfigs(map[string]*evaluation.Flag{"flagkey": FLAG_1["flagkey"], "unchanged": {Key: "unchanged"}})
+	updater := newFlagConfigUpdaterBase(storage, cohortStorage, cohortLoader, &Config{})
+
+	_, delta, err := parseStreamData(FLAG_DELTA_STR)
+	assert.Nil(t, err)
+	assert.Nil(t, updater.updateDelta(delta))
+
+	flags := flagConfigStorage.getFlagConfigs()
+	assert.Equal(t, 2, len(flags))
+	assert.Equal(t, "flagkey2", flags["flagkey2"].Key)
+}
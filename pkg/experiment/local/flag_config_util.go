@@ -1,6 +1,12 @@
 package local
 
 import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+
 	"github.com/amplitude/experiment-go-server/internal/evaluation"
 )
 
@@ -104,3 +110,55 @@ func selectorContainsGroups(selector []string) bool {
 	}
 	return false
 }
+
+// diffFlagConfigs returns the keys of flags which were added, removed, or changed between the previous and next flag configs.
+func diffFlagConfigs(previous, next map[string]*evaluation.Flag) (added, removed, changed []string) {
+	for key, flag := range next {
+		previousFlag, exists := previous[key]
+		if !exists {
+			added = append(added, key)
+		} else if !reflect.DeepEqual(previousFlag, flag) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range previous {
+		if _, exists := next[key]; !exists {
+			removed = append(removed, key)
+		}
+	}
+	return added, removed, changed
+}
+
+// getMissingDependencies returns the sorted keys of the dependencies of each flag which are not in
+// the flag configs, keyed by the flag's key. Flags without missing dependencies are omitted.
+func getMissingDependencies(flagConfigs map[string]*evaluation.Flag) map[string][]string {
+	missing := make(map[string][]string)
+	for key, flag := range flagConfigs {
+		for _, dependency := range flag.Dependencies {
+			if _, ok := flagConfigs[dependency]; !ok {
+				missing[key] = append(missing[key], dependency)
+			}
+		}
+		sort.Strings(missing[key])
+	}
+	return missing
+}
+
+// flagConfigsVersion returns a hash of the flag configs, which is the same for equal flag configs
+// regardless of whether they were polled or streamed, so clients can tell whether they evaluated
+// the same flag configs.
+func flagConfigsVersion(flagConfigs map[string]*evaluation.Flag) string {
+	keys := make([]string, 0, len(flagConfigs))
+	for key := range flagConfigs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	for _, key := range keys {
+		// Flag configs are decoded from JSON, so they always encode.
+		data, _ := json.Marshal(flagConfigs[key])
+		_, _ = h.Write(data)
+		_, _ = h.Write([]byte{'\n'})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
@@ -0,0 +1,192 @@
+package local
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+)
+
+// maxDistributionValue is the end of the distribution range, as distribution values are a 32 bit
+// hash divided by 100.
+const maxDistributionValue = 42949673
+
+var validConditionOps = func() map[string]struct{} {
+	ops := make(map[string]struct{})
+	for _, op := range evaluation.SupportedOperators() {
+		ops[op] = struct{}{}
+	}
+	return ops
+}()
+
+// SupportedOperators returns the condition operators which local evaluation supports, sorted.
+// Conditions with other operators never match. The operators match a property value as follows:
+//
+//   - "is" and "is not" match if the value equals any of the condition's values. Boolean values
+//     are compared case-insensitively.
+//   - "contains" and "does not contain" match if the value contains any of the values,
+//     case-insensitively.
+//   - "less", "less or equal", "greater", and "greater or equal" compare the value with each of
+//     the values as numbers if both parse as numbers, and as strings otherwise.
+//   - "version less", "version less or equal", "version greater", and "version greater or equal"
+//     compare semantic versions, falling back to string comparison.
+//   - "regex match" and "regex does not match" match the value against each of the regular
+//     expressions.
+//   - "set is", "set is not", "set contains", "set does not contain", "set contains any", and
+//     "set does not contain any" compare a list value with the values as sets.
+//
+// Other operators match list and map values by their JSON encoding.
+func SupportedOperators() []string {
+	return evaluation.SupportedOperators()
+}
+
+// ValidateFlagsJSON parses flag configs in the JSON formats accepted by SnapshotFromJSON and
+// validates them with ValidateFlags.
+func ValidateFlagsJSON(flagsJSON string) error {
+	flags, err := parseFlagConfigsJSON(flagsJSON)
+	if err != nil {
+		return &FlagValidationError{Errors: []error{err}}
+	}
+	return ValidateFlags(flags)
+}
+
+// ValidateFlags checks flag configs, keyed by flag key, without applying them to a client. It checks
+// that flag keys match, dependencies exist and are acyclic, segments and bucket distributions serve
+// variants of the flag, bucket ranges are well formed, condition operators are known, and cohort
+// conditions target user or group cohorts such that the cohorts are downloaded. All problems found
+// are returned in a *FlagValidationError, or nil if the flag configs are valid.
+func ValidateFlags(flags map[string]*evaluation.Flag) error {
+	var errs []error
+	keys := make([]string, 0, len(flags))
+	for key := range flags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, err := range validateFlag(key, flags[key], flags) {
+			errs = append(errs, fmt.Errorf("flag %s: %v", key, err))
+		}
+	}
+	if _, err := topologicalSort(flags, nil); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return &FlagValidationError{Errors: errs}
+	}
+	return nil
+}
+
+func validateFlag(key string, flag *evaluation.Flag, flags map[string]*evaluation.Flag) []error {
+	if flag == nil {
+		return []error{fmt.Errorf("flag config is nil")}
+	}
+	var errs []error
+	if flag.Key != key {
+		errs = append(errs, fmt.Errorf("key %q does not match", flag.Key))
+	}
+	for _, dependency := range flag.Dependencies {
+		if _, ok := flags[dependency]; !ok {
+			errs = append(errs, fmt.Errorf("dependency %s does not exist", dependency))
+		}
+	}
+	for variantKey, variant := range flag.Variants {
+		if variant == nil {
+			errs = append(errs, fmt.Errorf("variant %s is nil", variantKey))
+		} else if variant.Key != variantKey {
+			errs = append(errs, fmt.Errorf("variant %s has key %q", variantKey, variant.Key))
+		}
+	}
+	for i, segment := range flag.Segments {
+		for _, err := range validateSegment(segment, flag) {
+			errs = append(errs, fmt.Errorf("segment %d: %v", i, err))
+		}
+	}
+	return errs
+}
+
+func validateSegment(segment *evaluation.Segment, flag *evaluation.Flag) []error {
+	if segment == nil {
+		return []error{fmt.Errorf("segment is nil")}
+	}
+	var errs []error
+	if segment.Variant != "" && flag.Variants[segment.Variant] == nil {
+		errs = append(errs, fmt.Errorf("variant %s does not exist", segment.Variant))
+	}
+	for _, conditions := range segment.Conditions {
+		for _, condition := range conditions {
+			if err := validateCondition(condition); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if segment.Bucket == nil {
+		return errs
+	}
+	if len(segment.Bucket.Selector) == 0 {
+		errs = append(errs, fmt.Errorf("bucket selector is empty"))
+	}
+	for _, allocation := range segment.Bucket.Allocations {
+		if allocation == nil {
+			errs = append(errs, fmt.Errorf("allocation is nil"))
+			continue
+		}
+		if !validRange(allocation.Range, 100) {
+			errs = append(errs, fmt.Errorf("allocation range %v is not within [0, 100]", allocation.Range))
+		}
+		for _, distribution := range allocation.Distributions {
+			if distribution == nil {
+				errs = append(errs, fmt.Errorf("distribution is nil"))
+				continue
+			}
+			if flag.Variants[distribution.Variant] == nil {
+				errs = append(errs, fmt.Errorf("distribution variant %s does not exist", distribution.Variant))
+			}
+			if !validRange(distribution.Range, maxDistributionValue) {
+				errs = append(errs, fmt.Errorf("distribution range %v is not within [0, %d]", distribution.Range, maxDistributionValue))
+			}
+		}
+	}
+	return errs
+}
+
+// validRange returns true if the range is a start and end, with start <= end <= max.
+func validRange(r []uint64, max uint64) bool {
+	return len(r) == 2 && r[0] <= r[1] && r[1] <= max
+}
+
+func validateCondition(condition *evaluation.Condition) error {
+	if condition == nil {
+		return fmt.Errorf("condition is nil")
+	}
+	if len(condition.Selector) == 0 {
+		return fmt.Errorf("condition selector is empty")
+	}
+	if _, ok := validConditionOps[condition.Op]; !ok {
+		return fmt.Errorf("condition %v has unknown operator %q", condition.Selector, condition.Op)
+	}
+	if condition.Op == evaluation.OpRegexMatch || condition.Op == evaluation.OpRegexDoesNotMatch {
+		for _, value := range condition.Values {
+			if _, err := regexp.Compile(value); err != nil {
+				return fmt.Errorf("condition %v has invalid regex %q: %v", condition.Selector, value, err)
+			}
+		}
+	}
+	selector := condition.Selector
+	if selector[len(selector)-1] != "cohort_ids" {
+		return nil
+	}
+	// Cohorts are only downloaded for these cohort conditions, see getGroupedCohortConditionIDs.
+	if !isCohortFilter(condition) {
+		return fmt.Errorf("cohort condition %v has operator %q, which doesn't download cohorts", selector, condition.Op)
+	}
+	isUserCohort := len(selector) == 3 && selector[0] == "context" && selector[1] == "user"
+	isGroupCohort := len(selector) == 4 && selector[0] == "context" && selector[1] == "groups"
+	if !isUserCohort && !isGroupCohort {
+		return fmt.Errorf("cohort condition selector %v is not a user or group cohort selector", selector)
+	}
+	if len(condition.Values) == 0 {
+		return fmt.Errorf("cohort condition %v has no cohort IDs", selector)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package local
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFlagsValid(t *testing.T) {
+	flag := createTestBucketedFlag("bucketed", "salt")
+	flag.Dependencies = []string{"flag"}
+	assert.NoError(t, ValidateFlags(map[string]*evaluation.Flag{
+		"flag":     createTestFlag(),
+		"bucketed": flag,
+		"variant":  createTestVariantFlag("variant", nil),
+	}))
+	assert.NoError(t, ValidateFlagsJSON(string(FLAG_1_STR)))
+}
+
+func TestValidateFlagsAggregatesErrors(t *testing.T) {
+	bucketed := createTestBucketedFlag("bucketed", "salt")
+	bucketed.Segments[0].Bucket.Allocations[0].Range = []uint64{0, 101}
+	bucketed.Segments[0].Bucket.Allocations[0].Distributions[1].Variant = "missing"
+	cohort := createTestFlag()
+	cohort.Segments[0].Conditions[0][0].Op = evaluation.OpSetContains
+	err := ValidateFlags(map[string]*evaluation.Flag{
+		"a":        createTestVariantFlag("a", nil, "b"),
+		"b":        createTestVariantFlag("b", nil, "a", "missing"),
+		"bucketed": bucketed,
+		"flag":     cohort,
+		"key":      createTestVariantFlag("other-key", nil),
+	})
+	validationErr, ok := err.(*FlagValidationError)
+	if !assert.True(t, ok, "expected a FlagValidationError, got %v", err) {
+		return
+	}
+	messages := make([]string, len(validationErr.Errors))
+	for i, e := range validationErr.Errors {
+		messages[i] = e.Error()
+	}
+	assert.Equal(t, []string{
+		"flag b: dependency missing does not exist",
+		"flag bucketed: segment 0: allocation range [0 101] is not within [0, 100]",
+		"flag bucketed: segment 0: distribution variant missing does not exist",
+		"flag flag: segment 0: cohort condition [context user cohort_ids] has operator \"set contains\", which doesn't download cohorts",
+		"flag key: key \"other-key\" does not match",
+	}, messages[:len(messages)-1])
+	assert.Contains(t, messages[len(messages)-1], "detected a cycle")
+}
+
+func TestValidateFlagsJSONParseError(t *testing.T) {
+	err := ValidateFlagsJSON("not json")
+	_, ok := err.(*FlagValidationError)
+	assert.True(t, ok, "expected a FlagValidationError, got %v", err)
+}
+
+func TestSupportedOperators(t *testing.T) {
+	ops := SupportedOperators()
+	assert.Contains(t, ops, evaluation.OpIs)
+	assert.Contains(t, ops, evaluation.OpSetContainsAny)
+	assert.Contains(t, ops, evaluation.OpVersionGreaterThanEquals)
+	assert.Len(t, ops, 20)
+	assert.True(t, sort.StringsAreSorted(ops))
+	// Operators outside the engine's dispatch table never match, and fail validation.
+	flag := createTestConditionFlag("flag", &evaluation.Condition{
+		Selector: []string{"context", "user", "country"}, Op: "starts with", Values: []string{"U"},
+	})
+	assert.Error(t, ValidateFlags(map[string]*evaluation.Flag{"flag": flag}))
+	c := newTestClient(t, flag)
+	result, err := c.EvaluateV2(&experiment.User{Country: "US"}, nil)
+	assert.NoError(t, err)
+	assert.NotContains(t, result, "flag")
+}
@@ -0,0 +1,30 @@
+package local
+
+import "sync/atomic"
+
+// goroutineCounter counts the running background goroutines of a deployment, i.e. of the flag
+// config poller and stream, and the cohort loader, for Client.GoroutineCount. A nil counter starts
+// goroutines without counting them.
+type goroutineCounter struct {
+	count int32
+}
+
+// run calls fn on a new goroutine, which is counted until fn returns.
+func (g *goroutineCounter) run(fn func()) {
+	if g == nil {
+		go fn()
+		return
+	}
+	atomic.AddInt32(&g.count, 1)
+	go func() {
+		defer atomic.AddInt32(&g.count, -1)
+		fn()
+	}()
+}
+
+func (g *goroutineCounter) get() int {
+	if g == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&g.count))
+}
@@ -0,0 +1,26 @@
+package local
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGoroutineCounter(t *testing.T) {
+	g := &goroutineCounter{}
+	release := make(chan struct{})
+	g.run(func() { <-release })
+	g.run(func() { <-release })
+	assert.Equal(t, 2, g.get())
+	close(release)
+	assert.Eventually(t, func() bool { return g.get() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestGoroutineCounterNil(t *testing.T) {
+	var g *goroutineCounter
+	done := make(chan struct{})
+	g.run(func() { close(done) })
+	<-done
+	assert.Equal(t, 0, g.get())
+}
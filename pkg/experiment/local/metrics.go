@@ -0,0 +1,47 @@
+package local
+
+import "time"
+
+// Metrics receives measurements from the local evaluation client. Implementations must be safe for
+// concurrent use and should return quickly, since they are called inline.
+type Metrics interface {
+	// OnEvaluation is called after each evaluation with the number of flags evaluated.
+	OnEvaluation(flagCount int, duration time.Duration)
+	// OnFlagConfigFetch is called after each flag config poll request. err is nil on success.
+	OnFlagConfigFetch(duration time.Duration, err error)
+	// OnCohortCacheLookup is called on each evaluation with the number of cohorts required by the
+	// evaluated flags which were found in and missing from cohort storage.
+	OnCohortCacheLookup(hits, misses int)
+	// OnStreamConnect is called each time the flag config stream connects, i.e. receives its initial
+	// flag configs.
+	OnStreamConnect()
+	// OnStreamReconnect is called before each attempt to connect the flag config stream after the
+	// first. attempt is the number of attempts since the stream was last connected, starting at 1.
+	OnStreamReconnect(attempt int)
+	// OnStreamMessage is called for each flag config stream message, excluding keepalives.
+	OnStreamMessage()
+	// OnStreamError is called when connecting the flag config stream fails or the connected stream
+	// fails.
+	OnStreamError(err error)
+	// OnPanic is called when a panic in a background goroutine, e.g. in a callback or Metrics
+	// implementation, is recovered. source names the goroutine, e.g. "poller".
+	OnPanic(source string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) OnEvaluation(int, time.Duration)        {}
+func (noopMetrics) OnFlagConfigFetch(time.Duration, error) {}
+func (noopMetrics) OnCohortCacheLookup(int, int)           {}
+func (noopMetrics) OnStreamConnect()                       {}
+func (noopMetrics) OnStreamReconnect(int)                  {}
+func (noopMetrics) OnStreamMessage()                       {}
+func (noopMetrics) OnStreamError(error)                    {}
+func (noopMetrics) OnPanic(string)                         {}
+
+func metricsOrNoop(metrics Metrics) Metrics {
+	if metrics == nil {
+		return noopMetrics{}
+	}
+	return metrics
+}
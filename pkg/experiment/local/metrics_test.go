@@ -0,0 +1,174 @@
+package local
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockMetrics struct {
+	lock             sync.Mutex
+	evaluations      int
+	evaluatedFlags   int
+	fetches          int
+	fetchErrors      int
+	cohortHits       int
+	cohortMisses     int
+	streamReconnects int
+	panics           []string
+	// streamConnects, streamAttempts, streamMessages, and streamErrors count the stream callbacks.
+	streamConnects int
+	streamAttempts []int
+	streamMessages int
+	streamErrors   int
+}
+
+func (m *mockMetrics) OnEvaluation(flagCount int, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.evaluations++
+	m.evaluatedFlags += flagCount
+}
+
+func (m *mockMetrics) OnFlagConfigFetch(duration time.Duration, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.fetches++
+	if err != nil {
+		m.fetchErrors++
+	}
+}
+
+func (m *mockMetrics) OnCohortCacheLookup(hits, misses int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cohortHits += hits
+	m.cohortMisses += misses
+}
+
+func (m *mockMetrics) OnStreamConnect() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.streamConnects++
+}
+
+func (m *mockMetrics) OnStreamReconnect(attempt int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.streamReconnects++
+	m.streamAttempts = append(m.streamAttempts, attempt)
+}
+
+func (m *mockMetrics) OnStreamMessage() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.streamMessages++
+}
+
+func (m *mockMetrics) OnStreamError(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.streamErrors++
+}
+
+func (m *mockMetrics) OnPanic(source string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.panics = append(m.panics, source)
+}
+
+func (m *mockMetrics) panicSources() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string{}, m.panics...)
+}
+
+func TestEvaluationMetrics(t *testing.T) {
+	metrics := &mockMetrics{}
+	c := Initialize("test-"+t.Name(), &Config{Metrics: metrics})
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("variant-flag", nil))
+	c.flagConfigStorage.putFlagConfig(createTestFlag())
+	c.cohortStorage.putCohort(&Cohort{Id: CohortId, GroupType: userGroupType})
+
+	_, err := c.EvaluateV2(&experiment.User{UserId: "user"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, metrics.evaluations)
+	assert.Equal(t, 2, metrics.evaluatedFlags)
+	assert.Equal(t, 1, metrics.cohortHits)
+	assert.Equal(t, 0, metrics.cohortMisses)
+}
+
+func TestFlagConfigFetchMetrics(t *testing.T) {
+	metrics := &mockMetrics{}
+	api, flagConfigStorage, cohortStorage, cohortLoader := createTestPollerObjs()
+	poller := newFlagConfigPoller(&api, &Config{FlagConfigPollerInterval: 1 * time.Second, Metrics: metrics}, flagConfigStorage, cohortStorage, cohortLoader)
+
+	api.getFlagConfigsFunc = func() (map[string]*evaluation.Flag, error) {
+		return nil, errors.New("start error")
+	}
+	assert.NotNil(t, poller.Start(nil))
+	api.getFlagConfigsFunc = func() (map[string]*evaluation.Flag, error) {
+		return FLAG_1, nil
+	}
+	assert.Nil(t, poller.Start(nil))
+	poller.Stop()
+
+	assert.Equal(t, 2, metrics.fetches)
+	assert.Equal(t, 1, metrics.fetchErrors)
+}
+
+func TestStreamMetrics(t *testing.T) {
+	metrics := &mockMetrics{}
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 100*time.Millisecond)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	api.metrics = metrics
+	api.connectRetries = 1
+	api.connectRetryDelay = 0
+	connect := func() error {
+		return api.Connect(nil, func(map[string]*evaluation.Flag) error { return nil }, nil, nil)
+	}
+
+	go func() {
+		<-sse.chConnected
+		sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	}()
+	assert.Nil(t, connect())
+	assert.Equal(t, 1, metrics.streamConnects)
+	assert.Equal(t, 0, metrics.streamReconnects)
+	assert.Equal(t, 1, metrics.streamMessages)
+	assert.False(t, api.lastMessageTime().IsZero())
+	api.Close()
+
+	// Both attempts time out.
+	go func() {
+		<-sse.chConnected
+		<-sse.chConnected
+	}()
+	assert.NotNil(t, connect())
+	assert.Equal(t, []int{1, 2}, metrics.streamAttempts)
+	assert.Equal(t, 2, metrics.streamErrors)
+
+	go func() {
+		<-sse.chConnected
+		sse.messageCh <- streamEvent{data: FLAG_1_STR}
+	}()
+	assert.Nil(t, connect())
+	assert.Equal(t, []int{1, 2, 3}, metrics.streamAttempts)
+	assert.Equal(t, 2, metrics.streamConnects)
+	api.Close()
+}
+
+func TestTimeSinceLastStreamMessage(t *testing.T) {
+	c := Initialize("test-"+t.Name(), &Config{})
+	assert.Equal(t, time.Duration(0), c.TimeSinceLastStreamMessage())
+	c = Initialize("test-"+t.Name()+"-stream", &Config{StreamUpdates: true})
+	assert.Equal(t, time.Duration(0), c.TimeSinceLastStreamMessage())
+	c.flagStreamApi.lastMessage = time.Now().Add(-time.Minute)
+	assert.True(t, c.TimeSinceLastStreamMessage() >= time.Minute)
+}
@@ -1,28 +1,43 @@
 package local
 
-import "time"
+import (
+	"time"
+
+	"github.com/amplitude/experiment-go-server/internal/logger"
+)
 
 type poller struct {
 	shutdown chan bool
+	log      *logger.Log
+	metrics  Metrics
+	// goroutines, if set, counts the poller's goroutines.
+	goroutines *goroutineCounter
 }
 
 func newPoller() *poller {
 	return &poller{
 		shutdown: make(chan bool),
+		log:      logger.New(false),
+		metrics:  noopMetrics{},
 	}
 }
 
+// Poll calls the function on a new goroutine every interval until shutdown. Panics in the function
+// are recovered, so later calls are still made.
 func (p *poller) Poll(interval time.Duration, function func()) {
 	ticker := time.NewTicker(interval)
-	go func() {
+	p.goroutines.run(func() {
 		for {
 			select {
 			case <-p.shutdown:
 				ticker.Stop()
 				return
 			case <-ticker.C:
-				go function()
+				p.goroutines.run(func() {
+					defer recoverPanic(p.log, p.metrics, "poller")
+					function()
+				})
 			}
 		}
-	}()
+	})
 }
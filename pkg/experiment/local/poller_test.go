@@ -0,0 +1,30 @@
+package local
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollerRecoversPanic(t *testing.T) {
+	metrics := &mockMetrics{}
+	p := newPoller()
+	p.metrics = metrics
+	calls := make(chan int32, 10)
+	var count int32
+	p.Poll(10*time.Millisecond, func() {
+		call := atomic.AddInt32(&count, 1)
+		calls <- call
+		if call == 1 {
+			panic("poll panic")
+		}
+	})
+	defer close(p.shutdown)
+
+	assert.Equal(t, int32(1), <-calls)
+	assert.Equal(t, int32(2), <-calls)
+	assert.Eventually(t, func() bool { return len(metrics.panicSources()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "poller", metrics.panicSources()[0])
+}
@@ -0,0 +1,160 @@
+// Package prometheus provides a local.Metrics implementation which records the local evaluation
+// client's metrics with Prometheus. It's a separate package of the SDK's module, so the Prometheus
+// client is only compiled into applications which import it, and the adapter is always released
+// with the local.Metrics interface it implements.
+package prometheus
+
+import (
+	"time"
+
+	"github.com/amplitude/experiment-go-server/pkg/experiment/local"
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "experiment_local"
+
+// Metrics implements local.Metrics with Prometheus counters and histograms.
+type Metrics struct {
+	evaluations        prom.Counter
+	evaluatedFlags     prom.Counter
+	evaluationDuration prom.Histogram
+	fetchDuration      *prom.HistogramVec
+	cohortCacheHits    prom.Counter
+	cohortCacheMisses  prom.Counter
+	streamReconnects   prom.Counter
+	panics             *prom.CounterVec
+	streamConnects     prom.Counter
+	streamMessages     prom.Counter
+	streamLastMessage  prom.Gauge
+	streamErrors       prom.Counter
+}
+
+var _ local.Metrics = (*Metrics)(nil)
+
+// NewPrometheusMetrics creates the metrics and registers them with the registerer.
+func NewPrometheusMetrics(registerer prom.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		evaluations: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "evaluations_total",
+			Help:      "Number of evaluations.",
+		}),
+		evaluatedFlags: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "evaluated_flags_total",
+			Help:      "Number of flags evaluated across all evaluations.",
+		}),
+		evaluationDuration: prom.NewHistogram(prom.HistogramOpts{
+			Namespace: namespace,
+			Name:      "evaluation_duration_seconds",
+			Help:      "Duration of evaluations.",
+			Buckets:   []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01},
+		}),
+		fetchDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: namespace,
+			Name:      "flag_config_fetch_duration_seconds",
+			Help:      "Duration of flag config poll requests.",
+			Buckets:   prom.DefBuckets,
+		}, []string{"result"}),
+		cohortCacheHits: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "cohort_cache_hits_total",
+			Help:      "Number of cohorts required by evaluations which were found in cohort storage.",
+		}),
+		cohortCacheMisses: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "cohort_cache_misses_total",
+			Help:      "Number of cohorts required by evaluations which were missing from cohort storage.",
+		}),
+		streamReconnects: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "stream_reconnects_total",
+			Help:      "Number of flag config stream reconnect attempts.",
+		}),
+		panics: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "recovered_panics_total",
+			Help:      "Number of panics recovered in background goroutines.",
+		}, []string{"source"}),
+		streamConnects: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "stream_connects_total",
+			Help:      "Number of flag config stream connections.",
+		}),
+		streamMessages: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "stream_messages_total",
+			Help:      "Number of flag config stream messages, excluding keepalives.",
+		}),
+		streamLastMessage: prom.NewGauge(prom.GaugeOpts{
+			Namespace: namespace,
+			Name:      "stream_last_message_timestamp_seconds",
+			Help:      "Unix time of the latest flag config stream message, excluding keepalives.",
+		}),
+		streamErrors: prom.NewCounter(prom.CounterOpts{
+			Namespace: namespace,
+			Name:      "stream_errors_total",
+			Help:      "Number of failed flag config stream connection attempts and connections.",
+		}),
+	}
+	collectors := []prom.Collector{
+		m.evaluations,
+		m.evaluatedFlags,
+		m.evaluationDuration,
+		m.fetchDuration,
+		m.cohortCacheHits,
+		m.cohortCacheMisses,
+		m.streamReconnects,
+		m.panics,
+		m.streamConnects,
+		m.streamMessages,
+		m.streamLastMessage,
+		m.streamErrors,
+	}
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Metrics) OnEvaluation(flagCount int, duration time.Duration) {
+	m.evaluations.Inc()
+	m.evaluatedFlags.Add(float64(flagCount))
+	m.evaluationDuration.Observe(duration.Seconds())
+}
+
+func (m *Metrics) OnFlagConfigFetch(duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.fetchDuration.WithLabelValues(result).Observe(duration.Seconds())
+}
+
+func (m *Metrics) OnCohortCacheLookup(hits, misses int) {
+	m.cohortCacheHits.Add(float64(hits))
+	m.cohortCacheMisses.Add(float64(misses))
+}
+
+func (m *Metrics) OnStreamConnect() {
+	m.streamConnects.Inc()
+}
+
+func (m *Metrics) OnStreamReconnect(attempt int) {
+	m.streamReconnects.Inc()
+}
+
+func (m *Metrics) OnStreamMessage() {
+	m.streamMessages.Inc()
+	m.streamLastMessage.SetToCurrentTime()
+}
+
+func (m *Metrics) OnStreamError(err error) {
+	m.streamErrors.Inc()
+}
+
+func (m *Metrics) OnPanic(source string) {
+	m.panics.WithLabelValues(source).Inc()
+}
@@ -0,0 +1,48 @@
+package prometheus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	registry := prom.NewRegistry()
+	m, err := NewPrometheusMetrics(registry)
+	assert.Nil(t, err)
+
+	m.OnEvaluation(3, time.Millisecond)
+	m.OnEvaluation(2, time.Millisecond)
+	m.OnFlagConfigFetch(time.Millisecond, nil)
+	m.OnFlagConfigFetch(time.Millisecond, errors.New("fetch error"))
+	m.OnCohortCacheLookup(2, 1)
+	m.OnStreamConnect()
+	m.OnStreamReconnect(1)
+	m.OnStreamMessage()
+	m.OnStreamError(errors.New("stream error"))
+	m.OnPanic("poller")
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.evaluations))
+	assert.Equal(t, float64(5), testutil.ToFloat64(m.evaluatedFlags))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.fetchDuration))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.cohortCacheHits))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.cohortCacheMisses))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.streamReconnects))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.panics.WithLabelValues("poller")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.streamConnects))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.streamMessages))
+	assert.True(t, testutil.ToFloat64(m.streamLastMessage) > 0)
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.streamErrors))
+}
+
+func TestPrometheusMetricsRegisterTwiceFails(t *testing.T) {
+	registry := prom.NewRegistry()
+	_, err := NewPrometheusMetrics(registry)
+	assert.Nil(t, err)
+	_, err = NewPrometheusMetrics(registry)
+	assert.NotNil(t, err)
+}
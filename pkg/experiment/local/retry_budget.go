@@ -0,0 +1,74 @@
+package local
+
+import (
+	"sync"
+	"time"
+)
+
+// retryBudget is a token bucket shared by all retries of requests to Amplitude, i.e. flag config
+// updater retries and cohort download retries. Each retry takes a token, and tokens are regained
+// at a rate of one per refill interval up to the budget's capacity. A nil budget is unlimited.
+type retryBudget struct {
+	lock           sync.Mutex
+	capacity       float64
+	tokens         float64
+	refillInterval time.Duration
+	lastRefill     time.Time
+	now            func() time.Time
+}
+
+func newRetryBudget(config *RetryBudgetConfig) *retryBudget {
+	if config == nil {
+		return nil
+	}
+	return &retryBudget{
+		capacity:       float64(config.MaxRetries),
+		tokens:         float64(config.MaxRetries),
+		refillInterval: config.RefillInterval,
+		lastRefill:     time.Now(),
+		now:            time.Now,
+	}
+}
+
+// tryAcquire takes a token if one is available. Callers which fail to acquire a token should not
+// retry, and wait for their next regular attempt instead.
+func (b *retryBudget) tryAcquire() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve takes a token, going into debt if none are available, and returns how long the caller
+// must wait before retrying for its token to be regained.
+func (b *retryBudget) reserve() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens * float64(b.refillInterval))
+}
+
+func (b *retryBudget) refill() {
+	now := b.now()
+	if b.refillInterval > 0 {
+		b.tokens += float64(now.Sub(b.lastRefill)) / float64(b.refillInterval)
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+	}
+	b.lastRefill = now
+}
@@ -0,0 +1,60 @@
+package local
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Unix(0, 0)
+	budget := newRetryBudget(&RetryBudgetConfig{MaxRetries: 2, RefillInterval: 10 * time.Second})
+	budget.lastRefill = now
+	budget.now = func() time.Time { return now }
+
+	assert.True(t, budget.tryAcquire())
+	assert.True(t, budget.tryAcquire())
+	assert.False(t, budget.tryAcquire())
+	now = now.Add(10 * time.Second)
+	assert.True(t, budget.tryAcquire())
+	assert.False(t, budget.tryAcquire())
+
+	// Reservations go into debt and wait for it to be repaid.
+	assert.Equal(t, 10*time.Second, budget.reserve())
+	assert.Equal(t, 20*time.Second, budget.reserve())
+	now = now.Add(time.Hour)
+	assert.Equal(t, time.Duration(0), budget.reserve())
+}
+
+func TestRetryBudgetNil(t *testing.T) {
+	var budget *retryBudget
+	assert.True(t, budget.tryAcquire())
+	assert.Equal(t, time.Duration(0), budget.reserve())
+}
+
+func TestCohortDownloadApiRetryBudgetExhausted(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		// Close the connection without a response so the request fails and is retried.
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		_ = conn.Close()
+	}))
+	defer server.Close()
+
+	api := newDirectCohortDownloadApi("api", "secret", 15000, 0, server.URL, DefaultCohortSyncConfig.RequestTimeout, false)
+	api.retryBudget = newRetryBudget(&RetryBudgetConfig{MaxRetries: 1, RefillInterval: time.Hour})
+	_, err := api.getCohort("1234", nil)
+	assert.Error(t, err)
+	// One request, one budgeted retry, then the budget is exhausted.
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&requests, 0)
+	_, err = api.getCohort("1234", nil)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
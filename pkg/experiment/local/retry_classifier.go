@@ -0,0 +1,95 @@
+package local
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryAfter caps the delays requested by Retry-After headers, so a misconfigured server can't
+// stop flag config and cohort updates for long.
+const maxRetryAfter = 5 * time.Minute
+
+// RetryDecision is the result of a Config.RetryClassifier for a failed request.
+type RetryDecision struct {
+	// Retry is whether the request is retried. If false, the request fails.
+	Retry bool
+	// Delay, if positive, is the time to wait before the retry, replacing the default backoff, e.g.
+	// as requested by a Retry-After header.
+	Delay time.Duration
+}
+
+// DefaultRetryClassifier retries requests which failed without a response, e.g. because of a timeout
+// or connection error, and responses with a 5xx, 429, or 408 status, waiting as requested by the
+// response's Retry-After header, if any, for up to 5 minutes. Other responses, e.g. a 401 for an
+// invalid deployment key, and responses which exceed their size limit are not retried.
+func DefaultRetryClassifier(resp *http.Response, err error) RetryDecision {
+	if resp == nil {
+		switch e := err.(type) {
+		case *responseTooLargeException:
+			return RetryDecision{}
+		case *httpErrorResponseException:
+			return RetryDecision{Retry: isRetryableStatusCode(e.StatusCode)}
+		}
+		return RetryDecision{Retry: true}
+	}
+	if !isRetryableStatusCode(resp.StatusCode) {
+		return RetryDecision{}
+	}
+	return RetryDecision{Retry: true, Delay: retryAfter(resp, time.Now())}
+}
+
+// isRetryableStatusCode returns false for responses which would be the same if the request were
+// made again, i.e. client errors other than request timeouts and rate limiting.
+func isRetryableStatusCode(code int) bool {
+	return code < 400 || code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
+
+// retryAfter returns the delay requested by the response's Retry-After header, in seconds or as an
+// HTTP date, up to maxRetryAfter, or zero if there is none.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		if seconds >= int(maxRetryAfter/time.Second) {
+			return maxRetryAfter
+		}
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		delay = date.Sub(now)
+	}
+	if delay > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return delay
+}
+
+// rateLimitRetryAfter returns the delay requested by the Retry-After header of the 429 or 503
+// response which failed a request, if any.
+func rateLimitRetryAfter(err error) (time.Duration, bool) {
+	httpErr, ok := err.(*httpErrorResponseException)
+	if !ok || httpErr.response == nil {
+		return 0, false
+	}
+	if httpErr.StatusCode != http.StatusTooManyRequests && httpErr.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	delay := retryAfter(httpErr.response, time.Now())
+	return delay, delay > 0
+}
+
+// classifyRetry returns the classifier's decision for the error of a failed request, with the
+// response if the request failed because of an unsuccessful response.
+func classifyRetry(classifier func(resp *http.Response, err error) RetryDecision, err error) RetryDecision {
+	var resp *http.Response
+	if httpErr, ok := err.(*httpErrorResponseException); ok {
+		resp = httpErr.response
+	}
+	return classifier(resp, err)
+}
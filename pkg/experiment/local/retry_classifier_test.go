@@ -0,0 +1,192 @@
+package local
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestResponse(statusCode int, retryAfter string) *http.Response {
+	resp := &http.Response{StatusCode: statusCode, Header: http.Header{}}
+	if retryAfter != "" {
+		resp.Header.Set("Retry-After", retryAfter)
+	}
+	return resp
+}
+
+func TestDefaultRetryClassifier(t *testing.T) {
+	assert.Equal(t, RetryDecision{Retry: true}, DefaultRetryClassifier(nil, errors.New("connection refused")))
+	assert.Equal(t, RetryDecision{}, DefaultRetryClassifier(nil, &responseTooLargeException{Limit: 1}))
+	assert.Equal(t, RetryDecision{}, DefaultRetryClassifier(nil, &httpErrorResponseException{StatusCode: http.StatusUnauthorized}))
+	assert.Equal(t, RetryDecision{Retry: true}, DefaultRetryClassifier(newTestResponse(http.StatusServiceUnavailable, ""), nil))
+	assert.Equal(t, RetryDecision{Retry: true, Delay: 3 * time.Second}, DefaultRetryClassifier(newTestResponse(http.StatusTooManyRequests, "3"), nil))
+	assert.Equal(t, RetryDecision{Retry: true}, DefaultRetryClassifier(newTestResponse(http.StatusRequestTimeout, ""), nil))
+	assert.Equal(t, RetryDecision{}, DefaultRetryClassifier(newTestResponse(http.StatusUnauthorized, "3"), nil))
+	assert.Equal(t, RetryDecision{}, DefaultRetryClassifier(newTestResponse(http.StatusNotFound, ""), nil))
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), retryAfter(newTestResponse(http.StatusServiceUnavailable, ""), now))
+	assert.Equal(t, 5*time.Second, retryAfter(newTestResponse(http.StatusServiceUnavailable, "5"), now))
+	assert.Equal(t, time.Duration(0), retryAfter(newTestResponse(http.StatusServiceUnavailable, "-5"), now))
+	assert.Equal(t, time.Minute, retryAfter(newTestResponse(http.StatusServiceUnavailable, now.Add(time.Minute).Format(http.TimeFormat)), now))
+	assert.Equal(t, time.Duration(0), retryAfter(newTestResponse(http.StatusServiceUnavailable, now.Add(-time.Minute).Format(http.TimeFormat)), now))
+	assert.Equal(t, time.Duration(0), retryAfter(newTestResponse(http.StatusServiceUnavailable, "soon"), now))
+	assert.Equal(t, maxRetryAfter, retryAfter(newTestResponse(http.StatusServiceUnavailable, "3600"), now))
+	assert.Equal(t, maxRetryAfter, retryAfter(newTestResponse(http.StatusServiceUnavailable, now.Add(time.Hour).Format(http.TimeFormat)), now))
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	delay, ok := rateLimitRetryAfter(&httpErrorResponseException{StatusCode: http.StatusTooManyRequests, response: newTestResponse(http.StatusTooManyRequests, "2")})
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Second, delay)
+	_, ok = rateLimitRetryAfter(&httpErrorResponseException{StatusCode: http.StatusTooManyRequests, response: newTestResponse(http.StatusTooManyRequests, "")})
+	assert.False(t, ok)
+	_, ok = rateLimitRetryAfter(&httpErrorResponseException{StatusCode: http.StatusInternalServerError, response: newTestResponse(http.StatusInternalServerError, "2")})
+	assert.False(t, ok)
+	_, ok = rateLimitRetryAfter(errors.New("connection refused"))
+	assert.False(t, ok)
+}
+
+func TestFlagConfigPollerHonorsRetryAfter(t *testing.T) {
+	api, flagConfigStorage, cohortStorage, cohortLoader := createTestPollerObjs()
+	fetches := 0
+	api.getFlagConfigsFunc = func() (map[string]*evaluation.Flag, error) {
+		fetches++
+		return nil, &httpErrorResponseException{StatusCode: http.StatusTooManyRequests, response: newTestResponse(http.StatusTooManyRequests, "60")}
+	}
+	config := &Config{FlagConfigPollerInterval: time.Second, RetryClassifier: DefaultRetryClassifier}
+	poller := newFlagConfigPoller(&api, config, flagConfigStorage, cohortStorage, cohortLoader)
+
+	assert.NotNil(t, poller.Start(nil))
+	assert.Equal(t, 1, fetches)
+	err := poller.Start(nil)
+	assert.Contains(t, err.Error(), "delayed")
+	assert.Equal(t, 1, fetches)
+	delayedUntil := poller.(*flagConfigPoller).pollsDelayedUntil
+	assert.WithinDuration(t, time.Now().Add(time.Minute), delayedUntil, 5*time.Second)
+}
+
+func TestFlagConfigApiErrorResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	api := newFlagConfigApiV2("deployment-key", server.URL, time.Second, server.Client(), 0)
+	_, err := api.getFlagConfigs()
+	httpErr, ok := err.(*httpErrorResponseException)
+	assert.True(t, ok, "unexpected error %v", err)
+	assert.Equal(t, http.StatusServiceUnavailable, httpErr.StatusCode)
+	assert.Equal(t, RetryDecision{Retry: true, Delay: 7 * time.Second}, classifyRetry(DefaultRetryClassifier, err))
+}
+
+func TestFlagConfigPollerRetries(t *testing.T) {
+	api, flagConfigStorage, cohortStorage, cohortLoader := createTestPollerObjs()
+	fetches := 0
+	api.getFlagConfigsFunc = func() (map[string]*evaluation.Flag, error) {
+		fetches++
+		if fetches < 3 {
+			return nil, errors.New("fetch error")
+		}
+		return FLAG_1, nil
+	}
+	var decision RetryDecision
+	config := &Config{
+		FlagConfigPollerInterval: time.Second,
+		RetryClassifier: func(resp *http.Response, err error) RetryDecision {
+			return decision
+		},
+	}
+	poller := newFlagConfigPoller(&api, config, flagConfigStorage, cohortStorage, cohortLoader)
+
+	// Give up.
+	assert.NotNil(t, poller.Start(nil))
+	assert.Equal(t, 1, fetches)
+
+	// Retries which would wait until after the next poll delay polls instead.
+	decision = RetryDecision{Retry: true, Delay: time.Second}
+	assert.NotNil(t, poller.Start(nil))
+	assert.Equal(t, 2, fetches)
+	assert.NotNil(t, poller.Start(nil))
+	assert.Equal(t, 2, fetches)
+	poller.(*flagConfigPoller).pollsDelayedUntil = time.Time{}
+
+	decision = RetryDecision{Retry: true, Delay: time.Millisecond}
+	assert.Nil(t, poller.Start(nil))
+	assert.Equal(t, 3, fetches)
+	assert.Equal(t, FLAG_1, flagConfigStorage.getFlagConfigs())
+	poller.Stop()
+}
+
+func TestFlagConfigStreamApiRetryClassifier(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	api.connectRetries = 2
+	api.connectRetryDelay = time.Hour
+	maintenance := &httpErrorResponseException{StatusCode: http.StatusServiceUnavailable, response: newTestResponse(http.StatusServiceUnavailable, "")}
+	var classified []error
+	api.retryClassifier = func(resp *http.Response, err error) RetryDecision {
+		classified = append(classified, err)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		return RetryDecision{Retry: len(classified) == 1, Delay: time.Millisecond}
+	}
+
+	go func() {
+		<-sse.chConnected
+		sse.errorCh <- maintenance
+		<-sse.chConnected
+		sse.errorCh <- maintenance
+	}()
+	err := api.Connect(nil, nil, nil, nil)
+	assert.Equal(t, maintenance, err)
+	assert.Equal(t, []error{maintenance, maintenance}, classified)
+}
+
+func TestFlagConfigStreamApiRetryDelayCapped(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	api.connectRetries = 2
+	maintenance := &httpErrorResponseException{StatusCode: http.StatusServiceUnavailable, response: newTestResponse(http.StatusServiceUnavailable, "")}
+	api.retryClassifier = func(resp *http.Response, err error) RetryDecision {
+		return RetryDecision{Retry: true, Delay: time.Hour}
+	}
+
+	go func() {
+		<-sse.chConnected
+		sse.errorCh <- maintenance
+	}()
+	start := time.Now()
+	assert.Equal(t, maintenance, api.Connect(nil, nil, nil, nil))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestFlagConfigStreamApiCloseStopsRetryWait(t *testing.T) {
+	sse := mockSseStream{chConnected: make(chan bool)}
+	api := newFlagConfigStreamApiV2("deploymentkey", "serverurl", 1*time.Second)
+	api.newSseStreamFactory = sse.newSseStreamFactory
+	api.connectRetries = 2
+	api.connectRetryDelay = streamApiMaxConnectRetryDelay
+	api.retryClassifier = func(resp *http.Response, err error) RetryDecision {
+		return RetryDecision{Retry: true}
+	}
+
+	go func() {
+		<-sse.chConnected
+		sse.errorCh <- errors.New("stream disconnected error")
+		time.Sleep(50 * time.Millisecond)
+		api.Close()
+	}()
+	start := time.Now()
+	assert.Error(t, api.Connect(nil, nil, nil, nil))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
@@ -0,0 +1,123 @@
+package local
+
+import (
+	"reflect"
+	"sync/atomic"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+)
+
+// maxShadowEvaluations is the maximum number of shadow evaluations in progress. Shadow evaluations
+// of evaluations beyond it are dropped, so shadow evaluation never queues behind live traffic.
+const maxShadowEvaluations = 4
+
+// SetShadowFlags sets candidate flag configs which EvaluateV2 also evaluates users against, on a
+// separate goroutine, calling the OnShadowDivergence listeners for each flag whose shadow variant
+// differs from the live variant, e.g. to compare new flag definitions against the live flag configs
+// before rolling them out. Results are always evaluated from the live flag configs, and shadow
+// evaluations track no assignments. Variants differ if their keys, values, or payloads differ, and
+// flags which only one of the flag configs assign a variant are compared with an empty variant. At
+// most maxShadowEvaluations users are shadow evaluated at once, and the shadow evaluations of other
+// evaluations are dropped. Drain and Close wait for shadow evaluations in progress. Setting nil stops
+// shadow evaluation.
+func (c *Client) SetShadowFlags(flags map[string]*evaluation.Flag) {
+	var shadowFlags map[string]*evaluation.Flag
+	if flags != nil {
+		shadowFlags = make(map[string]*evaluation.Flag, len(flags))
+		for key, flag := range flags {
+			shadowFlags[key] = flag
+		}
+	}
+	c.shadowMutex.Lock()
+	defer c.shadowMutex.Unlock()
+	c.shadowFlags = shadowFlags
+}
+
+// OnShadowDivergence registers a listener which is called with the live and shadow variants of each
+// flag whose variants differ when a user is evaluated against the flag configs set by
+// SetShadowFlags. Listeners are called on the shadow evaluation's goroutine.
+func (c *Client) OnShadowDivergence(fn func(flagKey string, live, shadow experiment.Variant)) {
+	c.shadowMutex.Lock()
+	defer c.shadowMutex.Unlock()
+	c.shadowListeners = append(append([]func(string, experiment.Variant, experiment.Variant){}, c.shadowListeners...), fn)
+}
+
+// evaluateShadow evaluates a copy of the user against the shadow flag configs, if set, on a new
+// goroutine and calls the divergence listeners with the flags whose variants differ from the live
+// variants. The live variants are copied, since the caller owns them once evaluateShadow returns.
+func (c *Client) evaluateShadow(user *experiment.User, flagKeys []string, variants map[string]experiment.Variant) {
+	c.shadowMutex.RLock()
+	defer c.shadowMutex.RUnlock()
+	shadowFlags := c.shadowFlags
+	listeners := c.shadowListeners
+	if shadowFlags == nil || len(listeners) == 0 {
+		return
+	}
+	if atomic.AddInt32(&c.shadowRunning, 1) > maxShadowEvaluations {
+		atomic.AddInt32(&c.shadowRunning, -1)
+		c.log.Debug("Dropped shadow evaluation, %d shadow evaluations are in progress", maxShadowEvaluations)
+		return
+	}
+	var userCopy *experiment.User
+	if user != nil {
+		copied := *user
+		userCopy = &copied
+	}
+	live := make(map[string]experiment.Variant, len(variants))
+	for flagKey, variant := range variants {
+		live[flagKey] = variant
+	}
+	c.shadowEvaluations.Add(1)
+	c.deploymentRunner.goroutines.run(func() {
+		defer c.shadowEvaluations.Done()
+		defer atomic.AddInt32(&c.shadowRunning, -1)
+		defer recoverPanic(c.log, c.metrics, "shadow evaluation")
+		shadow, err := c.evaluateWithoutTracking(userCopy, shadowFlags, flagKeys)
+		if err != nil {
+			c.log.Error("Failed to evaluate shadow flag configs: %v", err)
+			return
+		}
+		for flagKey, variant := range live {
+			if !sameVariant(variant, shadow[flagKey]) {
+				for _, listener := range listeners {
+					listener(flagKey, variant, shadow[flagKey])
+				}
+			}
+		}
+		for flagKey, variant := range shadow {
+			if _, ok := live[flagKey]; !ok && !sameVariant(experiment.Variant{}, variant) {
+				for _, listener := range listeners {
+					listener(flagKey, experiment.Variant{}, variant)
+				}
+			}
+		}
+	})
+}
+
+// waitForShadowEvaluations waits for the shadow evaluations in progress to complete.
+func (c *Client) waitForShadowEvaluations() {
+	c.shadowMutex.Lock()
+	defer c.shadowMutex.Unlock()
+	c.shadowEvaluations.Wait()
+}
+
+// evaluateWithoutTracking evaluates the user against the flag configs without side effects, i.e.
+// without tracking assignments, sticky bucketing, or calling evaluation listeners and metrics.
+func (c *Client) evaluateWithoutTracking(user *experiment.User, flagConfigs map[string]*evaluation.Flag, flagKeys []string) (map[string]experiment.Variant, error) {
+	sortedFlags, err := c.sortFlags(flagConfigs, flagKeys)
+	if err != nil {
+		return nil, err
+	}
+	enrichedUser, err := c.enrichUserWithCohorts(user, flagConfigs, false)
+	if err != nil {
+		return nil, err
+	}
+	results := c.engine.Evaluate(c.evaluationContext(enrichedUser), sortedFlags)
+	return toVariants(results), nil
+}
+
+// sameVariant returns whether the variants have the same key, value, and payload.
+func sameVariant(a, b experiment.Variant) bool {
+	return a.Key == b.Key && a.Value == b.Value && reflect.DeepEqual(a.Payload, b.Payload)
+}
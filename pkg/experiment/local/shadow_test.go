@@ -0,0 +1,105 @@
+package local
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+)
+
+type shadowDivergence struct {
+	flagKey      string
+	live, shadow experiment.Variant
+}
+
+func TestShadowFlags(t *testing.T) {
+	c := newTestClient(t, createTestVariantFlag("changed", nil), createTestVariantFlag("unchanged", nil), createTestVariantFlag("removed", nil))
+	divergences := make(chan shadowDivergence, 10)
+	c.OnShadowDivergence(func(flagKey string, live, shadow experiment.Variant) {
+		divergences <- shadowDivergence{flagKey, live, shadow}
+	})
+	changed := createTestVariantFlag("changed", nil)
+	changed.Variants["off"] = &evaluation.Variant{Key: "off", Value: "off"}
+	changed.Segments = []*evaluation.Segment{{Variant: "off"}}
+	c.SetShadowFlags(map[string]*evaluation.Flag{
+		"changed":   changed,
+		"unchanged": createTestVariantFlag("unchanged", nil),
+		"added":     createTestVariantFlag("added", nil),
+	})
+
+	result, err := c.EvaluateV2(&experiment.User{UserId: "test_user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["changed"].Key != "on" {
+		t.Fatalf("Expected the live variant, got %v", result["changed"])
+	}
+	if _, ok := result["added"]; ok {
+		t.Fatalf("Unexpected shadow variant %v", result["added"])
+	}
+	found := make(map[string]shadowDivergence)
+	for len(found) < 3 {
+		select {
+		case divergence := <-divergences:
+			found[divergence.flagKey] = divergence
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for divergences, got %v", found)
+		}
+	}
+	if found["changed"].live.Key != "on" || found["changed"].shadow.Key != "off" {
+		t.Fatalf("Unexpected divergence %v", found["changed"])
+	}
+	if found["removed"].live.Key != "on" || found["removed"].shadow.Key != "" {
+		t.Fatalf("Unexpected divergence %v", found["removed"])
+	}
+	if found["added"].live.Key != "" || found["added"].shadow.Key != "on" {
+		t.Fatalf("Unexpected divergence %v", found["added"])
+	}
+	select {
+	case divergence := <-divergences:
+		t.Fatalf("Unexpected divergence %v", divergence)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.SetShadowFlags(nil)
+	if _, err := c.EvaluateV2(&experiment.User{UserId: "test_user"}, nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	select {
+	case divergence := <-divergences:
+		t.Fatalf("Unexpected divergence after clearing shadow flags %v", divergence)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestShadowFlagsBounded(t *testing.T) {
+	c := newTestClient(t, createTestVariantFlag("flag", nil))
+	release := make(chan struct{})
+	var calls int32
+	c.OnShadowDivergence(func(flagKey string, live, shadow experiment.Variant) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+	})
+	c.SetShadowFlags(map[string]*evaluation.Flag{})
+	for i := 0; i < maxShadowEvaluations*2; i++ {
+		result, err := c.EvaluateV2(&experiment.User{UserId: "test_user"}, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		// The caller owns the result.
+		result["other"] = experiment.Variant{}
+	}
+	if count := c.GoroutineCount(); count != maxShadowEvaluations {
+		t.Fatalf("Expected %d shadow evaluations, got %d", maxShadowEvaluations, count)
+	}
+	close(release)
+	c.Drain()
+	if count := c.GoroutineCount(); count != 0 {
+		t.Fatalf("Expected Drain to wait for shadow evaluations, got %d goroutines", count)
+	}
+	if count := atomic.LoadInt32(&calls); count != maxShadowEvaluations {
+		t.Fatalf("Expected %d shadow divergences, got %d", maxShadowEvaluations, count)
+	}
+}
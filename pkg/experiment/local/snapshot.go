@@ -0,0 +1,95 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+)
+
+// EvalSnapshot is a frozen view of the client's flag configs at the time the
+// snapshot was taken. Flag config updates applied to the client afterwards are
+// not visible to the snapshot. Cohort membership is still read from the
+// client's cohort storage at evaluation time.
+type EvalSnapshot struct {
+	client      *Client
+	flagConfigs map[string]*evaluation.Flag
+}
+
+// Snapshot returns an EvalSnapshot of the client's current flag configs. Use a
+// snapshot to evaluate multiple times, e.g. for the duration of a request,
+// against the same flag config version.
+func (c *Client) Snapshot() *EvalSnapshot {
+	return &EvalSnapshot{
+		client:      c,
+		flagConfigs: c.flagConfigStorage.getFlagConfigs(),
+	}
+}
+
+// SnapshotFromJSON returns an EvalSnapshot of flag configs from JSON, e.g. an
+// archived result of FlagsV2, to evaluate users against a past flag config
+// version. Both a JSON object of flag configs keyed by flag key, as returned by
+// FlagsV2, and a JSON array of flag configs are accepted.
+func (c *Client) SnapshotFromJSON(flagsJSON string) (*EvalSnapshot, error) {
+	flagConfigs, err := parseFlagConfigsJSON(flagsJSON)
+	if err != nil {
+		return nil, err
+	}
+	return &EvalSnapshot{client: c, flagConfigs: flagConfigs}, nil
+}
+
+// SnapshotFromYAML returns an EvalSnapshot of flag configs from YAML, e.g. a developer authored
+// fixture, like SnapshotFromJSON. See FlagConfigFormatYAML.
+func (c *Client) SnapshotFromYAML(flagsYAML string) (*EvalSnapshot, error) {
+	flagConfigs, err := parseFlagConfigsYAML(flagsYAML)
+	if err != nil {
+		return nil, err
+	}
+	return &EvalSnapshot{client: c, flagConfigs: flagConfigs}, nil
+}
+
+// SnapshotFromFile returns an EvalSnapshot of flag configs read from a file. Files with a .yaml or
+// .yml extension are parsed as YAML, and other files as JSON.
+func (c *Client) SnapshotFromFile(path string) (*EvalSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	flagConfigs, err := parseFlagConfigs(string(data), flagConfigFormatFromPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &EvalSnapshot{client: c, flagConfigs: flagConfigs}, nil
+}
+
+// FetchFlagsFrom returns an EvalSnapshot of the flag configs fetched from the server URL with the
+// client's deployment key, e.g. to compare evaluations against staging flag configs with a client
+// of production, without initializing a second client. The client's flag configs are not changed.
+func (c *Client) FetchFlagsFrom(ctx context.Context, serverUrl string) (*EvalSnapshot, error) {
+	api := newFlagConfigApiV2(c.getApiKey(), serverUrl, c.config.FlagConfigPollerRequestTimeout, c.client, c.config.MaxFlagConfigBytes)
+	api.queryParams = c.config.FlagConfigQueryParams
+	api.version = c.config.FlagsApiVersion
+	flagConfigs, err := api.getFlagConfigsWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &EvalSnapshot{client: c, flagConfigs: flagConfigs}, nil
+}
+
+// parseFlagConfigsJSON parses either a JSON object of flag configs keyed by flag key or a JSON
+// array of flag configs.
+func parseFlagConfigsJSON(flagsJSON string) (map[string]*evaluation.Flag, error) {
+	flagConfigs := make(map[string]*evaluation.Flag)
+	if err := json.Unmarshal([]byte(flagsJSON), &flagConfigs); err == nil {
+		return flagConfigs, nil
+	}
+	return parseData([]byte(flagsJSON))
+}
+
+// EvaluateV2 evaluates the user against the snapshot's flag configs. See Client.EvaluateV2.
+func (s *EvalSnapshot) EvaluateV2(user *experiment.User, flagKeys []string) (map[string]experiment.Variant, error) {
+	return s.client.evaluate(user, s.flagConfigs, flagKeys)
+}
@@ -0,0 +1,184 @@
+package local
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+)
+
+func TestSnapshotIgnoresLaterUpdates(t *testing.T) {
+	c := newTestClient(t, createTestVariantFlag("flag", nil))
+	snapshot := c.Snapshot()
+
+	// Update the flag to serve a different variant.
+	c.flagConfigStorage.putFlagConfig(&evaluation.Flag{
+		Key: "flag",
+		Variants: map[string]*evaluation.Variant{
+			"off": {Key: "off"},
+		},
+		Segments: []*evaluation.Segment{{Variant: "off"}},
+	})
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("new-flag", nil))
+
+	user := &experiment.User{UserId: "test_user"}
+	result, err := snapshot.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["flag"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["flag"])
+	}
+	if _, ok := result["new-flag"]; ok {
+		t.Fatalf("Unexpected variant %v", result["new-flag"])
+	}
+
+	result, err = c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["flag"].Key != "off" {
+		t.Fatalf("Unexpected variant %v", result["flag"])
+	}
+}
+
+func TestSnapshotFromJSON(t *testing.T) {
+	c := newTestClient(t)
+	user := &experiment.User{UserId: "test_user"}
+	for _, flagsJSON := range []string{
+		`{"flag":{"key":"flag","variants":{"on":{"key":"on","value":"on"}},"segments":[{"variant":"on"}]}}`,
+		`[{"key":"flag","variants":{"on":{"key":"on","value":"on"}},"segments":[{"variant":"on"}]}]`,
+	} {
+		snapshot, err := c.SnapshotFromJSON(flagsJSON)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		result, err := snapshot.EvaluateV2(user, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if result["flag"].Key != "on" {
+			t.Fatalf("Unexpected variant %v", result["flag"])
+		}
+	}
+	_, err := c.SnapshotFromJSON("not json")
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+const testFlagsYAML = `
+- key: flag
+  variants:
+    on:
+      key: on
+      value: 1
+  segments:
+    - variant: on
+`
+
+func TestSnapshotFromYAML(t *testing.T) {
+	c := newTestClient(t)
+	user := &experiment.User{UserId: "test_user"}
+	for _, flagsYAML := range []string{
+		testFlagsYAML,
+		"flag:\n  key: flag\n  variants: {on: {key: on, value: 1}}\n  segments: [{variant: on}]\n",
+	} {
+		snapshot, err := c.SnapshotFromYAML(flagsYAML)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		result, err := snapshot.EvaluateV2(user, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if result["flag"].Key != "on" || result["flag"].Value != "1" {
+			t.Fatalf("Unexpected variant %v", result["flag"])
+		}
+	}
+}
+
+func TestSnapshotFromYAMLFieldPathError(t *testing.T) {
+	c := newTestClient(t)
+	_, err := c.SnapshotFromYAML(`
+- key: flag
+  segments:
+    - bucket:
+        allocations:
+          - range: [zero, 100]
+`)
+	// Newer Go versions also include the index of each list element in the path.
+	if err == nil || !strings.HasPrefix(err.Error(), "[0].segments.") || !strings.Contains(err.Error(), "allocations.") ||
+		!strings.Contains(err.Error(), "range") {
+		t.Fatalf("Expected an error with the field path, got %v", err)
+	}
+}
+
+func TestSnapshotFromFile(t *testing.T) {
+	c := newTestClient(t)
+	dir := t.TempDir()
+	files := map[string]string{
+		"flags.yaml": testFlagsYAML,
+		"flags.json": `[{"key":"flag","variants":{"on":{"key":"on","value":1}},"segments":[{"variant":"on"}]}]`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		snapshot, err := c.SnapshotFromFile(path)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", name, err)
+		}
+		result, err := snapshot.EvaluateV2(&experiment.User{UserId: "test_user"}, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if result["flag"].Key != "on" {
+			t.Fatalf("Unexpected variant for %s: %v", name, result["flag"])
+		}
+	}
+}
+
+func TestFetchFlagsFrom(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte(`[{"key":"staging-flag","variants":{"on":{"key":"on"}},"segments":[{"variant":"on"}]}]`))
+	}))
+	defer server.Close()
+	c := newTestClient(t, createTestVariantFlag("flag", nil))
+
+	snapshot, err := c.FetchFlagsFrom(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if authorization != "Api-Key test-"+t.Name() {
+		t.Fatalf("Unexpected authorization %s", authorization)
+	}
+	result, err := snapshot.EvaluateV2(&experiment.User{UserId: "test_user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["staging-flag"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["staging-flag"])
+	}
+	if _, ok := result["flag"]; ok {
+		t.Fatalf("Unexpected variant %v", result["flag"])
+	}
+	if c.flagConfigStorage.getFlagConfig("staging-flag") != nil {
+		t.Fatalf("Expected the client's flag configs not to change")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.FetchFlagsFrom(ctx, server.URL); err == nil {
+		t.Fatalf("Expected an error with a canceled context")
+	}
+}
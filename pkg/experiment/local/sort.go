@@ -62,3 +62,24 @@ func parentTraversal(flagKey string, available map[string]*evaluation.Flag, path
 	delete(available, flagKey)
 	return result, nil
 }
+
+// dependencyWaves partitions topologically sorted flags into waves such that each flag only
+// depends on flags in earlier waves. Flags within a wave may be evaluated in any order.
+func dependencyWaves(sortedFlags []*evaluation.Flag) [][]*evaluation.Flag {
+	depths := make(map[string]int, len(sortedFlags))
+	waves := make([][]*evaluation.Flag, 0)
+	for _, flag := range sortedFlags {
+		depth := 0
+		for _, dependency := range flag.Dependencies {
+			if dependencyDepth, ok := depths[dependency]; ok && dependencyDepth+1 > depth {
+				depth = dependencyDepth + 1
+			}
+		}
+		depths[flag.Key] = depth
+		if depth == len(waves) {
+			waves = append(waves, nil)
+		}
+		waves[depth] = append(waves[depth], flag)
+	}
+	return waves
+}
@@ -417,6 +417,30 @@ func TestComplexNoCycleWithFlagKeys(t *testing.T) {
 
 // Utilities
 
+func TestDependencyWaves(t *testing.T) {
+	inputFlags := flagsArray(
+		evaluation.Flag{Key: "1", Dependencies: []string{"2", "3"}},
+		evaluation.Flag{Key: "2", Dependencies: []string{"3"}},
+		evaluation.Flag{Key: "3", Dependencies: []string{}},
+		evaluation.Flag{Key: "4", Dependencies: []string{}},
+		evaluation.Flag{Key: "5", Dependencies: []string{"4", "999"}},
+	)
+	sorted, _ := topologicalSortArray(inputFlags, []string{"1", "4", "5"})
+	actual := dependencyWaves(sorted)
+	expected := [][]*evaluation.Flag{
+		flagsArray(
+			evaluation.Flag{Key: "3", Dependencies: []string{}},
+			evaluation.Flag{Key: "4", Dependencies: []string{}}),
+		flagsArray(
+			evaluation.Flag{Key: "2", Dependencies: []string{"3"}},
+			evaluation.Flag{Key: "5", Dependencies: []string{"4", "999"}}),
+		flagsArray(evaluation.Flag{Key: "1", Dependencies: []string{"2", "3"}}),
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %v, actual %v", expected, actual)
+	}
+}
+
 func flagsArray(flags ...evaluation.Flag) []*evaluation.Flag {
 	result := make([]*evaluation.Flag, 0)
 	for i := 0; i < len(flags); i++ {
@@ -0,0 +1,93 @@
+package local
+
+import (
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+)
+
+const flagTypeExperiment = "experiment"
+
+// StickyBucketStore persists the variant assigned to each user for each experiment, so that users
+// keep their variant when the experiment's allocation changes. Implementations must be safe for
+// concurrent use.
+type StickyBucketStore interface {
+	// Get returns the key of the variant stored for the user and flag, and whether one was stored.
+	Get(userKey, flagKey string) (variantKey string, ok bool, err error)
+	// Put stores the key of the variant assigned to the user for the flag.
+	Put(userKey, flagKey, variantKey string) error
+}
+
+// applyStickyBuckets replaces the variants of experiments with the variants stored for the user,
+// and stores the variants of experiments which the user has no stored variant for. Default
+// variants are not stored, so users who are not yet allocated may be allocated later.
+func (c *Client) applyStickyBuckets(user *experiment.User, flagConfigs map[string]*evaluation.Flag, variants map[string]experiment.Variant) {
+	userKey := stickyBucketUserKey(user)
+	if userKey == "" {
+		return
+	}
+	for flagKey, variant := range variants {
+		if flagType, _ := variant.Metadata[experiment.MetadataFlagType].(string); flagType != flagTypeExperiment {
+			continue
+		}
+		flag := flagConfigs[flagKey]
+		if flag == nil {
+			continue
+		}
+		storedKey, ok, err := c.config.StickyBucketStore.Get(userKey, flagKey)
+		if err != nil {
+			c.log.Error("Failed to get sticky bucket for flag %s: %v", flagKey, err)
+			continue
+		}
+		if ok {
+			if storedKey == variant.Key {
+				continue
+			}
+			// Variants removed from the flag are no longer sticky.
+			if stored := flag.Variants[storedKey]; stored != nil {
+				variants[flagKey] = experiment.Variant{
+					Key:      stored.Key,
+					Value:    coerceString(stored.Value),
+					Payload:  stored.Payload,
+					Metadata: stickyVariantMetadata(flag, stored),
+				}
+				continue
+			}
+		}
+		if isDefault, _ := variant.Metadata[experiment.MetadataDefault].(bool); isDefault {
+			continue
+		}
+		if err := c.config.StickyBucketStore.Put(userKey, flagKey, variant.Key); err != nil {
+			c.log.Error("Failed to put sticky bucket for flag %s: %v", flagKey, err)
+		}
+	}
+}
+
+// stickyVariantMetadata returns the metadata of the stored variant of the flag, merged like the
+// engine merges it, but without the matched segment's metadata. The live evaluation's metadata may
+// be that of the default variant and its segment, which would mark the stored variant as default.
+func stickyVariantMetadata(flag *evaluation.Flag, stored *evaluation.Variant) map[string]interface{} {
+	metadata := make(map[string]interface{}, len(flag.Metadata)+len(stored.Metadata)+1)
+	for key, value := range flag.Metadata {
+		metadata[key] = value
+	}
+	for key, value := range stored.Metadata {
+		metadata[key] = value
+	}
+	metadata[experiment.MetadataFlagKey] = flag.Key
+	return metadata
+}
+
+// stickyBucketUserKey returns the key which identifies the user in the sticky bucket store, the
+// bucketing key if set, otherwise the user ID if set, otherwise the device ID.
+func stickyBucketUserKey(user *experiment.User) string {
+	if user == nil {
+		return ""
+	}
+	if user.BucketingKey != "" {
+		return user.BucketingKey
+	}
+	if user.UserId != "" {
+		return user.UserId
+	}
+	return user.DeviceId
+}
@@ -0,0 +1,127 @@
+package local
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+)
+
+type mapStickyBucketStore struct {
+	lock    sync.Mutex
+	buckets map[string]string
+}
+
+func (s *mapStickyBucketStore) Get(userKey, flagKey string) (string, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	variantKey, ok := s.buckets[userKey+" "+flagKey]
+	return variantKey, ok, nil
+}
+
+func (s *mapStickyBucketStore) Put(userKey, flagKey, variantKey string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.buckets[userKey+" "+flagKey] = variantKey
+	return nil
+}
+
+func createTestExperiment(variant string) *evaluation.Flag {
+	return &evaluation.Flag{
+		Key: "experiment",
+		Variants: map[string]*evaluation.Variant{
+			"control":   {Key: "control", Value: "control"},
+			"treatment": {Key: "treatment", Value: "treatment"},
+		},
+		Segments: []*evaluation.Segment{{Variant: variant}},
+		Metadata: map[string]interface{}{"flagType": flagTypeExperiment},
+	}
+}
+
+func TestStickyBucketStore(t *testing.T) {
+	store := &mapStickyBucketStore{buckets: make(map[string]string)}
+	c := newTestClient(t, createTestExperiment("control"), createTestVariantFlag("release", nil))
+	c.config.StickyBucketStore = store
+	user := &experiment.User{UserId: "test_user"}
+
+	result, err := c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["experiment"].Key != "control" {
+		t.Fatalf("Unexpected variant %v", result["experiment"])
+	}
+	if len(store.buckets) != 1 || store.buckets["test_user experiment"] != "control" {
+		t.Fatalf("Unexpected sticky buckets %v", store.buckets)
+	}
+
+	// The user keeps the stored variant after the allocation changes.
+	c.flagConfigStorage.putFlagConfig(createTestExperiment("treatment"))
+	result, err = c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["experiment"].Key != "control" || result["experiment"].Value != "control" {
+		t.Fatalf("Unexpected variant %v", result["experiment"])
+	}
+
+	// A removed variant is no longer sticky.
+	flag := createTestExperiment("treatment")
+	delete(flag.Variants, "control")
+	c.flagConfigStorage.putFlagConfig(flag)
+	result, err = c.EvaluateV2(user, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["experiment"].Key != "treatment" {
+		t.Fatalf("Unexpected variant %v", result["experiment"])
+	}
+	if store.buckets["test_user experiment"] != "treatment" {
+		t.Fatalf("Unexpected sticky buckets %v", store.buckets)
+	}
+}
+
+func TestStickyBucketStoreDefaultAllocation(t *testing.T) {
+	store := &mapStickyBucketStore{buckets: map[string]string{"test_user experiment": "control"}}
+	flag := createTestExperiment("off")
+	flag.Variants["control"].Metadata = map[string]interface{}{"description": "stored"}
+	flag.Variants["off"] = &evaluation.Variant{Key: "off", Metadata: map[string]interface{}{experiment.MetadataDefault: true}}
+	flag.Segments[0].Metadata = map[string]interface{}{experiment.MetadataSegmentName: "All Other Users"}
+	c := newTestClient(t, flag)
+	c.config.StickyBucketStore = store
+
+	result, err := c.EvaluateV2(&experiment.User{UserId: "test_user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	variant := result["experiment"]
+	if variant.Key != "control" {
+		t.Fatalf("Unexpected variant %v", variant)
+	}
+	if _, ok := variant.Metadata[experiment.MetadataDefault]; ok {
+		t.Fatalf("Expected the stored variant not to be default, got metadata %v", variant.Metadata)
+	}
+	if _, ok := variant.Metadata[experiment.MetadataSegmentName]; ok {
+		t.Fatalf("Expected no segment name, got metadata %v", variant.Metadata)
+	}
+	if variant.Metadata["description"] != "stored" || variant.Metadata[experiment.MetadataFlagType] != flagTypeExperiment {
+		t.Fatalf("Expected the flag and stored variant metadata, got %v", variant.Metadata)
+	}
+	if !isExposable(variant) {
+		t.Fatalf("Expected the stored variant to be exposable")
+	}
+}
+
+func TestStickyBucketStoreBucketingKey(t *testing.T) {
+	store := &mapStickyBucketStore{buckets: make(map[string]string)}
+	c := newTestClient(t, createTestExperiment("control"))
+	c.config.StickyBucketStore = store
+
+	if _, err := c.EvaluateV2(&experiment.User{UserId: "test_user", BucketingKey: "account"}, nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(store.buckets) != 1 || store.buckets["account experiment"] != "control" {
+		t.Fatalf("Unexpected sticky buckets %v", store.buckets)
+	}
+}
@@ -2,8 +2,10 @@ package local
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
 	"sync"
@@ -37,9 +39,24 @@ func newEventSource(httpClient *http.Client, url string, headers map[string]stri
 	client.Headers = headers
 	sse.ClientMaxBufferSize(1 << 32)(client)
 	client.ReconnectStrategy = &backoff.StopBackOff{}
+	client.ResponseValidator = validateStreamResponse
 	return client
 }
 
+// validateStreamResponse returns an httpErrorResponseException for unsuccessful responses, so
+// failures such as an unauthorized deployment key can be told apart from connection errors.
+func validateStreamResponse(_ *sse.Client, resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return &httpErrorResponseException{
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("could not connect to stream: %s", http.StatusText(resp.StatusCode)),
+			response:   resp,
+		}
+	}
+	return nil
+}
+
 type streamEvent struct {
 	data []byte
 }
@@ -61,6 +78,10 @@ type sseStream struct {
 	lock                sync.Mutex
 	cancelClientContext *context.CancelFunc
 	newESFactory        func(httpClient *http.Client, url string, headers map[string]string) eventSource
+	// tlsConfig, if set, replaces the default TLS configuration of the connection.
+	tlsConfig *tls.Config
+	// dialContext, if set, opens the connection instead of the default dialer.
+	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 func newSseStream(
@@ -82,6 +103,31 @@ func newSseStream(
 	}
 }
 
+// newSseStreamFactoryWithTransport returns a factory of streams like newSseStream, which connect with
+// the TLS configuration and dial function, if set.
+func newSseStreamFactoryWithTransport(tlsConfig *tls.Config, dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) func(
+	authToken,
+	url string,
+	connectionTimeout time.Duration,
+	keepaliveTimeout time.Duration,
+	reconnInterval time.Duration,
+	maxJitter time.Duration,
+) stream {
+	return func(
+		authToken,
+		url string,
+		connectionTimeout time.Duration,
+		keepaliveTimeout time.Duration,
+		reconnInterval time.Duration,
+		maxJitter time.Duration,
+	) stream {
+		s := newSseStream(authToken, url, connectionTimeout, keepaliveTimeout, reconnInterval, maxJitter).(*sseStream)
+		s.tlsConfig = tlsConfig
+		s.dialContext = dialContext
+		return s
+	}
+}
+
 func (s *sseStream) setNewESFactory(f func(httpClient *http.Client, url string, headers map[string]string) eventSource) {
 	s.newESFactory = f
 }
@@ -108,10 +154,16 @@ func (s *sseStream) connectInternal(
 		}).Dial,
 		TLSHandshakeTimeout:   s.connectionTimeout,
 		ResponseHeaderTimeout: s.connectionTimeout,
+		TLSClientConfig:       s.tlsConfig.Clone(),
+	}
+	if s.dialContext != nil {
+		transport.Dial = nil
+		transport.DialContext = s.dialContext
 	}
 
 	// The http client timeout includes reading body, which is the entire SSE lifecycle until SSE is closed.
-	httpClient := &http.Client{Transport: transport, Timeout: s.reconnInterval + s.maxJitter} // Max time for this connection.
+	// It allows the connection timeout beyond the planned reconnect, so it never races the reconnect.
+	httpClient := &http.Client{Transport: transport, Timeout: s.reconnInterval + s.maxJitter + s.connectionTimeout} // Max time for this connection.
 
 	client := s.newESFactory(httpClient, s.url, map[string]string{
 		"Authorization":     s.AuthToken,
@@ -206,7 +258,7 @@ func (s *sseStream) connectInternal(
 	}()
 
 	// Reconnect after interval.
-	time.AfterFunc(randTimeDuration(s.reconnInterval, s.maxJitter), func() {
+	time.AfterFunc(s.reconnectDelay(), func() {
 		select {
 		case <-ctx.Done(): // Cancelled.
 			return
@@ -226,3 +278,12 @@ func (s *sseStream) Cancel() {
 		s.cancelClientContext = nil
 	}
 }
+
+// reconnectDelay returns the time until the stream reconnects, the reconnect interval plus a random
+// jitter of less than maxJitter, so streams which connected together don't reconnect together.
+func (s *sseStream) reconnectDelay() time.Duration {
+	if s.maxJitter <= 0 {
+		return s.reconnInterval
+	}
+	return s.reconnInterval + time.Duration(rand.Int63n(int64(s.maxJitter)))
+}
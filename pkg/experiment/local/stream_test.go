@@ -3,6 +3,7 @@ package local
 import (
 	"context"
 	"errors"
+	"net"
 	"net/http"
 	"testing"
 	"time"
@@ -167,6 +168,8 @@ func TestStreamReconnectsTimeout(t *testing.T) {
 	client.Connect(messageCh, errorCh)
 	<-s.chConnected
 	s.onConnCb(nil)
+	// The connection outlives the planned reconnect by the connection timeout.
+	assert.Equal(t, 4*time.Second, s.httpClient.Timeout)
 
 	go func() { s.messageChan <- &sse.Event{Data: []byte("data1")} }()
 	assert.Equal(t, []byte("data1"), (<-messageCh).data)
@@ -297,3 +300,35 @@ func TestStreamConnectErrorPasses(t *testing.T) {
 		// No message received within the timeout, as expected
 	}
 }
+
+func TestStreamReconnectDelay(t *testing.T) {
+	reconnInterval := 2 * time.Second
+	maxJitter := 500 * time.Millisecond
+	s := newSseStream("", "", time.Second, time.Second, reconnInterval, maxJitter).(*sseStream)
+	for i := 0; i < 1000; i++ {
+		delay := s.reconnectDelay()
+		assert.GreaterOrEqual(t, int64(delay), int64(reconnInterval))
+		assert.Less(t, int64(delay), int64(reconnInterval+maxJitter))
+	}
+
+	s = newSseStream("", "", time.Second, time.Second, reconnInterval, 0).(*sseStream)
+	assert.Equal(t, reconnInterval, s.reconnectDelay())
+}
+
+func TestStreamDialContext(t *testing.T) {
+	dialed := make(chan string, 1)
+	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return nil, errors.New("dial refused")
+	}
+	factory := newSseStreamFactoryWithTransport(nil, dialContext)
+	client := factory("", "http://stream.test:8080/sdk/stream/v1/flags", 1*time.Second, 1*time.Second, 1*time.Minute, 0)
+	messageCh := make(chan streamEvent)
+	errorCh := make(chan error)
+	client.Connect(messageCh, errorCh)
+	defer client.Cancel()
+
+	assert.Equal(t, "stream.test:8080", <-dialed)
+	err := <-errorCh
+	assert.Contains(t, err.Error(), "dial refused")
+}
@@ -0,0 +1,153 @@
+// Package testutil provides test doubles for testing code which uses the local evaluation client.
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+const flagsPath = "/sdk/v2/flags"
+const streamFlagsPath = "/sdk/stream/v1/flags"
+const streamKeepAliveInterval = 5 * time.Second
+
+// FakeFlagServer is an in-memory flag config server which serves flag configs over both the
+// poll endpoint and the stream endpoint. Configure the local evaluation client's ServerUrl and
+// StreamServerUrl with the server's URL.
+type FakeFlagServer struct {
+	URL         string
+	server      *httptest.Server
+	lock        sync.Mutex
+	flags       []byte
+	subscribers map[chan []byte]struct{}
+	pollCount   int
+	streamCount int
+}
+
+// NewFakeFlagServer starts a server serving the flag configs, a JSON array of flags.
+func NewFakeFlagServer(flagsJSON string) (*FakeFlagServer, error) {
+	flags, err := compactFlags(flagsJSON)
+	if err != nil {
+		return nil, err
+	}
+	s := &FakeFlagServer{
+		flags:       flags,
+		subscribers: make(map[chan []byte]struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(flagsPath, s.handleFlags)
+	mux.HandleFunc(streamFlagsPath, s.handleStreamFlags)
+	s.server = httptest.NewServer(mux)
+	s.URL = s.server.URL
+	return s, nil
+}
+
+// SetFlags replaces the served flag configs, a JSON array of flags, and pushes them to all connected streams.
+func (s *FakeFlagServer) SetFlags(flagsJSON string) error {
+	flags, err := compactFlags(flagsJSON)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flags = flags
+	for ch := range s.subscribers {
+		// Only the latest flags matter, so replace any flags not yet sent. The send can't block
+		// since subscribers are only sent to while holding the lock.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- flags
+	}
+	return nil
+}
+
+// PollCount returns the number of requests made to the poll endpoint.
+func (s *FakeFlagServer) PollCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pollCount
+}
+
+// StreamCount returns the number of connections made to the stream endpoint.
+func (s *FakeFlagServer) StreamCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streamCount
+}
+
+// Close disconnects all streams and shuts down the server.
+func (s *FakeFlagServer) Close() {
+	s.server.CloseClientConnections()
+	s.server.Close()
+}
+
+func (s *FakeFlagServer) handleFlags(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	s.pollCount++
+	flags := s.flags
+	s.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(flags)
+}
+
+func (s *FakeFlagServer) handleStreamFlags(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan []byte, 1)
+	s.lock.Lock()
+	s.streamCount++
+	s.subscribers[ch] = struct{}{}
+	flags := s.flags
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		delete(s.subscribers, ch)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	writeEvent(w, flags)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case flags := <-ch:
+			writeEvent(w, flags)
+			flusher.Flush()
+		case <-keepAlive.C:
+			writeEvent(w, []byte(" "))
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, data []byte) {
+	_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+func compactFlags(flagsJSON string) ([]byte, error) {
+	var flags []json.RawMessage
+	if err := json.Unmarshal([]byte(flagsJSON), &flags); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(flagsJSON)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
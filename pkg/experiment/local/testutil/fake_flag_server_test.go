@@ -0,0 +1,120 @@
+package testutil
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+	"github.com/amplitude/experiment-go-server/pkg/experiment/local"
+)
+
+const flagOn = `[{"key":"flag","variants":{"on":{"key":"on","value":"on"}},"segments":[{"variant":"on"}]}]`
+const flagOff = `[{"key":"flag","variants":{"off":{"key":"off"}},"segments":[{"variant":"off"}]}]`
+
+func TestFakeFlagServerPoll(t *testing.T) {
+	server, err := NewFakeFlagServer(flagOn)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer server.Close()
+	client := local.Initialize("test-"+t.Name(), &local.Config{
+		ServerUrl:                server.URL,
+		FlagConfigPollerInterval: 100 * time.Millisecond,
+	})
+	defer client.Close()
+	if err := client.Start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	assertVariant(t, client, "on")
+
+	if err := server.SetFlags(flagOff); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	assertVariant(t, client, "off")
+	if server.PollCount() < 2 {
+		t.Fatalf("Unexpected poll count %v", server.PollCount())
+	}
+}
+
+func TestFakeFlagServerStream(t *testing.T) {
+	server, err := NewFakeFlagServer(flagOn)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer server.Close()
+	client := local.Initialize("test-"+t.Name(), &local.Config{
+		ServerUrl:       server.URL,
+		StreamServerUrl: server.URL,
+		StreamUpdates:   true,
+	})
+	defer client.Close()
+	if err := client.Start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	assertVariant(t, client, "on")
+
+	if err := server.SetFlags(flagOff); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	assertVariant(t, client, "off")
+	if server.StreamCount() != 1 {
+		t.Fatalf("Unexpected stream count %v", server.StreamCount())
+	}
+	if server.PollCount() != 0 {
+		t.Fatalf("Unexpected poll count %v", server.PollCount())
+	}
+}
+
+func TestFakeFlagServerDialContext(t *testing.T) {
+	server, err := NewFakeFlagServer(flagOn)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	var lock sync.Mutex
+	var dialed []string
+	// Resolve the hosts to the fake server, as a custom resolver would.
+	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		lock.Lock()
+		dialed = append(dialed, addr)
+		lock.Unlock()
+		return (&net.Dialer{}).DialContext(ctx, network, serverURL.Host)
+	}
+	client := local.Initialize("test-"+t.Name(), &local.Config{
+		ServerUrl:       "http://flags.test",
+		StreamServerUrl: "http://stream.test",
+		StreamUpdates:   true,
+		DialContext:     dialContext,
+	})
+	defer client.Close()
+	if err := client.Start(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	assertVariant(t, client, "on")
+	if server.StreamCount() != 1 {
+		t.Fatalf("Unexpected stream count %v", server.StreamCount())
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(dialed) == 0 || dialed[0] != "stream.test:80" {
+		t.Fatalf("Unexpected dialed addresses %v", dialed)
+	}
+}
+
+func assertVariant(t *testing.T, client *local.Client, expected string) {
+	t.Helper()
+	result, err := client.EvaluateV2(&experiment.User{UserId: "test_user"}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["flag"].Key != expected {
+		t.Fatalf("Unexpected variant %v", result["flag"])
+	}
+}
@@ -0,0 +1,108 @@
+package testutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/amplitude/experiment-go-server/internal/evaluation"
+)
+
+// FlagBuilder builds flag configs for tests. Segments are evaluated in the order they are added,
+// so add targeted segments before the default segment.
+type FlagBuilder struct {
+	flag *evaluation.Flag
+}
+
+// NewFlagBuilder returns a builder for a flag with the key.
+func NewFlagBuilder(key string) *FlagBuilder {
+	return &FlagBuilder{flag: &evaluation.Flag{
+		Key:      key,
+		Variants: make(map[string]*evaluation.Variant),
+	}}
+}
+
+// WithVariant adds a variant with the key and value.
+func (b *FlagBuilder) WithVariant(key string, value interface{}) *FlagBuilder {
+	b.flag.Variants[key] = &evaluation.Variant{Key: key, Value: value}
+	return b
+}
+
+// WithDependency adds a flag which must be evaluated before this flag.
+func (b *FlagBuilder) WithDependency(flagKey string) *FlagBuilder {
+	b.flag.Dependencies = append(b.flag.Dependencies, flagKey)
+	return b
+}
+
+// WithMetadata sets a metadata value, e.g. "flagType".
+func (b *FlagBuilder) WithMetadata(key string, value interface{}) *FlagBuilder {
+	if b.flag.Metadata == nil {
+		b.flag.Metadata = make(map[string]interface{})
+	}
+	b.flag.Metadata[key] = value
+	return b
+}
+
+// WithSegment adds a segment serving the variant to users matching the condition, e.g.
+// WithSegment("on", []string{"context", "user", "user_id"}, "is", "user").
+func (b *FlagBuilder) WithSegment(variant string, selector []string, op string, values ...string) *FlagBuilder {
+	b.flag.Segments = append(b.flag.Segments, &evaluation.Segment{
+		Conditions: [][]*evaluation.Condition{{{Selector: selector, Op: op, Values: values}}},
+		Variant:    variant,
+	})
+	return b
+}
+
+// WithDefaultSegment adds a segment serving the variant to all users.
+func (b *FlagBuilder) WithDefaultSegment(variant string) *FlagBuilder {
+	b.flag.Segments = append(b.flag.Segments, &evaluation.Segment{Variant: variant})
+	return b
+}
+
+// Build validates and returns the flag. It fails if the key is empty, a segment serves a variant
+// which was not added, or the flag depends on itself.
+func (b *FlagBuilder) Build() (*evaluation.Flag, error) {
+	if b.flag.Key == "" {
+		return nil, errors.New("flag key must be set")
+	}
+	for _, segment := range b.flag.Segments {
+		if _, ok := b.flag.Variants[segment.Variant]; !ok {
+			return nil, fmt.Errorf("flag %s segment serves unknown variant %q", b.flag.Key, segment.Variant)
+		}
+		for _, conditions := range segment.Conditions {
+			for _, condition := range conditions {
+				if len(condition.Selector) == 0 || condition.Op == "" {
+					return nil, fmt.Errorf("flag %s segment condition must have a selector and op", b.flag.Key)
+				}
+			}
+		}
+	}
+	for _, dependency := range b.flag.Dependencies {
+		if dependency == b.flag.Key {
+			return nil, fmt.Errorf("flag %s depends on itself", b.flag.Key)
+		}
+	}
+	return b.flag, nil
+}
+
+// MustBuild is like Build but panics if the flag is invalid.
+func (b *FlagBuilder) MustBuild() *evaluation.Flag {
+	flag, err := b.Build()
+	if err != nil {
+		panic(err)
+	}
+	return flag
+}
+
+// FlagsJSON returns the flags as a JSON array, as served by the flag config endpoints, for use with
+// NewFakeFlagServer or Client.SnapshotFromJSON.
+func FlagsJSON(flags ...*evaluation.Flag) (string, error) {
+	if flags == nil {
+		flags = []*evaluation.Flag{}
+	}
+	b, err := json.Marshal(flags)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,59 @@
+package testutil
+
+import (
+	"testing"
+
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+	"github.com/amplitude/experiment-go-server/pkg/experiment/local"
+)
+
+func TestFlagBuilder(t *testing.T) {
+	parent := NewFlagBuilder("parent").
+		WithVariant("on", "on").
+		WithSegment("on", []string{"context", "user", "user_id"}, "is", "included").
+		MustBuild()
+	child := NewFlagBuilder("child").
+		WithVariant("on", "on").
+		WithVariant("off", nil).
+		WithDependency("parent").
+		WithSegment("on", []string{"result", "parent", "key"}, "is", "on").
+		WithDefaultSegment("off").
+		MustBuild()
+	flagsJSON, err := FlagsJSON(parent, child)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	snapshot, err := local.Initialize("test-"+t.Name(), nil).SnapshotFromJSON(flagsJSON)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	result, err := snapshot.EvaluateV2(&experiment.User{UserId: "included"}, []string{"child"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["child"].Key != "on" {
+		t.Fatalf("Unexpected variant %v", result["child"])
+	}
+	result, err = snapshot.EvaluateV2(&experiment.User{UserId: "excluded"}, []string{"child"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if result["child"].Key != "off" {
+		t.Fatalf("Unexpected variant %v", result["child"])
+	}
+}
+
+func TestFlagBuilderInvalid(t *testing.T) {
+	builders := []*FlagBuilder{
+		NewFlagBuilder("").WithVariant("on", "on"),
+		NewFlagBuilder("flag").WithDefaultSegment("on"),
+		NewFlagBuilder("flag").WithVariant("on", "on").WithSegment("on", nil, "is", "user"),
+		NewFlagBuilder("flag").WithDependency("flag"),
+	}
+	for _, builder := range builders {
+		if _, err := builder.Build(); err == nil {
+			t.Errorf("Expected error building %v", builder.flag)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package local
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+)
+
+// ValidateUser checks the user for common mistakes which make targeting silently miss, such as a
+// user without a user ID or device ID, groups with empty names, or group properties of groups the
+// user is not in. All problems found are returned in a *UserValidationError, or nil if the user is
+// valid. Set Config.StrictUserValidation to validate users on evaluation.
+func ValidateUser(user *experiment.User) error {
+	if user == nil {
+		return &UserValidationError{Errors: []error{fmt.Errorf("user is nil")}}
+	}
+	var errs []error
+	if user.UserId == "" && user.DeviceId == "" {
+		errs = append(errs, fmt.Errorf("user has neither a user ID nor a device ID"))
+	}
+	if _, ok := user.UserProperties[""]; ok {
+		errs = append(errs, fmt.Errorf("user property has an empty name"))
+	}
+	groupTypes := make([]string, 0, len(user.Groups))
+	for groupType := range user.Groups {
+		groupTypes = append(groupTypes, groupType)
+	}
+	sort.Strings(groupTypes)
+	for _, groupType := range groupTypes {
+		groupNames := user.Groups[groupType]
+		if groupType == "" {
+			errs = append(errs, fmt.Errorf("group type is empty"))
+		}
+		if len(groupNames) == 0 {
+			errs = append(errs, fmt.Errorf("group type %q has no group names", groupType))
+		} else if contains(groupNames, "") {
+			errs = append(errs, fmt.Errorf("group type %q has an empty group name", groupType))
+		}
+	}
+	// Group properties are keyed by group type, then group name.
+	var groupProperties []string
+	for groupType, properties := range user.GroupProperties {
+		if _, ok := user.Groups[groupType]; !ok {
+			groupProperties = append(groupProperties, fmt.Sprintf("group properties of group type %q, which the user has no groups of", groupType))
+			continue
+		}
+		for groupName := range properties {
+			if !contains(user.Groups[groupType], groupName) {
+				groupProperties = append(groupProperties, fmt.Sprintf("group properties of group %q of type %q, which the user is not in", groupName, groupType))
+			}
+		}
+	}
+	sort.Strings(groupProperties)
+	for _, message := range groupProperties {
+		errs = append(errs, fmt.Errorf("%s", message))
+	}
+	if len(errs) > 0 {
+		return &UserValidationError{Errors: errs}
+	}
+	return nil
+}
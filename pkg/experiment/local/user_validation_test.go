@@ -0,0 +1,68 @@
+package local
+
+import (
+	"testing"
+
+	"github.com/amplitude/experiment-go-server/pkg/experiment"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateUserValid(t *testing.T) {
+	assert.NoError(t, ValidateUser(&experiment.User{UserId: "user"}))
+	assert.NoError(t, ValidateUser(&experiment.User{
+		DeviceId:        "device",
+		Groups:          map[string][]string{"org": {"amplitude"}},
+		GroupProperties: map[string]map[string]interface{}{"org": {"amplitude": map[string]interface{}{"plan": "pro"}}},
+	}))
+}
+
+func TestValidateUserInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		user     *experiment.User
+		expected []string
+	}{
+		{"nil", nil, []string{"user is nil"}},
+		{"no id", &experiment.User{Country: "US"}, []string{"user has neither a user ID nor a device ID"}},
+		{"empty property name", &experiment.User{UserId: "user", UserProperties: map[string]interface{}{"": "value"}}, []string{
+			"user property has an empty name",
+		}},
+		{"groups", &experiment.User{UserId: "user", Groups: map[string][]string{"": {"a"}, "org": {""}, "team": {}}}, []string{
+			"group type is empty",
+			`group type "org" has an empty group name`,
+			`group type "team" has no group names`,
+		}},
+		{"group properties", &experiment.User{
+			UserId: "user",
+			Groups: map[string][]string{"org": {"amplitude"}},
+			// Properties keyed by group type only, rather than group type then group name.
+			GroupProperties: map[string]map[string]interface{}{"org": {"plan": "pro"}, "team": {"experiment": nil}},
+		}, []string{
+			`group properties of group "plan" of type "org", which the user is not in`,
+			`group properties of group type "team", which the user has no groups of`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateUser(tt.user)
+			if !assert.IsType(t, &UserValidationError{}, err) {
+				return
+			}
+			var messages []string
+			for _, err := range err.(*UserValidationError).Errors {
+				messages = append(messages, err.Error())
+			}
+			assert.Equal(t, tt.expected, messages)
+		})
+	}
+}
+
+func TestStrictUserValidation(t *testing.T) {
+	c := Initialize("test-"+t.Name(), &Config{StrictUserValidation: true})
+	c.flagConfigStorage.putFlagConfig(createTestVariantFlag("flag", nil))
+	_, err := c.EvaluateV2(&experiment.User{}, nil)
+	assert.IsType(t, &UserValidationError{}, err)
+	result, err := c.EvaluateV2(&experiment.User{UserId: "user"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "on", result["flag"].Key)
+}
@@ -1,11 +1,26 @@
 package local
 
 import (
+	"context"
+	"crypto/tls"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
 	"time"
+
+	"github.com/amplitude/experiment-go-server/internal/logger"
 )
 
+// hashCode is Java's String.hashCode computed over the string's bytes and masked to 32 bits, so that
+// assignment insert IDs match those generated by the other server SDKs. Being a 32 bit hash, distinct
+// assignments for the same user, device, and day have a 1% chance of colliding at around 9,300
+// assignments, and strings with the same length and prefix collide easily (e.g. "Aa" and "BB").
 func hashCode(s string) int {
 	hash := 0
 	if len(s) == 0 {
@@ -19,6 +34,75 @@ func hashCode(s string) int {
 	return hash
 }
 
+// FNV1aHash is the 64 bit FNV-1a hash, which can be set as AssignmentConfig.InsertIDHash to make
+// insert ID collisions between distinct assignments negligible.
+func FNV1aHash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func defaultInsertIDHash(s string) uint64 {
+	return uint64(hashCode(s))
+}
+
+const httpMaxIdleConns = 100
+const httpMaxIdleConnsPerHost = 10
+const httpIdleConnTimeout = 90 * time.Second
+
+// newHttpClient returns a client for control plane requests. The client should be shared so that
+// connections are reused across requests. A nil tlsConfig or dialContext uses the default TLS
+// configuration or dialer.
+func newHttpClient(tlsConfig *tls.Config, dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = httpMaxIdleConns
+	transport.MaxIdleConnsPerHost = httpMaxIdleConnsPerHost
+	transport.IdleConnTimeout = httpIdleConnTimeout
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+	if dialContext != nil {
+		transport.DialContext = dialContext
+	}
+	return &http.Client{Transport: transport}
+}
+
+// limitedReader reads from r until more than limit bytes are read, then fails with a
+// responseTooLargeException rather than silently truncating like io.LimitReader.
+type limitedReader struct {
+	r         io.Reader
+	limit     int64
+	remaining int64
+}
+
+// newLimitedReader returns r unchanged if limit is not positive.
+func newLimitedReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &limitedReader{r: r, limit: limit, remaining: limit + 1}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, &responseTooLargeException{Limit: l.limit}
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining <= 0 {
+		return 0, &responseTooLargeException{Limit: l.limit}
+	}
+	return n, err
+}
+
+// readAllLimited reads r to the end, failing if it is longer than limit bytes.
+func readAllLimited(r io.Reader, limit int64) ([]byte, error) {
+	return ioutil.ReadAll(newLimitedReader(r, limit))
+}
+
 func difference(set1, set2 map[string]struct{}) map[string]struct{} {
 	diff := make(map[string]struct{})
 	for k := range set1 {
@@ -44,3 +128,24 @@ func randTimeDuration(base time.Duration, jitter time.Duration) time.Duration {
 	dmax := dmiddle + jitter.Nanoseconds()
 	return time.Duration(dmin + rand.Int63n(dmax-dmin))
 }
+
+// recoverPanic recovers a panic in a background goroutine, logs it, and reports it to the metrics,
+// so the panic doesn't crash the process. It must be deferred directly.
+func recoverPanic(log *logger.Log, metrics Metrics, source string) {
+	if r := recover(); r != nil {
+		log.Error("Recovered from panic in %s: %v\n%s", source, r, debug.Stack())
+		metrics.OnPanic(source)
+	}
+}
+
+// setQueryParams sets the params in the endpoint's query, replacing existing params of the same name.
+func setQueryParams(endpoint *url.URL, params map[string]string) {
+	if len(params) == 0 {
+		return
+	}
+	query := endpoint.Query()
+	for key, value := range params {
+		query.Set(key, value)
+	}
+	endpoint.RawQuery = query.Encode()
+}
@@ -23,6 +23,14 @@ type User struct {
 	Groups             map[string][]string                       `json:"groups,omitempty"`
 	CohortIds          map[string]struct{}                       `json:"cohort_ids,omitempty"`
 	GroupCohortIds     map[string]map[string]map[string]struct{} `json:"group_cohort_ids,omitempty"`
+	// BucketingKey, if set, replaces the user ID and device ID for bucketing by local evaluation, e.g.
+	// an account ID so that all users of an account are assigned the same variant. Users with the same
+	// bucketing key get the same variant of flags bucketed by user ID, device ID, or Amplitude ID,
+	// unless targeted differently, and a user's variants change if its bucketing key changes. Flags
+	// bucketed by a user property or group are unaffected. UserId and DeviceId are still used for
+	// targeting and to track assignments and exposures, while sticky buckets are stored by bucketing
+	// key. Remote evaluation ignores the bucketing key.
+	BucketingKey string `json:"bucketing_key,omitempty"`
 }
 
 func (u *User) AddGroupCohortIds(groupType, groupName string, cohortIds map[string]struct{}) {
@@ -45,3 +53,24 @@ type Variant struct {
 	Key      string                 `json:"key,omitempty"`
 	Metadata map[string]interface{} `json:"metadata,omitempty"`
 }
+
+// Well-known Variant.Metadata keys. Local evaluation sets MetadataFlagKey on every variant, and
+// the others when they are configured for the flag or the segment which matched.
+const (
+	// MetadataFlagKey is the key of the flag which was evaluated.
+	MetadataFlagKey = "flagKey"
+	// MetadataFlagType is the type of the flag, e.g. "experiment", "release", or "mutual-exclusion-group".
+	MetadataFlagType = "flagType"
+	// MetadataSegmentName is the name of the targeting segment which matched the user.
+	MetadataSegmentName = "segmentName"
+	// MetadataExperimentKey is the key of the experiment, set for experiments only.
+	MetadataExperimentKey = "experimentKey"
+	// MetadataDefault is true if the variant is the flag's default, i.e. the user was not targeted.
+	MetadataDefault = "default"
+	// MetadataDeadlineExceeded is true if the variant is a default because the flag could not be
+	// evaluated by the deadline of Client.EvaluateV2WithDeadline in the local package.
+	MetadataDeadlineExceeded = "deadlineExceeded"
+	// MetadataTrackAssignment is false if assignments of the flag should not be tracked. It is set in
+	// the flag's metadata, e.g. for operational flags such as kill switches.
+	MetadataTrackAssignment = "trackAssignment"
+)